@@ -52,7 +52,7 @@ func initCommonBuildFlags() []cli.Flag {
 		},
 		&cli.StringSliceFlag{
 			Name:  "layer-type",
-			Usage: "set the output layer type (supported values: tar, squashfs, erofs); can be supplied multiple times",
+			Usage: "set the output layer type (supported values: tar, tar+zstd, tar+zstd:chunked, tar+estargz, squashfs, erofs, with an optional @<level> for tar compression); can be supplied multiple times",
 			Value: cli.NewStringSlice("tar"),
 		},
 		&cli.BoolFlag{
@@ -73,6 +73,22 @@ func initCommonBuildFlags() []cli.Flag {
 			Usage: "set OCI annotations namespace in the OCI image manifest",
 			Value: "io.stackeroci",
 		},
+		&cli.BoolFlag{
+			Name:  "keep-failed",
+			Usage: "keep the rootfs of a layer whose run commands fail, for use with 'stacker debug'",
+		},
+		&cli.DurationFlag{
+			Name:  "run-timeout",
+			Usage: "kill the build if a layer's run commands take longer than this (e.g. 30m); a layer's 'timeout' takes precedence",
+		},
+		&cli.BoolFlag{
+			Name:  "offline",
+			Usage: "only use what 'stacker fetch' downloaded, and run without network access",
+		},
+		&cli.StringFlag{
+			Name:  "bundle",
+			Usage: "load a bundle made by 'stacker bundle' before building",
+		},
 	}
 }
 
@@ -102,7 +118,12 @@ func newBuildArgs(ctx *cli.Context) (stacker.BuildArgs, error) {
 		HashRequired:         ctx.Bool("require-hash"),
 		Progress:             shouldShowProgress(ctx),
 		AnnotationsNamespace: ctx.String("annotations-namespace"),
+		RunTimeout:           ctx.Duration("run-timeout"),
+		KeepFailed:           ctx.Bool("keep-failed"),
+		Bundle:               ctx.String("bundle"),
 	}
+	args.Config.Offline = ctx.Bool("offline")
+	types.Offline = args.Config.Offline
 	var err error
 	verity := verity.VerityMetadata(!ctx.Bool("no-verity"))
 	args.LayerTypes, err = types.NewLayerTypes(ctx.StringSlice("layer-type"), verity)
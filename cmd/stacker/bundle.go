@@ -0,0 +1,28 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	cli "github.com/urfave/cli/v2"
+	"stackerbuild.io/stacker/pkg/stacker"
+)
+
+var bundleCmd = cli.Command{
+	Name:      "bundle",
+	Usage:     "packs what 'stacker fetch' downloaded into a tarball, for 'stacker build --offline --bundle'",
+	Action:    doBundle,
+	ArgsUsage: `<file>`,
+}
+
+func doBundle(ctx *cli.Context) error {
+	if ctx.Args().Len() != 1 {
+		return errors.Errorf("wrong number of args")
+	}
+
+	_, locks, err := stacker.NewStorage(config)
+	if err != nil {
+		return err
+	}
+	defer locks.Unlock()
+
+	return stacker.Bundle(config, ctx.Args().Get(0))
+}
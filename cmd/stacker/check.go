@@ -10,14 +10,25 @@ import (
 	"github.com/pkg/xattr"
 	cli "github.com/urfave/cli/v2"
 	"stackerbuild.io/stacker/pkg/log"
-	"stackerbuild.io/stacker/pkg/overlay"
 	"stackerbuild.io/stacker/pkg/stacker"
+	"stackerbuild.io/stacker/pkg/types"
 )
 
 var checkCmd = cli.Command{
 	Name:   "check",
 	Usage:  "checks that all runtime required things (like kernel features) are present",
 	Action: doCheck,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "stacker-file",
+			Aliases: []string{"f"},
+			Usage:   "also check the security settings of the layers in this stackerfile",
+		},
+		&cli.StringSliceFlag{
+			Name:  "substitute",
+			Usage: "variable substitution in stackerfiles, FOO=bar format",
+		},
+	},
 }
 
 func doCheck(ctx *cli.Context) error {
@@ -51,20 +62,62 @@ func doCheck(ctx *cli.Context) error {
 
 	log.Infof("%s %s", config.RootFSDir, fstype)
 
-	if fstype == "NFS(6969)" {
-		return errors.Errorf("roots dir (--roots-dir) path %s is not supported on NFS.", config.RootFSDir)
+	if e := verifyNewUIDMap(ctx); e != nil {
+		return e
 	}
 
-	if e := verifyNewUIDMap(ctx); e != nil {
+	if e := checkSecurity(ctx); e != nil {
 		return e
 	}
 
-	switch config.StorageType {
-	case "overlay":
-		return overlay.Check(config)
-	default:
-		return errors.Errorf("invalid storage type %v", config.StorageType)
+	storageType, err := stacker.CheckStorage(config)
+	if err != nil {
+		return err
+	}
+
+	// overlay's whiteouts can't be written to NFS, but copies can
+	if fstype == "NFS(6969)" && storageType != "dir" {
+		return errors.Errorf("roots dir (--roots-dir) path %s is not supported on NFS with %s storage, use --storage-type=dir.", config.RootFSDir, storageType)
+	}
+
+	log.Infof("storage type: %s", storageType)
+	return nil
+}
+
+func checkSecurity(ctx *cli.Context) error {
+	if config.Security != nil {
+		if err := stacker.CheckSecurity(config, *config.Security); err != nil {
+			return errors.Wrapf(err, "%s", ctx.String("config"))
+		}
 	}
+
+	file := ctx.String("stacker-file")
+	if file == "" {
+		return nil
+	}
+
+	sf, err := types.NewStackerfile(file, false, ctx.StringSlice("substitute"))
+	if err != nil {
+		return err
+	}
+
+	for _, name := range sf.FileOrder {
+		l, ok := sf.Get(name)
+		if !ok {
+			continue
+		}
+
+		security := config.Security.Merge(l.Security)
+		if security == nil {
+			continue
+		}
+
+		if err := stacker.CheckSecurity(config, *security); err != nil {
+			return errors.Wrapf(err, "%s", name)
+		}
+	}
+
+	return nil
 }
 
 func verifyNewUIDMap(ctx *cli.Context) error {
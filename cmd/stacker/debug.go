@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+	cli "github.com/urfave/cli/v2"
+	"stackerbuild.io/stacker/pkg/log"
+	"stackerbuild.io/stacker/pkg/overlay"
+	"stackerbuild.io/stacker/pkg/stacker"
+)
+
+var debugCmd = cli.Command{
+	Name:   "debug",
+	Usage:  "re-enter the rootfs of a layer kept by 'build --keep-failed'",
+	Action: doDebug,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "commit",
+			Usage: "after the session, write the layer's changes as a tar layer to this file",
+		},
+	},
+	ArgsUsage: fmt.Sprintf(`<tag> [cmd]
+
+<tag> is the layer whose failed build to debug.
+
+<cmd> is the command to run, or %s if none is specified.
+
+Changes made during the session are kept, so it can be re-entered to iterate
+on a fix. They are discarded the next time the layer fails to build.`, stacker.DefaultShell),
+}
+
+func doDebug(ctx *cli.Context) error {
+	if ctx.Args().Len() < 1 {
+		return errors.Errorf("wrong number of args")
+	}
+
+	s, locks, err := stacker.NewStorage(config)
+	if err != nil {
+		return err
+	}
+	defer locks.Unlock()
+
+	fl, err := stacker.LoadFailedLayer(config, s, ctx.Args().Get(0))
+	if err != nil {
+		return err
+	}
+
+	cmd := []string{stacker.DefaultShell}
+	if ctx.Args().Len() > 1 {
+		cmd = ctx.Args().Slice()[1:]
+	}
+
+	commit := ctx.String("commit")
+	if commit != "" && s.Name() != "overlay" && s.Name() != "fuse-overlay" {
+		return errors.Errorf("--commit is not supported for storage type %v", s.Name())
+	}
+
+	log.Infof("debugging %s from %s", fl.Name, fl.StackerFile)
+	err = stacker.DebugFailedLayer(config, s, fl, cmd)
+	if commit == "" {
+		return err
+	}
+
+	// the exit status of the last command in an interactive session
+	// shouldn't prevent committing what was done
+	if err != nil {
+		log.Infof("%s", err)
+	}
+
+	f, err := os.Create(commit)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	if err := overlay.WriteDiff(config, fl.Snapshot, f); err != nil {
+		return err
+	}
+
+	log.Infof("wrote changes to %s", commit)
+	return nil
+}
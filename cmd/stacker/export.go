@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/pkg/errors"
+	cli "github.com/urfave/cli/v2"
+	"machinerun.io/atomfs/pkg/verity"
+	"stackerbuild.io/stacker/pkg/lib"
+	"stackerbuild.io/stacker/pkg/overlay"
+	"stackerbuild.io/stacker/pkg/stacker"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+var exportCmd = cli.Command{
+	Name:   "export",
+	Usage:  "exports a built image as a directory, tarball or image archive",
+	Action: doExport,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "format",
+			Usage: "the export format (supported values: dir, tar, oci-archive, docker-archive)",
+			Value: "dir",
+		},
+		&cli.StringFlag{
+			Name:  "layer-type",
+			Usage: "the output layer type of the image to export",
+			Value: "tar",
+		},
+		&cli.StringFlag{
+			Name:  "layout",
+			Usage: "the OCI layout containing the image (defaults to --oci-dir)",
+		},
+		&cli.StringFlag{
+			Name:  "name",
+			Usage: "the image name to record in a docker-archive (defaults to <tag>:latest)",
+		},
+	},
+	ArgsUsage: `<tag> <dest>
+
+<tag> is the built tag to export.
+
+<dest> is the directory (for --format dir) or file to export to.`,
+}
+
+func doExport(ctx *cli.Context) error {
+	if ctx.Args().Len() != 2 {
+		return errors.Errorf("wrong number of args")
+	}
+
+	tag := ctx.Args().Get(0)
+	dest := ctx.Args().Get(1)
+
+	layerType, err := types.NewLayerType(ctx.String("layer-type"), verity.VerityMetadataPresent)
+	if err != nil {
+		return err
+	}
+
+	layout := ctx.String("layout")
+	if layout == "" {
+		layout = config.OCIDir
+	}
+	src := fmt.Sprintf("oci:%s:%s", layout, layerType.LayerName(tag))
+
+	switch ctx.String("format") {
+	case "dir":
+		return exportDir(layout, layerType.LayerName(tag), dest)
+	case "tar":
+		return exportTar(layout, layerType.LayerName(tag), dest)
+	case "oci-archive":
+		return lib.ImageCopy(lib.ImageCopyOpts{
+			Src:  src,
+			Dest: fmt.Sprintf("oci-archive:%s:%s", dest, tag),
+		})
+	case "docker-archive":
+		// docker only understands tar layers
+		if layerType.Type != "tar" {
+			return errors.Errorf("docker-archive can't contain %s layers", layerType.Type)
+		}
+
+		name := ctx.String("name")
+		if name == "" {
+			name = fmt.Sprintf("%s:latest", tag)
+		}
+
+		return lib.ImageCopy(lib.ImageCopyOpts{
+			Src:  src,
+			Dest: fmt.Sprintf("docker-archive:%s:%s", dest, name),
+		})
+	default:
+		return errors.Errorf("invalid export format: %s", ctx.String("format"))
+	}
+}
+
+func flatten(layout string, tag string, dest string) error {
+	s, locks, err := stacker.NewStorage(config)
+	if err != nil {
+		return err
+	}
+	defer locks.Unlock()
+
+	if s.Name() != "overlay" && s.Name() != "fuse-overlay" {
+		return errors.Errorf("export is not supported for storage type %v", s.Name())
+	}
+
+	return overlay.Flatten(config, layout, tag, dest)
+}
+
+func exportDir(layout string, tag string, dest string) error {
+	ents, err := os.ReadDir(dest)
+	if err == nil && len(ents) > 0 {
+		return errors.Errorf("%s is not empty", dest)
+	} else if err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+
+	return flatten(layout, tag, dest)
+}
+
+func exportTar(layout string, tag string, dest string) error {
+	if err := os.MkdirAll(config.StackerDir, 0755); err != nil {
+		return errors.WithStack(err)
+	}
+
+	dir, err := os.MkdirTemp(config.StackerDir, fmt.Sprintf("export-%s-", tag))
+	if err != nil {
+		return errors.Wrapf(err, "failed to create export tempdir")
+	}
+	defer os.RemoveAll(dir)
+
+	if err := flatten(layout, tag, dir); err != nil {
+		return err
+	}
+
+	f, err := os.Create(dest)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	tarball := layer.GenerateInsertLayer(dir, "/", false, &layer.RepackOptions{
+		SourceDateEpoch: config.SourceDateEpoch,
+	})
+	defer tarball.Close()
+
+	if _, err := io.Copy(f, tarball); err != nil {
+		return errors.Wrapf(err, "couldn't write %s", dest)
+	}
+
+	return errors.WithStack(f.Close())
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	cli "github.com/urfave/cli/v2"
+	"stackerbuild.io/stacker/pkg/stacker"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+var fetchCmd = cli.Command{
+	Name:   "fetch",
+	Usage:  "downloads the base images and files stackerfiles need, for building with --offline",
+	Action: doFetch,
+	Flags: []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:    "stacker-file",
+			Aliases: []string{"f"},
+			Usage:   "the stackerfiles to fetch for; can be supplied multiple times",
+			Value:   cli.NewStringSlice("stacker.yaml"),
+		},
+		&cli.StringSliceFlag{
+			Name:  "substitute",
+			Usage: "variable substitution in stackerfiles, FOO=bar format",
+		},
+	},
+}
+
+func doFetch(ctx *cli.Context) error {
+	sfm, err := types.NewStackerFiles(ctx.StringSlice("stacker-file"), false, append(ctx.StringSlice("substitute"), config.Substitutions()...))
+	if err != nil {
+		return err
+	}
+
+	return stacker.Fetch(stacker.FetchArgs{
+		Config:   config,
+		Progress: shouldShowProgress(ctx),
+	}, sfm)
+}
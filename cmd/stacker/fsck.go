@@ -0,0 +1,54 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	cli "github.com/urfave/cli/v2"
+	"stackerbuild.io/stacker/pkg/log"
+	"stackerbuild.io/stacker/pkg/stacker"
+)
+
+var fsckCmd = cli.Command{
+	Name:   "fsck",
+	Usage:  "checks stacker's work dirs for what interrupted builds left behind",
+	Action: doFsck,
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "repair",
+			Usage: "unmount and remove what is broken, so that the next build recreates it",
+		},
+	},
+}
+
+func doFsck(ctx *cli.Context) error {
+	s, locks, err := stacker.NewStorage(config)
+	if err != nil {
+		return err
+	}
+	defer locks.Unlock()
+
+	problems, err := stacker.Fsck(config, s, ctx.Bool("repair"))
+	if err != nil {
+		return err
+	}
+
+	unrepaired := 0
+	for _, problem := range problems {
+		if problem.Repaired {
+			log.Infof("repaired %s: %s", problem.Path, problem.Problem)
+			continue
+		}
+
+		log.Infof("%s: %s", problem.Path, problem.Problem)
+		unrepaired++
+	}
+
+	if unrepaired > 0 {
+		return errors.Errorf("found %d problems, run stacker fsck --repair to repair them", unrepaired)
+	}
+
+	if len(problems) == 0 {
+		log.Infof("no problems found")
+	}
+
+	return nil
+}
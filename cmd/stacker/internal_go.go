@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"runtime"
@@ -13,6 +14,8 @@ import (
 	"stackerbuild.io/stacker/pkg/lib"
 	"stackerbuild.io/stacker/pkg/log"
 	"stackerbuild.io/stacker/pkg/overlay"
+	"stackerbuild.io/stacker/pkg/stacker"
+	"stackerbuild.io/stacker/pkg/types"
 )
 
 var internalGoCmd = cli.Command{
@@ -35,6 +38,10 @@ var internalGoCmd = cli.Command{
 			Name:   "check-aa-profile",
 			Action: doCheckAAProfile,
 		},
+		&cli.Command{
+			Name:   "check-files",
+			Action: doCheckFiles,
+		},
 		/*
 		 * these are not actually used by stacker, but are entrypoints
 		 * to the code for use in the test suite.
@@ -105,6 +112,32 @@ func doImageCopy(ctx *cli.Context) error {
 	})
 }
 
+// doCheckFiles runs the file checks from an image's 'test' directive inside
+// the image, and writes the results to the output file. Failed checks are
+// recorded in the results rather than reported via the exit code.
+func doCheckFiles(ctx *cli.Context) error {
+	if ctx.Args().Len() != 2 {
+		return errors.Errorf("wrong number of args")
+	}
+
+	content, err := os.ReadFile(ctx.Args().Get(0))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	tests := []types.FileTest{}
+	if err := json.Unmarshal(content, &tests); err != nil {
+		return errors.Wrapf(err, "couldn't parse file tests")
+	}
+
+	content, err = json.Marshal(stacker.CheckFiles(tests))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return errors.WithStack(os.WriteFile(ctx.Args().Get(1), content, 0644))
+}
+
 func doCP(ctx *cli.Context) error {
 	if ctx.Args().Len() != 2 {
 		return errors.Errorf("wrong number of args")
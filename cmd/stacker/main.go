@@ -96,7 +96,8 @@ func shouldSkipInternalUserns(ctx *cli.Context) bool {
 		return false
 	}
 
-	if arg0 == "unpriv-setup" || arg0 == "internal-go" {
+	// mounts need to be visible outside of stacker's namespaces
+	if arg0 == "unpriv-setup" || arg0 == "internal-go" || arg0 == "mount" || arg0 == "umount" {
 		return true
 	}
 
@@ -143,7 +144,16 @@ func main() {
 		&internalGoCmd,
 		&unprivSetupCmd,
 		&gcCmd,
+		&fsckCmd,
 		&checkCmd,
+		&testCmd,
+		&debugCmd,
+		&exportCmd,
+		&mountCmd,
+		&umountCmd,
+		&rebaseCmd,
+		&fetchCmd,
+		&bundleCmd,
 	}
 
 	app.DisableSliceFlagSeparator = true
@@ -192,8 +202,19 @@ func main() {
 		},
 		&cli.StringFlag{
 			Name:  "storage-type",
-			Usage: "storage type (must be \"overlay\", left for compatibility)",
-			Value: "overlay",
+			Usage: "storage type (\"overlay\", \"fuse-overlay\" or \"dir\", picked by stacker check when not set)",
+		},
+		&cli.StringFlag{
+			Name:  "registries-conf",
+			Usage: "registries.conf to use for pulling and publishing images instead of the system one",
+		},
+		&cli.IntFlag{
+			Name:  "fetch-jobs",
+			Usage: "how many imports and base images to fetch at the same time (default 4)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "trusted-key",
+			Usage: "GPG or minisign public key file to check import signatures against, can be given more than once",
 		},
 		&cli.BoolFlag{
 			Name:   "internal-userns",
@@ -247,6 +268,8 @@ func main() {
 			logLevel = log.FatalLevel
 		}
 
+		config.DownloadRetries = types.DefaultDownloadRetries
+
 		var err error
 		content, err := os.ReadFile(ctx.String("config"))
 		if err == nil {
@@ -254,6 +277,16 @@ func main() {
 			if err != nil {
 				return err
 			}
+
+			// like a layer's, the seccomp profile is relative to the
+			// file it is set in
+			if config.Security != nil && config.Security.Seccomp != "" && !filepath.IsAbs(config.Security.Seccomp) {
+				configDir, err := filepath.Abs(filepath.Dir(ctx.String("config")))
+				if err != nil {
+					return err
+				}
+				config.Security.Seccomp = filepath.Join(configDir, config.Security.Seccomp)
+			}
 		}
 
 		config.EmbeddedFS = embeddedFS
@@ -305,6 +338,30 @@ func main() {
 
 		config.StorageType = ctx.String("storage-type")
 
+		if ctx.IsSet("registries-conf") {
+			config.RegistriesConf = ctx.String("registries-conf")
+		}
+		if config.RegistriesConf != "" {
+			config.RegistriesConf, err = filepath.Abs(config.RegistriesConf)
+			if err != nil {
+				return err
+			}
+		}
+
+		if ctx.IsSet("fetch-jobs") {
+			config.FetchJobs = ctx.Int("fetch-jobs")
+		}
+
+		if ctx.IsSet("trusted-key") {
+			config.TrustedKeys = ctx.StringSlice("trusted-key")
+		}
+		for i, key := range config.TrustedKeys {
+			config.TrustedKeys[i], err = filepath.Abs(key)
+			if err != nil {
+				return err
+			}
+		}
+
 		// For reproducible builds
 		if sde := os.Getenv("SOURCE_DATE_EPOCH"); sde != "" {
 			epoch, err := strconv.ParseInt(sde, 10, 64)
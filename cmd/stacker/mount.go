@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/opencontainers/umoci"
+	"github.com/pkg/errors"
+	cli "github.com/urfave/cli/v2"
+	"machinerun.io/atomfs/pkg/molecule"
+	stackeroci "machinerun.io/atomfs/pkg/oci"
+	"stackerbuild.io/stacker/pkg/log"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+var mountCmd = cli.Command{
+	Name:   "mount",
+	Usage:  "mounts a squashfs or erofs image, or lists active mounts",
+	Action: doMount,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "layout",
+			Usage: "the OCI layout containing the image (defaults to --oci-dir)",
+		},
+		&cli.BoolFlag{
+			Name:  "allow-missing-verity",
+			Usage: "mount layers that don't have dm-verity data (e.g. built with --no-verity)",
+		},
+		&cli.BoolFlag{
+			Name:  "writable",
+			Usage: "add a writable overlay on top of the image",
+		},
+		&cli.StringFlag{
+			Name:  "writable-dir",
+			Usage: "keep the writable overlay's changes in this directory instead of discarding them on umount",
+		},
+	},
+	ArgsUsage: `[<tag> <mountpoint>]
+
+<tag> is the tag of a squashfs or erofs image in the OCI layout, e.g.
+myimage-squashfs.
+
+<mountpoint> is the directory to mount it on.
+
+With no arguments, the active mounts are listed.`,
+}
+
+var umountCmd = cli.Command{
+	Name:   "umount",
+	Usage:  "unmounts an image mounted with 'stacker mount'",
+	Action: doUmount,
+	ArgsUsage: `<mountpoint>
+
+<mountpoint> is the directory the image is mounted on.`,
+}
+
+// mountRecord describes an image mounted by 'stacker mount', so that mounts
+// can be listed and cleaned up.
+type mountRecord struct {
+	Tag        string `json:"tag"`
+	Layout     string `json:"layout"`
+	Mountpoint string `json:"mountpoint"`
+	Writable   bool   `json:"writable,omitempty"`
+
+	// TempOverlay is the writable overlay created for the mount, which is
+	// removed on umount.
+	TempOverlay string `json:"temp_overlay,omitempty"`
+}
+
+func mountRecordsDir() string {
+	return path.Join(config.StackerDir, "mounts")
+}
+
+func mountRecordPath(mountpoint string) string {
+	return path.Join(mountRecordsDir(), fmt.Sprintf("%x.json", sha256.Sum256([]byte(mountpoint))))
+}
+
+// isMountpoint reports whether dir is a mountpoint in the current mount
+// namespace.
+func isMountpoint(dir string) (bool, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+
+		// spaces etc. are octal escaped, e.g. \040
+		mountpoint, err := strconv.Unquote(`"` + fields[4] + `"`)
+		if err != nil {
+			mountpoint = fields[4]
+		}
+
+		if mountpoint == dir {
+			return true, nil
+		}
+	}
+
+	return false, errors.WithStack(scanner.Err())
+}
+
+func doMount(ctx *cli.Context) error {
+	if ctx.Args().Len() == 0 {
+		return listMounts()
+	}
+
+	if ctx.Args().Len() != 2 {
+		return errors.Errorf("wrong number of args for mount")
+	}
+
+	tag := ctx.Args().Get(0)
+	mountpoint, err := filepath.Abs(ctx.Args().Get(1))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	layout := ctx.String("layout")
+	if layout == "" {
+		layout = config.OCIDir
+	}
+	layout, err = filepath.Abs(layout)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err := checkMountable(layout, tag); err != nil {
+		return err
+	}
+
+	record := mountRecord{
+		Tag:        tag,
+		Layout:     layout,
+		Mountpoint: mountpoint,
+		Writable:   ctx.Bool("writable") || ctx.String("writable-dir") != "",
+	}
+
+	opts := molecule.MountOCIOpts{
+		OCIDir:                 layout,
+		Tag:                    tag,
+		Target:                 mountpoint,
+		AllowMissingVerityData: ctx.Bool("allow-missing-verity"),
+		AddWriteableOverlay:    record.Writable,
+		WriteableOverlayPath:   ctx.String("writable-dir"),
+	}
+
+	if err := os.MkdirAll(mountRecordsDir(), 0755); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if record.Writable && opts.WriteableOverlayPath == "" {
+		dir, err := os.MkdirTemp(config.StackerDir, "mount-overlay-")
+		if err != nil {
+			return errors.Wrapf(err, "failed to create writable overlay dir")
+		}
+		record.TempOverlay = dir
+		opts.WriteableOverlayPath = dir
+	}
+
+	mol, err := molecule.BuildMoleculeFromOCI(opts)
+	if err != nil {
+		if record.TempOverlay != "" {
+			os.RemoveAll(record.TempOverlay)
+		}
+		return err
+	}
+
+	log.Debugf("about to mount %v", mol)
+	if err := mol.Mount(mountpoint); err != nil {
+		if record.TempOverlay != "" {
+			os.RemoveAll(record.TempOverlay)
+		}
+		return err
+	}
+
+	content, err := json.Marshal(record)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return errors.WithStack(os.WriteFile(mountRecordPath(mountpoint), content, 0644))
+}
+
+// checkMountable makes sure tag only has filesystem layers, since tar layers
+// can't be mounted.
+func checkMountable(layout string, tag string) error {
+	oci, err := umoci.OpenLayout(layout)
+	if err != nil {
+		return err
+	}
+	defer oci.Close()
+
+	manifest, err := stackeroci.LookupManifest(oci, tag)
+	if err != nil {
+		return err
+	}
+
+	layerType, err := types.NewLayerTypeManifest(manifest)
+	if err != nil {
+		return err
+	}
+
+	if layerType.Type == "tar" {
+		return errors.Errorf("%s has tar layers; only squashfs and erofs images can be mounted", tag)
+	}
+
+	return nil
+}
+
+func listMounts() error {
+	ents, err := os.ReadDir(mountRecordsDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.WithStack(err)
+	}
+
+	for _, ent := range ents {
+		content, err := os.ReadFile(path.Join(mountRecordsDir(), ent.Name()))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		record := mountRecord{}
+		if err := json.Unmarshal(content, &record); err != nil {
+			return errors.Wrapf(err, "couldn't parse mount record %s", ent.Name())
+		}
+
+		mounted, err := isMountpoint(record.Mountpoint)
+		if err != nil {
+			return err
+		}
+
+		mode := "ro"
+		if record.Writable {
+			mode = "rw"
+		}
+
+		state := ""
+		if !mounted {
+			state = " (not mounted)"
+		}
+
+		fmt.Printf("%s\t%s:%s\t%s%s\n", record.Mountpoint, record.Layout, record.Tag, mode, state)
+	}
+
+	return nil
+}
+
+func doUmount(ctx *cli.Context) error {
+	if ctx.Args().Len() != 1 {
+		return errors.Errorf("wrong number of args for umount")
+	}
+
+	mountpoint, err := filepath.Abs(ctx.Args().Get(0))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	record := mountRecord{}
+	content, err := os.ReadFile(mountRecordPath(mountpoint))
+	if err == nil {
+		if err := json.Unmarshal(content, &record); err != nil {
+			return errors.Wrapf(err, "couldn't parse mount record for %s", mountpoint)
+		}
+	} else if !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+
+	mounted, err := isMountpoint(mountpoint)
+	if err != nil {
+		return err
+	}
+
+	if mounted {
+		if err := molecule.Umount(mountpoint); err != nil {
+			return err
+		}
+	} else if record.Mountpoint == "" {
+		return errors.Errorf("%s is not mounted", mountpoint)
+	}
+
+	if record.TempOverlay != "" {
+		if err := os.RemoveAll(record.TempOverlay); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	err = os.Remove(mountRecordPath(mountpoint))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
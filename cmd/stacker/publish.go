@@ -69,9 +69,13 @@ var publishCmd = cli.Command{
 		},
 		&cli.StringSliceFlag{
 			Name:  "layer-type",
-			Usage: "set the output layer type (supported values: tar, squashfs, erofs); can be supplied multiple times",
+			Usage: "set the output layer type (supported values: tar, tar+zstd, tar+zstd:chunked, tar+estargz, squashfs, erofs, with an optional @<level> for tar compression); can be supplied multiple times",
 			Value: cli.NewStringSlice("tar"),
 		},
+		&cli.BoolFlag{
+			Name:  "squash",
+			Usage: "publish each image as a single layer, squashing all of its layers together",
+		},
 		&cli.StringSliceFlag{
 			Name:  "image",
 			Usage: "specific image to be published when a stacker file has many images; can be specified multiple times",
@@ -128,6 +132,7 @@ func doPublish(ctx *cli.Context) error {
 		SkipTLS:        ctx.Bool("skip-tls"),
 		LayerTypes:     layerTypes,
 		Images:         ctx.StringSlice("image"),
+		Squash:         ctx.Bool("squash"),
 	}
 
 	var stackerFiles []string
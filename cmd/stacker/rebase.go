@@ -0,0 +1,77 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	cli "github.com/urfave/cli/v2"
+	"machinerun.io/atomfs/pkg/verity"
+	"stackerbuild.io/stacker/pkg/stacker"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+var rebaseCmd = cli.Command{
+	Name:   "rebase",
+	Usage:  "replaces the base image of a built image without rebuilding it",
+	Action: doRebase,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "stacker-file",
+			Aliases: []string{"f"},
+			Usage:   "the stackerfile the image was built from",
+			Value:   "stacker.yaml",
+		},
+		&cli.StringFlag{
+			Name:  "onto",
+			Usage: "the new base image, as a docker:// or oci: url",
+		},
+		&cli.StringSliceFlag{
+			Name:  "substitute",
+			Usage: "variable substitution in stackerfiles, FOO=bar format",
+		},
+		&cli.StringSliceFlag{
+			Name:  "layer-type",
+			Usage: "the output layer types to rebase; can be supplied multiple times",
+			Value: cli.NewStringSlice("tar"),
+		},
+		&cli.BoolFlag{
+			Name:    "no-verity",
+			Usage:   "do not append dm-verity data to fs archives",
+			Aliases: []string{"no-squashfs-verity"},
+		},
+	},
+	ArgsUsage: `<tag> --onto <base>
+
+<tag> is a built image whose base is a docker or oci image.
+
+<base> is the image to replace its base with. The layers stacker built for
+<tag> are kept as they are, so <base> should be a compatible version of the
+original base, e.g. one with security fixes.`,
+}
+
+func doRebase(ctx *cli.Context) error {
+	if ctx.Args().Len() != 1 {
+		return errors.Errorf("wrong number of args")
+	}
+
+	if ctx.String("onto") == "" {
+		return errors.Errorf("--onto is a mandatory argument for rebasing")
+	}
+
+	verity := verity.VerityMetadata(!ctx.Bool("no-verity"))
+	layerTypes, err := types.NewLayerTypes(ctx.StringSlice("layer-type"), verity)
+	if err != nil {
+		return err
+	}
+
+	sfm, err := types.NewStackerFiles([]string{ctx.String("stacker-file")}, false, append(ctx.StringSlice("substitute"), config.Substitutions()...))
+	if err != nil {
+		return err
+	}
+
+	return stacker.Rebase(stacker.RebaseArgs{
+		Config:     config,
+		Name:       ctx.Args().Get(0),
+		Onto:       ctx.String("onto"),
+		LayerTypes: layerTypes,
+		Progress:   shouldShowProgress(ctx),
+	}, sfm)
+}
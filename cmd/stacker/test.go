@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/mutate"
+	"github.com/pkg/errors"
+	cli "github.com/urfave/cli/v2"
+	"machinerun.io/atomfs/pkg/verity"
+	"stackerbuild.io/stacker/pkg/lib"
+	"stackerbuild.io/stacker/pkg/log"
+	"stackerbuild.io/stacker/pkg/stacker"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+var testCmd = cli.Command{
+	Name:   "test",
+	Usage:  "runs the tests in a stackerfile against already built images",
+	Action: doTest,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "stacker-file",
+			Aliases: []string{"f"},
+			Usage:   "the input stackerfile",
+			Value:   "stacker.yaml",
+		},
+		&cli.StringSliceFlag{
+			Name:  "substitute",
+			Usage: "variable substitution in stackerfiles, FOO=bar format",
+		},
+		&cli.StringFlag{
+			Name:  "layer-type",
+			Usage: "the output layer type of the images to test",
+			Value: "tar",
+		},
+		&cli.StringFlag{
+			Name:  "layout",
+			Usage: "the OCI layout containing the images (defaults to --oci-dir)",
+		},
+		&cli.StringFlag{
+			Name:  "junit",
+			Usage: "write a JUnit XML report of the results to this file",
+		},
+	},
+	ArgsUsage: `[tag...]
+
+<tag> is a layer in the stackerfile whose tests should be run. If none are
+supplied, the tests for every layer with a 'test' directive are run.`,
+}
+
+func doTest(ctx *cli.Context) error {
+	sf, err := types.NewStackerfile(ctx.String("f"), false, ctx.StringSlice("substitute"))
+	if err != nil {
+		return err
+	}
+
+	layerType, err := types.NewLayerType(ctx.String("layer-type"), verity.VerityMetadataPresent)
+	if err != nil {
+		return err
+	}
+
+	layout := ctx.String("layout")
+	if layout == "" {
+		layout = config.OCIDir
+	}
+
+	tags := ctx.Args().Slice()
+	if len(tags) == 0 {
+		for _, name := range sf.FileOrder {
+			if l, ok := sf.Get(name); ok && l.Test != nil {
+				tags = append(tags, name)
+			}
+		}
+	}
+
+	s, locks, err := stacker.NewStorage(config)
+	if err != nil {
+		return err
+	}
+	defer locks.Unlock()
+
+	suites := []stacker.TestSuite{}
+	failed := 0
+	for _, tag := range tags {
+		l, ok := sf.Get(tag)
+		if !ok {
+			return errors.Errorf("no layer %s in stackerfile", tag)
+		}
+
+		if l.Test == nil {
+			return errors.Errorf("layer %s has no tests", tag)
+		}
+
+		suite, err := testImage(s, layout, layerType.LayerName(tag), *l.Test)
+		if err != nil {
+			return err
+		}
+
+		stacker.LogTestSuite(suite)
+		failed += suite.Failed()
+		suites = append(suites, suite)
+	}
+
+	if ctx.String("junit") != "" {
+		f, err := os.Create(ctx.String("junit"))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer f.Close()
+
+		if err := stacker.WriteJUnit(f, suites); err != nil {
+			return err
+		}
+	}
+
+	if failed > 0 {
+		return errors.Errorf("%d tests failed", failed)
+	}
+
+	return nil
+}
+
+// testImage unpacks the image from the layout into a temporary rootfs and
+// runs its tests.
+func testImage(s types.Storage, layout string, tag string, test types.ImageTest) (stacker.TestSuite, error) {
+	oci, err := umoci.OpenLayout(layout)
+	if err != nil {
+		return stacker.TestSuite{}, err
+	}
+	defer oci.Close()
+
+	descPaths, err := oci.ResolveReference(context.Background(), tag)
+	if err != nil {
+		return stacker.TestSuite{}, err
+	}
+
+	if len(descPaths) == 0 {
+		return stacker.TestSuite{}, errors.Errorf("tag %s not found in %s", tag, layout)
+	}
+
+	mutator, err := mutate.New(oci, descPaths[0])
+	if err != nil {
+		return stacker.TestSuite{}, errors.Wrapf(err, "mutator failed")
+	}
+
+	imageConfig, err := mutator.Config(context.Background())
+	if err != nil {
+		return stacker.TestSuite{}, err
+	}
+
+	cacheDir := path.Join(config.StackerDir, "layer-bases", "oci")
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return stacker.TestSuite{}, errors.WithStack(err)
+	}
+
+	testTag := fmt.Sprintf("stacker-test-%s", tag)
+	err = lib.ImageCopy(lib.ImageCopyOpts{
+		Src:  fmt.Sprintf("oci:%s:%s", layout, tag),
+		Dest: fmt.Sprintf("oci:%s:%s", cacheDir, testTag),
+	})
+	if err != nil {
+		return stacker.TestSuite{}, err
+	}
+	defer func() {
+		if err := deleteTag(cacheDir, testTag); err != nil {
+			log.Infof("failed to delete %s: %v", testTag, err)
+		}
+	}()
+
+	// clean up after any previous run that was interrupted
+	if err := s.Delete(testTag); err != nil && !os.IsNotExist(errors.Unwrap(err)) {
+		return stacker.TestSuite{}, err
+	}
+
+	if err := s.Unpack(testTag, testTag); err != nil {
+		return stacker.TestSuite{}, err
+	}
+	defer func() {
+		if err := s.Delete(testTag); err != nil {
+			log.Infof("failed to delete %s: %v", testTag, err)
+		}
+	}()
+
+	suite, err := stacker.RunImageTests(stacker.ImageTestOpts{
+		Config:      config,
+		Storage:     s,
+		Name:        testTag,
+		Test:        test,
+		ImageConfig: imageConfig.Config,
+	})
+	suite.Name = tag
+	return suite, err
+}
+
+// deleteTag removes tag from the OCI layout at layout.
+func deleteTag(layout string, tag string) error {
+	oci, err := umoci.OpenLayout(layout)
+	if err != nil {
+		return err
+	}
+	defer oci.Close()
+
+	return oci.DeleteReference(context.Background(), tag)
+}
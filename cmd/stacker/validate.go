@@ -7,7 +7,9 @@ import (
 
 	"github.com/pkg/errors"
 	cli "github.com/urfave/cli/v2"
+	"machinerun.io/atomfs/pkg/verity"
 	"stackerbuild.io/stacker/pkg/stacker"
+	"stackerbuild.io/stacker/pkg/types"
 )
 
 /*
@@ -44,17 +46,19 @@ func validateLayerTypeFlags(ctx *cli.Context) error {
 		return errors.Errorf("must specify at least one output --layer-type")
 	}
 
+	names := map[string]string{}
 	for _, layerType := range layerTypes {
-		switch layerType {
-		case "tar":
-			break
-		case "squashfs":
-			break
-		case "erofs":
-			break
-		default:
-			return errors.Errorf("unknown layer type: %s", layerType)
+		parsed, err := types.NewLayerType(layerType, verity.VerityMetadataMissing)
+		if err != nil {
+			return err
+		}
+
+		// e.g. tar+zstd@3 and tar+zstd@19 would be output to the same tag
+		name := parsed.LayerName("")
+		if other, ok := names[name]; ok {
+			return errors.Errorf("layer types %s and %s can't both be output", other, layerType)
 		}
+		names[name] = layerType
 	}
 
 	return nil
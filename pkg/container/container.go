@@ -8,7 +8,9 @@ import (
 	"os/signal"
 	"path"
 	"strings"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/lxc/go-lxc"
@@ -27,6 +29,7 @@ type Container struct {
 	sc          types.StackerConfig
 	c           *lxc.Container
 	displayName string
+	timeout     time.Duration
 }
 
 func New(sc types.StackerConfig, name string) (*Container, error) {
@@ -128,6 +131,12 @@ func (c *Container) containerError(theErr error, msg string) error {
 	return errors.Wrap(theErr, msg)
 }
 
+// SetTimeout limits how long subsequent calls to Execute may run for; once
+// the timeout expires, the container is killed. A zero timeout means no limit.
+func (c *Container) SetTimeout(timeout time.Duration) {
+	c.timeout = timeout
+}
+
 func (c *Container) Execute(args []string, stdin io.Reader) error {
 	f, err := os.CreateTemp("", fmt.Sprintf("stacker_%s_run", c.c.Name()))
 	if err != nil {
@@ -212,9 +221,36 @@ func (c *Container) Execute(args []string, stdin io.Reader) error {
 		}
 	}()
 
-	cmdErr := cmd.Run()
+	if err := cmd.Start(); err != nil {
+		done <- true
+		return c.containerError(err, "execute failed")
+	}
+
+	var timedOut atomic.Bool
+	if c.timeout > 0 {
+		timer := time.AfterFunc(c.timeout, func() {
+			timedOut.Store(true)
+			log.Infof("%s: run timed out after %s, killing container", c.displayName, c.timeout)
+
+			// kill init first so that everything in the container
+			// dies, then the wrapper in case init never started.
+			if pid := c.c.InitPid(); pid > 0 {
+				if err := syscall.Kill(pid, syscall.SIGKILL); err != nil {
+					log.Infof("failed to kill container init %d: %v", pid, err)
+				}
+			}
+			_ = cmd.Process.Kill()
+		})
+		defer timer.Stop()
+	}
+
+	cmdErr := cmd.Wait()
 	done <- true
 
+	if timedOut.Load() {
+		return errors.Errorf("%s: timed out after %s", c.displayName, c.timeout)
+	}
+
 	return c.containerError(cmdErr, "execute failed")
 }
 
@@ -16,6 +16,22 @@ func ResolveCurrentIdmapSet() (*idmap.Set, error) {
 	return resolveIdmapSet(currentUser)
 }
 
+// ResolveSingleIdmapSet is the idmap for users that have no subordinate ids
+// in /etc/sub{u,g}id: only the current user, mapped to root.
+func ResolveSingleIdmapSet() (*idmap.Set, error) {
+	currentUser, err := user.Current()
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't resolve current user")
+	}
+
+	hostMap, err := currentUserEntries(currentUser)
+	if err != nil {
+		return nil, err
+	}
+
+	return &idmap.Set{Entries: hostMap}, nil
+}
+
 func resolveIdmapSet(user *user.User) (*idmap.Set, error) {
 	idmapSet, err := idmap.NewSetFromSystem(user.Username)
 	if err != nil {
@@ -26,28 +42,9 @@ func resolveIdmapSet(user *user.User) (*idmap.Set, error) {
 		/* Let's make our current user the root user in the ns, so that when
 		 * stacker emits files, it does them as the right user.
 		 */
-		uid, err := strconv.Atoi(user.Uid)
-		if err != nil {
-			return nil, errors.Wrapf(err, "couldn't decode uid")
-		}
-
-		gid, err := strconv.Atoi(user.Gid)
+		hostMap, err := currentUserEntries(user)
 		if err != nil {
-			return nil, errors.Wrapf(err, "couldn't decode gid")
-		}
-		hostMap := []idmap.Entry{
-			idmap.Entry{
-				IsUID:    true,
-				HostID:   int64(uid),
-				NSID:     0,
-				MapRange: 1,
-			},
-			idmap.Entry{
-				IsGID:    true,
-				HostID:   int64(gid),
-				NSID:     0,
-				MapRange: 1,
-			},
+			return nil, err
 		}
 
 		for _, hm := range hostMap {
@@ -60,3 +57,31 @@ func resolveIdmapSet(user *user.User) (*idmap.Set, error) {
 
 	return idmapSet, nil
 }
+
+// currentUserEntries are the entries that map user's uid and gid to root.
+func currentUserEntries(user *user.User) ([]idmap.Entry, error) {
+	uid, err := strconv.Atoi(user.Uid)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't decode uid")
+	}
+
+	gid, err := strconv.Atoi(user.Gid)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't decode gid")
+	}
+
+	return []idmap.Entry{
+		idmap.Entry{
+			IsUID:    true,
+			HostID:   int64(uid),
+			NSID:     0,
+			MapRange: 1,
+		},
+		idmap.Entry{
+			IsGID:    true,
+			HostID:   int64(gid),
+			NSID:     0,
+			MapRange: 1,
+		},
+	}, nil
+}
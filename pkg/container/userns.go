@@ -42,8 +42,16 @@ func MaybeRunInNamespace(config types.StackerConfig, userCmd []string) error {
 			return err
 		}
 
+		// without subordinate ids (i.e. no stacker unpriv-setup), only
+		// the current user can be mapped; files that belong to anyone
+		// else are then owned by root, with their owner kept in an
+		// xattr.
 		if idmapSet == nil {
-			return errors.Errorf("no idmap and not root, can't run %v", userCmd)
+			log.Debugf("no subordinate ids in /etc/sub{u,g}id, only mapping the current user")
+			idmapSet, err = stackeridmap.ResolveSingleIdmapSet()
+			if err != nil {
+				return err
+			}
 		}
 
 		args = append(args, "usernsexec")
@@ -0,0 +1,169 @@
+package dir
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/pkg/xattr"
+	"golang.org/x/sys/unix"
+)
+
+type inode struct {
+	dev uint64
+	ino uint64
+}
+
+// copyTree copies the tree at source to target, which must not exist,
+// keeping everything layers are generated from: owners, modes, xattrs, times
+// and hard links. File contents are reflinked where the filesystem can.
+func copyTree(source string, target string) error {
+	links := map[inode]string{}
+	dirs := []string{}
+
+	err := filepath.WalkDir(source, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(source, p)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		dest := filepath.Join(target, rel)
+
+		fi, err := d.Info()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		stat := fi.Sys().(*syscall.Stat_t)
+
+		switch fi.Mode().Type() {
+		case fs.ModeDir:
+			if err := os.Mkdir(dest, 0700); err != nil {
+				return errors.WithStack(err)
+			}
+			// directory times are set once everything in them is
+			// copied
+			dirs = append(dirs, rel)
+			return copyMetadata(p, dest, fi)
+		case fs.ModeSymlink:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			if err := os.Symlink(link, dest); err != nil {
+				return errors.WithStack(err)
+			}
+		default:
+			key := inode{uint64(stat.Dev), stat.Ino}
+			if stat.Nlink > 1 {
+				if first, ok := links[key]; ok {
+					return errors.WithStack(os.Link(first, dest))
+				}
+				links[key] = dest
+			}
+
+			if fi.Mode().IsRegular() {
+				err = cloneFile(p, dest)
+			} else {
+				err = unix.Mknod(dest, stat.Mode, int(stat.Rdev))
+				err = errors.Wrapf(err, "couldn't create %s", dest)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		if err := copyMetadata(p, dest, fi); err != nil {
+			return err
+		}
+		return setTimes(dest, fi)
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		fi, err := os.Lstat(filepath.Join(source, dirs[i]))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if err := setTimes(filepath.Join(target, dirs[i]), fi); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// cloneFile reflinks source to target, falling back to copying it.
+func cloneFile(source string, target string) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer out.Close()
+
+	if err := unix.IoctlFileClone(int(out.Fd()), int(in.Fd())); err != nil {
+		if _, err := io.Copy(out, in); err != nil {
+			return errors.Wrapf(err, "couldn't copy %s", source)
+		}
+	}
+
+	return errors.WithStack(out.Close())
+}
+
+func copyMetadata(source string, target string, fi fs.FileInfo) error {
+	stat := fi.Sys().(*syscall.Stat_t)
+	if err := os.Lchown(target, int(stat.Uid), int(stat.Gid)); err != nil {
+		return errors.Wrapf(err, "couldn't chown %s", target)
+	}
+
+	// user.* xattrs can't exist on symlinks, and their mode is meaningless
+	if fi.Mode()&fs.ModeSymlink != 0 {
+		return nil
+	}
+
+	// chmod after chown, which clears setuid bits
+	if err := unix.Chmod(target, stat.Mode&07777); err != nil {
+		return errors.Wrapf(err, "couldn't chmod %s", target)
+	}
+
+	attrs, err := xattr.LList(source)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't list xattrs of %s", source)
+	}
+
+	for _, attr := range attrs {
+		val, err := xattr.LGet(source, attr)
+		if err != nil {
+			return errors.Wrapf(err, "couldn't get xattr %s of %s", attr, source)
+		}
+
+		if err := xattr.LSet(target, attr, val); err != nil {
+			return errors.Wrapf(err, "couldn't set xattr %s on %s", attr, target)
+		}
+	}
+
+	return nil
+}
+
+func setTimes(target string, fi fs.FileInfo) error {
+	stat := fi.Sys().(*syscall.Stat_t)
+	ts := []unix.Timespec{
+		unix.NsecToTimespec(syscall.TimespecToNsec(stat.Atim)),
+		unix.NsecToTimespec(syscall.TimespecToNsec(stat.Mtim)),
+	}
+	err := unix.UtimesNanoAt(unix.AT_FDCWD, target, ts, unix.AT_SYMLINK_NOFOLLOW)
+	return errors.Wrapf(err, "couldn't set times on %s", target)
+}
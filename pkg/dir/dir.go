@@ -0,0 +1,166 @@
+// A copy based storage backend, for where overlay can't be mounted (in
+// containers, on NFS, etc.).
+//
+// Each tag is a full copy of its filesystem in <roots>/<name>/rootfs, which
+// is what LXC uses as the container's rootfs. Snapshots are reflinked where
+// the filesystem supports it, and copied otherwise. Next to the rootfs is an
+// mtree manifest of what it was like the last time it was unpacked or
+// repacked, which the new layer is generated from the differences to.
+package dir
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"stackerbuild.io/stacker/pkg/lib"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+var _ types.Storage = &dir{}
+
+// Check checks that the dir storage can be used, which it always can.
+func Check(config types.StackerConfig) error {
+	return nil
+}
+
+type dir struct {
+	config types.StackerConfig
+}
+
+func NewDir(config types.StackerConfig) (types.Storage, error) {
+	return &dir{config}, nil
+}
+
+func (d *dir) Name() string {
+	return "dir"
+}
+
+func (d *dir) rootfs(name string) string {
+	return path.Join(d.config.RootFSDir, name, "rootfs")
+}
+
+func (d *dir) Create(name string) error {
+	err := os.MkdirAll(d.rootfs(name), 0755)
+	return errors.Wrapf(err, "couldn't create %s", name)
+}
+
+func (d *dir) SetupEmptyRootfs(name string) error {
+	return d.writeBaseline(name)
+}
+
+func (d *dir) snapshot(source string, target string) error {
+	if err := d.Delete(target); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(path.Join(d.config.RootFSDir, target), 0755); err != nil {
+		return errors.Wrapf(err, "couldn't create %s", target)
+	}
+
+	if err := removeMountpoints(d.rootfs(source)); err != nil {
+		return err
+	}
+
+	if err := copyTree(d.rootfs(source), d.rootfs(target)); err != nil {
+		return errors.Wrapf(err, "couldn't snapshot %s to %s", source, target)
+	}
+
+	// the new rootfs differs from the source's baseline exactly the same
+	// way, so the changes of build only layers end up in the next layer
+	// that is repacked.
+	err := lib.FileCopyNoPerms(baselinePath(d.config, target), baselinePath(d.config, source))
+	return errors.Wrapf(err, "couldn't copy baseline of %s", source)
+}
+
+func (d *dir) Snapshot(source, target string) error {
+	return d.snapshot(source, target)
+}
+
+func (d *dir) Restore(source, target string) error {
+	return d.snapshot(source, target)
+}
+
+func (d *dir) Delete(thing string) error {
+	return errors.Wrapf(os.RemoveAll(path.Join(d.config.RootFSDir, thing)), "couldn't delete %s", thing)
+}
+
+func (d *dir) Exists(thing string) bool {
+	_, err := os.Stat(path.Join(d.config.RootFSDir, thing))
+	return err == nil
+}
+
+func (d *dir) Rename(source, target string) error {
+	if err := d.Delete(target); err != nil {
+		return err
+	}
+
+	err := os.Rename(path.Join(d.config.RootFSDir, source), path.Join(d.config.RootFSDir, target))
+	return errors.Wrapf(err, "couldn't rename %s to %s", source, target)
+}
+
+func (d *dir) TemporaryWritableSnapshot(source string) (string, func(), error) {
+	tmp, err := os.MkdirTemp(d.config.RootFSDir, fmt.Sprintf("temp-snapshot-%s-", source))
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "failed to create snapshot")
+	}
+
+	cleanup := func() {
+		d.Delete(path.Base(tmp))
+	}
+
+	err = d.Snapshot(source, path.Base(tmp))
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+
+	return path.Base(tmp), cleanup, nil
+}
+
+func (d *dir) Clean() error {
+	return errors.Wrapf(os.RemoveAll(d.config.RootFSDir), "couldn't clean rootfs dir")
+}
+
+func (d *dir) GC() error {
+	// nothing is shared between tags, so there is nothing to collect
+	return nil
+}
+
+func (d *dir) GetLXCRootfsConfig(name string) (string, error) {
+	return fmt.Sprintf("dir:%s", d.rootfs(name)), nil
+}
+
+func (d *dir) TarExtractLocation(name string) string {
+	return d.rootfs(name)
+}
+
+// SetOverlayDirs copies overlayDirs into name's rootfs, so that they are part
+// of the layer generated from it.
+func (d *dir) SetOverlayDirs(name string, overlayDirs []types.OverlayDir, layerTypes []types.LayerType) error {
+	for _, overlayDir := range overlayDirs {
+		st, err := os.Stat(overlayDir.Source)
+		if os.IsNotExist(err) {
+			return errors.Errorf("Given overlay_dir %s doesn't exists", overlayDir.Source)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "couldn't stat overlay_dir %s", overlayDir.Source)
+		}
+		if !st.IsDir() {
+			return errors.Errorf("Given overlay_dir %s should be a directory", overlayDir.Source)
+		}
+
+		dest := filepath.Join(d.rootfs(name), filepath.Clean("/"+overlayDir.Dest))
+		if err := os.MkdirAll(dest, 0755); err != nil {
+			return errors.Wrapf(err, "couldn't create overlay_dir dest %s", overlayDir.Dest)
+		}
+
+		if err := lib.DirCopy(dest, overlayDir.Source); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,145 @@
+package dir
+
+import (
+	"context"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/stretchr/testify/assert"
+	"machinerun.io/atomfs/pkg/verity"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+func TestSnapshotAndDiff(t *testing.T) {
+	assert := assert.New(t)
+
+	tmp := t.TempDir()
+	config := types.StackerConfig{
+		StackerDir: path.Join(tmp, ".stacker"),
+		RootFSDir:  path.Join(tmp, "roots"),
+		OCIDir:     path.Join(tmp, "oci"),
+	}
+
+	s, err := NewDir(config)
+	assert.NoError(err)
+	d := s.(*dir)
+
+	assert.NoError(s.Create("base"))
+	assert.NoError(s.SetupEmptyRootfs("base"))
+
+	rootfs := s.TarExtractLocation("base")
+	assert.NoError(os.MkdirAll(path.Join(rootfs, "etc"), 0755))
+	assert.NoError(os.WriteFile(path.Join(rootfs, "etc/kept"), []byte("kept"), 0600))
+	assert.NoError(os.WriteFile(path.Join(rootfs, "etc/removed"), []byte("removed"), 0644))
+	assert.NoError(os.Link(path.Join(rootfs, "etc/kept"), path.Join(rootfs, "etc/link")))
+	assert.NoError(os.Symlink("kept", path.Join(rootfs, "etc/symlink")))
+	assert.NoError(os.Chown(path.Join(rootfs, "etc/kept"), 1000, 1000))
+
+	diffs, err := d.diff("base")
+	assert.NoError(err)
+	assert.NotEmpty(diffs)
+	assert.NoError(d.writeBaseline("base"))
+
+	// a snapshot is the same as its source, so nothing changed since
+	// the baseline
+	assert.NoError(s.Snapshot("base", "child"))
+	diffs, err = d.diff("child")
+	assert.NoError(err)
+	assert.Empty(diffs)
+
+	child := s.TarExtractLocation("child")
+	fi, err := os.Stat(path.Join(child, "etc/kept"))
+	assert.NoError(err)
+	stat := fi.Sys().(*syscall.Stat_t)
+	assert.EqualValues(2, stat.Nlink)
+	assert.EqualValues(1000, stat.Uid)
+	assert.Equal(os.FileMode(0600), fi.Mode().Perm())
+
+	// an empty /stacker mountpoint is dropped, changes aren't
+	assert.NoError(os.Mkdir(path.Join(child, "stacker"), 0755))
+	assert.NoError(os.Remove(path.Join(child, "etc/removed")))
+	assert.NoError(os.WriteFile(path.Join(child, "etc/new"), []byte("new"), 0644))
+	assert.NoError(removeMountpoints(child))
+	assert.NoDirExists(path.Join(child, "stacker"))
+
+	diffs, err = d.diff("child")
+	assert.NoError(err)
+	changed := []string{}
+	for _, diff := range diffs {
+		changed = append(changed, diff.Path())
+	}
+	assert.ElementsMatch([]string{"etc/removed", "etc/new"}, changed)
+
+	// and they end up in a layer on top of the image
+	oci, err := umoci.CreateLayout(config.OCIDir)
+	assert.NoError(err)
+	defer oci.Close()
+
+	layerType, err := types.NewLayerType("tar", verity.VerityMetadataMissing)
+	assert.NoError(err)
+	assert.NoError(umoci.NewImage(oci, layerType.LayerName("child"), nil))
+	assert.NoError(d.addDiffLayer(oci, "child", layerType, diffs, &ispec.History{}))
+
+	descPaths, err := oci.ResolveReference(context.Background(), layerType.LayerName("child"))
+	assert.NoError(err)
+	assert.Len(descPaths, 1)
+
+	blob, err := oci.FromDescriptor(context.Background(), descPaths[0].Descriptor())
+	assert.NoError(err)
+	defer blob.Close()
+	assert.Len(blob.Data.(ispec.Manifest).Layers, 1)
+}
+
+func TestRepackRejectsFilesystemLayers(t *testing.T) {
+	assert := assert.New(t)
+
+	layerType, err := types.NewLayerType("squashfs", verity.VerityMetadataMissing)
+	assert.NoError(err)
+	assert.ErrorContains(checkLayerTypes([]types.LayerType{layerType}), "can only generate tar layers")
+}
+
+func TestFsck(t *testing.T) {
+	assert := assert.New(t)
+
+	tmp := t.TempDir()
+	config := types.StackerConfig{
+		StackerDir: path.Join(tmp, ".stacker"),
+		RootFSDir:  path.Join(tmp, "roots"),
+		OCIDir:     path.Join(tmp, "oci"),
+	}
+
+	s, err := NewDir(config)
+	assert.NoError(err)
+
+	assert.NoError(s.Create("good"))
+	assert.NoError(s.SetupEmptyRootfs("good"))
+
+	// a build interrupted before the baseline was written
+	assert.NoError(s.Create("bad"))
+
+	problems, err := s.Fsck(types.FsckOpts{})
+	assert.NoError(err)
+	assert.Len(problems, 1)
+	assert.Equal(path.Join(config.RootFSDir, "bad"), problems[0].Path)
+	assert.False(problems[0].Repaired)
+	assert.True(s.Exists("bad"))
+
+	problems, err = s.Fsck(types.FsckOpts{Repair: true})
+	assert.NoError(err)
+	assert.Len(problems, 1)
+	assert.True(problems[0].Repaired)
+	assert.False(s.Exists("bad"))
+	assert.True(s.Exists("good"))
+
+	// a layer named like a temporary dir isn't removed
+	assert.NoError(s.Create("squash-good"))
+	assert.NoError(s.SetupEmptyRootfs("squash-good"))
+	problems, err = s.Fsck(types.FsckOpts{Repair: true, Layers: map[string]bool{"squash-good": true}})
+	assert.NoError(err)
+	assert.Empty(problems)
+	assert.True(s.Exists("squash-good"))
+}
@@ -0,0 +1,55 @@
+package dir
+
+import (
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+	"stackerbuild.io/stacker/pkg/lib"
+	"stackerbuild.io/stacker/pkg/storage"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+// Fsck checks that each tag has a rootfs and the baseline its next layer is
+// generated from. Tags without them are deleted when repairing, so that they
+// are set up again by the next build.
+func (d *dir) Fsck(opts types.FsckOpts) ([]types.FsckProblem, error) {
+	f := &storage.FsckProblems{Repair: opts.Repair}
+
+	ents, err := os.ReadDir(d.config.RootFSDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "couldn't read roots dir")
+	}
+
+	for _, ent := range ents {
+		name := ent.Name()
+		if !ent.IsDir() || strings.HasPrefix(name, ".") {
+			continue
+		}
+
+		p := path.Join(d.config.RootFSDir, name)
+		remove := func() error { return d.Delete(name) }
+
+		problem := ""
+		switch {
+		case storage.IsTempDir(name) && !opts.Layers[name]:
+			problem = "orphaned temporary dir"
+		case !lib.PathExists(d.rootfs(name)):
+			problem = "missing rootfs"
+		case !lib.PathExists(baselinePath(d.config, name)):
+			problem = "missing baseline.mtree"
+		}
+
+		if problem != "" {
+			if err := f.Found(p, remove, "%s", problem); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return f.Problems, nil
+}
@@ -0,0 +1,339 @@
+package dir
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/mutate"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/opencontainers/umoci/pkg/fseval"
+	"github.com/opencontainers/umoci/pkg/mtreefilter"
+	"github.com/pkg/errors"
+	"github.com/vbatts/go-mtree"
+	"golang.org/x/sys/unix"
+	stackeroci "machinerun.io/atomfs/pkg/oci"
+	"stackerbuild.io/stacker/pkg/log"
+	stackermtree "stackerbuild.io/stacker/pkg/mtree"
+	"stackerbuild.io/stacker/pkg/overlay"
+	"stackerbuild.io/stacker/pkg/storage"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+func baselinePath(config types.StackerConfig, name string) string {
+	return path.Join(config.RootFSDir, name, "baseline.mtree")
+}
+
+// mapOptions are how owners are kept on disk. Where files can't be chowned
+// to other users than root, their owners are kept in the
+// user.rootlesscontainers xattr, as for the overlay storage.
+func mapOptions() layer.MapOptions {
+	return layer.MapOptions{Rootless: overlay.InSingleIdNamespace()}
+}
+
+func fsEval() fseval.FsEval {
+	if mapOptions().Rootless {
+		return fseval.Rootless
+	}
+	return fseval.Default
+}
+
+// removeMountpoints removes the mountpoint LXC creates in the rootfs for
+// /stacker, so that it doesn't end up in layers. It's only removed if it is
+// empty, i.e. if it isn't something the layer put there.
+func removeMountpoints(rootfs string) error {
+	err := os.Remove(path.Join(rootfs, "stacker"))
+	if err == nil || os.IsNotExist(err) || errors.Is(err, unix.ENOTEMPTY) || errors.Is(err, unix.ENOTDIR) {
+		return nil
+	}
+	return errors.Wrapf(err, "couldn't remove /stacker mountpoint")
+}
+
+// writeBaseline records what name's rootfs is like now, to generate the next
+// layer from the differences to it.
+func (d *dir) writeBaseline(name string) error {
+	dh, err := mtree.Walk(d.rootfs(name), nil, umoci.MtreeKeywords, fsEval())
+	if err != nil {
+		return errors.Wrapf(err, "couldn't walk %s", name)
+	}
+
+	f, err := os.Create(baselinePath(d.config, name))
+	if err != nil {
+		return errors.Wrapf(err, "couldn't create baseline of %s", name)
+	}
+	defer f.Close()
+
+	if _, err := dh.WriteTo(f); err != nil {
+		return errors.Wrapf(err, "couldn't write baseline of %s", name)
+	}
+
+	return errors.WithStack(f.Close())
+}
+
+// diff returns how name's rootfs changed since its baseline.
+func (d *dir) diff(name string) ([]mtree.InodeDelta, error) {
+	f, err := os.Open(baselinePath(d.config, name))
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't open baseline of %s", name)
+	}
+	defer f.Close()
+
+	spec, err := mtree.ParseSpec(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't parse baseline of %s", name)
+	}
+
+	diffs, err := mtree.Check(d.rootfs(name), spec, umoci.MtreeKeywords, fsEval())
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't diff %s", name)
+	}
+
+	return mtreefilter.FilterDeltas(diffs, stackermtree.LayerGenerationIgnoreRoot, mtreefilter.SimplifyFilter(diffs)), nil
+}
+
+func (d *dir) Unpack(tag, name string) error {
+	oci, err := umoci.OpenLayout(path.Join(d.config.StackerDir, "layer-bases", "oci"))
+	if err != nil {
+		return err
+	}
+	defer oci.Close()
+
+	manifest, err := stackeroci.LookupManifest(oci, tag)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(path.Join(d.config.RootFSDir, name), 0755); err != nil {
+		return errors.Wrapf(err, "couldn't create %s", name)
+	}
+
+	if err := os.RemoveAll(d.rootfs(name)); err != nil {
+		return errors.Wrapf(err, "couldn't clear rootfs of %s", name)
+	}
+
+	opts := layer.UnpackOptions{OnDiskFormat: layer.DirRootfs{MapOptions: mapOptions()}}
+	err = layer.UnpackRootfs(context.Background(), oci, d.rootfs(name), manifest, &opts)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't unpack %s", tag)
+	}
+
+	return d.writeBaseline(name)
+}
+
+// checkLayerTypes errors for layer types other than tar, since layers are
+// generated from mtree differences, which is only done for tar layers.
+func checkLayerTypes(layerTypes []types.LayerType) error {
+	for _, layerType := range layerTypes {
+		if layerType.Type != "tar" {
+			return errors.Errorf("dir storage can only generate tar layers, not %s", layerType)
+		}
+	}
+	return nil
+}
+
+func (d *dir) Repack(name string, l types.Layer, layerTypes []types.LayerType, sfm types.StackerFiles) error {
+	if err := checkLayerTypes(layerTypes); err != nil {
+		return err
+	}
+
+	convert := func(cacheTag string, name string, layerType types.LayerType) error {
+		return errors.Errorf("dir storage can't convert %s to %s, use its layer type", cacheTag, layerType)
+	}
+
+	err := storage.InitializeBasesInOutput(d.config, name, layerTypes, sfm, convert)
+	if err != nil {
+		return err
+	}
+
+	if err := removeMountpoints(d.rootfs(name)); err != nil {
+		return err
+	}
+
+	diffs, err := d.diff(name)
+	if err != nil {
+		return err
+	}
+
+	oci, err := umoci.OpenLayout(d.config.OCIDir)
+	if err != nil {
+		return err
+	}
+	defer oci.Close()
+
+	if len(diffs) != 0 {
+		log.Debugf("generating layer for %s from %d changes", name, len(diffs))
+
+		now := time.Now()
+		if d.config.SourceDateEpoch != nil {
+			now = *d.config.SourceDateEpoch
+		}
+		history := &ispec.History{
+			Created:    &now,
+			CreatedBy:  fmt.Sprintf("stacker build of %s", name),
+			EmptyLayer: false,
+		}
+
+		for _, layerType := range layerTypes {
+			if err := d.addDiffLayer(oci, name, layerType, diffs, history); err != nil {
+				return err
+			}
+		}
+
+		if err := d.writeBaseline(name); err != nil {
+			return err
+		}
+	}
+
+	// the unsquashed image is kept, so that layers built on this one and
+	// the build cache can use it
+	for _, layerType := range layerTypes {
+		if !l.Squash {
+			if err := storage.DropUnsquashed(oci, layerType.LayerName(name)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := storage.KeepUnsquashed(oci, layerType.LayerName(name)); err != nil {
+			return err
+		}
+
+		err = squashImage(d.config, oci, layerType.LayerName(name), layerType.LayerName(name), layerType)
+		if err != nil {
+			return errors.Wrapf(err, "couldn't squash %s", layerType.LayerName(name))
+		}
+	}
+
+	return nil
+}
+
+// addDiffLayer adds a layerType layer with the diffs of name's rootfs to
+// layerType's image of name.
+func (d *dir) addDiffLayer(oci casext.Engine, name string, layerType types.LayerType, diffs []mtree.InodeDelta, history *ispec.History) error {
+	descPaths, err := oci.ResolveReference(context.Background(), layerType.LayerName(name))
+	if err != nil {
+		return err
+	}
+
+	mutator, err := mutate.New(oci, descPaths[0])
+	if err != nil {
+		return err
+	}
+
+	blob, err := layer.GenerateLayer(d.rootfs(name), diffs, &layer.RepackOptions{
+		OnDiskFormat:    layer.DirRootfs{MapOptions: mapOptions()},
+		SourceDateEpoch: d.config.SourceDateEpoch,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "couldn't generate layer for %s", name)
+	}
+	defer blob.Close()
+
+	desc, err := overlay.AddTarLayer(d.config, oci, mutator, layerType, blob, history)
+	if err != nil {
+		return err
+	}
+	log.Debugf("generated %s layer %s for %s", layerType, desc.Digest, name)
+
+	newPath, err := mutator.Commit(context.Background())
+	if err != nil {
+		return err
+	}
+
+	return oci.UpdateReference(context.Background(), layerType.LayerName(name), newPath.Root())
+}
+
+func (d *dir) Squash(tag string, target string, layerType types.LayerType) error {
+	if err := checkLayerTypes([]types.LayerType{layerType}); err != nil {
+		return err
+	}
+
+	oci, err := umoci.OpenLayout(d.config.OCIDir)
+	if err != nil {
+		return err
+	}
+	defer oci.Close()
+
+	return squashImage(d.config, oci, tag, target, layerType)
+}
+
+// squashImage writes the image tag in the output OCI layout to target as an
+// image with a single layerType layer holding all of its layers' contents.
+// target may be tag itself.
+func squashImage(config types.StackerConfig, oci casext.Engine, tag string, target string, layerType types.LayerType) error {
+	manifest, err := stackeroci.LookupManifest(oci, tag)
+	if err != nil {
+		return err
+	}
+
+	// there's nothing to squash, but target should still be the image
+	if len(manifest.Layers) <= 1 {
+		if tag == target {
+			return nil
+		}
+
+		descPaths, err := oci.ResolveReference(context.Background(), tag)
+		if err != nil {
+			return err
+		}
+
+		return oci.UpdateReference(context.Background(), target, descPaths[0].Root())
+	}
+
+	imageConfig, err := stackeroci.LookupConfig(oci, manifest.Config)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.MkdirTemp(config.RootFSDir, "squash-")
+	if err != nil {
+		return errors.Wrapf(err, "couldn't create squash dir")
+	}
+	defer os.RemoveAll(tmp)
+
+	contents := path.Join(tmp, "rootfs")
+	unpackOpts := layer.UnpackOptions{OnDiskFormat: layer.DirRootfs{MapOptions: mapOptions()}}
+	err = layer.UnpackRootfs(context.Background(), oci, contents, manifest, &unpackOpts)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't unpack %s", tag)
+	}
+
+	packOpts := layer.RepackOptions{
+		OnDiskFormat:    layer.DirRootfs{MapOptions: mapOptions()},
+		SourceDateEpoch: config.SourceDateEpoch,
+	}
+	blob := layer.GenerateInsertLayer(contents, "/", false, &packOpts)
+	defer blob.Close()
+
+	desc, diffID, err := overlay.PutTarLayer(config, oci, layerType, blob)
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("squashed %d layers of %s into %s", len(manifest.Layers), tag, desc.Digest)
+
+	now := time.Now()
+	if config.SourceDateEpoch != nil {
+		now = *config.SourceDateEpoch
+	}
+
+	newConfig := imageConfig
+	newConfig.RootFS.DiffIDs = []digest.Digest{diffID}
+	newConfig.History = []ispec.History{{
+		Created:   &now,
+		CreatedBy: fmt.Sprintf("stacker squash of %s", tag),
+		Comment:   fmt.Sprintf("squashed %d layers", len(manifest.Layers)),
+	}}
+
+	newManifest := manifest
+	newManifest.Layers = []ispec.Descriptor{desc}
+
+	_, err = stackeroci.UpdateImageConfig(oci, target, newConfig, newManifest)
+	return err
+}
@@ -0,0 +1,113 @@
+package lib
+
+import (
+	"bufio"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+var (
+	// e.g. "b5bb9d80...  foo.tar.gz", or "*foo.tar.gz" for binary mode
+	gnuChecksum = regexp.MustCompile(`^([0-9a-fA-F]+) [ *](.+)$`)
+	// e.g. "SHA256 (foo.tar.gz) = b5bb9d80..."
+	bsdChecksum = regexp.MustCompile(`^(SHA256|SHA512) \((.+)\) = ([0-9a-fA-F]+)$`)
+	bareHash    = regexp.MustCompile(`^[0-9a-fA-F]+$`)
+)
+
+// checksumAlgorithm is the algorithm of a hex encoded hash, by its length.
+func checksumAlgorithm(hash string) (digest.Algorithm, error) {
+	switch len(hash) {
+	case 64:
+		return digest.SHA256, nil
+	case 128:
+		return digest.SHA512, nil
+	}
+	return "", errors.Errorf("unsupported hash %s: only sha256 and sha512 are supported", hash)
+}
+
+// ChecksumFor finds the hash of name in a checksum file, like the
+// SHA256SUMS and SHA512SUMS files sha256sum and sha512sum (or their BSD
+// --tag counterparts) write, or a .sha256/.sha512 file with nothing but the
+// hash in it.
+func ChecksumFor(file string, name string) (digest.Digest, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", errors.Wrapf(err, "couldn't open checksum file %s", file)
+	}
+	defer f.Close()
+
+	var found []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var hash, entry string
+		if m := bsdChecksum.FindStringSubmatch(line); m != nil {
+			hash, entry = m[3], m[2]
+		} else if m := gnuChecksum.FindStringSubmatch(line); m != nil {
+			hash, entry = m[1], m[2]
+		} else if bareHash.MatchString(line) {
+			hash = line
+		} else {
+			continue
+		}
+
+		if entry == "" || entry == name || path.Base(entry) == name {
+			found = append(found, strings.ToLower(hash))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", errors.Wrapf(err, "couldn't read checksum file %s", file)
+	}
+
+	if len(found) == 0 {
+		return "", errors.Errorf("no checksum for %s in %s", name, file)
+	}
+
+	for _, hash := range found[1:] {
+		if hash != found[0] {
+			return "", errors.Errorf("conflicting checksums for %s in %s", name, file)
+		}
+	}
+
+	alg, err := checksumAlgorithm(found[0])
+	if err != nil {
+		return "", err
+	}
+
+	return digest.NewDigestFromEncoded(alg, found[0]), nil
+}
+
+// VerifyFileDigest checks that the content of file has digest d.
+func VerifyFileDigest(file string, d digest.Digest) error {
+	if err := d.Validate(); err != nil {
+		return errors.Wrapf(err, "bad digest %s", d)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't open %s for hashing", file)
+	}
+	defer f.Close()
+
+	actual, err := d.Algorithm().FromReader(f)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't hash %s", file)
+	}
+
+	if actual != d {
+		return errors.Errorf("the hash of %s is different than its checksum: %s != %s", file, actual, d)
+	}
+
+	return nil
+}
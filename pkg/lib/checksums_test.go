@@ -0,0 +1,53 @@
+package lib
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChecksumFor(t *testing.T) {
+	assert := assert.New(t)
+
+	content := "hello world\n"
+	sha256 := digest.SHA256.FromString(content)
+	sha512 := digest.SHA512.FromString(content)
+	other := digest.SHA256.FromString("other")
+
+	for _, tc := range []struct {
+		desc     string
+		sums     string
+		expected digest.Digest
+		errstr   string
+	}{
+		{"gnu", other.Encoded() + "  foo-1.0.tar.gz\n" + sha256.Encoded() + "  foo-1.1.tar.gz\n", sha256, ""},
+		{"gnu binary", "# sums\n" + sha512.Encoded() + " *foo-1.1.tar.gz\n", sha512, ""},
+		{"in a subdirectory", sha256.Encoded() + "  ./dist/foo-1.1.tar.gz\n", sha256, ""},
+		{"bsd", "SHA512 (foo-1.1.tar.gz) = " + strings.ToUpper(sha512.Encoded()) + "\n", sha512, ""},
+		{"bare hash", sha256.Encoded() + "\n", sha256, ""},
+		{"missing", other.Encoded() + "  foo-1.0.tar.gz\n", "", "no checksum"},
+		{"conflicting", sha256.Encoded() + "  foo-1.1.tar.gz\n" + other.Encoded() + "  foo-1.1.tar.gz\n", "", "conflicting"},
+		{"unsupported", "abcd  foo-1.1.tar.gz\n", "", "unsupported hash"},
+	} {
+		sums := path.Join(t.TempDir(), "SUMS")
+		assert.NoError(os.WriteFile(sums, []byte(tc.sums), 0644))
+
+		d, err := ChecksumFor(sums, "foo-1.1.tar.gz")
+		if tc.errstr != "" {
+			assert.ErrorContains(err, tc.errstr, tc.desc)
+			continue
+		}
+		assert.NoError(err, tc.desc)
+		assert.Equal(tc.expected, d, tc.desc)
+	}
+
+	file := path.Join(t.TempDir(), "foo-1.1.tar.gz")
+	assert.NoError(os.WriteFile(file, []byte(content), 0644))
+	assert.NoError(VerifyFileDigest(file, sha256))
+	assert.NoError(VerifyFileDigest(file, sha512))
+	assert.ErrorContains(VerifyFileDigest(file, other), "different than its checksum")
+}
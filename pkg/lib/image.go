@@ -2,13 +2,20 @@ package lib
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"strings"
+	"time"
 
 	"github.com/containers/image/v5/copy"
 	"github.com/containers/image/v5/docker"
+	dockerarchive "github.com/containers/image/v5/docker/archive"
 	"github.com/containers/image/v5/docker/daemon"
+	"github.com/containers/image/v5/docker/reference"
+	ociarchive "github.com/containers/image/v5/oci/archive"
 	"github.com/containers/image/v5/oci/layout"
+	"github.com/containers/image/v5/pkg/shortnames"
+	"github.com/containers/image/v5/pkg/sysregistriesv2"
 	"github.com/containers/image/v5/signature"
 	"github.com/containers/image/v5/types"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -31,6 +38,8 @@ func init() {
 	RegisterURLScheme("oci", layout.ParseReference)
 	RegisterURLScheme("docker", docker.ParseReference)
 	RegisterURLScheme("docker-daemon", daemon.ParseReference)
+	RegisterURLScheme("oci-archive", ociarchive.ParseReference)
+	RegisterURLScheme("docker-archive", dockerarchive.ParseReference)
 }
 
 func localRefParser(ref string) (types.ImageReference, error) {
@@ -61,21 +70,96 @@ type ImageCopyOpts struct {
 	Context           context.Context
 	OverrideOS        string
 	OverrideArch      string
+
+	// RegistriesConf and RegistriesConfDir override the registries.conf
+	// file and drop-in directory used for pulls and pushes.
+	RegistriesConf    string
+	RegistriesConfDir string
+
+	// LogProgress, if set, is called with the progress of the copy a line
+	// at a time, which stays readable when several images are copied at
+	// the same time, unlike the bars written to Progress.
+	LogProgress func(format string, args ...interface{})
+
+	// DestSharedBlobDir is the blobs directory of another OCI layout,
+	// which the blobs of an oci: Dest are written to instead of its own.
+	DestSharedBlobDir string
+
+	// ShortNameAliasesConf is where containers/image looks for (and
+	// locks) the user's short name aliases. docker:// refs without a
+	// registry are only resolved with registries.conf's aliases if it is
+	// set.
+	ShortNameAliasesConf string
 }
 
-func ImageCopy(opts ImageCopyOpts) error {
-	if opts.Context == nil {
-		opts.Context = context.Background()
+// resolveShortNameAlias resolves a docker:// ref without a registry using the
+// short-name aliases in registries.conf. Refs that aren't aliased are left as
+// they are, which means docker.io.
+func resolveShortNameAlias(sys *types.SystemContext, ref string) (string, error) {
+	name, ok := strings.CutPrefix(ref, "docker://")
+	if !ok || sys.UserShortNameAliasConfPath == "" || !shortnames.IsShortName(name) {
+		return ref, nil
 	}
 
-	srcRef, err := localRefParser(opts.Src)
+	named, err := reference.Parse(name)
 	if err != nil {
-		return err
+		return "", errors.Wrapf(err, "bad image ref: %s", ref)
+	}
+
+	repo, ok := named.(reference.Named)
+	if !ok {
+		return ref, nil
 	}
 
-	destRef, err := localRefParser(opts.Dest)
+	alias, _, err := sysregistriesv2.ResolveShortNameAlias(sys, repo.Name())
 	if err != nil {
-		return err
+		return "", errors.Wrapf(err, "couldn't resolve short name %s", repo.Name())
+	}
+	if alias == nil {
+		return ref, nil
+	}
+
+	resolved := alias.String()
+	if tagged, ok := named.(reference.Tagged); ok {
+		resolved = fmt.Sprintf("%s:%s", resolved, tagged.Tag())
+	}
+	if digested, ok := named.(reference.Digested); ok {
+		resolved = fmt.Sprintf("%s@%s", resolved, digested.Digest())
+	}
+
+	return fmt.Sprintf("docker://%s", resolved), nil
+}
+
+// progressLogInterval is how often the progress of a blob that is being
+// copied is logged.
+const progressLogInterval = 5 * time.Second
+
+// logCopyProgress logs the blob events from progress with logf, until progress
+// is closed.
+func logCopyProgress(progress <-chan types.ProgressProperties, logf func(string, ...interface{}), done chan<- struct{}) {
+	defer close(done)
+	for p := range progress {
+		blob := p.Artifact.Digest.Encoded()
+		if len(blob) > 12 {
+			blob = blob[:12]
+		}
+
+		switch p.Event {
+		case types.ProgressEventNewArtifact:
+			logf("copying blob %s (%d bytes)", blob, p.Artifact.Size)
+		case types.ProgressEventRead:
+			logf("copying blob %s: %d/%d bytes", blob, p.Offset, p.Artifact.Size)
+		case types.ProgressEventSkipped:
+			logf("blob %s already present", blob)
+		case types.ProgressEventDone:
+			logf("copied blob %s", blob)
+		}
+	}
+}
+
+func ImageCopy(opts ImageCopyOpts) error {
+	if opts.Context == nil {
+		opts.Context = context.Background()
 	}
 
 	policy, err := signature.NewPolicyContext(&signature.Policy{
@@ -128,6 +212,33 @@ func ImageCopy(opts ImageCopyOpts) error {
 
 	args.SourceCtx.OCIAcceptUncompressedLayers = true
 	args.DestinationCtx.OCIAcceptUncompressedLayers = true
+	args.DestinationCtx.OCISharedBlobDirPath = opts.DestSharedBlobDir
+
+	for _, sys := range []*types.SystemContext{args.SourceCtx, args.DestinationCtx} {
+		sys.SystemRegistriesConfPath = opts.RegistriesConf
+		sys.SystemRegistriesConfDirPath = opts.RegistriesConfDir
+		sys.UserShortNameAliasConfPath = opts.ShortNameAliasesConf
+	}
+
+	src, err := resolveShortNameAlias(args.SourceCtx, opts.Src)
+	if err != nil {
+		return err
+	}
+
+	srcRef, err := localRefParser(src)
+	if err != nil {
+		return err
+	}
+
+	dest, err := resolveShortNameAlias(args.DestinationCtx, opts.Dest)
+	if err != nil {
+		return err
+	}
+
+	destRef, err := localRefParser(dest)
+	if err != nil {
+		return err
+	}
 
 	// Set ForceManifestMIMEType
 	// Supported manifest type :- https://github.com/containers/image/blob/master/manifest/manifest.go#L49
@@ -136,6 +247,18 @@ func ImageCopy(opts ImageCopyOpts) error {
 		args.ForceManifestMIMEType = opts.ForceManifestType
 	}
 
+	if opts.LogProgress != nil {
+		progress := make(chan types.ProgressProperties)
+		done := make(chan struct{})
+		go logCopyProgress(progress, opts.LogProgress, done)
+		defer func() {
+			close(progress)
+			<-done
+		}()
+		args.Progress = progress
+		args.ProgressInterval = progressLogInterval
+	}
+
 	_, err = copy.Image(opts.Context, policy, destRef, srcRef, args)
 	if err != nil {
 		return err
@@ -8,6 +8,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/containers/image/v5/types"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/opencontainers/umoci"
 	"github.com/opencontainers/umoci/mutate"
@@ -147,3 +148,40 @@ func TestOldManifestReallyRemoved(t *testing.T) {
 	assert.NoError(err)
 	assert.Len(index.Manifests, 1)
 }
+
+func TestResolveShortNameAlias(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+
+	registriesConf := path.Join(dir, "registries.conf")
+	err := os.WriteFile(registriesConf, []byte(`
+[aliases]
+"busybox" = "registry.example.com/library/busybox"
+`), 0644)
+	assert.NoError(err)
+
+	sys := &types.SystemContext{
+		SystemRegistriesConfPath:    registriesConf,
+		SystemRegistriesConfDirPath: path.Join(dir, "registries.conf.d"),
+		UserShortNameAliasConfPath:  path.Join(dir, "short-name-aliases.conf"),
+	}
+
+	for ref, expected := range map[string]string{
+		"docker://busybox:1.36":             "docker://registry.example.com/library/busybox:1.36",
+		"docker://busybox":                  "docker://registry.example.com/library/busybox",
+		"docker://alpine:latest":            "docker://alpine:latest",
+		"docker://docker.io/busybox:latest": "docker://docker.io/busybox:latest",
+		"oci:busybox:latest":                "oci:busybox:latest",
+	} {
+		resolved, err := resolveShortNameAlias(sys, ref)
+		assert.NoError(err, ref)
+		assert.Equal(expected, resolved, ref)
+	}
+
+	// without somewhere for containers/image to look for user aliases,
+	// short names are left alone
+	sys.UserShortNameAliasConfPath = ""
+	resolved, err := resolveShortNameAlias(sys, "docker://busybox:1.36")
+	assert.NoError(err)
+	assert.Equal("docker://busybox:1.36", resolved)
+}
@@ -0,0 +1,156 @@
+package lib
+
+import (
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+type pathPattern struct {
+	negate   bool
+	dirOnly  bool
+	anchored bool
+	parts    []string
+}
+
+func (p pathPattern) matches(rel string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+
+	names := strings.Split(rel, "/")
+	if !p.anchored {
+		// patterns without a slash match the name at any depth
+		ok, _ := path.Match(p.parts[0], names[len(names)-1])
+		return ok
+	}
+
+	return matchParts(p.parts, names)
+}
+
+func matchParts(parts []string, names []string) bool {
+	if len(parts) == 0 {
+		return len(names) == 0
+	}
+
+	if parts[0] == "**" {
+		if len(parts) == 1 {
+			// a trailing ** matches everything inside, but not the
+			// directory itself
+			return len(names) > 0
+		}
+
+		for i := 0; i <= len(names); i++ {
+			if matchParts(parts[1:], names[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(names) == 0 {
+		return false
+	}
+
+	ok, _ := path.Match(parts[0], names[0])
+	return ok && matchParts(parts[1:], names[1:])
+}
+
+// PathMatcher matches relative paths against a list of gitignore style
+// patterns.
+type PathMatcher []pathPattern
+
+// NewPathMatcher parses patterns, which are in gitignore syntax: blank lines
+// and lines starting with # are skipped, a leading ! negates a pattern, a
+// trailing / only matches directories, a pattern with a / in it is relative to
+// the root while one without matches at any depth, and ** matches any number
+// of directories.
+func NewPathMatcher(patterns []string) (PathMatcher, error) {
+	pm := PathMatcher{}
+	for _, orig := range patterns {
+		line := strings.TrimRight(orig, " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		p := pathPattern{}
+		if strings.HasPrefix(line, "!") {
+			p.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+			line = line[1:]
+		}
+
+		if strings.HasSuffix(line, "/") {
+			p.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+
+		if strings.Contains(line, "/") {
+			p.anchored = true
+			line = strings.TrimLeft(line, "/")
+		}
+
+		if line == "" {
+			return nil, errors.Errorf("bad pattern %q", orig)
+		}
+
+		p.parts = strings.Split(line, "/")
+		for _, part := range p.parts {
+			if _, err := path.Match(part, ""); err != nil {
+				return nil, errors.Wrapf(err, "bad pattern %q", orig)
+			}
+		}
+
+		if !p.anchored && p.parts[0] == "**" {
+			p.anchored = true
+		}
+
+		pm = append(pm, p)
+	}
+
+	return pm, nil
+}
+
+func (pm PathMatcher) matchesLast(rel string, isDir bool) bool {
+	matched := false
+	for _, p := range pm {
+		if p.matches(rel, isDir) {
+			matched = !p.negate
+		}
+	}
+	return matched
+}
+
+// Match reports whether rel, a slash separated path relative to the root the
+// patterns apply to, or a directory it is in is matched by the patterns. As in
+// gitignore, the last pattern that matches a path wins, and nothing under a
+// matched directory can be negated.
+func (pm PathMatcher) Match(rel string, isDir bool) bool {
+	return pm.MatchIn("", rel, isDir)
+}
+
+// MatchIn is like Match for dir/rel, except that dir and the directories
+// above it aren't matched.
+func (pm PathMatcher) MatchIn(dir string, rel string, isDir bool) bool {
+	rel = path.Clean(rel)
+	if len(pm) == 0 || rel == "." {
+		return false
+	}
+
+	start := 0
+	dir = path.Clean(dir)
+	if dir != "." {
+		start = len(strings.Split(dir, "/"))
+	}
+
+	names := strings.Split(path.Join(dir, rel), "/")
+	for i := start + 1; i < len(names); i++ {
+		if pm.matchesLast(strings.Join(names[:i], "/"), true) {
+			return true
+		}
+	}
+
+	return pm.matchesLast(strings.Join(names, "/"), isDir)
+}
@@ -0,0 +1,64 @@
+package lib
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPathMatcher(t *testing.T) {
+	assert := assert.New(t)
+
+	pm, err := NewPathMatcher([]string{
+		"# editor files",
+		"*.swp",
+		"",
+		".git/",
+		"/build",
+		"docs/**/*.html",
+		"*.log",
+		"!keep.log",
+		`\#notacomment`,
+	})
+	assert.NoError(err)
+
+	for _, tc := range []struct {
+		path    string
+		isDir   bool
+		matched bool
+	}{
+		{"foo.swp", false, true},
+		{"src/foo.swp", false, true},
+		{"src/foo.go", false, false},
+		{".git", true, true},
+		{".git/config", false, true},
+		{"sub/.git/config", false, true},
+		{".git", false, false},
+		{"build", true, true},
+		{"build/out.o", false, true},
+		{"src/build", true, false},
+		{"docs/index.html", false, true},
+		{"docs/a/b/index.html", false, true},
+		{"src/docs/index.html", false, false},
+		{"debug.log", false, true},
+		{"keep.log", false, false},
+		{"build/keep.log", false, true},
+		{"#notacomment", false, true},
+		{".", true, false},
+	} {
+		assert.Equal(tc.matched, pm.Match(tc.path, tc.isDir), tc.path)
+	}
+
+	// the directory the paths are in isn't matched itself
+	assert.False(pm.MatchIn("build", "foo.c", false))
+	assert.True(pm.MatchIn("build", "foo.swp", false))
+	assert.True(pm.MatchIn("docs", "a/index.html", false))
+	assert.True(pm.MatchIn("src", ".git/config", false))
+
+	_, err = NewPathMatcher([]string{"[z-a"})
+	assert.Error(err)
+
+	empty, err := NewPathMatcher(nil)
+	assert.NoError(err)
+	assert.False(empty.Match("foo", false))
+}
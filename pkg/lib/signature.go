@@ -0,0 +1,210 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	minisignComment        = "untrusted comment:"
+	minisignTrustedComment = "trusted comment: "
+)
+
+// minisignKey is a minisign public key: "Ed", its id, and an ed25519 key.
+type minisignKey struct {
+	id  []byte
+	key ed25519.PublicKey
+}
+
+// minisignSignature is a minisign signature: "Ed" (or "ED" if the file was
+// hashed with blake2b first), the id of the key, and the ed25519 signature,
+// along with the trusted comment and the signature of both.
+type minisignSignature struct {
+	prehashed      bool
+	keyID          []byte
+	signature      []byte
+	trustedComment string
+	globalSig      []byte
+}
+
+// minisignLines is the non empty lines of a minisign file, which start with
+// an untrusted comment.
+func minisignLines(content []byte) ([]string, bool) {
+	lines := []string{}
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	return lines, len(lines) > 0 && strings.HasPrefix(lines[0], minisignComment)
+}
+
+func parseMinisignKey(content []byte) (minisignKey, bool) {
+	lines, ok := minisignLines(content)
+	if !ok || len(lines) < 2 {
+		return minisignKey{}, false
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil || len(raw) != 2+8+ed25519.PublicKeySize || string(raw[:2]) != "Ed" {
+		return minisignKey{}, false
+	}
+
+	return minisignKey{id: raw[2:10], key: ed25519.PublicKey(raw[10:])}, true
+}
+
+func parseMinisignSignature(content []byte) (minisignSignature, error) {
+	lines, ok := minisignLines(content)
+	if !ok || len(lines) != 4 || !strings.HasPrefix(lines[2], minisignTrustedComment) {
+		return minisignSignature{}, errors.Errorf("not a minisign signature")
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil || len(raw) != 2+8+ed25519.SignatureSize {
+		return minisignSignature{}, errors.Errorf("bad minisign signature")
+	}
+
+	alg := string(raw[:2])
+	if alg != "Ed" && alg != "ED" {
+		return minisignSignature{}, errors.Errorf("unsupported minisign signature algorithm %q", alg)
+	}
+
+	globalSig, err := base64.StdEncoding.DecodeString(lines[3])
+	if err != nil || len(globalSig) != ed25519.SignatureSize {
+		return minisignSignature{}, errors.Errorf("bad minisign trusted comment signature")
+	}
+
+	return minisignSignature{
+		prehashed:      alg == "ED",
+		keyID:          raw[2:10],
+		signature:      raw[10:],
+		trustedComment: strings.TrimPrefix(lines[2], minisignTrustedComment),
+		globalSig:      globalSig,
+	}, nil
+}
+
+func verifyMinisign(file string, content []byte, keys []minisignKey) error {
+	sig, err := parseMinisignSignature(content)
+	if err != nil {
+		return err
+	}
+
+	var key *minisignKey
+	for i := range keys {
+		if bytes.Equal(keys[i].id, sig.keyID) {
+			key = &keys[i]
+			break
+		}
+	}
+	if key == nil {
+		return errors.Errorf("%s isn't signed by a trusted minisign key", file)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	var message []byte
+	if sig.prehashed {
+		h, _ := blake2b.New512(nil)
+		if _, err := io.Copy(h, f); err != nil {
+			return errors.Wrapf(err, "couldn't read %s", file)
+		}
+		message = h.Sum(nil)
+	} else {
+		message, err = io.ReadAll(f)
+		if err != nil {
+			return errors.Wrapf(err, "couldn't read %s", file)
+		}
+	}
+
+	if !ed25519.Verify(key.key, message, sig.signature) {
+		return errors.Errorf("bad minisign signature of %s", file)
+	}
+
+	trusted := append(append([]byte{}, sig.signature...), sig.trustedComment...)
+	if !ed25519.Verify(key.key, trusted, sig.globalSig) {
+		return errors.Errorf("bad minisign trusted comment signature of %s", file)
+	}
+
+	return nil
+}
+
+func verifyGPG(file string, content []byte, keyring openpgp.EntityList) error {
+	if len(keyring) == 0 {
+		return errors.Errorf("%s isn't signed by a trusted GPG key: there are none", file)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	check := openpgp.CheckDetachedSignature
+	if bytes.HasPrefix(bytes.TrimSpace(content), []byte("-----BEGIN PGP SIGNATURE-----")) {
+		check = openpgp.CheckArmoredDetachedSignature
+	}
+
+	if _, err := check(keyring, f, bytes.NewReader(content), nil); err != nil {
+		return errors.Wrapf(err, "bad GPG signature of %s", file)
+	}
+
+	return nil
+}
+
+// VerifySignature checks that sig is a detached GPG (armored or not) or
+// minisign signature of file, by one of the public keys in keyFiles.
+func VerifySignature(file string, sig string, keyFiles []string) error {
+	if len(keyFiles) == 0 {
+		return errors.Errorf("can't check the signature of %s: no trusted keys are configured", file)
+	}
+
+	minisignKeys := []minisignKey{}
+	keyring := openpgp.EntityList{}
+	for _, keyFile := range keyFiles {
+		content, err := os.ReadFile(keyFile)
+		if err != nil {
+			return errors.Wrapf(err, "couldn't read trusted key %s", keyFile)
+		}
+
+		if key, ok := parseMinisignKey(content); ok {
+			minisignKeys = append(minisignKeys, key)
+			continue
+		}
+
+		var entities openpgp.EntityList
+		if bytes.HasPrefix(bytes.TrimSpace(content), []byte("-----BEGIN PGP")) {
+			entities, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(content))
+		} else {
+			entities, err = openpgp.ReadKeyRing(bytes.NewReader(content))
+		}
+		if err != nil {
+			return errors.Wrapf(err, "trusted key %s isn't a GPG or minisign public key", keyFile)
+		}
+		keyring = append(keyring, entities...)
+	}
+
+	content, err := os.ReadFile(sig)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't read signature %s", sig)
+	}
+
+	if _, ok := minisignLines(content); ok {
+		return verifyMinisign(file, content, minisignKeys)
+	}
+
+	return verifyGPG(file, content, keyring)
+}
@@ -0,0 +1,119 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/blake2b"
+)
+
+// gpgKey writes the armored public key of a new GPG key to dir, and returns
+// it and the key.
+func gpgKey(t *testing.T, dir string) (string, *openpgp.Entity) {
+	entity, err := openpgp.NewEntity("stacker", "", "stacker@example.com", nil)
+	assert.NoError(t, err)
+
+	keyFile := path.Join(dir, "key.asc")
+	f, err := os.Create(keyFile)
+	assert.NoError(t, err)
+	defer f.Close()
+
+	w, err := armor.Encode(f, openpgp.PublicKeyType, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, entity.Serialize(w))
+	assert.NoError(t, w.Close())
+	return keyFile, entity
+}
+
+type testMinisignKey struct {
+	id   []byte
+	priv ed25519.PrivateKey
+}
+
+// newMinisignKey writes the public key of a new minisign key to dir, and
+// returns it and the key.
+func newMinisignKey(t *testing.T, dir string, id string) (string, testMinisignKey) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+
+	keyFile := path.Join(dir, "minisign.pub")
+	raw := append([]byte("Ed"+id), pub...)
+	content := fmt.Sprintf("untrusted comment: minisign public key %X\n%s\n", id, base64.StdEncoding.EncodeToString(raw))
+	assert.NoError(t, os.WriteFile(keyFile, []byte(content), 0644))
+	return keyFile, testMinisignKey{id: []byte(id), priv: priv}
+}
+
+// sign writes a minisign signature of content, prehashed or not.
+func (k testMinisignKey) sign(t *testing.T, sigFile string, content []byte, prehashed bool) {
+	alg, message := "Ed", content
+	if prehashed {
+		sum := blake2b.Sum512(content)
+		alg, message = "ED", sum[:]
+	}
+
+	sig := ed25519.Sign(k.priv, message)
+	trusted := "timestamp:1700000000\tfile:foo.tar.gz"
+	global := ed25519.Sign(k.priv, append(append([]byte{}, sig...), trusted...))
+
+	raw := append([]byte(alg), k.id...)
+	raw = append(raw, sig...)
+	out := fmt.Sprintf("untrusted comment: signature\n%s\ntrusted comment: %s\n%s\n",
+		base64.StdEncoding.EncodeToString(raw), trusted, base64.StdEncoding.EncodeToString(global))
+	assert.NoError(t, os.WriteFile(sigFile, []byte(out), 0644))
+}
+
+func TestVerifySignature(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+
+	content := []byte("stacker verifies things")
+	file := path.Join(dir, "foo.tar.gz")
+	assert.NoError(os.WriteFile(file, content, 0644))
+	tampered := path.Join(dir, "tampered.tar.gz")
+	assert.NoError(os.WriteFile(tampered, []byte("stacker verifies other things"), 0644))
+
+	gpgFile, entity := gpgKey(t, t.TempDir())
+	minisignFile, minisign := newMinisignKey(t, t.TempDir(), "12345678")
+	otherFile, other := newMinisignKey(t, t.TempDir(), "87654321")
+	keys := []string{gpgFile, minisignFile}
+
+	// armored and binary GPG signatures
+	asc := path.Join(dir, "foo.tar.gz.asc")
+	buf := bytes.Buffer{}
+	assert.NoError(openpgp.ArmoredDetachSign(&buf, entity, bytes.NewReader(content), nil))
+	assert.NoError(os.WriteFile(asc, buf.Bytes(), 0644))
+
+	sig := path.Join(dir, "foo.tar.gz.sig")
+	buf.Reset()
+	assert.NoError(openpgp.DetachSign(&buf, entity, bytes.NewReader(content), nil))
+	assert.NoError(os.WriteFile(sig, buf.Bytes(), 0644))
+
+	for _, s := range []string{asc, sig} {
+		assert.NoError(VerifySignature(file, s, keys), s)
+		assert.Error(VerifySignature(tampered, s, keys), s)
+		assert.Error(VerifySignature(file, s, []string{minisignFile}), s)
+	}
+
+	// minisign signatures, of the file and of its blake2b hash
+	for _, prehashed := range []bool{false, true} {
+		minisig := path.Join(dir, "foo.tar.gz.minisig")
+		minisign.sign(t, minisig, content, prehashed)
+		assert.NoError(VerifySignature(file, minisig, keys))
+		assert.ErrorContains(VerifySignature(tampered, minisig, keys), "bad minisign signature")
+		assert.ErrorContains(VerifySignature(file, minisig, []string{gpgFile, otherFile}), "isn't signed by a trusted minisign key")
+
+		other.sign(t, minisig, content, prehashed)
+		assert.ErrorContains(VerifySignature(file, minisig, keys), "isn't signed by a trusted minisign key")
+	}
+
+	assert.ErrorContains(VerifySignature(file, asc, nil), "no trusted keys")
+	assert.ErrorContains(VerifySignature(file, asc, []string{file}), "isn't a GPG or minisign public key")
+}
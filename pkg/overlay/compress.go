@@ -0,0 +1,345 @@
+package overlay
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containers/storage/pkg/chunked/compressor"
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/mutate"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+// levelCompressor is a mutate.Compressor for gzip or zstd at a specific
+// compression level; umoci's compressors only use the default level.
+type levelCompressor struct {
+	suffix string
+	level  int
+}
+
+func (lc levelCompressor) MediaTypeSuffix() string {
+	return lc.suffix
+}
+
+func (lc levelCompressor) Compress(r io.Reader) (io.ReadCloser, error) {
+	var w io.WriteCloser
+	var err error
+
+	pr, pw := io.Pipe()
+	switch lc.suffix {
+	case "gzip":
+		w, err = pgzip.NewWriterLevel(pw, lc.level)
+	case "zstd":
+		w, err = zstd.NewWriter(pw, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(lc.level)))
+	default:
+		err = errors.Errorf("unknown compression %s", lc.suffix)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		if _, err := io.Copy(w, r); err != nil {
+			pw.CloseWithError(errors.Wrapf(err, "couldn't compress layer"))
+			return
+		}
+		pw.CloseWithError(w.Close())
+	}()
+
+	return pr, nil
+}
+
+// tarCompressor returns the compressor for gzip and zstd tar layers.
+func tarCompressor(layerType types.LayerType) (mutate.Compressor, error) {
+	switch layerType.Compression {
+	case "":
+		if layerType.Level == 0 {
+			return mutate.GzipCompressor, nil
+		}
+		return levelCompressor{"gzip", layerType.Level}, nil
+	case "zstd":
+		if layerType.Level == 0 {
+			return mutate.ZstdCompressor, nil
+		}
+		return levelCompressor{"zstd", layerType.Level}, nil
+	default:
+		return nil, errors.Errorf("no streaming compressor for %s", layerType)
+	}
+}
+
+// AddTarLayer compresses the uncompressed tar blob as layerType says and adds
+// it to the image being mutated.
+func AddTarLayer(config types.StackerConfig, oci casext.Engine, mutator *mutate.Mutator, layerType types.LayerType, blob io.Reader, history *ispec.History) (ispec.Descriptor, error) {
+	if layerType.Compression == "" || layerType.Compression == "zstd" {
+		compressor, err := tarCompressor(layerType)
+		if err != nil {
+			return ispec.Descriptor{}, err
+		}
+		return mutator.Add(context.Background(), ispec.MediaTypeImageLayer, blob, history, compressor, nil)
+	}
+
+	// zstd:chunked and estargz rewrite the tar stream, so the diff id
+	// isn't simply the hash of what we generated; mutator.Add can't be
+	// used for them.
+	desc, diffID, err := PutTarLayer(config, oci, layerType, blob)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+
+	err = mutator.AddExisting(context.Background(), desc, history, diffID)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+
+	return desc, nil
+}
+
+// PutTarLayer compresses the uncompressed tar blob as layerType says and puts
+// it in oci, returning its descriptor and diff id.
+func PutTarLayer(config types.StackerConfig, oci casext.Engine, layerType types.LayerType, blob io.Reader) (ispec.Descriptor, digest.Digest, error) {
+	switch layerType.Compression {
+	case "estargz":
+		return putEstargzLayer(config, oci, layerType, blob)
+	case "zstd:chunked":
+		return putZstdChunkedLayer(oci, layerType, blob)
+	}
+
+	compressor, err := tarCompressor(layerType)
+	if err != nil {
+		return ispec.Descriptor{}, "", err
+	}
+
+	digester := digest.Canonical.Digester()
+	compressed, err := compressor.Compress(io.TeeReader(blob, digester.Hash()))
+	if err != nil {
+		return ispec.Descriptor{}, "", err
+	}
+	defer compressed.Close()
+
+	layerDigest, size, err := oci.PutBlob(context.Background(), compressed)
+	if err != nil {
+		return ispec.Descriptor{}, "", err
+	}
+
+	desc := ispec.Descriptor{
+		MediaType: fmt.Sprintf("%s+%s", ispec.MediaTypeImageLayer, compressor.MediaTypeSuffix()),
+		Digest:    layerDigest,
+		Size:      size,
+	}
+	return desc, digester.Digest(), nil
+}
+
+func putZstdChunkedLayer(oci casext.Engine, layerType types.LayerType, blob io.Reader) (ispec.Descriptor, digest.Digest, error) {
+	var level *int
+	if layerType.Level != 0 {
+		level = &layerType.Level
+	}
+
+	// the tar stream itself is unchanged; the table of contents is
+	// appended in zstd skippable frames.
+	digester := digest.Canonical.Digester()
+	annotations := map[string]string{}
+
+	pr, pw := io.Pipe()
+	go func() {
+		w, err := compressor.ZstdCompressor(pw, annotations, level)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+
+		if _, err := io.Copy(w, io.TeeReader(blob, digester.Hash())); err != nil {
+			w.Close()
+			pw.CloseWithError(errors.Wrapf(err, "couldn't compress layer"))
+			return
+		}
+		pw.CloseWithError(w.Close())
+	}()
+	defer pr.Close()
+
+	layerDigest, size, err := oci.PutBlob(context.Background(), pr)
+	if err != nil {
+		return ispec.Descriptor{}, "", err
+	}
+
+	desc := ispec.Descriptor{
+		MediaType:   ispec.MediaTypeImageLayerZstd,
+		Digest:      layerDigest,
+		Size:        size,
+		Annotations: annotations,
+	}
+	return desc, digester.Digest(), nil
+}
+
+func putEstargzLayer(config types.StackerConfig, oci casext.Engine, layerType types.LayerType, blob io.Reader) (ispec.Descriptor, digest.Digest, error) {
+	// estargz needs random access to the tar to sort its entries
+	tmp, err := os.CreateTemp(config.StackerDir, "estargz-")
+	if err != nil {
+		return ispec.Descriptor{}, "", errors.WithStack(err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	size, err := io.Copy(tmp, blob)
+	if err != nil {
+		return ispec.Descriptor{}, "", errors.Wrapf(err, "couldn't write estargz input")
+	}
+
+	level := gzip.BestCompression
+	if layerType.Level != 0 {
+		level = layerType.Level
+	}
+
+	compression := estargzCompression{estargz.NewGzipCompressorWithLevel(level), &estargz.GzipDecompressor{}}
+	built, err := estargz.Build(io.NewSectionReader(tmp, 0, size), estargz.WithCompression(compression))
+	if err != nil {
+		return ispec.Descriptor{}, "", errors.Wrapf(err, "couldn't build estargz layer")
+	}
+	defer built.Close()
+
+	layerDigest, layerSize, err := oci.PutBlob(context.Background(), built)
+	if err != nil {
+		return ispec.Descriptor{}, "", err
+	}
+
+	uncompressedSize, err := built.UncompressedSize()
+	if err != nil {
+		return ispec.Descriptor{}, "", errors.WithStack(err)
+	}
+
+	desc := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageLayerGzip,
+		Digest:    layerDigest,
+		Size:      layerSize,
+		Annotations: map[string]string{
+			types.EstargzTOCDigestAnnotation:        built.TOCDigest().String(),
+			estargz.StoreUncompressedSizeAnnotation: fmt.Sprintf("%d", uncompressedSize),
+		},
+	}
+	return desc, built.DiffID(), nil
+}
+
+// estargzCompression is estargz's gzip compression, but with a footer that
+// doesn't depend on how compress/gzip encodes empty streams: newer versions of
+// it don't produce the 51 byte footer estargz requires.
+type estargzCompression struct {
+	*estargz.GzipCompressor
+	*estargz.GzipDecompressor
+}
+
+func (ec estargzCompression) WriteTOCAndFooter(w io.Writer, off int64, toc *estargz.JTOC, diffHash hash.Hash) (digest.Digest, error) {
+	tocJSON, err := json.MarshalIndent(toc, "", "\t")
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	gz, err := ec.Writer(w)
+	if err != nil {
+		return "", err
+	}
+
+	gw := io.Writer(gz)
+	if diffHash != nil {
+		gw = io.MultiWriter(gz, diffHash)
+	}
+
+	tw := tar.NewWriter(gw)
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     estargz.TOCTarName,
+		Size:     int64(len(tocJSON)),
+	})
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	if _, err := tw.Write(tocJSON); err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	if err := tw.Close(); err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	if err := gz.Close(); err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	if _, err := w.Write(estargzFooter(off)); err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	return digest.FromBytes(tocJSON), nil
+}
+
+// estargzFooter is an empty gzip member whose extra field records the offset
+// of the table of contents.
+func estargzFooter(tocOffset int64) []byte {
+	subfield := fmt.Sprintf("%016xSTARGZ", tocOffset)
+
+	footer := []byte{
+		0x1f, 0x8b, // magic
+		8,          // deflate
+		4,          // FEXTRA
+		0, 0, 0, 0, // mtime
+		0,    // extra flags
+		0xff, // unknown OS
+	}
+	footer = binary.LittleEndian.AppendUint16(footer, uint16(4+len(subfield)))
+	footer = append(footer, 'S', 'G')
+	footer = binary.LittleEndian.AppendUint16(footer, uint16(len(subfield)))
+	footer = append(footer, subfield...)
+
+	// a final stored block with no data, then the crc and size of nothing
+	footer = append(footer, 1, 0, 0, 0xff, 0xff)
+	footer = append(footer, 0, 0, 0, 0, 0, 0, 0, 0)
+
+	return footer
+}
+
+// decompressLayer returns the uncompressed tar stream of a tar layer blob.
+func decompressLayer(mediaType string, compressed io.Reader) (io.ReadCloser, error) {
+	switch mediaType {
+	case ispec.MediaTypeImageLayer:
+		return io.NopCloser(compressed), nil
+	case ispec.MediaTypeImageLayerGzip:
+		return pgzip.NewReader(compressed)
+	case ispec.MediaTypeImageLayerZstd:
+		// zstd:chunked metadata is in skippable frames, which the
+		// decoder ignores
+		decoder, err := zstd.NewReader(compressed)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return decoder.IOReadCloser(), nil
+	default:
+		return nil, errors.Errorf("unknown tar layer media type %s", mediaType)
+	}
+}
+
+// removeEstargzMetadata removes the table of contents and landmark files
+// estargz layers have in their tar stream from an unpacked layer.
+func removeEstargzMetadata(dir string) error {
+	for _, name := range []string{estargz.TOCTarName, estargz.PrefetchLandmark, estargz.NoPrefetchLandmark} {
+		err := os.Remove(filepath.Join(dir, name))
+		if err != nil && !os.IsNotExist(err) {
+			return errors.WithStack(err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,100 @@
+package overlay
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"path"
+	"testing"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/stretchr/testify/assert"
+	"machinerun.io/atomfs/pkg/verity"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+func testTar(t *testing.T) []byte {
+	buf := bytes.Buffer{}
+	tw := tar.NewWriter(&buf)
+	for _, name := range []string{"etc/hostname", "etc/hosts"} {
+		content := []byte("contents of " + name)
+		err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+		assert.NoError(t, err)
+		_, err = tw.Write(content)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+func TestPutTarLayer(t *testing.T) {
+	dir := t.TempDir()
+	config := types.StackerConfig{StackerDir: dir}
+
+	oci, err := umoci.CreateLayout(path.Join(dir, "oci"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer oci.Close()
+
+	for _, lt := range []string{"tar", "tar@1", "tar+zstd", "tar+zstd@19", "tar+zstd:chunked", "tar+estargz@1"} {
+		assert := assert.New(t)
+
+		layerType, err := types.NewLayerType(lt, verity.VerityMetadataMissing)
+		assert.NoError(err)
+
+		desc, diffID, err := PutTarLayer(config, oci, layerType, bytes.NewReader(testTar(t)))
+		if !assert.NoError(err, lt) {
+			continue
+		}
+
+		// the manifest has to say what the layer is
+		manifestType, err := types.NewLayerTypeManifest(ispec.Manifest{Layers: []ispec.Descriptor{desc}})
+		assert.NoError(err)
+		assert.True(manifestType.SameFormat(layerType), lt)
+
+		blob, err := oci.GetBlob(context.Background(), desc.Digest)
+		assert.NoError(err)
+		defer blob.Close()
+
+		uncompressed, err := decompressLayer(desc.MediaType, blob)
+		if !assert.NoError(err, lt) {
+			continue
+		}
+		defer uncompressed.Close()
+
+		content, err := io.ReadAll(uncompressed)
+		assert.NoError(err, lt)
+		assert.Equal(digest.FromBytes(content), diffID, lt)
+
+		names := []string{}
+		tr := tar.NewReader(bytes.NewReader(content))
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if !assert.NoError(err, lt) {
+				break
+			}
+			names = append(names, hdr.Name)
+		}
+		assert.Contains(names, "etc/hostname", lt)
+		assert.Contains(names, "etc/hosts", lt)
+	}
+}
+
+func TestEstargzFooter(t *testing.T) {
+	assert := assert.New(t)
+
+	footer := estargzFooter(0x1234)
+	assert.Len(footer, estargz.FooterSize)
+
+	_, tocOffset, _, err := (&estargz.GzipDecompressor{}).ParseFooter(footer)
+	assert.NoError(err)
+	assert.Equal(int64(0x1234), tocOffset)
+}
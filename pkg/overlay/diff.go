@@ -0,0 +1,42 @@
+package overlay
+
+import (
+	"io"
+	"os"
+	"path"
+
+	"github.com/pkg/errors"
+	"machinerun.io/atomfs/pkg/verity"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+// WriteDiff writes the changes made in name's rootfs, relative to the layers
+// it is built on, as an OCI tar layer.
+func WriteDiff(config types.StackerConfig, name string, w io.Writer) error {
+	dir := path.Join(config.RootFSDir, name, "overlay")
+	if _, err := os.Stat(dir); err != nil {
+		return errors.Wrapf(err, "couldn't find changes for %s", name)
+	}
+
+	// stacker debug leaves a fuse-overlay rootfs mounted
+	if isFuseMount(path.Join(config.RootFSDir, name, "rootfs")) {
+		f := fuseOverlay{&overlay{config}}
+		if err := f.unmount(name); err != nil {
+			return err
+		}
+	}
+
+	layerType, err := types.NewLayerType("tar", verity.VerityMetadataMissing)
+	if err != nil {
+		return err
+	}
+
+	blob, _, _, err := generateBlob(layerType, dir, config.OCIDir, config.SourceDateEpoch)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	_, err = io.Copy(w, blob)
+	return errors.Wrapf(err, "couldn't write diff of %s", name)
+}
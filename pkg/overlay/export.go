@@ -0,0 +1,253 @@
+package overlay
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/opencontainers/umoci"
+	"github.com/pkg/errors"
+	"github.com/pkg/xattr"
+	"golang.org/x/sys/unix"
+	stackeroci "machinerun.io/atomfs/pkg/oci"
+	"stackerbuild.io/stacker/pkg/log"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+// Flatten extracts the image tag in the OCI layout ociDir into dest as a
+// single filesystem. The layers are unpacked the same way as for builds, and
+// then merged in order, honoring the overlay whiteouts and opaque directories
+// in each of them.
+func Flatten(config types.StackerConfig, ociDir string, tag string, dest string) error {
+	oci, err := umoci.OpenLayout(ociDir)
+	if err != nil {
+		return err
+	}
+	defer oci.Close()
+
+	manifest, err := stackeroci.LookupManifest(oci, tag)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return errors.WithStack(err)
+	}
+
+	for _, l := range manifest.Layers {
+		contents := overlayPath(config.RootFSDir, l.Digest, "overlay")
+		if err := unpackOne(l, ociDir, contents); err != nil {
+			return errors.Wrapf(err, "couldn't unpack layer %s", l.Digest)
+		}
+
+		// some docker layers may be empty tars, see lxcRootfsString()
+		if _, err := os.Stat(contents); os.IsNotExist(err) {
+			continue
+		}
+
+		log.Debugf("merging layer %s into %s", l.Digest, dest)
+		if err := mergeOverlayLayer(contents, dest); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func isWhiteout(fi fs.FileInfo) bool {
+	if fi.Mode()&fs.ModeCharDevice == 0 {
+		return false
+	}
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && stat.Rdev == 0
+}
+
+func isOpaque(p string) bool {
+	for _, attr := range []string{"user.overlay.opaque", "trusted.overlay.opaque"} {
+		val, err := xattr.LGet(p, attr)
+		if err == nil && string(val) == "y" {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeOverlayLayer copies the contents of an overlay layer dir on top of
+// dest.
+func mergeOverlayLayer(layerDir string, dest string) error {
+	type dirTimes struct {
+		path string
+		fi   fs.FileInfo
+	}
+	dirs := []dirTimes{}
+	links := map[uint64]string{}
+
+	err := filepath.WalkDir(layerDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(layerDir, p)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		target := filepath.Join(dest, rel)
+
+		fi, err := os.Lstat(p)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		if isWhiteout(fi) {
+			return errors.WithStack(os.RemoveAll(target))
+		}
+
+		// leave the metadata of the export dir itself alone
+		if rel == "." {
+			return nil
+		}
+
+		if fi.IsDir() {
+			existing, err := os.Lstat(target)
+			if err == nil && (!existing.IsDir() || isOpaque(p)) {
+				if err := os.RemoveAll(target); err != nil {
+					return errors.WithStack(err)
+				}
+			}
+
+			if err := os.Mkdir(target, fi.Mode().Perm()); err != nil && !os.IsExist(err) {
+				return errors.WithStack(err)
+			}
+
+			if err := copyMetadata(p, target, fi); err != nil {
+				return err
+			}
+			dirs = append(dirs, dirTimes{target, fi})
+			return nil
+		}
+
+		if err := os.RemoveAll(target); err != nil {
+			return errors.WithStack(err)
+		}
+
+		stat := fi.Sys().(*syscall.Stat_t)
+		if stat.Nlink > 1 {
+			if first, ok := links[stat.Ino]; ok {
+				return errors.WithStack(os.Link(first, target))
+			}
+			links[stat.Ino] = target
+		}
+
+		switch {
+		case fi.Mode().IsRegular():
+			if err := copyFileContents(p, target); err != nil {
+				return err
+			}
+		case fi.Mode()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return errors.WithStack(err)
+			}
+		case fi.Mode()&(fs.ModeDevice|fs.ModeNamedPipe) != 0:
+			if err := unix.Mknod(target, stat.Mode, int(stat.Rdev)); err != nil {
+				return errors.Wrapf(err, "couldn't create %s", target)
+			}
+		default:
+			log.Debugf("skipping %s with unsupported type %s", p, fi.Mode().Type())
+			return nil
+		}
+
+		if err := copyMetadata(p, target, fi); err != nil {
+			return err
+		}
+		return setTimes(target, fi)
+	})
+	if err != nil {
+		return err
+	}
+
+	// directory times change as their contents are created, so set them
+	// last, deepest first.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := setTimes(dirs[i].path, dirs[i].fi); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func copyFileContents(source string, target string) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return errors.Wrapf(err, "couldn't copy %s", source)
+	}
+
+	return errors.WithStack(out.Close())
+}
+
+func copyMetadata(source string, target string, fi fs.FileInfo) error {
+	stat := fi.Sys().(*syscall.Stat_t)
+	if err := os.Lchown(target, int(stat.Uid), int(stat.Gid)); err != nil {
+		return errors.Wrapf(err, "couldn't chown %s", target)
+	}
+
+	// user.* xattrs can't exist on symlinks, and their mode is meaningless
+	if fi.Mode()&fs.ModeSymlink != 0 {
+		return nil
+	}
+
+	// chmod after chown, which clears setuid bits
+	if err := unix.Chmod(target, stat.Mode&07777); err != nil {
+		return errors.Wrapf(err, "couldn't chmod %s", target)
+	}
+
+	attrs, err := xattr.LList(source)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't list xattrs of %s", source)
+	}
+
+	for _, attr := range attrs {
+		if strings.Contains(attr, ".overlay.") {
+			continue
+		}
+
+		val, err := xattr.LGet(source, attr)
+		if err != nil {
+			return errors.Wrapf(err, "couldn't get xattr %s of %s", attr, source)
+		}
+
+		if err := xattr.LSet(target, attr, val); err != nil {
+			return errors.Wrapf(err, "couldn't set xattr %s on %s", attr, target)
+		}
+	}
+
+	return nil
+}
+
+func setTimes(target string, fi fs.FileInfo) error {
+	stat := fi.Sys().(*syscall.Stat_t)
+	ts := []unix.Timespec{
+		unix.NsecToTimespec(syscall.TimespecToNsec(stat.Atim)),
+		unix.NsecToTimespec(syscall.TimespecToNsec(stat.Mtim)),
+	}
+	err := unix.UtimesNanoAt(unix.AT_FDCWD, target, ts, unix.AT_SYMLINK_NOFOLLOW)
+	return errors.Wrapf(err, "couldn't set times on %s", target)
+}
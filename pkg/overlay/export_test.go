@@ -0,0 +1,72 @@
+package overlay
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/xattr"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestMergeOverlayLayer(t *testing.T) {
+	assert := assert.New(t)
+
+	lower := t.TempDir()
+	upper := t.TempDir()
+	dest := t.TempDir()
+
+	assert.NoError(os.MkdirAll(filepath.Join(lower, "etc/app"), 0755))
+	assert.NoError(os.WriteFile(filepath.Join(lower, "etc/app/old.conf"), []byte("old"), 0644))
+	assert.NoError(os.WriteFile(filepath.Join(lower, "etc/removed"), []byte("removed"), 0644))
+	assert.NoError(os.WriteFile(filepath.Join(lower, "etc/replaced"), []byte("file"), 0644))
+	assert.NoError(os.Symlink("removed", filepath.Join(lower, "etc/link")))
+
+	err := unix.Mknod(filepath.Join(upper, "whiteout-test"), syscall.S_IFCHR|0666, int(unix.Mkdev(0, 0)))
+	if err != nil {
+		t.Skipf("can't create whiteouts: %v", err)
+	}
+	assert.NoError(os.Remove(filepath.Join(upper, "whiteout-test")))
+
+	assert.NoError(os.MkdirAll(filepath.Join(upper, "etc/app"), 0700))
+	if err := xattr.LSet(filepath.Join(upper, "etc/app"), "user.overlay.opaque", []byte("y")); err != nil {
+		t.Skipf("can't set user xattrs: %v", err)
+	}
+	assert.NoError(os.WriteFile(filepath.Join(upper, "etc/app/new.conf"), []byte("new"), 0600))
+	assert.NoError(unix.Mknod(filepath.Join(upper, "etc/removed"), syscall.S_IFCHR|0666, int(unix.Mkdev(0, 0))))
+	assert.NoError(os.MkdirAll(filepath.Join(upper, "etc/replaced"), 0755))
+
+	assert.NoError(mergeOverlayLayer(lower, dest))
+	assert.NoError(mergeOverlayLayer(upper, dest))
+
+	// opaque dirs hide everything below them
+	_, err = os.Stat(filepath.Join(dest, "etc/app/old.conf"))
+	assert.True(os.IsNotExist(err))
+	content, err := os.ReadFile(filepath.Join(dest, "etc/app/new.conf"))
+	assert.NoError(err)
+	assert.Equal("new", string(content))
+
+	fi, err := os.Stat(filepath.Join(dest, "etc/app"))
+	assert.NoError(err)
+	assert.Equal(os.FileMode(0700), fi.Mode().Perm())
+
+	// whiteouts remove things
+	_, err = os.Lstat(filepath.Join(dest, "etc/removed"))
+	assert.True(os.IsNotExist(err))
+
+	// files can be replaced by dirs
+	fi, err = os.Stat(filepath.Join(dest, "etc/replaced"))
+	assert.NoError(err)
+	assert.True(fi.IsDir())
+
+	link, err := os.Readlink(filepath.Join(dest, "etc/link"))
+	assert.NoError(err)
+	assert.Equal("removed", link)
+
+	// overlay xattrs aren't carried over
+	attrs, err := xattr.LList(filepath.Join(dest, "etc/app"))
+	assert.NoError(err)
+	assert.NotContains(attrs, "user.overlay.opaque")
+}
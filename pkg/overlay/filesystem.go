@@ -0,0 +1,155 @@
+package overlay
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+	"machinerun.io/atomfs/pkg/erofs"
+	"machinerun.io/atomfs/pkg/squashfs"
+	"machinerun.io/atomfs/pkg/verity"
+	"stackerbuild.io/stacker/pkg/log"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+// the compressions used when a layer type has filesystem options but no
+// compression
+const (
+	defaultSquashfsCompression = "zstd"
+	defaultErofsCompression    = "lz4hc"
+)
+
+// the names mkfs.erofs uses for compressions that are called something else
+// in layer types
+var erofsCompressionNames = map[string]string{
+	"gzip": "deflate",
+	"xz":   "lzma",
+}
+
+// filesystemCompression is the compression a layer of layerType is generated
+// with by makeFilesystem.
+func filesystemCompression(layerType types.LayerType) string {
+	if layerType.Compression != "" {
+		return layerType.Compression
+	}
+
+	if layerType.Type == "erofs" {
+		return defaultErofsCompression
+	}
+	return defaultSquashfsCompression
+}
+
+// tempFileReader is an image file that is removed once it has been read.
+type tempFileReader struct {
+	*os.File
+}
+
+func (t tempFileReader) Close() error {
+	err := t.File.Close()
+	if rmErr := os.Remove(t.Name()); rmErr != nil && err == nil {
+		err = errors.WithStack(rmErr)
+	}
+	return err
+}
+
+func mksquashfsArgs(layerType types.LayerType, rootfs string, image string) []string {
+	compression := filesystemCompression(layerType)
+	args := []string{rootfs, image, "-noappend", "-no-progress"}
+	if compression == "lz4hc" {
+		args = append(args, "-comp", "lz4", "-Xhc")
+	} else {
+		args = append(args, "-comp", compression)
+	}
+
+	if layerType.Level != 0 {
+		args = append(args, "-Xcompression-level", fmt.Sprintf("%d", layerType.Level))
+	}
+
+	if layerType.BlockSize != 0 {
+		args = append(args, "-b", fmt.Sprintf("%d", layerType.BlockSize))
+	}
+
+	return args
+}
+
+func mkfsErofsArgs(layerType types.LayerType, rootfs string, image string) []string {
+	compression := filesystemCompression(layerType)
+	if name, ok := erofsCompressionNames[compression]; ok {
+		compression = name
+	}
+
+	if layerType.Level != 0 {
+		compression = fmt.Sprintf("%s,%d", compression, layerType.Level)
+	}
+
+	args := []string{"-z", compression}
+	if layerType.BlockSize != 0 {
+		args = append(args, "-C", fmt.Sprintf("%d", layerType.BlockSize))
+	}
+
+	extended := []string{}
+	if layerType.Dedupe {
+		extended = append(extended, "dedupe")
+	}
+	if layerType.Fragments {
+		extended = append(extended, "fragments")
+	}
+	if len(extended) > 0 {
+		args = append(args, "-E", strings.Join(extended, ","))
+	}
+
+	return append(args, image, rootfs)
+}
+
+// makeFilesystem generates a squashfs or erofs image of rootfs with the
+// settings in layerType, which atomfs doesn't support. It returns the image,
+// its media type, and its verity root hash if layerType wants verity data.
+func makeFilesystem(layerType types.LayerType, rootfs string, tempdir string) (io.ReadCloser, string, string, error) {
+	tmp, err := os.CreateTemp(tempdir, fmt.Sprintf("stacker-%s-img-", layerType.Type))
+	if err != nil {
+		return nil, "", "", errors.WithStack(err)
+	}
+	image := tmp.Name()
+	tmp.Close()
+
+	var cmd *exec.Cmd
+	var mediaType string
+	switch layerType.Type {
+	case "squashfs":
+		cmd = exec.Command("mksquashfs", mksquashfsArgs(layerType, rootfs, image)...)
+		mediaType = squashfs.GenerateSquashfsMediaType(squashfs.SquashfsCompression(filesystemCompression(layerType)))
+	case "erofs":
+		cmd = exec.Command("mkfs.erofs", mkfsErofsArgs(layerType, rootfs, image)...)
+		mediaType = erofs.GenerateErofsMediaType(erofs.ErofsCompression(filesystemCompression(layerType)))
+	default:
+		os.Remove(image)
+		return nil, "", "", errors.Errorf("can't make a filesystem for %s", layerType)
+	}
+
+	log.Debugf("generating %s layer: %s", layerType, strings.Join(cmd.Args, " "))
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		os.Remove(image)
+		return nil, "", "", errors.Wrapf(err, "%s failed: %s", cmd.Args[0], string(output))
+	}
+
+	rootHash := ""
+	if layerType.Verity {
+		rootHash, err = verity.AppendVerityData(image)
+		if err != nil {
+			os.Remove(image)
+			return nil, "", "", errors.Wrapf(err, "couldn't append verity data to %s", image)
+		}
+	}
+
+	f, err := os.Open(image)
+	if err != nil {
+		os.Remove(image)
+		return nil, "", "", errors.WithStack(err)
+	}
+
+	return tempFileReader{f}, mediaType, rootHash, nil
+}
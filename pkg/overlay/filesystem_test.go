@@ -0,0 +1,24 @@
+package overlay
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+func TestMakeFilesystemArgs(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal([]string{"rootfs", "img", "-noappend", "-no-progress", "-comp", "zstd", "-b", "65536"},
+		mksquashfsArgs(types.LayerType{Type: "squashfs", BlockSize: 65536}, "rootfs", "img"))
+	assert.Equal([]string{"rootfs", "img", "-noappend", "-no-progress", "-comp", "gzip", "-Xcompression-level", "9"},
+		mksquashfsArgs(types.LayerType{Type: "squashfs", Compression: "gzip", Level: 9}, "rootfs", "img"))
+	assert.Equal([]string{"rootfs", "img", "-noappend", "-no-progress", "-comp", "lz4", "-Xhc"},
+		mksquashfsArgs(types.LayerType{Type: "squashfs", Compression: "lz4hc"}, "rootfs", "img"))
+
+	assert.Equal([]string{"-z", "lz4hc", "-E", "dedupe,fragments", "img", "rootfs"},
+		mkfsErofsArgs(types.LayerType{Type: "erofs", Dedupe: true, Fragments: true}, "rootfs", "img"))
+	assert.Equal([]string{"-z", "lzma,6", "-C", "131072", "img", "rootfs"},
+		mkfsErofsArgs(types.LayerType{Type: "erofs", Compression: "xz", Level: 6, BlockSize: 131072}, "rootfs", "img"))
+}
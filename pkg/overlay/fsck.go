@@ -0,0 +1,147 @@
+package overlay
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"stackerbuild.io/stacker/pkg/lib"
+	"stackerbuild.io/stacker/pkg/storage"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+// Fsck checks the unpacked layers and each tag's overlay metadata. Tags
+// whose metadata is missing, or refers to layers that are neither unpacked nor
+// in an OCI layout to unpack them from, are deleted when repairing, so that
+// they are set up again by the next build.
+func (o *overlay) Fsck(opts types.FsckOpts) ([]types.FsckProblem, error) {
+	f := &storage.FsckProblems{Repair: opts.Repair}
+
+	ents, err := os.ReadDir(o.config.RootFSDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "couldn't read roots dir")
+	}
+
+	// first the layers, so that tags using the ones that are removed are
+	// found below
+	for _, ent := range ents {
+		if !strings.HasPrefix(ent.Name(), "sha256_") {
+			continue
+		}
+
+		p := path.Join(o.config.RootFSDir, ent.Name())
+		remove := func() error { return os.RemoveAll(p) }
+
+		// converted layers are symlinks to the layer they were
+		// converted from, overlay dir layers have an overlay symlink
+		// to their contents
+		for _, link := range []string{p, path.Join(p, "overlay")} {
+			if isLink, _ := lib.IsSymlink(link); !isLink {
+				continue
+			}
+
+			if _, err := os.Stat(link); err == nil {
+				continue
+			}
+
+			if err := f.Found(p, remove, "dangling layer symlink %s", link); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+
+	for _, ent := range ents {
+		name := ent.Name()
+		if !ent.IsDir() || strings.HasPrefix(name, "sha256_") || strings.HasPrefix(name, ".") {
+			continue
+		}
+
+		p := path.Join(o.config.RootFSDir, name)
+		remove := func() error { return o.Delete(name) }
+
+		if storage.IsTempDir(name) && !opts.Layers[name] {
+			err = f.Found(p, remove, "orphaned temporary dir")
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if problem := o.checkTag(name, opts.CorruptBlobs); problem != "" {
+			if err := f.Found(p, remove, "%s", problem); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return f.Problems, nil
+}
+
+// checkTag returns what is wrong with tag's overlay metadata, if anything.
+func (o *overlay) checkTag(tag string, corrupt map[digest.Digest]bool) string {
+	metadata := path.Join(o.config.RootFSDir, tag, "overlay_metadata.json")
+	if !lib.PathExists(metadata) {
+		return "missing overlay_metadata.json"
+	}
+
+	ovl, err := readOverlayMetadata(o.config.RootFSDir, tag)
+	if err != nil {
+		return fmt.Sprintf("invalid overlay metadata: %v", err)
+	}
+
+	for layerType, manifest := range ovl.Manifests {
+		if config, ok := ovl.Configs[layerType]; ok && len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+			return fmt.Sprintf("%s manifest has %d layers but its config %d diff ids",
+				layerType, len(manifest.Layers), len(config.RootFS.DiffIDs))
+		}
+
+		for _, layer := range manifest.Layers {
+			if !o.layerAvailable(layer.Digest, corrupt) {
+				return fmt.Sprintf("%s layer %s is neither unpacked nor in an OCI layout", layerType, layer.Digest)
+			}
+		}
+	}
+
+	for _, built := range ovl.BuiltLayers {
+		if !lib.PathExists(path.Join(o.config.RootFSDir, built, "overlay")) {
+			return fmt.Sprintf("built layer %s is missing", built)
+		}
+	}
+
+	for layerType, descs := range ovl.OverlayDirLayers {
+		for _, desc := range descs {
+			if !lib.PathExists(overlayPath(o.config.RootFSDir, desc.Digest, "overlay")) {
+				return fmt.Sprintf("%s overlay dir layer %s is missing", layerType, desc.Digest)
+			}
+		}
+	}
+
+	return ""
+}
+
+// layerAvailable is whether the layer d is unpacked, or can be unpacked
+// from one of the OCI layouts, which it can't if its blob is corrupt.
+func (o *overlay) layerAvailable(d digest.Digest, corrupt map[digest.Digest]bool) bool {
+	if lib.PathExists(overlayPath(o.config.RootFSDir, d, "overlay")) {
+		return true
+	}
+
+	if corrupt[d] {
+		return false
+	}
+
+	for _, ociDir := range []string{o.config.OCIDir, path.Join(o.config.StackerDir, "layer-bases", "oci")} {
+		if lib.PathExists(path.Join(ociDir, "blobs", d.Algorithm().String(), d.Encoded())) {
+			return true
+		}
+	}
+
+	return false
+}
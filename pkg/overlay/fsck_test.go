@@ -0,0 +1,105 @@
+package overlay
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"machinerun.io/atomfs/pkg/verity"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+func TestFsck(t *testing.T) {
+	assert := assert.New(t)
+
+	tmp := t.TempDir()
+	config := types.StackerConfig{
+		StackerDir: path.Join(tmp, ".stacker"),
+		RootFSDir:  path.Join(tmp, "roots"),
+		OCIDir:     path.Join(tmp, "oci"),
+	}
+
+	s, err := NewOverlay(config)
+	assert.NoError(err)
+
+	layerType, err := types.NewLayerType("tar", verity.VerityMetadataMissing)
+	assert.NoError(err)
+
+	// a tag whose only layer is unpacked
+	layer := digest.FromString("layer")
+	assert.NoError(os.MkdirAll(overlayPath(config.RootFSDir, layer, "overlay"), 0755))
+	assert.NoError(os.MkdirAll(path.Join(config.RootFSDir, "good"), 0755))
+	ovl := newOverlayMetadata()
+	ovl.Manifests[layerType] = ispec.Manifest{Layers: []ispec.Descriptor{{Digest: layer}}}
+	ovl.Configs[layerType] = ispec.Image{RootFS: ispec.RootFS{DiffIDs: []digest.Digest{layer}}}
+	assert.NoError(ovl.write(config, "good"))
+
+	problems, err := s.Fsck(types.FsckOpts{})
+	assert.NoError(err)
+	assert.Empty(problems)
+
+	// a tag whose layer is gone, one without metadata, a leftover snapshot
+	// and a converted layer whose source is gone
+	missing := digest.FromString("missing")
+	assert.NoError(os.MkdirAll(path.Join(config.RootFSDir, "bad"), 0755))
+	ovl.Manifests[layerType] = ispec.Manifest{Layers: []ispec.Descriptor{{Digest: missing}}}
+	ovl.Configs[layerType] = ispec.Image{RootFS: ispec.RootFS{DiffIDs: []digest.Digest{missing}}}
+	assert.NoError(ovl.write(config, "bad"))
+	assert.NoError(os.MkdirAll(path.Join(config.RootFSDir, "interrupted"), 0755))
+	assert.NoError(os.MkdirAll(path.Join(config.RootFSDir, "temp-snapshot-good-1234"), 0755))
+	converted := overlayPath(config.RootFSDir, digest.FromString("converted"))
+	assert.NoError(os.Symlink(overlayPath(config.RootFSDir, missing), converted))
+
+	problems, err = s.Fsck(types.FsckOpts{})
+	assert.NoError(err)
+	found := []string{}
+	for _, problem := range problems {
+		assert.False(problem.Repaired)
+		found = append(found, path.Base(problem.Path))
+	}
+	assert.ElementsMatch([]string{"bad", "interrupted", "temp-snapshot-good-1234", path.Base(converted)}, found)
+
+	problems, err = s.Fsck(types.FsckOpts{Repair: true})
+	assert.NoError(err)
+	assert.Len(problems, 4)
+	for _, problem := range problems {
+		assert.True(problem.Repaired)
+	}
+
+	assert.True(s.Exists("good"))
+	assert.False(s.Exists("bad"))
+	assert.False(s.Exists("interrupted"))
+	assert.NoFileExists(converted)
+
+	problems, err = s.Fsck(types.FsckOpts{})
+	assert.NoError(err)
+	assert.Empty(problems)
+
+	// a layer named like a temporary dir is checked like any other tag
+	assert.NoError(os.MkdirAll(path.Join(config.RootFSDir, "squash-good"), 0755))
+	assert.NoError(ovl.write(config, "squash-good"))
+	problems, err = s.Fsck(types.FsckOpts{Repair: true, Layers: map[string]bool{"squash-good": true}})
+	assert.NoError(err)
+	assert.Len(problems, 1)
+	assert.Contains(problems[0].Problem, "neither unpacked nor in an OCI layout")
+
+	// and layers can't be unpacked from corrupt blobs
+	other := digest.FromString("other")
+	assert.NoError(os.MkdirAll(path.Join(config.OCIDir, "blobs", "sha256"), 0755))
+	assert.NoError(os.WriteFile(path.Join(config.OCIDir, "blobs", "sha256", other.Encoded()), []byte("corrupt"), 0644))
+	ovl.Manifests[layerType] = ispec.Manifest{Layers: []ispec.Descriptor{{Digest: other}}}
+	ovl.Configs[layerType] = ispec.Image{RootFS: ispec.RootFS{DiffIDs: []digest.Digest{other}}}
+	assert.NoError(ovl.write(config, "good"))
+
+	problems, err = s.Fsck(types.FsckOpts{})
+	assert.NoError(err)
+	assert.Empty(problems)
+
+	problems, err = s.Fsck(types.FsckOpts{CorruptBlobs: map[digest.Digest]bool{other: true}})
+	assert.NoError(err)
+	assert.Len(problems, 1)
+	assert.Equal(path.Join(config.RootFSDir, "good"), problems[0].Path)
+}
@@ -0,0 +1,294 @@
+package overlay
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/pkg/xattr"
+	"golang.org/x/sys/unix"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+const (
+	// fuse-overlayfs writes whiteouts as .wh.<name> files, and marks
+	// opaque dirs with a .wh..wh..opq file or its own xattr, where it
+	// can't use the kernel's format.
+	fuseWhiteoutPrefix = ".wh."
+	fuseOpaqueWhiteout = ".wh..wh..opq"
+	fuseXattrPrefix    = "user.fuseoverlayfs."
+	fuseOpaqueXattr    = fuseXattrPrefix + "opaque"
+
+	overlayOpaqueXattr = "user.overlay.opaque"
+)
+
+var _ types.Storage = &fuseOverlay{}
+
+// mountFuseOverlay mounts lowers (the top most first) and upper at mountpoint
+// with fuse-overlayfs.
+func mountFuseOverlay(lowers []string, upper string, work string, mountpoint string) error {
+	opts := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", strings.Join(lowers, ":"), upper, work)
+	output, err := exec.Command("fuse-overlayfs", "-o", opts, mountpoint).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "couldn't mount fuse-overlayfs: %s", string(output))
+	}
+	return nil
+}
+
+// detach lazily unmounts mountpoint, if something is mounted there.
+func detach(mountpoint string) error {
+	err := unix.Unmount(mountpoint, unix.MNT_DETACH)
+	if err == nil || errors.Is(err, unix.EINVAL) || errors.Is(err, unix.ENOENT) {
+		return nil
+	}
+	return errors.Wrapf(err, "couldn't unmount %s", mountpoint)
+}
+
+func isFuseMount(dir string) bool {
+	stat := syscall.Statfs_t{}
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return false
+	}
+	return stat.Type == unix.FUSE_SUPER_MAGIC
+}
+
+// canMountFuseOverlay detects whether the current task can mount
+// fuse-overlayfs.
+func canMountFuseOverlay() error {
+	if _, err := exec.LookPath("fuse-overlayfs"); err != nil {
+		return errors.Wrapf(err, "couldn't find fuse-overlayfs")
+	}
+
+	if _, err := os.Stat("/dev/fuse"); err != nil {
+		return errors.Wrapf(err, "couldn't find /dev/fuse")
+	}
+
+	dir, err := os.MkdirTemp("", "stacker-fuse-overlay-mount-")
+	if err != nil {
+		return errors.Wrapf(err, "couldn't create fuse-overlay tmpdir")
+	}
+	defer os.RemoveAll(dir)
+
+	dirs := map[string]string{}
+	for _, name := range []string{"lower", "upper", "work", "mountpoint"} {
+		dirs[name] = path.Join(dir, name)
+		if err := os.Mkdir(dirs[name], 0755); err != nil {
+			return errors.Wrapf(err, "couldn't create fuse-overlay %s dir", name)
+		}
+	}
+
+	err = mountFuseOverlay([]string{dirs["lower"]}, dirs["upper"], dirs["work"], dirs["mountpoint"])
+	if err != nil {
+		return err
+	}
+	return detach(dirs["mountpoint"])
+}
+
+// CheckFuse checks that the fuse-overlay storage can be used: rootfses are
+// mounted with fuse-overlayfs, but layers are still unpacked with whiteouts.
+func CheckFuse(config types.StackerConfig) error {
+	err := canMountFuseOverlay()
+	if err != nil {
+		return err
+	}
+
+	return canWriteWhiteouts(config)
+}
+
+// fuseOverlay is the overlay storage for where the kernel's overlay can't be
+// mounted. Layers are laid out and unpacked the same way, but rootfses are
+// mounted with fuse-overlayfs by stacker, rather than by LXC, and what was
+// written through it is converted to the kernel's format once unmounted.
+type fuseOverlay struct {
+	*overlay
+}
+
+func NewFuseOverlay(config types.StackerConfig) (types.Storage, error) {
+	return &fuseOverlay{&overlay{config}}, nil
+}
+
+func (f *fuseOverlay) Name() string {
+	return "fuse-overlay"
+}
+
+// unmount unmounts name's rootfs, if it is mounted, and converts its changes
+// to the kernel's overlay format.
+func (f *fuseOverlay) unmount(name string) error {
+	if err := detach(path.Join(f.config.RootFSDir, name, "rootfs")); err != nil {
+		return err
+	}
+
+	return fromFuseFormat(path.Join(f.config.RootFSDir, name, "overlay"))
+}
+
+func (f *fuseOverlay) Snapshot(source, target string) error {
+	if err := f.unmount(source); err != nil {
+		return err
+	}
+	return f.overlay.Snapshot(source, target)
+}
+
+func (f *fuseOverlay) Restore(source, target string) error {
+	if err := f.unmount(source); err != nil {
+		return err
+	}
+	return f.overlay.Restore(source, target)
+}
+
+func (f *fuseOverlay) Delete(thing string) error {
+	if err := detach(path.Join(f.config.RootFSDir, thing, "rootfs")); err != nil {
+		return err
+	}
+	return f.overlay.Delete(thing)
+}
+
+func (f *fuseOverlay) Rename(source, target string) error {
+	for _, thing := range []string{source, target} {
+		if err := detach(path.Join(f.config.RootFSDir, thing, "rootfs")); err != nil {
+			return err
+		}
+	}
+	return f.overlay.Rename(source, target)
+}
+
+func (f *fuseOverlay) TemporaryWritableSnapshot(source string) (string, func(), error) {
+	if err := f.unmount(source); err != nil {
+		return "", nil, err
+	}
+
+	name, cleanup, err := f.overlay.TemporaryWritableSnapshot(source)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return name, func() {
+		detach(path.Join(f.config.RootFSDir, name, "rootfs"))
+		cleanup()
+	}, nil
+}
+
+func (f *fuseOverlay) Clean() error {
+	ents, err := os.ReadDir(f.config.RootFSDir)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "couldn't read roots dir")
+	}
+
+	for _, ent := range ents {
+		if err := detach(path.Join(f.config.RootFSDir, ent.Name(), "rootfs")); err != nil {
+			return err
+		}
+	}
+
+	return f.overlay.Clean()
+}
+
+func (f *fuseOverlay) Repack(name string, layer types.Layer, layerTypes []types.LayerType, sfm types.StackerFiles) error {
+	if err := f.unmount(name); err != nil {
+		return err
+	}
+	return f.overlay.Repack(name, layer, layerTypes, sfm)
+}
+
+// GetLXCRootfsConfig mounts name's rootfs, since LXC can only mount the
+// kernel's overlay itself.
+func (f *fuseOverlay) GetLXCRootfsConfig(name string) (string, error) {
+	if err := f.unmount(name); err != nil {
+		return "", err
+	}
+
+	ovl, err := readOverlayMetadata(f.config.RootFSDir, name)
+	if err != nil {
+		return "", err
+	}
+
+	lxcRootfsString, err := ovl.lxcRootfsString(f.config, name)
+	if err != nil {
+		return "", err
+	}
+
+	// overlayfs:lowerdir[:lowerdir2:lowerdir3...]:upperdir
+	dirs := strings.Split(strings.TrimPrefix(lxcRootfsString, "overlayfs:"), ":")
+	lowers, upper := dirs[:len(dirs)-1], dirs[len(dirs)-1]
+
+	work := path.Join(f.config.RootFSDir, name, "work")
+	if err := os.MkdirAll(work, 0755); err != nil {
+		return "", errors.Wrapf(err, "couldn't create fuse-overlay work dir")
+	}
+
+	rootfs := path.Join(f.config.RootFSDir, name, "rootfs")
+	if err := mountFuseOverlay(lowers, upper, work, rootfs); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("dir:%s", rootfs), nil
+}
+
+// fromFuseFormat converts the whiteouts and opaque dirs fuse-overlayfs wrote
+// to the upper dir into the kernel's overlay format with userxattr, which is
+// what layers are generated from, and drops fuse-overlayfs' own xattrs.
+func fromFuseFormat(dir string) error {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil
+	}
+
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		name := d.Name()
+		switch {
+		case name == fuseOpaqueWhiteout:
+			if err := os.Remove(p); err != nil {
+				return errors.WithStack(err)
+			}
+			return setOpaque(filepath.Dir(p))
+		case strings.HasPrefix(name, fuseWhiteoutPrefix):
+			if err := os.Remove(p); err != nil {
+				return errors.WithStack(err)
+			}
+			whiteout := filepath.Join(filepath.Dir(p), strings.TrimPrefix(name, fuseWhiteoutPrefix))
+			err := unix.Mknod(whiteout, syscall.S_IFCHR|0666, int(unix.Mkdev(0, 0)))
+			return errors.Wrapf(err, "couldn't create overlay whiteout %s", whiteout)
+		case d.Type()&fs.ModeSymlink != 0:
+			// user.* xattrs "can not" exist on symlinks
+			return nil
+		}
+
+		attrs, err := xattr.LList(p)
+		if err != nil {
+			return err
+		}
+
+		for _, attr := range attrs {
+			if !strings.HasPrefix(attr, fuseXattrPrefix) {
+				continue
+			}
+
+			if attr == fuseOpaqueXattr {
+				val, err := xattr.LGet(p, attr)
+				if err == nil && string(val) == "y" {
+					if err := setOpaque(p); err != nil {
+						return err
+					}
+				}
+			}
+
+			if err := xattr.LRemove(p, attr); err != nil {
+				return errors.Errorf("%s: failed to remove attr %s: %v", p, attr, err)
+			}
+		}
+		return nil
+	})
+}
+
+func setOpaque(dir string) error {
+	err := xattr.LSet(dir, overlayOpaqueXattr, []byte("y"))
+	return errors.Wrapf(err, "couldn't mark %s opaque", dir)
+}
@@ -0,0 +1,62 @@
+package overlay
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/xattr"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestFromFuseFormat(t *testing.T) {
+	assert := assert.New(t)
+
+	upper := t.TempDir()
+
+	err := unix.Mknod(filepath.Join(upper, "whiteout-test"), syscall.S_IFCHR|0666, int(unix.Mkdev(0, 0)))
+	if err != nil {
+		t.Skipf("can't create whiteouts: %v", err)
+	}
+	assert.NoError(os.Remove(filepath.Join(upper, "whiteout-test")))
+
+	assert.NoError(os.MkdirAll(filepath.Join(upper, "etc/opaque"), 0755))
+	if err := xattr.LSet(filepath.Join(upper, "etc"), fuseXattrPrefix+"origin", []byte("lower")); err != nil {
+		t.Skipf("can't set user xattrs: %v", err)
+	}
+	assert.NoError(os.WriteFile(filepath.Join(upper, "etc/opaque", fuseOpaqueWhiteout), nil, 0700))
+	assert.NoError(os.WriteFile(filepath.Join(upper, "etc/opaque/new.conf"), []byte("new"), 0644))
+	assert.NoError(os.MkdirAll(filepath.Join(upper, "etc/xattr-opaque"), 0755))
+	assert.NoError(xattr.LSet(filepath.Join(upper, "etc/xattr-opaque"), fuseOpaqueXattr, []byte("y")))
+	assert.NoError(os.WriteFile(filepath.Join(upper, "etc", fuseWhiteoutPrefix+"removed"), nil, 0))
+	assert.NoError(os.Symlink("removed", filepath.Join(upper, "etc/link")))
+
+	assert.NoError(fromFuseFormat(upper))
+
+	assert.NoFileExists(filepath.Join(upper, "etc/opaque", fuseOpaqueWhiteout))
+	assert.NoFileExists(filepath.Join(upper, "etc", fuseWhiteoutPrefix+"removed"))
+	assert.FileExists(filepath.Join(upper, "etc/opaque/new.conf"))
+
+	for _, dir := range []string{"etc/opaque", "etc/xattr-opaque"} {
+		assert.True(isOpaque(filepath.Join(upper, dir)), dir)
+	}
+	assert.False(isOpaque(filepath.Join(upper, "etc")))
+
+	fi, err := os.Lstat(filepath.Join(upper, "etc/removed"))
+	assert.NoError(err)
+	assert.True(isWhiteout(fi))
+
+	for _, p := range []string{"etc", "etc/xattr-opaque"} {
+		attrs, err := xattr.LList(filepath.Join(upper, p))
+		assert.NoError(err)
+		assert.NotContains(attrs, fuseXattrPrefix+"origin")
+		assert.NotContains(attrs, fuseOpaqueXattr)
+	}
+
+	// converting again changes nothing, and a missing upper dir is fine
+	assert.NoError(fromFuseFormat(upper))
+	assert.True(isOpaque(filepath.Join(upper, "etc/opaque")))
+	assert.NoError(fromFuseFormat(filepath.Join(upper, "missing")))
+}
@@ -196,6 +196,15 @@ func (o *overlay) Exists(thing string) bool {
 	return err == nil
 }
 
+func (o *overlay) Rename(source, target string) error {
+	if err := o.Delete(target); err != nil {
+		return err
+	}
+
+	err := os.Rename(path.Join(o.config.RootFSDir, source), path.Join(o.config.RootFSDir, target))
+	return errors.Wrapf(err, "couldn't rename %s to %s", source, target)
+}
+
 func (o *overlay) TemporaryWritableSnapshot(source string) (string, func(), error) {
 	// should use create maybe?
 	dir, err := os.MkdirTemp(o.config.RootFSDir, fmt.Sprintf("temp-snapshot-%s-", source))
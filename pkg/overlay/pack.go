@@ -13,7 +13,6 @@ import (
 	"sync"
 	"time"
 
-	"github.com/klauspost/pgzip"
 	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/opencontainers/umoci"
@@ -136,8 +135,18 @@ func ConvertAndOutput(config types.StackerConfig, tag, name string, layerType ty
 			return err
 		}
 		defer blob.Close()
-		// add it to the oci repository
-		desc, err := ociPutBlob(blob, config, mediaType, rootHash)
+
+		// add it to the oci repository; plain tar layers are left
+		// uncompressed, but the other tar types are only useful
+		// compressed.
+		var desc ispec.Descriptor
+		diffID := digest.Digest("")
+		if layerType.Type == "tar" && layerType.Compression != "" {
+			desc, diffID, err = PutTarLayer(config, oci, layerType, blob)
+		} else {
+			desc, err = ociPutBlob(blob, config, mediaType, rootHash)
+			diffID = desc.Digest
+		}
 		if err != nil {
 			return err
 		}
@@ -154,7 +163,7 @@ func ConvertAndOutput(config types.StackerConfig, tag, name string, layerType ty
 			}
 		}
 		newManifest.Layers = append(newManifest.Layers, desc)
-		newConfig.RootFS.DiffIDs = append(newConfig.RootFS.DiffIDs, desc.Digest)
+		newConfig.RootFS.DiffIDs = append(newConfig.RootFS.DiffIDs, diffID)
 	}
 	// update image
 	_, err = stackeroci.UpdateImageConfig(oci, layerType.LayerName(name), newConfig, newManifest)
@@ -165,107 +174,78 @@ func ConvertAndOutput(config types.StackerConfig, tag, name string, layerType ty
 	return nil
 }
 
-func lookupManifestInDir(dir, name string) (ispec.Manifest, error) {
-	oci, err := umoci.OpenLayout(dir)
-	if err != nil {
-		return ispec.Manifest{}, err
+func (o *overlay) Repack(name string, layer types.Layer, layerTypes []types.LayerType, sfm types.StackerFiles) error {
+	convert := func(cacheTag string, name string, layerType types.LayerType) error {
+		return ConvertAndOutput(o.config, cacheTag, name, layerType)
 	}
-	defer oci.Close()
 
-	return stackeroci.LookupManifest(oci, name)
-}
-
-func (o *overlay) initializeBasesInOutput(name string, layerTypes []types.LayerType, sfm types.StackerFiles) error {
-	baseTag, baseLayer, foundBase, err := storage.FindFirstBaseInOutput(name, sfm)
+	err := storage.InitializeBasesInOutput(o.config, name, layerTypes, sfm, convert)
 	if err != nil {
 		return err
 	}
 
-	initialized := false
-	if foundBase {
-		if !baseLayer.BuildOnly && baseTag != name {
-			// otherwise if it's already been built and the base
-			// types match, import it from there
-			for _, layerType := range layerTypes {
-				log.Debugf("Running image copy to oci:%s:%s", o.config.OCIDir, layerType.LayerName(name))
-				err = lib.ImageCopy(lib.ImageCopyOpts{
-					Src:  fmt.Sprintf("oci:%s:%s", o.config.OCIDir, layerType.LayerName(baseTag)),
-					Dest: fmt.Sprintf("oci:%s:%s", o.config.OCIDir, layerType.LayerName(name)),
-				})
-				if err != nil {
-					return err
-				}
-			}
-
-			initialized = true
-		} else if types.IsContainersImageLayer(baseLayer.From.Type) {
-			cacheDir := path.Join(o.config.StackerDir, "layer-bases", "oci")
-			cacheTag, err := baseLayer.From.ParseTag()
-			if err != nil {
-				return err
-			}
+	err = repackOverlay(o.config, name, layer, layerTypes)
+	if err != nil {
+		return err
+	}
 
-			manifest, err := lookupManifestInDir(cacheDir, cacheTag)
-			if err != nil {
-				return err
-			}
+	oci, err := umoci.OpenLayout(o.config.OCIDir)
+	if err != nil {
+		return err
+	}
+	defer oci.Close()
 
-			sourceLayerType, err := types.NewLayerTypeManifest(manifest)
-			if err != nil {
+	// the overlay metadata still has the unsquashed layers, and the
+	// unsquashed image is kept in the output, so that things built on
+	// this layer (and rebuilds of it) can keep using them.
+	for _, layerType := range layerTypes {
+		if !layer.Squash {
+			if err := storage.DropUnsquashed(oci, layerType.LayerName(name)); err != nil {
 				return err
 			}
-
-			for _, layerType := range layerTypes {
-				if sourceLayerType == layerType {
-					err = lib.ImageCopy(lib.ImageCopyOpts{
-						Src:  fmt.Sprintf("oci:%s:%s", cacheDir, cacheTag),
-						Dest: fmt.Sprintf("oci:%s:%s", o.config.OCIDir, layerType.LayerName(name)),
-					})
-					if err != nil {
-						return err
-					}
-				} else {
-					log.Debugf("creating oci image %s (type=%s) by converting %s (type=%s)",
-						layerType.LayerName(name), layerType, sourceLayerType.LayerName(name), sourceLayerType)
-					err = ConvertAndOutput(o.config, cacheTag, name, layerType)
-					if err != nil {
-						return err
-					}
-				}
-			}
-
-			initialized = true
+			continue
 		}
-	}
 
-	if !initialized {
-		oci, err := umoci.OpenLayout(o.config.OCIDir)
+		blobType, err := layerType.WithFilesystemOptions(layer.Filesystem)
 		if err != nil {
+			return errors.Wrapf(err, "%s", name)
+		}
+
+		if err := storage.KeepUnsquashed(oci, layerType.LayerName(name)); err != nil {
 			return err
 		}
-		defer oci.Close()
 
-		for _, layerType := range layerTypes {
-			err = umoci.NewImage(oci, layerType.LayerName(name), o.config.SourceDateEpoch)
-			if err != nil {
-				return err
-			}
+		err = squashImage(o.config, oci, layerType.LayerName(name), layerType.LayerName(name), blobType)
+		if err != nil {
+			return errors.Wrapf(err, "couldn't squash %s", layerType.LayerName(name))
 		}
 	}
 
 	return nil
 }
 
-func (o *overlay) Repack(name string, layer types.Layer, layerTypes []types.LayerType, sfm types.StackerFiles) error {
-	err := o.initializeBasesInOutput(name, layerTypes, sfm)
+// InSingleIdNamespace is whether stacker runs in a user namespace that only
+// maps one uid, i.e. for a user without subordinate ids.
+func InSingleIdNamespace() bool {
+	content, err := os.ReadFile("/proc/self/uid_map")
 	if err != nil {
-		return err
+		return false
 	}
+	fields := strings.Fields(string(content))
+	return len(fields) == 3 && fields[2] == "1"
+}
 
-	return repackOverlay(o.config, name, layer, layerTypes)
+// overlayfsRootfs is the on disk format of layers. Where files can't be
+// chowned to other users than root, their owners are kept in the
+// user.rootlesscontainers xattr, and restored from it when generating layers.
+func overlayfsRootfs() layer.OverlayfsRootfs {
+	return layer.OverlayfsRootfs{
+		UserXattr:  true,
+		MapOptions: layer.MapOptions{Rootless: InSingleIdNamespace()},
+	}
 }
 
-// generateBlob generates either a tar blob or a squashfs blob based on layerType
+// generateBlob generates either a tar blob or a squashfs/erofs blob based on layerType
 func generateBlob(layerType types.LayerType, contents string, ociDir string, sourceDateEpoch *time.Time) (io.ReadCloser, string, string, error) {
 	var blob io.ReadCloser
 	var err error
@@ -273,11 +253,16 @@ func generateBlob(layerType types.LayerType, contents string, ociDir string, sou
 	var rootHash string
 	if layerType.Type == "tar" {
 		packOptions := layer.RepackOptions{
-			OnDiskFormat:    layer.OverlayfsRootfs{UserXattr: true},
+			OnDiskFormat:    overlayfsRootfs(),
 			SourceDateEpoch: sourceDateEpoch,
 		}
 		blob = layer.GenerateInsertLayer(contents, "/", false, &packOptions)
 		mediaType = ispec.MediaTypeImageLayer
+	} else if layerType.HasFilesystemOptions() {
+		blob, mediaType, rootHash, err = makeFilesystem(layerType, contents, ociDir)
+		if err != nil {
+			return nil, "", "", err
+		}
 	} else {
 		fsi := stackerfs.New(fstypes.FilesystemType(layerType.Type))
 		blob, mediaType, rootHash, err = fsi.Make(ociDir, contents, nil, layerType.Verity)
@@ -359,7 +344,7 @@ func stripOverlayAttrsUnder(dirPath string) error {
 		})
 }
 
-func generateLayer(config types.StackerConfig, _ casext.Engine, mutators []*mutate.Mutator,
+func generateLayer(config types.StackerConfig, oci casext.Engine, mutators []*mutate.Mutator,
 	name string, layer types.Layer, layerTypes []types.LayerType,
 ) (bool, error) {
 	dir := path.Join(config.RootFSDir, name, "overlay")
@@ -417,14 +402,20 @@ func generateLayer(config types.StackerConfig, _ casext.Engine, mutators []*muta
 		mutator := mutators[i]
 		var desc ispec.Descriptor
 
-		blob, mediaType, rootHash, err := generateBlob(layerType, dir, config.OCIDir, config.SourceDateEpoch)
+		// the layer's own filesystem options win over the build's
+		blobType, err := layerType.WithFilesystemOptions(layer.Filesystem)
+		if err != nil {
+			return false, errors.Wrapf(err, "%s", name)
+		}
+
+		blob, mediaType, rootHash, err := generateBlob(blobType, dir, config.OCIDir, config.SourceDateEpoch)
 		if err != nil {
 			return false, err
 		}
 		defer blob.Close()
 
 		if layerType.Type == "tar" {
-			desc, err = mutator.Add(context.Background(), mediaType, blob, history, mutate.GzipCompressor, nil)
+			desc, err = AddTarLayer(config, oci, mutator, layerType, blob, history)
 			if err != nil {
 				return false, err
 			}
@@ -684,13 +675,21 @@ func unpackOne(l ispec.Descriptor, ociDir string, extractDir string) error {
 		return nil
 	}
 
-	if fsi := stackerfs.NewFromMediaType(l.MediaType); fsi != nil {
+	fsi := stackerfs.NewFromMediaType(l.MediaType)
+	if fsi == nil {
+		// atomfs only knows the compressions it generates itself
+		if fsType := types.FilesystemMediaType(l.MediaType); fsType != "" {
+			fsi = stackerfs.New(fstypes.FilesystemType(fsType))
+		}
+	}
+
+	if fsi != nil {
 		return fsi.ExtractSingle(
 			path.Join(ociDir, "blobs", "sha256", l.Digest.Encoded()), extractDir)
 	}
 
 	switch l.MediaType {
-	case ispec.MediaTypeImageLayer, ispec.MediaTypeImageLayerGzip:
+	case ispec.MediaTypeImageLayer, ispec.MediaTypeImageLayerGzip, ispec.MediaTypeImageLayerZstd:
 		tarEx.Lock()
 		defer tarEx.Unlock()
 
@@ -706,14 +705,20 @@ func unpackOne(l ispec.Descriptor, ociDir string, extractDir string) error {
 		}
 		defer compressed.Close()
 
-		uncompressed, err := pgzip.NewReader(compressed)
+		uncompressed, err := decompressLayer(l.MediaType, compressed)
 		if err != nil {
 			return err
 		}
+		defer uncompressed.Close()
 
 		// always unpack with Overlay whiteout mode to prevent ignoring whiteouts in tar layers
 		// see test/publish.bats: "building from published images with whiteouts" for more details
-		err = layer.UnpackLayer(extractDir, uncompressed, &layer.UnpackOptions{OnDiskFormat: layer.OverlayfsRootfs{UserXattr: true}})
+		err = layer.UnpackLayer(extractDir, uncompressed, &layer.UnpackOptions{OnDiskFormat: overlayfsRootfs()})
+		if err == nil {
+			if _, ok := l.Annotations[types.EstargzTOCDigestAnnotation]; ok {
+				err = removeEstargzMetadata(extractDir)
+			}
+		}
 		if err != nil {
 			if rmErr := os.RemoveAll(extractDir); rmErr != nil {
 				log.Errorf("Failed to remove dir '%s' after failed extraction: %v", extractDir, rmErr)
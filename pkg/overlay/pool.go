@@ -14,12 +14,13 @@ type ThreadPool struct {
 	cancel context.CancelFunc
 	n      int
 	tasks  chan func(context.Context) error
+	errMu  sync.Mutex
 	err    error
 }
 
 func NewThreadPool(n int) *ThreadPool {
 	ctx, cancel := context.WithCancel(context.Background())
-	return &ThreadPool{ctx, cancel, n, make(chan func(context.Context) error, 1000), nil}
+	return &ThreadPool{ctx: ctx, cancel: cancel, n: n, tasks: make(chan func(context.Context) error, 1000)}
 }
 
 func (tp *ThreadPool) Add(f func(context.Context) error) {
@@ -47,7 +48,11 @@ func (tp *ThreadPool) Run() error {
 
 					err := f(tp.ctx)
 					if err != nil && err != ThreadPoolCancelled {
-						tp.err = err
+						tp.errMu.Lock()
+						if tp.err == nil {
+							tp.err = err
+						}
+						tp.errMu.Unlock()
 						tp.cancel()
 						return
 					}
@@ -0,0 +1,125 @@
+package overlay
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+	stackeroci "machinerun.io/atomfs/pkg/oci"
+	"stackerbuild.io/stacker/pkg/lib"
+	"stackerbuild.io/stacker/pkg/log"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+func (o *overlay) Squash(tag string, target string, layerType types.LayerType) error {
+	oci, err := umoci.OpenLayout(o.config.OCIDir)
+	if err != nil {
+		return err
+	}
+	defer oci.Close()
+
+	return squashImage(o.config, oci, tag, target, layerType)
+}
+
+// squashImage writes the image tag in the output OCI layout to target as an
+// image with a single layerType layer holding all of its layers' contents.
+// target may be tag itself.
+func squashImage(config types.StackerConfig, oci casext.Engine, tag string, target string, layerType types.LayerType) error {
+	manifest, err := stackeroci.LookupManifest(oci, tag)
+	if err != nil {
+		return err
+	}
+
+	// there's nothing to squash, but target should still be the image
+	if len(manifest.Layers) <= 1 {
+		if tag == target {
+			return nil
+		}
+
+		descPaths, err := oci.ResolveReference(context.Background(), tag)
+		if err != nil {
+			return err
+		}
+
+		return oci.UpdateReference(context.Background(), target, descPaths[0].Root())
+	}
+
+	imageConfig, err := stackeroci.LookupConfig(oci, manifest.Config)
+	if err != nil {
+		return err
+	}
+
+	dir, err := os.MkdirTemp(config.RootFSDir, "squash-")
+	if err != nil {
+		return errors.Wrapf(err, "couldn't create squash dir")
+	}
+	defer os.RemoveAll(dir)
+
+	contents := path.Join(dir, "overlay")
+	if err := Flatten(config, config.OCIDir, tag, contents); err != nil {
+		return err
+	}
+
+	blob, mediaType, rootHash, err := generateBlob(layerType, contents, config.OCIDir, config.SourceDateEpoch)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	var desc ispec.Descriptor
+	diffID := digest.Digest("")
+	if layerType.Type == "tar" {
+		desc, diffID, err = PutTarLayer(config, oci, layerType, blob)
+	} else {
+		desc, err = ociPutBlob(blob, config, mediaType, rootHash)
+		diffID = desc.Digest
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("squashed %d layers of %s into %s", len(manifest.Layers), tag, desc.Digest)
+
+	now := time.Now()
+	if config.SourceDateEpoch != nil {
+		now = *config.SourceDateEpoch
+	}
+
+	newConfig := imageConfig
+	newConfig.RootFS.DiffIDs = []digest.Digest{diffID}
+	newConfig.History = []ispec.History{{
+		Created:   &now,
+		CreatedBy: fmt.Sprintf("stacker squash of %s", tag),
+		Comment:   fmt.Sprintf("squashed %d layers", len(manifest.Layers)),
+	}}
+
+	newManifest := manifest
+	newManifest.Layers = []ispec.Descriptor{desc}
+
+	_, err = stackeroci.UpdateImageConfig(oci, target, newConfig, newManifest)
+	if err != nil {
+		return err
+	}
+
+	// keep the merged contents as the squashed layer's, so that things
+	// can be built on top of it without unpacking it again.
+	if !lib.PathExists(overlayPath(config.RootFSDir, desc.Digest, "overlay")) {
+		if err := os.MkdirAll(overlayPath(config.RootFSDir, desc.Digest), 0755); err != nil {
+			return errors.Wrapf(err, "couldn't make squashed layer dir")
+		}
+
+		err = os.Rename(contents, overlayPath(config.RootFSDir, desc.Digest, "overlay"))
+		if err != nil {
+			return errors.Wrapf(err, "couldn't move squashed layer contents")
+		}
+	}
+
+	return nil
+}
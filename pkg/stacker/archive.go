@@ -0,0 +1,177 @@
+package stacker
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/pkg/errors"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	zipMagic  = []byte("PK\x03\x04")
+)
+
+// archiveMagic returns the first few bytes of file, to tell what kind of
+// archive it is.
+func archiveMagic(file string) ([]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't open %s", file)
+	}
+	defer f.Close()
+
+	magic := make([]byte, 4)
+	n, err := io.ReadFull(f, magic)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, errors.Wrapf(err, "couldn't read %s", file)
+	}
+
+	return magic[:n], nil
+}
+
+// checkNoSymlinkParents makes sure none of the directories name is in under
+// root are symlinks, so that writing name doesn't write outside of root.
+func checkNoSymlinkParents(root string, name string) error {
+	parent := path.Dir(name)
+	for parent != "." && parent != "/" {
+		st, err := os.Lstat(path.Join(root, parent))
+		if err == nil && st.Mode()&fs.ModeSymlink != 0 {
+			return errors.Errorf("bad path %s: it is under a symlink", name)
+		} else if err != nil && !os.IsNotExist(err) {
+			return errors.WithStack(err)
+		}
+		parent = path.Dir(parent)
+	}
+
+	return nil
+}
+
+// unpackTar extracts a tarball, which may be gzip or zstd compressed, to
+// destDir.
+func unpackTar(destDir string, tar string) error {
+	tarReader, err := os.Open(tar)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't open %s", tar)
+	}
+	defer tarReader.Close()
+
+	buffered := bufio.NewReader(tarReader)
+	magic, _ := buffered.Peek(4)
+
+	var uncompressed io.Reader = buffered
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gz, err := pgzip.NewReader(buffered)
+		if err != nil {
+			return errors.Wrapf(err, "couldn't decompress %s", tar)
+		}
+		defer gz.Close()
+		uncompressed = gz
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(buffered)
+		if err != nil {
+			return errors.Wrapf(err, "couldn't decompress %s", tar)
+		}
+		defer zr.Close()
+		uncompressed = zr
+	}
+
+	return layer.UnpackLayer(destDir, uncompressed, &layer.UnpackOptions{KeepDirlinks: true})
+}
+
+// unpackZip extracts a zip file to destDir.
+func unpackZip(destDir string, file string) error {
+	zr, err := zip.OpenReader(file)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't open %s", file)
+	}
+	defer zr.Close()
+
+	for _, f := range zr.File {
+		if !filepath.IsLocal(f.Name) {
+			return errors.Errorf("bad path in %s: %s", file, f.Name)
+		}
+
+		name := path.Clean(f.Name)
+		if err := checkNoSymlinkParents(destDir, name); err != nil {
+			return err
+		}
+
+		dest := path.Join(destDir, name)
+		if f.FileInfo().IsDir() {
+			if err := os.MkdirAll(dest, f.Mode().Perm()|0700); err != nil {
+				return errors.WithStack(err)
+			}
+			continue
+		}
+
+		if err := os.MkdirAll(path.Dir(dest), 0755); err != nil {
+			return errors.WithStack(err)
+		}
+
+		if err := os.RemoveAll(dest); err != nil {
+			return errors.WithStack(err)
+		}
+
+		if err := unpackZipEntry(dest, f); err != nil {
+			return errors.Wrapf(err, "couldn't extract %s from %s", f.Name, file)
+		}
+	}
+
+	return nil
+}
+
+func unpackZipEntry(dest string, f *zip.File) error {
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// a symlink's target is its content
+	if f.Mode()&fs.ModeSymlink != 0 {
+		target, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(string(target), dest)
+	}
+
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, f.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, r); err != nil {
+		return err
+	}
+
+	return out.Close()
+}
+
+// unpackArchive extracts file, a tarball (possibly compressed) or a zip file,
+// to destDir.
+func unpackArchive(destDir string, file string) error {
+	magic, err := archiveMagic(file)
+	if err != nil {
+		return err
+	}
+
+	if bytes.HasPrefix(magic, zipMagic) {
+		return unpackZip(destDir, file)
+	}
+
+	return unpackTar(destDir, file)
+}
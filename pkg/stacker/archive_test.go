@@ -0,0 +1,192 @@
+package stacker
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/stretchr/testify/assert"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+var archiveContent = map[string]string{"bin/hello": "hello", "README": "read me"}
+
+func writeTar(t *testing.T, w io.Writer) {
+	tw := tar.NewWriter(w)
+	assert.NoError(t, tw.WriteHeader(&tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755}))
+	for name, content := range archiveContent {
+		hdr := &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))}
+		assert.NoError(t, tw.WriteHeader(hdr))
+		_, err := tw.Write([]byte(content))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, tw.Close())
+}
+
+// writeArchive writes archiveContent to file, in the format its extension
+// says.
+func writeArchive(t *testing.T, file string) {
+	f, err := os.Create(file)
+	assert.NoError(t, err)
+	defer f.Close()
+
+	switch path.Ext(file) {
+	case ".tar":
+		writeTar(t, f)
+	case ".gz":
+		gz := gzip.NewWriter(f)
+		writeTar(t, gz)
+		assert.NoError(t, gz.Close())
+	case ".zst":
+		zw, err := zstd.NewWriter(f)
+		assert.NoError(t, err)
+		writeTar(t, zw)
+		assert.NoError(t, zw.Close())
+	case ".zip":
+		zw := zip.NewWriter(f)
+		for name, content := range archiveContent {
+			w, err := zw.Create(name)
+			assert.NoError(t, err)
+			_, err = w.Write([]byte(content))
+			assert.NoError(t, err)
+		}
+		assert.NoError(t, zw.Close())
+	default:
+		t.Fatalf("unknown archive type %s", file)
+	}
+}
+
+func TestUnpackArchive(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, name := range []string{"a.tar", "a.tar.gz", "a.tar.zst", "a.zip"} {
+		archive := path.Join(t.TempDir(), name)
+		writeArchive(t, archive)
+
+		dest := t.TempDir()
+		assert.NoError(unpackArchive(dest, archive), name)
+		for file, expected := range archiveContent {
+			content, err := os.ReadFile(path.Join(dest, file))
+			assert.NoError(err, name)
+			assert.Equal(expected, string(content), name)
+		}
+	}
+}
+
+func TestUnpackZipBadPaths(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, entries := range [][]string{{"../evil"}, {"/evil"}, {"link", "link/evil"}} {
+		archive := path.Join(t.TempDir(), "bad.zip")
+		f, err := os.Create(archive)
+		assert.NoError(err)
+
+		outside := t.TempDir()
+		zw := zip.NewWriter(f)
+		for _, name := range entries {
+			hdr := &zip.FileHeader{Name: name}
+			content := "evil"
+			if name == "link" {
+				hdr.SetMode(os.ModeSymlink | 0777)
+				content = outside
+			}
+			w, err := zw.CreateHeader(hdr)
+			assert.NoError(err)
+			_, err = w.Write([]byte(content))
+			assert.NoError(err)
+		}
+		assert.NoError(zw.Close())
+		f.Close()
+
+		assert.Error(unpackArchive(t.TempDir(), archive), entries)
+		assert.NoFileExists(path.Join(outside, "evil"))
+	}
+}
+
+func TestExtractImport(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+
+	config := types.StackerConfig{
+		StackerDir: path.Join(dir, ".stacker"),
+		RootFSDir:  path.Join(dir, "roots"),
+	}
+
+	archive := path.Join(dir, "app.tar.gz")
+	writeArchive(t, archive)
+
+	stackerYaml := path.Join(dir, "stacker.yaml")
+	err := os.WriteFile(stackerYaml, []byte(`
+foo:
+    from:
+        type: scratch
+    imports:
+        - path: app.tar.gz
+          dest: /opt/app
+          extract: true
+          mode: 0700
+`), 0644)
+	assert.NoError(err)
+
+	sf, err := types.NewStackerfile(stackerYaml, false, nil)
+	assert.NoError(err)
+	sfm := types.StackerFiles{"dummy": sf}
+	l, ok := sfm.LookupLayerDefinition("foo")
+	assert.True(ok)
+
+	cache, err := OpenCache(config, casext.Engine{}, sfm)
+	assert.NoError(err)
+
+	var overlayDirs types.OverlayDirs
+	build := func() bool {
+		assert.NoError(CleanImportsDir(config, "foo", l.Imports, cache))
+		overlayDirs = types.OverlayDirs{}
+		assert.NoError(Import(config, nil, "foo", l.Imports, &overlayDirs, false))
+
+		_, hit, err := cache.Lookup("foo")
+		assert.NoError(err)
+		if !hit {
+			assert.NoError(cache.Put("foo", map[types.LayerType]ispec.Descriptor{}, nil))
+		}
+		return hit
+	}
+
+	assert.False(build())
+	assert.Len(overlayDirs, 1)
+	assert.Equal("/opt/app", overlayDirs[0].Dest)
+
+	extracted := path.Join(overlayDirs[0].Source, "bin", "hello")
+	content, err := os.ReadFile(extracted)
+	assert.NoError(err)
+	assert.Equal("hello", string(content))
+
+	st, err := os.Stat(extracted)
+	assert.NoError(err)
+	assert.Equal(os.FileMode(0700), st.Mode().Perm())
+
+	// the archive isn't extracted again if it didn't change; mtimes
+	// aren't part of the cache
+	marked := time.Unix(1234567890, 0)
+	assert.NoError(os.Chtimes(extracted, marked, marked))
+	assert.True(build())
+	st, err = os.Stat(extracted)
+	assert.NoError(err)
+	assert.True(marked.Equal(st.ModTime()))
+
+	// but is when it did
+	archiveContent["bin/hello"] = "hello again"
+	defer func() { archiveContent["bin/hello"] = "hello" }()
+	writeArchive(t, archive)
+	assert.False(build())
+	content, err = os.ReadFile(extracted)
+	assert.NoError(err)
+	assert.Equal("hello again", string(content))
+}
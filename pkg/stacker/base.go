@@ -1,15 +1,13 @@
 package stacker
 
 import (
-	"fmt"
-	"io"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
 
-	"github.com/klauspost/pgzip"
 	"github.com/opencontainers/umoci"
 	"github.com/opencontainers/umoci/oci/casext"
-	"github.com/opencontainers/umoci/oci/layer"
 	"github.com/pkg/errors"
 	"stackerbuild.io/stacker/pkg/lib"
 	"stackerbuild.io/stacker/pkg/log"
@@ -40,7 +38,13 @@ func GetBase(o BaseLayerOpts) error {
 			return err
 		}
 
-		_, _, err := acquireUrl(o.Config, o.Storage, o.Layer.From.Url, cacheDir, "", "", nil, -1, -1, o.Progress)
+		// tar bases with the same name go to the same place
+		defer fetchLocks.lock(cacheDir)()
+		imp := types.Import{Path: o.Layer.From.Url, Uid: lib.UidEmpty, Gid: lib.GidEmpty}
+		_, _, err := acquireUrl(o.Config, o.Storage, imp, cacheDir, o.Progress)
+		return err
+	case types.GitLayer:
+		_, _, err := gitCheckout(o.Config, o.Layer.From.Url, o.Layer.From.Ref, o.Layer.From.Submodules)
 		return err
 	/* now we can do all the containers/image types */
 	case types.OCILayer:
@@ -84,6 +88,12 @@ func SetupRootfs(o BaseLayerOpts) error {
 			return err
 		}
 		return setupTarRootfs(o)
+	case types.GitLayer:
+		err := o.Storage.SetupEmptyRootfs(o.Name)
+		if err != nil {
+			return err
+		}
+		return setupGitRootfs(o)
 	case types.OCILayer:
 		fallthrough
 	case types.DockerLayer:
@@ -98,13 +108,23 @@ func SetupRootfs(o BaseLayerOpts) error {
 }
 
 func importContainersImage(layer types.Layer, config types.StackerConfig, progress bool) error {
-	is := layer.From
-	toImport, err := is.ContainersImageURL()
+	tag, err := layer.From.ParseTag()
 	if err != nil {
 		return err
 	}
 
-	tag, err := is.ParseTag()
+	if config.Offline {
+		return importFetchedImage(layer, config, tag)
+	}
+
+	return importContainersImageAs(layer, config, tag, progress)
+}
+
+// importContainersImageAs imports the base image of layer into the
+// layer-bases cache as tag.
+func importContainersImageAs(layer types.Layer, config types.StackerConfig, tag string, progress bool) error {
+	is := layer.From
+	toImport, err := is.ContainersImageURL()
 	if err != nil {
 		return err
 	}
@@ -126,11 +146,6 @@ func importContainersImage(layer types.Layer, config types.StackerConfig, progre
 		defer oci.Close()
 	}()
 
-	var progressWriter io.Writer
-	if progress {
-		progressWriter = os.Stderr
-	}
-
 	os := ""
 	if layer.OS != nil {
 		os = *layer.OS
@@ -140,15 +155,19 @@ func importContainersImage(layer types.Layer, config types.StackerConfig, progre
 		arch = *layer.Arch
 	}
 
-	log.Infof("loading %s", toImport)
-	err = lib.ImageCopy(lib.ImageCopyOpts{
+	copyOpts, err := withRegistries(config, lib.ImageCopyOpts{
 		Src:          toImport,
-		Dest:         fmt.Sprintf("oci:%s:%s", cacheDir, tag),
 		SrcSkipTLS:   is.Insecure,
-		Progress:     progressWriter,
 		OverrideOS:   os,
 		OverrideArch: arch,
 	})
+	if err != nil {
+		return err
+	}
+	copyOpts = withCopyProgress(copyOpts, toImport, fetchProgress(config, progress))
+
+	log.Infof("loading %s", toImport)
+	err = copyToLayerBases(config, copyOpts, tag)
 	if err != nil {
 		return errors.Wrapf(err, "couldn't import base layer %s", tag)
 	}
@@ -177,23 +196,33 @@ func setupTarRootfs(o BaseLayerOpts) error {
 	return unpackTar(layerPath, tar)
 }
 
-func unpackTar(destDir string, tar string) error {
-	tarReader, err := os.Open(tar)
+// setupGitRootfs copies the checkout GetBase made, or the directory in it
+// From.Path names, to the rootfs, or extracts From.Path if it's a tarball.
+func setupGitRootfs(o BaseLayerOpts) error {
+	from := o.Layer.From
+	checkout, commit, err := fetchedGitCheckout(o.Config, from.Url, from.Ref, from.Submodules)
 	if err != nil {
-		return errors.Wrapf(err, "couldn't open %s", tar)
+		return err
 	}
-	defer tarReader.Close()
-	var uncompressed io.ReadCloser
-	uncompressed, err = pgzip.NewReader(tarReader)
+
+	source, err := filepath.EvalSymlinks(filepath.Join(checkout, from.Path))
 	if err != nil {
-		_, err = tarReader.Seek(0, os.SEEK_SET)
-		if err != nil {
-			return errors.Wrapf(err, "failed to 0 seek %s", tar)
-		}
-		uncompressed = tarReader
-	} else {
-		defer uncompressed.Close()
+		return errors.Wrapf(err, "couldn't find %s in %s at %s", from.Path, from.Url, commit)
+	}
+
+	if rel, err := filepath.Rel(checkout, source); err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return errors.Errorf("%s is outside of %s", from.Path, from.Url)
+	}
+
+	st, err := os.Stat(source)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	layerPath := o.Storage.TarExtractLocation(o.Name)
+	if !st.IsDir() {
+		return unpackTar(layerPath, source)
 	}
 
-	return layer.UnpackLayer(destDir, uncompressed, &layer.UnpackOptions{KeepDirlinks: true})
+	return lib.DirCopy(layerPath, source)
 }
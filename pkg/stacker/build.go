@@ -20,6 +20,7 @@ import (
 	"stackerbuild.io/stacker/pkg/container"
 	"stackerbuild.io/stacker/pkg/lib"
 	"stackerbuild.io/stacker/pkg/log"
+	"stackerbuild.io/stacker/pkg/storage"
 	"stackerbuild.io/stacker/pkg/test"
 	"stackerbuild.io/stacker/pkg/types"
 )
@@ -43,6 +44,9 @@ type BuildArgs struct {
 	AnnotationsNamespace string
 	Username             string
 	Password             string
+	RunTimeout           time.Duration
+	KeepFailed           bool
+	Bundle               string
 }
 
 // Builder is responsible for building the layers based on stackerfiles
@@ -298,19 +302,47 @@ func (b *Builder) updateOCIConfigForOutput(sf *types.Stackerfile, s types.Storag
 		Author:     author,
 	}
 
-	err = mutator.Set(context.Background(), imageConfig, meta, annotations, &history)
-	if err != nil {
-		return err
+	// layers built on a squashed layer start from its unsquashed image, so
+	// that gets the same config
+	tags := []string{layerName}
+	if l.Squash {
+		unsquashed := storage.UnsquashedTag(layerName)
+		descPaths, err := oci.ResolveReference(context.Background(), unsquashed)
+		if err != nil {
+			return err
+		}
+		if len(descPaths) > 0 {
+			tags = append(tags, unsquashed)
+		}
 	}
 
-	newPath, err := mutator.Commit(context.Background())
-	if err != nil {
-		return err
-	}
+	for i, tag := range tags {
+		if i > 0 {
+			descPaths, err := oci.ResolveReference(context.Background(), tag)
+			if err != nil {
+				return err
+			}
 
-	err = oci.UpdateReference(context.Background(), layerName, newPath.Root())
-	if err != nil {
-		return err
+			mutator, err = mutate.New(oci, descPaths[0])
+			if err != nil {
+				return errors.Wrapf(err, "mutator failed")
+			}
+		}
+
+		err = mutator.Set(context.Background(), imageConfig, meta, annotations, &history)
+		if err != nil {
+			return err
+		}
+
+		newPath, err := mutator.Commit(context.Background())
+		if err != nil {
+			return err
+		}
+
+		err = oci.UpdateReference(context.Background(), tag, newPath.Root())
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -379,6 +411,11 @@ func (b *Builder) build(s types.Storage, file string) error {
 		return err
 	}
 
+	fetched, err := prefetchLayers(opts, s, sf, order, buildCache, oci)
+	if err != nil {
+		return err
+	}
+
 	for _, name := range order {
 		l, ok := sf.Get(name)
 		if !ok {
@@ -406,13 +443,17 @@ func (b *Builder) build(s types.Storage, file string) error {
 		// against imports for caching layers. Since we don't do
 		// network copies if the files are present and we use rsync to
 		// copy things across, hopefully this isn't too expensive.
-		err = CleanImportsDir(opts.Config, name, l.Imports, buildCache)
-		if err != nil {
-			return err
-		}
+		if overlayDirs, ok := fetched.overlayDirs[name]; ok {
+			l.OverlayDirs = overlayDirs
+		} else {
+			err = CleanImportsDir(opts.Config, name, l.Imports, buildCache)
+			if err != nil {
+				return err
+			}
 
-		if err := Import(opts.Config, s, name, l.Imports, &l.OverlayDirs, opts.Progress); err != nil {
-			return err
+			if err := Import(opts.Config, s, name, l.Imports, &l.OverlayDirs, opts.Progress); err != nil {
+				return err
+			}
 		}
 
 		log.Debugf("overlay-dirs, possibly modified after import: %v", l.OverlayDirs)
@@ -432,8 +473,10 @@ func (b *Builder) build(s types.Storage, file string) error {
 			Progress:   opts.Progress,
 		}
 
-		if err := GetBase(baseOpts); err != nil {
-			return err
+		if !fetched.bases[name] {
+			if err := GetBase(baseOpts); err != nil {
+				return err
+			}
 		}
 
 		cacheEntry, cacheHit, err := buildCache.Lookup(name)
@@ -460,6 +503,17 @@ func (b *Builder) build(s types.Storage, file string) error {
 						if err != nil {
 							return err
 						}
+
+						// layers built on a squashed one use its
+						// unsquashed image
+						if unsquashed, ok := cacheEntry.Unsquashed[layerType]; ok {
+							err = oci.UpdateReference(context.Background(), storage.UnsquashedTag(layerName), unsquashed)
+						} else {
+							err = storage.DropUnsquashed(oci, layerName)
+						}
+						if err != nil {
+							return err
+						}
 						log.Infof("found cached layer %s", layerName)
 					}
 				}
@@ -518,8 +572,18 @@ func (b *Builder) build(s types.Storage, file string) error {
 				return err
 			}
 
+			timeout, err := l.RunTimeout()
+			if err != nil {
+				return err
+			}
+			if timeout == 0 {
+				timeout = opts.RunTimeout
+			}
+			c.SetTimeout(timeout)
+
 			// These should all be non-interactive; let's ensure that.
 			err = c.Execute([]string{filepath.Join(inDir, "imports", ".stacker-run.sh")}, nil)
+			c.SetTimeout(0)
 			if err != nil {
 				if opts.OnRunFailure != "" {
 					err2 := c.Execute([]string{opts.OnRunFailure}, os.Stdin)
@@ -527,10 +591,20 @@ func (b *Builder) build(s types.Storage, file string) error {
 						log.Infof("failed executing %s: %s\n", opts.OnRunFailure, err2)
 					}
 				}
+				if opts.KeepFailed {
+					if err2 := keepFailedLayer(opts.Config, s, c, sf, l, name); err2 != nil {
+						log.Infof("failed to keep failed layer %s: %s", name, err2)
+					}
+				}
 				return errors.Errorf("run commands failed for image %q in %q: %s", name, sf.FilePath(), err)
 			}
 		}
 
+		// what was kept of an earlier failure is stale now
+		if err := DeleteFailedLayer(opts.Config, s, name); err != nil {
+			return err
+		}
+
 		// This is a build only layer, meaning we don't need to include
 		// it in the final image, as outputs from it are going to be
 		// imported into future images. Let's just snapshot it and add
@@ -542,8 +616,14 @@ func (b *Builder) build(s types.Storage, file string) error {
 			// of the name, so we can make sure it exists when
 			// there is a cache hit. We should probably make this
 			// into some sort of proper Either type.
+			if l.Test != nil {
+				if err := runLayerTests(opts.Config, s, *l.Test, name, ispec.ImageConfig{}); err != nil {
+					return err
+				}
+			}
+
 			manifests := map[types.LayerType]ispec.Descriptor{opts.LayerTypes[0]: ispec.Descriptor{}}
-			if err := buildCache.Put(name, manifests); err != nil {
+			if err := buildCache.Put(name, manifests, nil); err != nil {
 				return err
 			}
 			continue
@@ -555,6 +635,7 @@ func (b *Builder) build(s types.Storage, file string) error {
 		}
 
 		manifests := map[types.LayerType]ispec.Descriptor{}
+		var unsquashed map[types.LayerType]ispec.Descriptor
 		for _, layerType := range opts.LayerTypes {
 			err = b.updateOCIConfigForOutput(sf, s, oci, layerType, l, name)
 			if err != nil {
@@ -568,9 +649,46 @@ func (b *Builder) build(s types.Storage, file string) error {
 
 			manifests[layerType] = descPaths[0].Descriptor()
 
+			if l.Squash {
+				descPaths, err = oci.ResolveReference(context.Background(), storage.UnsquashedTag(layerType.LayerName(name)))
+				if err != nil {
+					return err
+				}
+
+				if len(descPaths) > 0 {
+					if unsquashed == nil {
+						unsquashed = map[types.LayerType]ispec.Descriptor{}
+					}
+					unsquashed[layerType] = descPaths[0].Descriptor()
+				}
+			}
 		}
 
-		if err := buildCache.Put(name, manifests); err != nil {
+		// the tests see the image as it was output, so that its
+		// config can be checked too; a failure isn't cached, so the
+		// layer is rebuilt and tested again
+		if l.Test != nil {
+			imageConfig, err := outputImageConfig(oci, opts.LayerTypes[0].LayerName(name))
+			if err != nil {
+				return err
+			}
+
+			if err := runLayerTests(opts.Config, s, *l.Test, name, imageConfig); err != nil {
+				// an image that fails its tests mustn't be
+				// published
+				for _, layerType := range opts.LayerTypes {
+					layerName := layerType.LayerName(name)
+					for _, tag := range []string{layerName, storage.UnsquashedTag(layerName)} {
+						if err2 := oci.DeleteReference(context.Background(), tag); err2 != nil {
+							log.Infof("failed to remove %s: %s", tag, err2)
+						}
+					}
+				}
+				return err
+			}
+		}
+
+		if err := buildCache.Put(name, manifests, unsquashed); err != nil {
 			return err
 		}
 
@@ -597,6 +715,18 @@ func (b *Builder) BuildMultiple(paths []string) error {
 		return err
 	}
 
+	if opts.Bundle != "" {
+		if err := ExtractBundle(opts.Config, opts.Bundle); err != nil {
+			return err
+		}
+	}
+
+	if opts.Config.Offline {
+		if err := CheckOffline(opts.Config, stackerFiles); err != nil {
+			return err
+		}
+	}
+
 	// Initialize the DAG
 	dag, err := NewStackerFilesDAG(stackerFiles)
 	if err != nil {
@@ -633,6 +763,52 @@ func (b *Builder) BuildMultiple(paths []string) error {
 	return nil
 }
 
+// outputImageConfig returns the config of the image tag in oci.
+func outputImageConfig(oci casext.Engine, tag string) (ispec.ImageConfig, error) {
+	descPaths, err := oci.ResolveReference(context.Background(), tag)
+	if err != nil {
+		return ispec.ImageConfig{}, err
+	}
+
+	if len(descPaths) == 0 {
+		return ispec.ImageConfig{}, errors.Errorf("tag %s not found", tag)
+	}
+
+	mutator, err := mutate.New(oci, descPaths[0])
+	if err != nil {
+		return ispec.ImageConfig{}, errors.Wrapf(err, "mutator failed")
+	}
+
+	config, err := mutator.Config(context.Background())
+	if err != nil {
+		return ispec.ImageConfig{}, err
+	}
+
+	return config.Config, nil
+}
+
+// runLayerTests runs a layer's image tests, and fails if any of them fail.
+func runLayerTests(config types.StackerConfig, s types.Storage, test types.ImageTest, name string, imageConfig ispec.ImageConfig) error {
+	log.Infof("running tests for %s", name)
+	suite, err := RunImageTests(ImageTestOpts{
+		Config:      config,
+		Storage:     s,
+		Name:        name,
+		Test:        test,
+		ImageConfig: imageConfig,
+	})
+	if err != nil {
+		return err
+	}
+
+	LogTestSuite(suite)
+	if failed := suite.Failed(); failed > 0 {
+		return errors.Errorf("%d of %d tests failed for %s", failed, len(suite.Results), name)
+	}
+
+	return nil
+}
+
 // generateShellForRunning generates a shell script to run inside the
 // container, and writes it to the contianer. It checks that the script already
 // have a shebang? If so, it leaves it as is, otherwise it prepends a shebang.
@@ -692,6 +868,12 @@ func SetupBuildContainerConfig(config types.StackerConfig, storage types.Storage
 		"lxc.apparmor.allow_incomplete": "1",
 	}
 
+	// without a network namespace, the container has the host's network;
+	// an empty one only has loopback
+	if config.Offline {
+		configs["lxc.net.0.type"] = "empty"
+	}
+
 	if err := c.SetConfigs(configs); err != nil {
 		return err
 	}
@@ -802,6 +984,23 @@ func SetupLayerConfig(config types.StackerConfig, c *container.Container, l type
 		}
 	}
 
+	if l.Limits != nil {
+		limits, err := l.Limits.LXCConfig()
+		if err != nil {
+			return err
+		}
+
+		if err := c.SetConfigs(limits); err != nil {
+			return err
+		}
+	}
+
+	if security := config.Security.Merge(l.Security); security != nil {
+		if err := setupSecurityConfig(config, c, *security); err != nil {
+			return err
+		}
+	}
+
 	for _, bind := range l.Binds {
 		log.Debugf("bind mounting %q into container at %q", bind.Source, bind.Dest)
 		err = c.BindMount(bind.Source, bind.Dest, "")
@@ -812,3 +1011,48 @@ func SetupLayerConfig(config types.StackerConfig, c *container.Container, l type
 
 	return err
 }
+
+// CheckSecurity checks that the security settings can be applied on this
+// host: that they are valid, the seccomp profile is usable, and the AppArmor
+// profile is loaded.
+func CheckSecurity(config types.StackerConfig, security types.Security) error {
+	if err := security.Validate(); err != nil {
+		return err
+	}
+
+	if err := security.CheckSeccompProfile(); err != nil {
+		return err
+	}
+
+	// unlike the default profile, we don't fall back to unconfined if an
+	// explicitly requested profile is missing.
+	if security.AppArmor != "" && security.AppArmor != "unconfined" {
+		err := runInternalGoSubcommand(config, []string{"check-aa-profile", security.AppArmor})
+		if err != nil {
+			return errors.Errorf("security: AppArmor profile %s is not available", security.AppArmor)
+		}
+	}
+
+	return nil
+}
+
+func setupSecurityConfig(config types.StackerConfig, c *container.Container, security types.Security) error {
+	if err := CheckSecurity(config, security); err != nil {
+		return err
+	}
+
+	configs, err := security.LXCConfig()
+	if err != nil {
+		return err
+	}
+
+	if err := c.SetConfigs(configs); err != nil {
+		return err
+	}
+
+	if security.AppArmor != "" {
+		return c.SetConfig("lxc.apparmor.profile", security.AppArmor)
+	}
+
+	return nil
+}
@@ -0,0 +1,267 @@
+package stacker
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/pkg/errors"
+	"stackerbuild.io/stacker/pkg/lib"
+	"stackerbuild.io/stacker/pkg/log"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+// the parts of the stacker dir that 'stacker fetch' fills in
+var bundleDirs = []string{"layer-bases/oci", "imports/.fetched", "git"}
+
+// Bundle writes everything 'stacker fetch' downloaded to a tarball, to be
+// used by 'stacker build --offline --bundle' on another machine.
+func Bundle(config types.StackerConfig, file string) error {
+	out, err := os.Create(file)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't create bundle")
+	}
+	defer out.Close()
+
+	tw := tar.NewWriter(out)
+	for _, dir := range bundleDirs {
+		root := path.Join(config.StackerDir, dir)
+		if !lib.PathExists(root) {
+			continue
+		}
+
+		err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			// git checkouts can have symlinks in them
+			link := ""
+			if d.Type()&fs.ModeSymlink != 0 {
+				link, err = os.Readlink(p)
+				if err != nil {
+					return err
+				}
+			} else if !d.IsDir() && !d.Type().IsRegular() {
+				return nil
+			}
+
+			rel, err := filepath.Rel(config.StackerDir, p)
+			if err != nil {
+				return err
+			}
+
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+
+			hdr, err := tar.FileInfoHeader(fi, link)
+			if err != nil {
+				return err
+			}
+			hdr.Name = rel
+			hdr.Uid, hdr.Gid = 0, 0
+			hdr.Uname, hdr.Gname = "", ""
+			if d.IsDir() {
+				hdr.Name += "/"
+			}
+
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+
+			if d.IsDir() || link != "" {
+				return nil
+			}
+
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			_, err = io.Copy(tw, f)
+			return err
+		})
+		if err != nil {
+			return errors.Wrapf(err, "couldn't bundle %s", dir)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return errors.WithStack(out.Close())
+}
+
+// bundlePath checks that name is somewhere a bundle is allowed to write to,
+// and returns it cleaned.
+func bundlePath(name string) (string, error) {
+	cleaned := path.Clean(name)
+	if path.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", errors.Errorf("bad path in bundle: %s", name)
+	}
+
+	for _, dir := range bundleDirs {
+		if cleaned == dir || strings.HasPrefix(cleaned, dir+"/") {
+			return cleaned, nil
+		}
+	}
+
+	return "", errors.Errorf("unexpected path in bundle: %s", name)
+}
+
+// mergeIndex adds the manifests in the bundle's index to the layer-bases
+// cache's; the bundle's replace any with the same name.
+func mergeIndex(indexPath string, bundled ispec.Index) error {
+	content, err := os.ReadFile(indexPath)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	index := ispec.Index{}
+	if err := json.Unmarshal(content, &index); err != nil {
+		return errors.Wrapf(err, "couldn't parse %s", indexPath)
+	}
+
+	replaced := map[string]bool{}
+	for _, desc := range bundled.Manifests {
+		replaced[desc.Annotations[ispec.AnnotationRefName]] = true
+	}
+
+	manifests := []ispec.Descriptor{}
+	for _, desc := range index.Manifests {
+		name := desc.Annotations[ispec.AnnotationRefName]
+		if name != "" && replaced[name] {
+			continue
+		}
+		manifests = append(manifests, desc)
+	}
+	index.Manifests = append(manifests, bundled.Manifests...)
+
+	content, err = json.Marshal(index)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return errors.WithStack(os.WriteFile(indexPath, content, 0644))
+}
+
+// ExtractBundle adds the contents of a bundle made by Bundle to the stacker
+// dir.
+func ExtractBundle(config types.StackerConfig, file string) error {
+	in, err := os.Open(file)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't open bundle")
+	}
+	defer in.Close()
+
+	ociDir := path.Join(config.StackerDir, "layer-bases", "oci")
+	if !lib.PathExists(ociDir) {
+		oci, err := umoci.CreateLayout(ociDir)
+		if err != nil {
+			return err
+		}
+		oci.Close()
+	}
+
+	log.Infof("loading bundle %s", file)
+
+	var bundled *ispec.Index
+	tr := tar.NewReader(in)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errors.Wrapf(err, "couldn't read bundle")
+		}
+
+		name, err := bundlePath(hdr.Name)
+		if err != nil {
+			return err
+		}
+		dest := path.Join(config.StackerDir, name)
+
+		if err := checkNoSymlinkParents(config.StackerDir, name); err != nil {
+			return err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(dest, 0755); err != nil {
+				return errors.WithStack(err)
+			}
+			continue
+		case tar.TypeSymlink:
+			if !strings.HasPrefix(name, "git/") {
+				return errors.Errorf("unexpected symlink in bundle: %s", hdr.Name)
+			}
+
+			if err := os.MkdirAll(path.Dir(dest), 0755); err != nil {
+				return errors.WithStack(err)
+			}
+
+			if err := os.RemoveAll(dest); err != nil {
+				return errors.WithStack(err)
+			}
+
+			if err := os.Symlink(hdr.Linkname, dest); err != nil {
+				return errors.WithStack(err)
+			}
+			continue
+		case tar.TypeReg:
+		default:
+			return errors.Errorf("unexpected file type in bundle: %s", hdr.Name)
+		}
+
+		if name == path.Join("layer-bases", "oci", "index.json") {
+			bundled = &ispec.Index{}
+			if err := json.NewDecoder(tr).Decode(bundled); err != nil {
+				return errors.Wrapf(err, "couldn't parse bundled index")
+			}
+			continue
+		}
+
+		// blobs are content addressed, so existing ones are the same
+		if lib.PathExists(dest) && strings.HasPrefix(name, path.Join("layer-bases", "oci", "blobs")+"/") {
+			continue
+		}
+
+		if err := os.MkdirAll(path.Dir(dest), 0755); err != nil {
+			return errors.WithStack(err)
+		}
+
+		tmp := dest + ".partial"
+		out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, hdr.FileInfo().Mode().Perm())
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		_, err = io.Copy(out, tr)
+		out.Close()
+		if err != nil {
+			os.Remove(tmp)
+			return errors.Wrapf(err, "couldn't extract %s", name)
+		}
+
+		if err := os.Rename(tmp, dest); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	if bundled == nil {
+		return nil
+	}
+
+	return mergeIndex(path.Join(ociDir, "index.json"), *bundled)
+}
@@ -0,0 +1,130 @@
+package stacker
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/stretchr/testify/assert"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+func readIndex(t *testing.T, dir string) ispec.Index {
+	content, err := os.ReadFile(path.Join(dir, "layer-bases", "oci", "index.json"))
+	assert.NoError(t, err)
+
+	index := ispec.Index{}
+	assert.NoError(t, json.Unmarshal(content, &index))
+	return index
+}
+
+func writeIndex(t *testing.T, dir string, refs map[string]string) {
+	ociDir := path.Join(dir, "layer-bases", "oci")
+	oci, err := umoci.CreateLayout(ociDir)
+	assert.NoError(t, err)
+	oci.Close()
+
+	index := ispec.Index{}
+	index.SchemaVersion = 2
+	for ref, hex := range refs {
+		index.Manifests = append(index.Manifests, ispec.Descriptor{
+			MediaType:   ispec.MediaTypeImageManifest,
+			Digest:      digest.NewDigestFromEncoded(digest.SHA256, hex),
+			Annotations: map[string]string{ispec.AnnotationRefName: ref},
+		})
+	}
+
+	content, err := json.Marshal(index)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(path.Join(ociDir, "index.json"), content, 0644))
+}
+
+func TestBundle(t *testing.T) {
+	assert := assert.New(t)
+
+	from := types.StackerConfig{StackerDir: t.TempDir()}
+	writeIndex(t, from.StackerDir, map[string]string{"fetched-a": "aaaa", "fetched-b": "bbbb"})
+	download := fetchedPath(from, "https://example.com/files/foo.tar.gz")
+	assert.NoError(os.MkdirAll(path.Dir(download), 0755))
+	assert.NoError(os.WriteFile(download, []byte("foo"), 0644))
+	checkout := path.Join(from.StackerDir, "git", "checkouts", "abcd", "repo")
+	assert.NoError(os.MkdirAll(checkout, 0755))
+	assert.NoError(os.WriteFile(path.Join(checkout, "run.sh"), []byte("true"), 0755))
+	assert.NoError(os.Symlink("run.sh", path.Join(checkout, "link")))
+
+	bundle := path.Join(t.TempDir(), "bundle.tar")
+	assert.NoError(Bundle(from, bundle))
+
+	// the bundle is merged into what's already there
+	to := types.StackerConfig{StackerDir: t.TempDir()}
+	writeIndex(t, to.StackerDir, map[string]string{"fetched-a": "0000", "busybox": "cccc"})
+	assert.NoError(ExtractBundle(to, bundle))
+
+	refs := map[string]string{}
+	for _, desc := range readIndex(t, to.StackerDir).Manifests {
+		refs[desc.Annotations[ispec.AnnotationRefName]] = desc.Digest.Encoded()
+	}
+	assert.Equal(map[string]string{"fetched-a": "aaaa", "fetched-b": "bbbb", "busybox": "cccc"}, refs)
+
+	content, err := os.ReadFile(fetchedPath(to, "https://example.com/files/foo.tar.gz"))
+	assert.NoError(err)
+	assert.Equal("foo", string(content))
+
+	// git checkouts keep their symlinks and modes
+	checkout = path.Join(to.StackerDir, "git", "checkouts", "abcd", "repo")
+	link, err := os.Readlink(path.Join(checkout, "link"))
+	assert.NoError(err)
+	assert.Equal("run.sh", link)
+	st, err := os.Stat(path.Join(checkout, "run.sh"))
+	assert.NoError(err)
+	assert.Equal(os.FileMode(0755), st.Mode().Perm())
+
+	// and into an empty stacker dir
+	empty := types.StackerConfig{StackerDir: t.TempDir()}
+	assert.NoError(ExtractBundle(empty, bundle))
+	assert.Len(readIndex(t, empty.StackerDir).Manifests, 2)
+}
+
+func TestExtractBundleSymlinks(t *testing.T) {
+	assert := assert.New(t)
+
+	bundle := path.Join(t.TempDir(), "bundle.tar")
+	f, err := os.Create(bundle)
+	assert.NoError(err)
+
+	outside := t.TempDir()
+	tw := tar.NewWriter(f)
+	assert.NoError(tw.WriteHeader(&tar.Header{Name: "git/checkouts/abcd", Typeflag: tar.TypeSymlink, Linkname: outside}))
+	assert.NoError(tw.WriteHeader(&tar.Header{Name: "git/checkouts/abcd/evil", Typeflag: tar.TypeReg, Mode: 0644, Size: 4}))
+	_, err = tw.Write([]byte("evil"))
+	assert.NoError(err)
+	assert.NoError(tw.Close())
+	f.Close()
+
+	config := types.StackerConfig{StackerDir: t.TempDir()}
+	assert.Error(ExtractBundle(config, bundle))
+	assert.NoFileExists(path.Join(outside, "evil"))
+}
+
+func TestExtractBundleBadPaths(t *testing.T) {
+	for _, name := range []string{"../evil", "/etc/passwd", "layer-bases/oci/../../../evil", "roots/evil"} {
+		bundle := path.Join(t.TempDir(), "bundle.tar")
+		f, err := os.Create(bundle)
+		assert.NoError(t, err)
+
+		tw := tar.NewWriter(f)
+		assert.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: 4}))
+		_, err = tw.Write([]byte("evil"))
+		assert.NoError(t, err)
+		assert.NoError(t, tw.Close())
+		f.Close()
+
+		config := types.StackerConfig{StackerDir: t.TempDir()}
+		assert.Error(t, ExtractBundle(config, bundle), name)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"io"
 	"os"
 	"path"
+	"path/filepath"
 	"reflect"
 	"time"
 
@@ -23,7 +24,7 @@ import (
 	"stackerbuild.io/stacker/pkg/types"
 )
 
-const currentCacheVersion = 16
+const currentCacheVersion = 26
 
 type ImportType int
 
@@ -42,6 +43,10 @@ type ImportHash struct {
 	// directory. This indicates which.
 	Type ImportType
 	Hash string
+
+	// Dest is the import's dest, if it has one. Those imports are
+	// copied to their own directory, which is what's hashed.
+	Dest string `json:"dest,omitempty"`
 }
 
 type OverlayDirHash struct {
@@ -52,13 +57,18 @@ type CacheEntry struct {
 	// A map of LayerType:Manifest this build corresponds to.
 	Manifests map[types.LayerType]ispec.Descriptor
 
-	// A map of the import url to the base64 encoded result of mtree walk
-	// or sha256 sum of a file, depending on what Type is.
+	// A map of the import url (and dest, if it has one) to the base64
+	// encoded result of mtree walk or sha256 sum of a file, depending on
+	// what Type is.
 	Imports map[string]ImportHash
 
 	// A map of the overlay_dir url to the base64 encoded result of mtree walk
 	OverlayDirs map[string]OverlayDirHash
 
+	// A map of LayerType:Manifest of the unsquashed image of a squashed
+	// layer, which the output keeps along with the squashed one.
+	Unsquashed map[types.LayerType]ispec.Descriptor `json:"unsquashed,omitempty"`
+
 	// The name of this layer as it was built. Useful for the BuildOnly
 	// case to make sure it still exists, and for printing error messages.
 	Name string
@@ -76,6 +86,10 @@ type CacheEntry struct {
 	// was in effect when this layer was built. A change in this value
 	// causes a cache miss because it affects image timestamps and author.
 	SourceDateEpoch *int64 `json:"source_date_epoch,omitempty"`
+
+	// Security is the layer's security settings merged with the defaults
+	// in the stacker config file, which the layer was built under.
+	Security *types.Security `json:"security,omitempty"`
 }
 
 type BuildCache struct {
@@ -175,8 +189,87 @@ func OpenCache(config types.StackerConfig, oci casext.Engine, sfm types.StackerF
 /* Explicitly don't use mtime */
 var mtreeKeywords = []mtree.Keyword{"type", "link", "uid", "gid", "xattr", "mode", "sha256digest"}
 
-func walkImport(path string) (*mtree.DirectoryHierarchy, error) {
-	return mtree.Walk(path, nil, mtreeKeywords, nil)
+// importFilter leaves what an import's include, exclude and .stackerignore
+// don't want out of walks of the import.
+type importFilter struct {
+	include   lib.PathMatcher
+	exclude   lib.PathMatcher
+	ignore    lib.PathMatcher
+	ignoreDir string
+}
+
+func newImportFilter(imp types.Import) (*importFilter, error) {
+	if len(imp.Include) == 0 && len(imp.Exclude) == 0 && imp.StackerIgnore == nil {
+		return nil, nil
+	}
+
+	var err error
+	f := &importFilter{}
+	f.include, err = lib.NewPathMatcher(imp.Include)
+	if err != nil {
+		return nil, err
+	}
+
+	f.exclude, err = lib.NewPathMatcher(imp.Exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	if imp.StackerIgnore != nil {
+		f.ignore, err = lib.NewPathMatcher(imp.StackerIgnore.Patterns)
+		if err != nil {
+			return nil, err
+		}
+		f.ignoreDir = imp.StackerIgnore.Dir
+	}
+
+	return f, nil
+}
+
+// skip is whether rel, relative to the root of the import, is left out.
+func (f *importFilter) skip(rel string, isDir bool) bool {
+	if f.ignore.MatchIn(f.ignoreDir, rel, isDir) || f.exclude.Match(rel, isDir) {
+		return true
+	}
+
+	// directories are kept, so that the files in them can be included
+	return len(f.include) > 0 && !isDir && !f.include.Match(rel, isDir)
+}
+
+// filteredFsEval hides what an importFilter leaves out from mtree walks, so
+// that they don't descend into skipped directories.
+type filteredFsEval struct {
+	mtree.DefaultFsEval
+	root   string
+	filter *importFilter
+}
+
+func (fs filteredFsEval) Readdir(dir string) ([]os.FileInfo, error) {
+	infos, err := fs.DefaultFsEval.Readdir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	rel, err := filepath.Rel(fs.root, dir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	kept := []os.FileInfo{}
+	for _, info := range infos {
+		if !fs.filter.skip(filepath.ToSlash(filepath.Join(rel, info.Name())), info.IsDir()) {
+			kept = append(kept, info)
+		}
+	}
+	return kept, nil
+}
+
+func walkImport(path string, filter *importFilter) (*mtree.DirectoryHierarchy, error) {
+	var fsEval mtree.FsEval
+	if filter != nil {
+		fsEval = filteredFsEval{root: path, filter: filter}
+	}
+	return mtree.Walk(path, nil, mtreeKeywords, fsEval)
 }
 
 func (c *BuildCache) Lookup(name string) (*CacheEntry, bool, error) {
@@ -219,21 +312,19 @@ func (c *BuildCache) Lookup(name string) (*CacheEntry, bool, error) {
 		return nil, false, nil
 	}
 
-	for _, imp := range l.Imports {
-		if imp.Dest != "" {
-			// ignore imports which are copied
-			continue
-		}
+	if !reflect.DeepEqual(c.config.Security.Merge(l.Security), result.Security) {
+		log.Infof("cache miss because the security settings changed")
+		return nil, false, nil
+	}
 
-		cachedImport, ok := result.Imports[imp.Path]
+	for _, imp := range l.Imports {
+		cachedImport, ok := result.Imports[importCacheKey(imp)]
 		if !ok {
 			log.Infof("cache miss because of new import: %s", imp.Path)
 			return nil, false, nil
 		}
 
-		fname := path.Base(imp.Path)
-		importsDir := path.Join(c.config.StackerDir, "imports")
-		diskPath := path.Join(importsDir, name, fname)
+		diskPath := importDiskPath(c.config, name, imp)
 		st, err := os.Stat(diskPath)
 		if err != nil {
 			if os.IsNotExist(err) {
@@ -249,7 +340,12 @@ func (c *BuildCache) Lookup(name string) (*CacheEntry, bool, error) {
 		}
 
 		if st.IsDir() {
-			dirChanged, err := isCachedDirChanged(diskPath, cachedImport.Hash)
+			filter, err := importDiskFilter(imp)
+			if err != nil {
+				return nil, false, err
+			}
+
+			dirChanged, err := isCachedDirChanged(diskPath, cachedImport.Hash, filter)
 			if err != nil {
 				return nil, false, err
 			}
@@ -286,7 +382,7 @@ func (c *BuildCache) Lookup(name string) (*CacheEntry, bool, error) {
 			}
 			return nil, false, err
 		}
-		dirChanged, err := isCachedDirChanged(overlayDir.Source, cachedOverlayDir.Hash)
+		dirChanged, err := isCachedDirChanged(overlayDir.Source, cachedOverlayDir.Hash, nil)
 		if err != nil {
 			return nil, false, err
 		}
@@ -318,7 +414,7 @@ func (c *BuildCache) Lookup(name string) (*CacheEntry, bool, error) {
 	return &result, true, nil
 }
 
-func isCachedDirChanged(dirPath string, cachedDirHash string) (bool, error) {
+func isCachedDirChanged(dirPath string, cachedDirHash string, filter *importFilter) (bool, error) {
 	rawCachedImport, err := base64.StdEncoding.DecodeString(cachedDirHash)
 	if err != nil {
 		return true, err
@@ -329,7 +425,7 @@ func isCachedDirChanged(dirPath string, cachedDirHash string) (bool, error) {
 		return true, err
 	}
 
-	dh, err := walkImport(dirPath)
+	dh, err := walkImport(dirPath, filter)
 	if err != nil {
 		return true, err
 	}
@@ -357,7 +453,7 @@ func cachedFileDiff(dirPath string, cachedDirHash string) ([]string, error) {
 		return nil, err
 	}
 
-	dh, err := walkImport(dirPath)
+	dh, err := walkImport(dirPath, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -380,8 +476,8 @@ func cachedFileDiff(dirPath string, cachedDirHash string) ([]string, error) {
 	return changedFiles, nil
 }
 
-func getEncodedMtree(path string) (string, error) {
-	dh, err := walkImport(path)
+func getEncodedMtree(path string, filter *importFilter) (string, error) {
+	dh, err := walkImport(path, filter)
 	if err != nil {
 		return "", err
 	}
@@ -428,6 +524,10 @@ func (c *BuildCache) getBaseHash(name string) (string, error) {
 		cacheDir := path.Join(c.config.StackerDir, "layer-bases")
 		tar := path.Join(cacheDir, path.Base(l.From.Url))
 		return lib.HashFile(tar, true)
+	case types.GitLayer:
+		// the commit the base was checked out at
+		_, commit, err := fetchedGitCheckout(c.config, l.From.Url, l.From.Ref, l.From.Submodules)
+		return commit, err
 	case types.OCILayer:
 		fallthrough
 	case types.DockerLayer:
@@ -458,7 +558,7 @@ func (c *BuildCache) getBaseHash(name string) (string, error) {
 	}
 }
 
-func (c *BuildCache) Put(name string, manifests map[types.LayerType]ispec.Descriptor) error {
+func (c *BuildCache) Put(name string, manifests map[types.LayerType]ispec.Descriptor, unsquashed map[types.LayerType]ispec.Descriptor) error {
 	l, ok := c.sfm.LookupLayerDefinition(name)
 	if !ok {
 		return errors.Errorf("%s missing from stackerfile?", name)
@@ -471,32 +571,32 @@ func (c *BuildCache) Put(name string, manifests map[types.LayerType]ispec.Descri
 
 	ent := CacheEntry{
 		Manifests:       manifests,
+		Unsquashed:      unsquashed,
 		Imports:         map[string]ImportHash{},
 		OverlayDirs:     map[string]OverlayDirHash{},
 		Name:            name,
 		Layer:           l,
 		Base:            baseHash,
 		SourceDateEpoch: sourceDateEpochToInt64(c.config.SourceDateEpoch),
+		Security:        c.config.Security.Merge(l.Security),
 	}
 
 	for _, imp := range l.Imports {
-		if imp.Dest != "" {
-			// ignore imports which are copied
-			continue
-		}
-
-		fname := path.Base(imp.Path)
-		importsDir := path.Join(c.config.StackerDir, "imports")
-		diskPath := path.Join(importsDir, name, fname)
+		diskPath := importDiskPath(c.config, name, imp)
 		st, err := os.Stat(diskPath)
 		if err != nil {
 			return err
 		}
 
-		ih := ImportHash{}
+		ih := ImportHash{Dest: imp.Dest}
 		if st.IsDir() {
 			ih.Type = ImportDir
-			ih.Hash, err = getEncodedMtree(diskPath)
+			filter, err := importDiskFilter(imp)
+			if err != nil {
+				return err
+			}
+
+			ih.Hash, err = getEncodedMtree(diskPath, filter)
 			if err != nil {
 				return err
 			}
@@ -508,12 +608,12 @@ func (c *BuildCache) Put(name string, manifests map[types.LayerType]ispec.Descri
 			}
 		}
 
-		ent.Imports[imp.Path] = ih
+		ent.Imports[importCacheKey(imp)] = ih
 	}
 
 	for _, overlayDir := range l.OverlayDirs {
 		odh := OverlayDirHash{}
-		odh.Hash, err = getEncodedMtree(overlayDir.Source)
+		odh.Hash, err = getEncodedMtree(overlayDir.Source, nil)
 		if err != nil {
 			return err
 		}
@@ -524,6 +624,17 @@ func (c *BuildCache) Put(name string, manifests map[types.LayerType]ispec.Descri
 	return c.persist()
 }
 
+// Delete removes the cache entry of name, if there is one, so that the layer is
+// rebuilt.
+func (c *BuildCache) Delete(name string) error {
+	if _, ok := c.Cache[name]; !ok {
+		return nil
+	}
+
+	delete(c.Cache, name)
+	return c.persist()
+}
+
 func (c *BuildCache) persist() error {
 	content, err := json.Marshal(c)
 	if err != nil {
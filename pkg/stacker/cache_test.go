@@ -71,7 +71,7 @@ foo:
 		t.Fatalf("couldn't fake successful bulid %v", err)
 	}
 
-	err = cache.Put("foo", map[types.LayerType]ispec.Descriptor{})
+	err = cache.Put("foo", map[types.LayerType]ispec.Descriptor{}, nil)
 	if err != nil {
 		t.Fatalf("couldn't put to cache %v", err)
 	}
@@ -125,5 +125,281 @@ func TestCacheEntryChanged(t *testing.T) {
 	// This test works because the type information is included in the
 	// hashstructure hash above, so using a zero valued CacheEntry is
 	// enough to capture changes in types.
-	assert.Equal(uint64(0x9fa3e20d827f5ae5), h)
+	assert.Equal(uint64(0x47ebb89ba9271897), h)
+}
+
+func TestDestImportCaching(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+
+	config := types.StackerConfig{
+		StackerDir: path.Join(dir, ".stacker"),
+		RootFSDir:  path.Join(dir, "roots"),
+	}
+
+	importFile := path.Join(dir, "config.json")
+	assert.NoError(os.WriteFile(importFile, []byte("{}"), 0644))
+
+	stackerYaml := path.Join(dir, "stacker.yaml")
+	err := os.WriteFile(stackerYaml, []byte(`
+foo:
+    from:
+        type: scratch
+    imports:
+        - path: config.json
+          dest: /etc/foo/config.json
+        - path: config.json
+          dest: /etc/bar/
+`), 0644)
+	assert.NoError(err)
+
+	sf, err := types.NewStackerfile(stackerYaml, false, nil)
+	assert.NoError(err)
+	sfm := types.StackerFiles{"dummy": sf}
+	l, ok := sfm.LookupLayerDefinition("foo")
+	assert.True(ok)
+
+	cache, err := OpenCache(config, casext.Engine{}, sfm)
+	assert.NoError(err)
+
+	build := func() bool {
+		assert.NoError(CleanImportsDir(config, "foo", l.Imports, cache))
+		overlayDirs := types.OverlayDirs{}
+		assert.NoError(Import(config, nil, "foo", l.Imports, &overlayDirs, false))
+		assert.Len(overlayDirs, 2)
+
+		_, hit, err := cache.Lookup("foo")
+		assert.NoError(err)
+		if !hit {
+			assert.NoError(cache.Put("foo", map[types.LayerType]ispec.Descriptor{}, nil))
+		}
+		return hit
+	}
+
+	assert.False(build())
+	assert.Len(cache.Cache["foo"].Imports, 2)
+
+	// the copies are in the same place every time, so they're cached
+	assert.True(build())
+
+	// and changes to them are noticed
+	assert.NoError(os.WriteFile(importFile, []byte(`{"changed": true}`), 0644))
+	assert.False(build())
+	assert.True(build())
+}
+
+func TestImportFilterCaching(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+
+	config := types.StackerConfig{
+		StackerDir: path.Join(dir, ".stacker"),
+		RootFSDir:  path.Join(dir, "roots"),
+	}
+
+	for _, f := range []string{"src/main.go", "src/main.go.swp", "src/.git/HEAD", "src/docs/README", "src/build/out"} {
+		assert.NoError(os.MkdirAll(path.Join(dir, path.Dir(f)), 0755))
+		assert.NoError(os.WriteFile(path.Join(dir, f), []byte(f), 0644))
+	}
+	assert.NoError(os.WriteFile(path.Join(dir, ".stackerignore"), []byte("# comment\n.git/\n/src/build\n"), 0644))
+
+	stackerYaml := path.Join(dir, "stacker.yaml")
+	err := os.WriteFile(stackerYaml, []byte(`
+foo:
+    from:
+        type: scratch
+    imports:
+        - path: src
+          exclude:
+              - "*.swp"
+`), 0644)
+	assert.NoError(err)
+
+	sf, err := types.NewStackerfile(stackerYaml, false, nil)
+	assert.NoError(err)
+	sfm := types.StackerFiles{"dummy": sf}
+	l, ok := sfm.LookupLayerDefinition("foo")
+	assert.True(ok)
+	assert.Equal(&types.StackerIgnore{Patterns: []string{".git/", "/src/build"}, Dir: "src"}, l.Imports[0].StackerIgnore)
+
+	cache, err := OpenCache(config, casext.Engine{}, sfm)
+	assert.NoError(err)
+
+	build := func() bool {
+		assert.NoError(CleanImportsDir(config, "foo", l.Imports, cache))
+		overlayDirs := types.OverlayDirs{}
+		assert.NoError(Import(config, nil, "foo", l.Imports, &overlayDirs, false))
+
+		_, hit, err := cache.Lookup("foo")
+		assert.NoError(err)
+		if !hit {
+			assert.NoError(cache.Put("foo", map[types.LayerType]ispec.Descriptor{}, nil))
+		}
+		return hit
+	}
+
+	assert.False(build())
+	imported := path.Join(config.StackerDir, "imports", "foo", "src")
+	assert.FileExists(path.Join(imported, "main.go"))
+	assert.FileExists(path.Join(imported, "docs", "README"))
+	assert.NoFileExists(path.Join(imported, "main.go.swp"))
+	assert.NoDirExists(path.Join(imported, ".git"))
+	assert.NoDirExists(path.Join(imported, "build"))
+
+	// changes to ignored files don't matter
+	assert.NoError(os.WriteFile(path.Join(dir, "src/main.go.swp"), []byte("changed"), 0644))
+	assert.NoError(os.WriteFile(path.Join(dir, "src/.git/HEAD"), []byte("changed"), 0644))
+	assert.NoError(os.WriteFile(path.Join(dir, "src/build/new"), []byte("new"), 0644))
+	assert.True(build())
+
+	// others do
+	assert.NoError(os.WriteFile(path.Join(dir, "src/main.go"), []byte("changed"), 0644))
+	assert.False(build())
+	assert.True(build())
+}
+
+func TestRenamedDestImportRemovals(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+
+	config := types.StackerConfig{
+		StackerDir: path.Join(dir, ".stacker"),
+		RootFSDir:  path.Join(dir, "roots"),
+	}
+
+	importDir := path.Join(dir, "mydir")
+	assert.NoError(os.MkdirAll(importDir, 0755))
+	assert.NoError(os.WriteFile(path.Join(importDir, "kept"), []byte("kept"), 0644))
+	assert.NoError(os.WriteFile(path.Join(importDir, "removed"), []byte("removed"), 0644))
+
+	stackerYaml := path.Join(dir, "stacker.yaml")
+	err := os.WriteFile(stackerYaml, []byte(`
+foo:
+    from:
+        type: scratch
+    imports:
+        - path: mydir
+          dest: /opt/app
+`), 0644)
+	assert.NoError(err)
+
+	sf, err := types.NewStackerfile(stackerYaml, false, nil)
+	assert.NoError(err)
+	sfm := types.StackerFiles{"dummy": sf}
+	l, ok := sfm.LookupLayerDefinition("foo")
+	assert.True(ok)
+
+	cache, err := OpenCache(config, casext.Engine{}, sfm)
+	assert.NoError(err)
+
+	build := func() bool {
+		assert.NoError(CleanImportsDir(config, "foo", l.Imports, cache))
+		overlayDirs := types.OverlayDirs{}
+		assert.NoError(Import(config, nil, "foo", l.Imports, &overlayDirs, false))
+
+		_, hit, err := cache.Lookup("foo")
+		assert.NoError(err)
+		if !hit {
+			assert.NoError(cache.Put("foo", map[types.LayerType]ispec.Descriptor{}, nil))
+		}
+		return hit
+	}
+
+	assert.False(build())
+	assert.True(build())
+
+	// the dir is copied to app, which is overlaid onto /opt
+	copied := path.Join(importCopyDir(config, "foo", l.Imports[0]), "app")
+	assert.FileExists(path.Join(copied, "removed"))
+
+	// a file removed from the source is removed from the copy too, and
+	// the layer is rebuilt
+	assert.NoError(os.Remove(path.Join(importDir, "removed")))
+	assert.False(build())
+	assert.NoFileExists(path.Join(copied, "removed"))
+	assert.FileExists(path.Join(copied, "kept"))
+	assert.True(build())
+}
+
+func TestCacheDelete(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	config := types.StackerConfig{StackerDir: dir, RootFSDir: dir}
+
+	oci, err := umoci.CreateLayout(path.Join(dir, "layer-bases", "oci"))
+	assert.NoError(err)
+	defer oci.Close()
+	assert.NoError(umoci.NewImage(oci, "centos", nil))
+
+	stackerYaml := path.Join(dir, "stacker.yaml")
+	assert.NoError(os.WriteFile(stackerYaml, []byte(`
+foo:
+    from:
+        type: docker
+        url: docker://centos:latest
+    run: zomg
+    build_only: true
+`), 0644))
+	sf, err := types.NewStackerfile(stackerYaml, false, nil)
+	assert.NoError(err)
+	sfm := types.StackerFiles{"dummy": sf}
+
+	cache, err := OpenCache(config, casext.Engine{}, sfm)
+	assert.NoError(err)
+	assert.NoError(os.MkdirAll(path.Join(dir, "foo"), 0755))
+	assert.NoError(cache.Put("foo", map[types.LayerType]ispec.Descriptor{}, nil))
+
+	cache, err = OpenCache(config, casext.Engine{}, sfm)
+	assert.NoError(err)
+	_, ok, err := cache.Lookup("foo")
+	assert.NoError(err)
+	assert.True(ok)
+
+	// deleted entries stay deleted, so the layer is rebuilt
+	assert.NoError(cache.Delete("foo"))
+	assert.NoError(cache.Delete("foo"))
+	cache, err = OpenCache(config, casext.Engine{}, sfm)
+	assert.NoError(err)
+	_, ok, err = cache.Lookup("foo")
+	assert.NoError(err)
+	assert.False(ok)
+}
+
+func TestSecurityCaching(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	config := types.StackerConfig{StackerDir: dir, RootFSDir: dir}
+
+	stackerYaml := path.Join(dir, "stacker.yaml")
+	assert.NoError(os.WriteFile(stackerYaml, []byte(`
+foo:
+    from:
+        type: scratch
+    security:
+        cap_drop: [sys_admin]
+`), 0644))
+	sf, err := types.NewStackerfile(stackerYaml, false, nil)
+	assert.NoError(err)
+	sfm := types.StackerFiles{"dummy": sf}
+
+	lookup := func(config types.StackerConfig) bool {
+		cache, err := OpenCache(config, casext.Engine{}, sfm)
+		assert.NoError(err)
+		_, ok, err := cache.Lookup("foo")
+		assert.NoError(err)
+		return ok
+	}
+
+	cache, err := OpenCache(config, casext.Engine{}, sfm)
+	assert.NoError(err)
+	assert.NoError(cache.Put("foo", map[types.LayerType]ispec.Descriptor{}, nil))
+	assert.True(lookup(config))
+	assert.Equal([]string{"sys_admin"}, cache.Cache["foo"].Security.CapDrop)
+
+	// the defaults in the stacker config file are part of what the layer
+	// was built under too
+	config.Security = &types.Security{NoNewPrivs: true}
+	assert.False(lookup(config))
 }
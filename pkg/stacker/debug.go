@@ -0,0 +1,146 @@
+package stacker
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"stackerbuild.io/stacker/pkg/container"
+	"stackerbuild.io/stacker/pkg/log"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+// FailedLayer records the state of a layer whose run commands failed, so that
+// it can be debugged later.
+type FailedLayer struct {
+	// Name of the layer in the stackerfile.
+	Name string `json:"name"`
+
+	// Snapshot is the storage tag the failed rootfs was preserved as.
+	Snapshot string `json:"snapshot"`
+
+	StackerFile string      `json:"stacker_file"`
+	Layer       types.Layer `json:"layer"`
+}
+
+// FailedSnapshotName is the storage tag the failed rootfs of a layer is kept
+// under.
+func FailedSnapshotName(name string) string {
+	return fmt.Sprintf("failed-%s", name)
+}
+
+func failedLayerPath(config types.StackerConfig, name string) string {
+	return path.Join(config.StackerDir, "failed", fmt.Sprintf("%s.json", name))
+}
+
+// keepFailedLayer preserves the rootfs and LXC config of a layer whose run
+// commands failed.
+func keepFailedLayer(config types.StackerConfig, s types.Storage, c *container.Container, sf *types.Stackerfile, l types.Layer, name string) error {
+	snapshot := FailedSnapshotName(name)
+
+	if err := s.Rename(name, snapshot); err != nil {
+		return err
+	}
+
+	err := c.SaveConfigFile(filepath.Join(config.RootFSDir, snapshot, "lxc.conf"))
+	if err != nil {
+		return errors.Wrapf(err, "error saving config file for %s", name)
+	}
+
+	content, err := json.Marshal(FailedLayer{
+		Name:        name,
+		Snapshot:    snapshot,
+		StackerFile: sf.FilePath(),
+		Layer:       l,
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	p := failedLayerPath(config, name)
+	if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err := os.WriteFile(p, content, 0644); err != nil {
+		return errors.Wrapf(err, "couldn't save failed layer %s", name)
+	}
+
+	log.Infof("kept failed layer %s, use 'stacker debug %s' to inspect it", name, name)
+	return nil
+}
+
+// LoadFailedLayer loads the state of a layer kept by 'build --keep-failed'.
+func LoadFailedLayer(config types.StackerConfig, s types.Storage, name string) (FailedLayer, error) {
+	fl := FailedLayer{}
+
+	content, err := os.ReadFile(failedLayerPath(config, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fl, errors.Errorf("no failed state for %s, build it with --keep-failed first", name)
+		}
+		return fl, errors.WithStack(err)
+	}
+
+	if err := json.Unmarshal(content, &fl); err != nil {
+		return fl, errors.Wrapf(err, "couldn't parse failed layer %s", name)
+	}
+
+	if !s.Exists(fl.Snapshot) {
+		return fl, errors.Errorf("failed rootfs for %s no longer exists", name)
+	}
+
+	return fl, nil
+}
+
+// DeleteFailedLayer removes the state of a layer kept by 'build
+// --keep-failed', if there is any, e.g. once the layer builds again.
+func DeleteFailedLayer(config types.StackerConfig, s types.Storage, name string) error {
+	p := failedLayerPath(config, name)
+	if _, err := os.Stat(p); os.IsNotExist(err) {
+		return nil
+	}
+
+	if err := s.Delete(FailedSnapshotName(name)); err != nil {
+		return err
+	}
+
+	log.Debugf("removing the failed state of %s", name)
+	return errors.WithStack(os.Remove(p))
+}
+
+// DebugFailedLayer runs cmd in the preserved rootfs of a failed layer, with
+// the same configuration (imports, binds, environment) it was built with.
+// Changes made during the session are kept.
+func DebugFailedLayer(config types.StackerConfig, s types.Storage, fl FailedLayer, cmd []string) error {
+	c, err := container.New(config, fl.Snapshot)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	inDir := types.InternalStackerDir
+	if fl.Layer.WasLegacyImport {
+		inDir = types.LegacyInternalStackerDir
+	}
+
+	err = SetupBuildContainerConfig(config, s, c, inDir, fl.Snapshot)
+	if err != nil {
+		return err
+	}
+
+	// the imports and build environment are those of the original layer
+	err = SetupLayerConfig(config, c, fl.Layer, inDir, fl.Name)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(path.Join(config.StackerDir, "imports", fl.Name, ".stacker-run.sh")); err == nil {
+		log.Infof("re-run the layer's commands with %s", filepath.Join(inDir, "imports", ".stacker-run.sh"))
+	}
+
+	return c.Execute(cmd, os.Stdin)
+}
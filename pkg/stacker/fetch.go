@@ -0,0 +1,273 @@
+package stacker
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/opencontainers/umoci"
+	"github.com/pkg/errors"
+	"stackerbuild.io/stacker/pkg/lib"
+	"stackerbuild.io/stacker/pkg/log"
+	"stackerbuild.io/stacker/pkg/overlay"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+type FetchArgs struct {
+	Config   types.StackerConfig
+	Progress bool
+}
+
+// fetchInput is something a build downloads: either a base image, an http
+// file (an import or a tar base), a git repository (an import or a git base)
+// or the image or artifact of an image import.
+type fetchInput struct {
+	Layer      types.Layer
+	Name       string
+	Image      *types.ImageSource
+	Url        string
+	Hash       string
+	Mirrors    []string
+	Git        bool
+	Ref        string
+	Submodules bool
+	ImageRef   string
+}
+
+func (fi fetchInput) String() string {
+	if fi.Image != nil {
+		return fmt.Sprintf("%s base image %s", fi.Name, fi.Image.Url)
+	}
+	if fi.Git && fi.Ref != "" {
+		return fmt.Sprintf("%s import %s at %s", fi.Name, fi.Url, fi.Ref)
+	}
+	return fmt.Sprintf("%s import %s", fi.Name, fi.Url)
+}
+
+func gitFetchInput(l types.Layer, name string, u string, ref string, submodules bool) (fetchInput, string) {
+	key := fmt.Sprintf("%s\x00%s\x00%v", u, ref, submodules)
+	return fetchInput{Layer: l, Name: name, Url: u, Git: true, Ref: ref, Submodules: submodules}, key
+}
+
+func isHttpUrl(u string) bool {
+	url, err := types.NewDockerishUrl(u)
+	if err != nil {
+		return false
+	}
+
+	return url.Scheme == "http" || url.Scheme == "https"
+}
+
+// fetchInputs lists the inputs of the layers in sfm that can be fetched.
+func fetchInputs(sfm types.StackerFiles) []fetchInput {
+	paths := []string{}
+	for p := range sfm {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	inputs := []fetchInput{}
+	seen := map[string]bool{}
+	add := func(input fetchInput, key string) {
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+		inputs = append(inputs, input)
+	}
+
+	for _, p := range paths {
+		sf := sfm[p]
+		for _, name := range sf.FileOrder {
+			l, ok := sf.Get(name)
+			if !ok {
+				continue
+			}
+
+			if types.IsContainersImageLayer(l.From.Type) {
+				from := l.From
+				add(fetchInput{Layer: l, Name: name, Image: &from}, fetchedImageTag(l))
+			} else if l.From.Type == types.TarLayer && isHttpUrl(l.From.Url) {
+				add(fetchInput{Layer: l, Name: name, Url: l.From.Url}, l.From.Url)
+			} else if l.From.Type == types.GitLayer {
+				add(gitFetchInput(l, name, l.From.Url, l.From.Ref, l.From.Submodules))
+			}
+
+			for _, imp := range l.Imports {
+				if isHttpUrl(imp.Path) {
+					add(fetchInput{Layer: l, Name: name, Url: imp.Path, Hash: imp.Hash, Mirrors: imp.Mirrors}, imp.Path)
+					for _, u := range []string{imp.Checksums, imp.Signature} {
+						if isHttpUrl(u) {
+							add(fetchInput{Layer: l, Name: name, Url: u}, u)
+						}
+					}
+				} else if types.IsGitUrl(imp.Path) {
+					add(gitFetchInput(l, name, imp.Path, imp.Ref, imp.Submodules))
+				} else if types.IsImageUrl(imp.Path) {
+					ref, _ := parseImageImport(imp.Path)
+					add(fetchInput{Layer: l, Name: name, Url: imp.Path, ImageRef: ref}, ref)
+				}
+			}
+		}
+	}
+
+	return inputs
+}
+
+func urlKey(u string) string {
+	sum := sha256.Sum256([]byte(u))
+	return hex.EncodeToString(sum[:])
+}
+
+// fetchedImageTag is the tag in the layer-bases cache of the fetched base
+// image of l. Unlike the tag the base is imported as for builds, it is unique
+// for each image (and platform).
+func fetchedImageTag(l types.Layer) string {
+	key := l.From.Url
+	if l.OS != nil {
+		key += fmt.Sprintf(" os=%s", *l.OS)
+	}
+	if l.Arch != nil {
+		key += fmt.Sprintf(" arch=%s", *l.Arch)
+	}
+
+	return fmt.Sprintf("fetched-%s", urlKey(key))
+}
+
+// fetchedPath is where the fetched http file u is in the imports cache. Layers'
+// imports are in directories named after them, and layer names are tags,
+// which can't start with a dot.
+func fetchedPath(config types.StackerConfig, u string) string {
+	return path.Join(config.StackerDir, "imports", ".fetched", urlKey(u), path.Base(u))
+}
+
+func hasCachedImage(config types.StackerConfig, tag string) bool {
+	oci, err := umoci.OpenLayout(path.Join(config.StackerDir, "layer-bases", "oci"))
+	if err != nil {
+		return false
+	}
+	defer oci.Close()
+
+	descPaths, err := oci.ResolveReference(context.Background(), tag)
+	return err == nil && len(descPaths) > 0
+}
+
+// importFetchedImage imports the fetched base image of layer as tag, without
+// using the network.
+func importFetchedImage(layer types.Layer, config types.StackerConfig, tag string) error {
+	cacheDir := path.Join(config.StackerDir, "layer-bases", "oci")
+	fetched := fetchedImageTag(layer)
+
+	defer fetchLocks.lock(cacheDir)()
+	if !hasCachedImage(config, fetched) {
+		return errors.Errorf("offline: base image %s wasn't fetched, run 'stacker fetch' first", layer.From.Url)
+	}
+
+	log.Infof("loading fetched %s", layer.From.Url)
+
+	// it is already in the layout, so it only has to be tagged
+	oci, err := umoci.OpenLayout(cacheDir)
+	if err != nil {
+		return err
+	}
+	defer oci.Close()
+
+	descPaths, err := oci.ResolveReference(context.Background(), fetched)
+	if err != nil {
+		return err
+	}
+
+	return oci.UpdateReference(context.Background(), tag, descPaths[0].Root())
+}
+
+// CheckOffline makes sure everything the layers in sfm need from the network
+// has been fetched, so that an offline build doesn't fail halfway through.
+func CheckOffline(config types.StackerConfig, sfm types.StackerFiles) error {
+	missing := []string{}
+	for _, input := range fetchInputs(sfm) {
+		if input.Image != nil {
+			if !hasCachedImage(config, fetchedImageTag(input.Layer)) {
+				missing = append(missing, input.String())
+			}
+			continue
+		}
+
+		if input.Git {
+			if _, _, err := fetchedGitCheckout(config, input.Url, input.Ref, input.Submodules); err != nil {
+				missing = append(missing, input.String())
+			}
+			continue
+		}
+
+		if input.ImageRef != "" {
+			if !hasCachedImage(config, imageImportTag(input.ImageRef)) {
+				missing = append(missing, input.String())
+			}
+			continue
+		}
+
+		if !lib.PathExists(fetchedPath(config, input.Url)) {
+			missing = append(missing, input.String())
+		}
+	}
+
+	if len(missing) > 0 {
+		return errors.Errorf("offline: these inputs weren't fetched, run 'stacker fetch' first:\n  %s", strings.Join(missing, "\n  "))
+	}
+
+	return nil
+}
+
+// Fetch downloads the base images, http files, git repositories and image
+// imports the layers in sfm need, so that they can be built with --offline.
+func Fetch(opts FetchArgs, sfm types.StackerFiles) error {
+	config := opts.Config
+	if config.Offline {
+		return errors.Errorf("can't fetch while offline")
+	}
+
+	_, locks, err := NewStorage(config)
+	if err != nil {
+		return err
+	}
+	defer locks.Unlock()
+
+	progress := opts.Progress
+	pool := overlay.NewThreadPool(fetchJobs(config))
+	for _, input := range fetchInputs(sfm) {
+		pool.Add(func(ctx context.Context) error {
+			if ctx.Err() != nil {
+				return overlay.ThreadPoolCancelled
+			}
+
+			log.Infof("fetching %s", input)
+			return fetchOne(config, input, progress)
+		})
+	}
+
+	pool.DoneAddingJobs()
+	return pool.Run()
+}
+
+// fetchOne fetches one input of a build.
+func fetchOne(config types.StackerConfig, input fetchInput, progress bool) error {
+	if input.Image != nil {
+		return importContainersImageAs(input.Layer, config, fetchedImageTag(input.Layer), progress)
+	}
+
+	if input.Git {
+		_, _, err := gitCheckout(config, input.Url, input.Ref, input.Submodules)
+		return err
+	}
+
+	if input.ImageRef != "" {
+		return pullImageImport(config, input.ImageRef, progress)
+	}
+
+	_, err := fetchHttp(config, input.Url, input.Hash, input.Mirrors, progress)
+	return err
+}
@@ -0,0 +1,356 @@
+package stacker
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	"stackerbuild.io/stacker/pkg/lib"
+	"stackerbuild.io/stacker/pkg/storage"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+// Fsck checks stacker's work dirs for what interrupted builds left behind:
+// mounts in the roots dir, blobs that don't match their digest, images missing
+// blobs in the OCI layouts, broken tags and layers in the storage, and build
+// cache entries for outputs that are gone. With repair, what has
+// problems is unmounted or removed, so that the next build recreates it.
+//
+// The stacker locks must be held, so that no build is running.
+func Fsck(config types.StackerConfig, s types.Storage, repair bool) ([]types.FsckProblem, error) {
+	f := &storage.FsckProblems{Repair: repair}
+
+	// with nothing running, nothing should be mounted in the roots dir
+	if err := fsckMounts(config, f); err != nil {
+		return nil, err
+	}
+
+	// before anything is repaired, so that layers whose images are
+	// removed below still aren't mistaken for temporary dirs
+	layers, err := knownLayers(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// blobs that don't match their digest, whether they were removed
+	// or not; the storage can't unpack layers from them either
+	corrupt := map[digest.Digest]bool{}
+	for _, ociDir := range []string{config.OCIDir, layerBasesDir(config)} {
+		if err := fsckLayout(ociDir, f, corrupt); err != nil {
+			return nil, err
+		}
+	}
+
+	problems, err := s.Fsck(types.FsckOpts{Repair: repair, Layers: layers, CorruptBlobs: corrupt})
+	if err != nil {
+		return nil, err
+	}
+	f.Problems = append(f.Problems, problems...)
+
+	if err := fsckBuildCache(config, f, corrupt); err != nil {
+		return nil, err
+	}
+
+	return f.Problems, nil
+}
+
+// knownLayers returns the names of the layers in the build cache and the tags
+// in the output, which may be in the roots dir.
+func knownLayers(config types.StackerConfig) (map[string]bool, error) {
+	layers := map[string]bool{}
+
+	// an invalid or old cache is dealt with by fsckBuildCache
+	content, err := os.ReadFile(config.CacheFile())
+	if err == nil {
+		cache := &BuildCache{}
+		if json.Unmarshal(content, cache) == nil {
+			for _, ent := range cache.Cache {
+				layers[ent.Name] = true
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "couldn't read build cache")
+	}
+
+	if !lib.PathExists(config.OCIDir) {
+		return layers, nil
+	}
+
+	oci, err := umoci.OpenLayout(config.OCIDir)
+	if err != nil {
+		// fsckLayout reports it
+		return layers, nil
+	}
+	defer oci.Close()
+
+	refs, err := oci.ListReferences(context.Background())
+	if err != nil {
+		return layers, nil
+	}
+
+	for _, ref := range refs {
+		layers[ref] = true
+	}
+
+	return layers, nil
+}
+
+// mountsUnder returns the mountpoints below dir, the deepest first.
+func mountsUnder(dir string) ([]string, error) {
+	file, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer file.Close()
+
+	mounts := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+
+		// spaces etc. are octal escaped, e.g. \040
+		mountpoint, err := strconv.Unquote(`"` + fields[4] + `"`)
+		if err != nil {
+			mountpoint = fields[4]
+		}
+
+		if strings.HasPrefix(mountpoint, dir+"/") {
+			mounts = append(mounts, mountpoint)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	sort.Slice(mounts, func(i, j int) bool { return len(mounts[i]) > len(mounts[j]) })
+	return mounts, nil
+}
+
+func fsckMounts(config types.StackerConfig, f *storage.FsckProblems) error {
+	roots, err := filepath.Abs(config.RootFSDir)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	mounts, err := mountsUnder(roots)
+	if err != nil {
+		return err
+	}
+
+	for _, mountpoint := range mounts {
+		detach := func() error {
+			return errors.WithStack(unix.Unmount(mountpoint, unix.MNT_DETACH))
+		}
+
+		if err := f.Found(mountpoint, detach, "stale mount"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func blobPath(ociDir string, d digest.Digest) string {
+	return path.Join(ociDir, "blobs", d.Algorithm().String(), d.Encoded())
+}
+
+// missingBlob returns a blob of the image desc describes that is missing
+// from ociDir or corrupt, if there is one.
+func missingBlob(ociDir string, desc ispec.Descriptor, corrupt map[digest.Digest]bool) digest.Digest {
+	present := func(d digest.Digest) bool {
+		return !corrupt[d] && lib.PathExists(blobPath(ociDir, d))
+	}
+
+	if !present(desc.Digest) {
+		return desc.Digest
+	}
+
+	if desc.MediaType != ispec.MediaTypeImageManifest {
+		return ""
+	}
+
+	content, err := os.ReadFile(blobPath(ociDir, desc.Digest))
+	if err != nil {
+		return desc.Digest
+	}
+
+	manifest := ispec.Manifest{}
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return desc.Digest
+	}
+
+	if !present(manifest.Config.Digest) {
+		return manifest.Config.Digest
+	}
+
+	for _, layer := range manifest.Layers {
+		if !present(layer.Digest) {
+			return layer.Digest
+		}
+	}
+
+	return ""
+}
+
+// fsckLayout verifies the digests of the blobs in ociDir, and that its images
+// have all their blobs. Corrupt blobs are removed when repairing, and so are
+// the tags of images with missing or corrupt blobs.
+func fsckLayout(ociDir string, f *storage.FsckProblems, corrupt map[digest.Digest]bool) error {
+	if !lib.PathExists(ociDir) {
+		return nil
+	}
+
+	blobsDir := path.Join(ociDir, "blobs", string(digest.SHA256))
+	ents, err := os.ReadDir(blobsDir)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "couldn't read %s", blobsDir)
+	}
+
+	for _, ent := range ents {
+		expected := digest.NewDigestFromEncoded(digest.SHA256, ent.Name())
+		if expected.Validate() != nil || !ent.Type().IsRegular() {
+			continue
+		}
+
+		p := path.Join(blobsDir, ent.Name())
+		blob, err := os.Open(p)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		actual, err := digest.SHA256.FromReader(blob)
+		blob.Close()
+		if err != nil {
+			return errors.Wrapf(err, "couldn't hash %s", p)
+		}
+
+		if actual != expected {
+			corrupt[expected] = true
+			remove := func() error { return errors.WithStack(os.Remove(p)) }
+			if err := f.Found(p, remove, "blob content has digest %s", actual); err != nil {
+				return err
+			}
+		}
+	}
+
+	oci, err := umoci.OpenLayout(ociDir)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't open %s", ociDir)
+	}
+	defer oci.Close()
+
+	refs, err := oci.ListReferences(context.Background())
+	if err != nil {
+		return errors.Wrapf(err, "couldn't list images in %s", ociDir)
+	}
+
+	for _, ref := range refs {
+		remove := func() error { return oci.DeleteReference(context.Background(), ref) }
+
+		descPaths, err := oci.ResolveReference(context.Background(), ref)
+		if err != nil {
+			if err := f.Found(fmt.Sprintf("%s:%s", ociDir, ref), remove, "couldn't resolve: %v", err); err != nil {
+				return err
+			}
+			continue
+		}
+
+		for _, descPath := range descPaths {
+			if missing := missingBlob(ociDir, descPath.Descriptor(), corrupt); missing != "" {
+				if err := f.Found(fmt.Sprintf("%s:%s", ociDir, ref), remove, "missing blob %s", missing); err != nil {
+					return err
+				}
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+// fsckBuildCache checks that the outputs of the build cache's entries are
+// still there: the roots dir tag of build only layers, and the images in the
+// output for the others. Entries that aren't are removed when repairing, so
+// that their layers are rebuilt.
+func fsckBuildCache(config types.StackerConfig, f *storage.FsckProblems, corrupt map[digest.Digest]bool) error {
+	content, err := os.ReadFile(config.CacheFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "couldn't read build cache")
+	}
+
+	removeCache := func() error { return errors.WithStack(os.Remove(config.CacheFile())) }
+
+	cacheOk, err := versionMatches(content)
+	if err != nil {
+		return f.Found(config.CacheFile(), removeCache, "invalid build cache: %v", err)
+	}
+
+	// an old cache is cleared by the next build anyway
+	if !cacheOk {
+		return nil
+	}
+
+	cache := &BuildCache{config: config}
+	if err := json.Unmarshal(content, cache); err != nil {
+		return f.Found(config.CacheFile(), removeCache, "invalid build cache: %v", err)
+	}
+
+	pruned := false
+	for name, ent := range cache.Cache {
+		remove := func() error {
+			delete(cache.Cache, name)
+			pruned = true
+			return nil
+		}
+
+		problem := ""
+		if ent.Layer.BuildOnly {
+			if !lib.PathExists(path.Join(config.RootFSDir, ent.Name)) {
+				problem = fmt.Sprintf("build only layer %s is missing from the roots dir", ent.Name)
+			}
+		} else {
+			for layerType, desc := range ent.Manifests {
+				if missing := missingBlob(config.OCIDir, desc, corrupt); missing != "" {
+					problem = fmt.Sprintf("%s output of %s is missing blob %s", layerType, ent.Name, missing)
+					break
+				}
+			}
+
+			for layerType, desc := range ent.Unsquashed {
+				if missing := missingBlob(config.OCIDir, desc, corrupt); missing != "" && problem == "" {
+					problem = fmt.Sprintf("unsquashed %s output of %s is missing blob %s", layerType, ent.Name, missing)
+					break
+				}
+			}
+		}
+
+		if problem != "" {
+			if err := f.Found(config.CacheFile(), remove, "%s", problem); err != nil {
+				return err
+			}
+		}
+	}
+
+	if pruned {
+		return cache.persist()
+	}
+
+	return nil
+}
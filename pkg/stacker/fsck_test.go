@@ -0,0 +1,141 @@
+package stacker
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/stretchr/testify/assert"
+	"machinerun.io/atomfs/pkg/verity"
+	"stackerbuild.io/stacker/pkg/dir"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+func TestFsck(t *testing.T) {
+	assert := assert.New(t)
+
+	tmp := t.TempDir()
+	config := types.StackerConfig{
+		StackerDir: path.Join(tmp, ".stacker"),
+		RootFSDir:  path.Join(tmp, "roots"),
+		OCIDir:     path.Join(tmp, "oci"),
+	}
+	assert.NoError(os.MkdirAll(config.StackerDir, 0755))
+
+	s, err := dir.NewDir(config)
+	assert.NoError(err)
+
+	oci, err := umoci.CreateLayout(config.OCIDir)
+	assert.NoError(err)
+	assert.NoError(umoci.NewImage(oci, "test", nil))
+
+	descPaths, err := oci.ResolveReference(context.Background(), "test")
+	assert.NoError(err)
+	assert.Len(descPaths, 1)
+	manifest := descPaths[0].Descriptor()
+
+	blob, err := oci.FromDescriptor(context.Background(), manifest)
+	assert.NoError(err)
+	configDigest := blob.Data.(ispec.Manifest).Config.Digest
+	blob.Close()
+	oci.Close()
+
+	layerType, err := types.NewLayerType("tar", verity.VerityMetadataMissing)
+	assert.NoError(err)
+
+	cache := &BuildCache{
+		config:  config,
+		Version: currentCacheVersion,
+		Cache: map[string]CacheEntry{
+			"test": {Name: "test", Manifests: map[types.LayerType]ispec.Descriptor{layerType: manifest}},
+		},
+	}
+	assert.NoError(cache.persist())
+
+	// everything is there
+	problems, err := Fsck(config, s, false)
+	assert.NoError(err)
+	assert.Empty(problems)
+
+	// a corrupt config breaks the image, and its cache entry
+	configPath := path.Join(config.OCIDir, "blobs", "sha256", configDigest.Encoded())
+	assert.NoError(os.WriteFile(configPath, []byte("corrupt"), 0644))
+
+	problems, err = Fsck(config, s, false)
+	assert.NoError(err)
+	assert.Len(problems, 3)
+	for _, problem := range problems {
+		assert.False(problem.Repaired)
+	}
+	assert.FileExists(configPath)
+
+	problems, err = Fsck(config, s, true)
+	assert.NoError(err)
+	assert.Len(problems, 3)
+	for _, problem := range problems {
+		assert.True(problem.Repaired)
+	}
+	assert.NoFileExists(configPath)
+
+	oci, err = umoci.OpenLayout(config.OCIDir)
+	assert.NoError(err)
+	defer oci.Close()
+	refs, err := oci.ListReferences(context.Background())
+	assert.NoError(err)
+	assert.Empty(refs)
+
+	// and it is all gone
+	problems, err = Fsck(config, s, false)
+	assert.NoError(err)
+	assert.Empty(problems)
+}
+
+func TestFsckKnownLayers(t *testing.T) {
+	assert := assert.New(t)
+
+	tmp := t.TempDir()
+	config := types.StackerConfig{
+		StackerDir: path.Join(tmp, ".stacker"),
+		RootFSDir:  path.Join(tmp, "roots"),
+		OCIDir:     path.Join(tmp, "oci"),
+	}
+	assert.NoError(os.MkdirAll(config.StackerDir, 0755))
+
+	s, err := dir.NewDir(config)
+	assert.NoError(err)
+
+	oci, err := umoci.CreateLayout(config.OCIDir)
+	assert.NoError(err)
+	assert.NoError(umoci.NewImage(oci, "squash-output", nil))
+	oci.Close()
+
+	cache := &BuildCache{
+		config:  config,
+		Version: currentCacheVersion,
+		Cache: map[string]CacheEntry{
+			"squash-cached": {Name: "squash-cached", Layer: types.Layer{BuildOnly: true}},
+		},
+	}
+	assert.NoError(cache.persist())
+
+	layers, err := knownLayers(config)
+	assert.NoError(err)
+	assert.Equal(map[string]bool{"squash-output": true, "squash-cached": true}, layers)
+
+	// layers named like temporary dirs are kept, but real ones aren't
+	for _, name := range []string{"squash-output", "squash-cached", "squash-1234"} {
+		assert.NoError(s.Create(name))
+		assert.NoError(s.SetupEmptyRootfs(name))
+	}
+
+	problems, err := Fsck(config, s, true)
+	assert.NoError(err)
+	assert.Len(problems, 1)
+	assert.Equal(path.Join(config.RootFSDir, "squash-1234"), problems[0].Path)
+	assert.True(s.Exists("squash-output"))
+	assert.True(s.Exists("squash-cached"))
+	assert.False(s.Exists("squash-1234"))
+}
@@ -1,10 +1,17 @@
 package stacker
 
 import (
+	"io/fs"
+	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
 	"strings"
 
-	"github.com/apex/log"
+	"github.com/pkg/errors"
+	"stackerbuild.io/stacker/pkg/lib"
+	"stackerbuild.io/stacker/pkg/log"
+	"stackerbuild.io/stacker/pkg/types"
 )
 
 // gitHash generates a version string similar to git describe --always
@@ -34,7 +41,7 @@ func GitVersion(path string) (string, error) {
 	if err == nil {
 		vers = strings.TrimSpace(string(output))
 	} else {
-		log.Debug("'git describe --tags' failed, falling back to hash")
+		log.Debugf("'git describe --tags' failed, falling back to hash")
 		vers, err = gitHash(path, false)
 		if err != nil {
 			return "", err
@@ -55,3 +62,229 @@ func GitVersion(path string) (string, error) {
 
 	return vers + "-dirty", nil
 }
+
+// gitRemote is the url git is given for a git+ url.
+func gitRemote(u string) string {
+	return strings.TrimPrefix(u, "git+")
+}
+
+// gitRepoName is the name of the directory the repository at u is checked
+// out to.
+func gitRepoName(u string) string {
+	return strings.TrimSuffix(path.Base(strings.TrimRight(gitRemote(u), "/")), ".git")
+}
+
+func runGit(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	// fail rather than hang asking for credentials
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", errors.Wrapf(err, "git %s failed: %s", strings.Join(args, " "), strings.TrimSpace(string(output)))
+	}
+
+	return strings.TrimSpace(string(output)), nil
+}
+
+// gitRefRecord is where the commit ref of u was last resolved to is kept, so
+// that builds use the same commit throughout, and offline builds use the
+// fetched one.
+func gitRefRecord(c types.StackerConfig, u string, ref string) string {
+	return path.Join(c.StackerDir, "git", "refs", urlKey(u+"\x00"+ref))
+}
+
+// gitCheckoutDir is where commit of u is checked out to.
+func gitCheckoutDir(c types.StackerConfig, u string, commit string, submodules bool) string {
+	name := commit
+	if submodules {
+		name += "-submodules"
+	}
+	return path.Join(c.StackerDir, "git", "checkouts", name, gitRepoName(u))
+}
+
+// recordedGitRef is the commit ref of u was last resolved to.
+func recordedGitRef(c types.StackerConfig, u string, ref string) (string, error) {
+	if types.IsGitCommit(ref) {
+		return ref, nil
+	}
+
+	content, err := os.ReadFile(gitRefRecord(c, u, ref))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", errors.Errorf("%s wasn't fetched", u)
+		}
+		return "", errors.WithStack(err)
+	}
+
+	return strings.TrimSpace(string(content)), nil
+}
+
+// resolveGitRef finds the commit a branch or tag of u is at; the default
+// branch if ref is empty. Full commit ids are used as they are.
+func resolveGitRef(c types.StackerConfig, u string, ref string) (string, error) {
+	if types.IsGitCommit(ref) {
+		return ref, nil
+	}
+
+	if c.Offline {
+		commit, err := recordedGitRef(c, u, ref)
+		if err != nil {
+			return "", errors.Wrapf(err, "offline: run 'stacker fetch' first")
+		}
+		return commit, nil
+	}
+
+	pattern := ref
+	if pattern == "" {
+		pattern = "HEAD"
+	}
+
+	// annotated tags are only peeled to the commit they point to when
+	// the peeled name is asked for too
+	output, err := runGit("", "ls-remote", gitRemote(u), pattern, pattern+"^{}")
+	if err != nil {
+		return "", err
+	}
+
+	refs := map[string]string{}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 {
+			refs[fields[1]] = fields[0]
+		}
+	}
+
+	commit := ""
+	for _, name := range []string{pattern, "refs/heads/" + pattern, "refs/tags/" + pattern + "^{}", "refs/tags/" + pattern} {
+		if refs[name] != "" {
+			commit = refs[name]
+			break
+		}
+	}
+
+	if commit == "" {
+		return "", errors.Errorf("couldn't find %s in %s; abbreviated commits aren't supported, use the full commit id", pattern, u)
+	}
+
+	record := gitRefRecord(c, u, ref)
+	if err := os.MkdirAll(path.Dir(record), 0755); err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	if err := os.WriteFile(record, []byte(commit+"\n"), 0644); err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	log.Debugf("%s %s is at %s", u, pattern, commit)
+	return commit, nil
+}
+
+// fetchedGitCheckout is the existing checkout of ref of u, as resolved by the
+// last gitCheckout, and its commit.
+func fetchedGitCheckout(c types.StackerConfig, u string, ref string, submodules bool) (string, string, error) {
+	commit, err := recordedGitRef(c, u, ref)
+	if err != nil {
+		return "", "", err
+	}
+
+	dir := gitCheckoutDir(c, u, commit, submodules)
+	if !lib.PathExists(dir) {
+		return "", "", errors.Errorf("%s at %s wasn't fetched", u, commit)
+	}
+
+	return dir, commit, nil
+}
+
+// gitCheckout checks ref of u out to the git cache, without its history, and
+// returns where it is and its commit. Checkouts are by commit, so a ref that
+// hasn't moved isn't fetched again.
+func gitCheckout(c types.StackerConfig, u string, ref string, submodules bool) (string, string, error) {
+	defer fetchLocks.lock(gitRefRecord(c, u, ref))()
+	commit, err := resolveGitRef(c, u, ref)
+	if err != nil {
+		return "", "", err
+	}
+
+	dir := gitCheckoutDir(c, u, commit, submodules)
+	defer fetchLocks.lock(path.Dir(dir))()
+	if lib.PathExists(dir) {
+		log.Infof("using cached checkout of %s at %s", u, commit)
+		return dir, commit, nil
+	}
+
+	if c.Offline {
+		return "", "", errors.Errorf("offline: %s at %s wasn't fetched, run 'stacker fetch' first", u, commit)
+	}
+
+	log.Infof("checking out %s at %s", u, commit)
+
+	partial := path.Dir(dir) + ".partial"
+	if err := os.RemoveAll(partial); err != nil {
+		return "", "", errors.WithStack(err)
+	}
+	defer os.RemoveAll(partial)
+
+	work := path.Join(partial, gitRepoName(u))
+	if err := os.MkdirAll(work, 0755); err != nil {
+		return "", "", errors.WithStack(err)
+	}
+
+	// the remote is named so that relative submodule urls work
+	for _, args := range [][]string{{"init", "-q"}, {"remote", "add", "origin", gitRemote(u)}} {
+		if _, err := runGit(work, args...); err != nil {
+			return "", "", err
+		}
+	}
+
+	if _, err := runGit(work, "fetch", "-q", "--depth", "1", "origin", commit); err != nil {
+		// not all servers allow fetching a commit that isn't a
+		// branch or a tag by its id
+		log.Debugf("shallow fetch of %s failed, fetching everything: %v", commit, err)
+		if _, err := runGit(work, "fetch", "-q", "--tags", "origin", "+refs/heads/*:refs/remotes/origin/*"); err != nil {
+			return "", "", err
+		}
+	}
+
+	if _, err := runGit(work, "-c", "advice.detachedHead=false", "checkout", "-q", "--detach", commit); err != nil {
+		return "", "", err
+	}
+
+	if submodules {
+		if _, err := runGit(work, "submodule", "update", "-q", "--init", "--recursive", "--depth", "1"); err != nil {
+			log.Debugf("shallow submodule update failed, fetching everything: %v", err)
+			if _, err := runGit(work, "submodule", "update", "-q", "--init", "--recursive"); err != nil {
+				return "", "", err
+			}
+		}
+	}
+
+	// the history isn't part of what's imported
+	err = filepath.WalkDir(work, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.Name() != ".git" {
+			return nil
+		}
+
+		if err := os.RemoveAll(p); err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return "", "", errors.Wrapf(err, "couldn't clean up checkout of %s", u)
+	}
+
+	if err := os.Rename(partial, path.Dir(dir)); err != nil {
+		return "", "", errors.WithStack(err)
+	}
+
+	return dir, commit, nil
+}
@@ -0,0 +1,107 @@
+package stacker
+
+import (
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+// gitRepo makes a repository with a commit on main and a v1 tag, then
+// another commit on main, and returns its git+file:// url and the two
+// commits.
+func gitRepo(t *testing.T) (string, string, string) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git isn't installed")
+	}
+
+	dir := path.Join(t.TempDir(), "repo.git")
+	git := func(args ...string) string {
+		args = append([]string{"-c", "user.name=stacker", "-c", "user.email=stacker@example.com"}, args...)
+		out, err := runGit(dir, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+
+	assert.NoError(t, os.MkdirAll(path.Join(dir, "rootfs"), 0755))
+	git("init", "-q", "-b", "main")
+	assert.NoError(t, os.WriteFile(path.Join(dir, "rootfs", "hello"), []byte("v1"), 0755))
+	git("add", ".")
+	git("commit", "-q", "-m", "v1")
+	git("tag", "-a", "-m", "v1", "v1")
+	first := git("rev-parse", "HEAD")
+
+	assert.NoError(t, os.WriteFile(path.Join(dir, "rootfs", "hello"), []byte("v2"), 0755))
+	git("commit", "-q", "-a", "-m", "v2")
+	second := git("rev-parse", "HEAD")
+
+	return "git+file://" + dir, first, second
+}
+
+func TestResolveGitRef(t *testing.T) {
+	assert := assert.New(t)
+	url, first, second := gitRepo(t)
+	config := types.StackerConfig{StackerDir: t.TempDir()}
+
+	for ref, expected := range map[string]string{"": second, "main": second, "v1": first, first: first} {
+		commit, err := resolveGitRef(config, url, ref)
+		assert.NoError(err, ref)
+		assert.Equal(expected, commit, ref)
+	}
+
+	_, err := resolveGitRef(config, url, "nope")
+	assert.Error(err)
+
+	// offline, the last resolution is used
+	config.Offline = true
+	commit, err := resolveGitRef(config, url, "main")
+	assert.NoError(err)
+	assert.Equal(second, commit)
+
+	_, err = resolveGitRef(config, url, "other")
+	assert.Error(err)
+}
+
+func TestGitCheckout(t *testing.T) {
+	assert := assert.New(t)
+	url, first, _ := gitRepo(t)
+	config := types.StackerConfig{StackerDir: t.TempDir()}
+
+	dir, commit, err := gitCheckout(config, url, "v1", false)
+	assert.NoError(err)
+	assert.Equal(first, commit)
+	assert.Equal("repo", path.Base(dir))
+	assert.NoFileExists(path.Join(dir, ".git"))
+	assert.NoDirExists(path.Join(dir, ".git"))
+
+	content, err := os.ReadFile(path.Join(dir, "rootfs", "hello"))
+	assert.NoError(err)
+	assert.Equal("v1", string(content))
+
+	st, err := os.Stat(path.Join(dir, "rootfs", "hello"))
+	assert.NoError(err)
+	assert.NotZero(st.Mode() & 0100)
+
+	fetched, fetchedCommit, err := fetchedGitCheckout(config, url, "v1", false)
+	assert.NoError(err)
+	assert.Equal(dir, fetched)
+	assert.Equal(first, fetchedCommit)
+
+	// submodules are checked out separately
+	_, _, err = fetchedGitCheckout(config, url, "v1", true)
+	assert.Error(err)
+
+	// the checkout is reused, even offline
+	config.Offline = true
+	again, _, err := gitCheckout(config, url, first, false)
+	assert.NoError(err)
+	assert.Equal(dir, again)
+
+	_, _, err = gitCheckout(config, url, "main", false)
+	assert.Error(err)
+}
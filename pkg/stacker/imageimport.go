@@ -0,0 +1,276 @@
+package stacker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/pkg/errors"
+	"stackerbuild.io/stacker/pkg/lib"
+	"stackerbuild.io/stacker/pkg/log"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+// parseImageImport splits an image import into the containers/image
+// reference of the image, and the path in its filesystem that is imported, if
+// there is one, e.g. docker://example.com/tools:1.0#/usr/bin/tool. Without a
+// path, the import is an artifact, whose layers are the files imported.
+func parseImageImport(i string) (string, string) {
+	ref, imagePath, _ := strings.Cut(i, "#")
+	if strings.HasPrefix(ref, "oci://") {
+		ref = "oci:" + strings.TrimPrefix(ref, "oci://")
+	}
+	return ref, imagePath
+}
+
+// imageImportName is the name of the file or directory an image import is
+// copied to: the base of the path in the image, or the name of the artifact's
+// repository or layout.
+func imageImportName(i string) string {
+	ref, imagePath := parseImageImport(i)
+	if imagePath != "" {
+		return path.Base(imagePath)
+	}
+
+	_, name, _ := strings.Cut(ref, ":")
+	name, _, _ = strings.Cut(name, "@")
+	name, _, _ = strings.Cut(path.Base(strings.TrimRight(name, "/")), ":")
+	return name
+}
+
+// imageImportTag is the tag of the image ref is pulled as in the layer-bases
+// cache.
+func imageImportTag(ref string) string {
+	return fmt.Sprintf("import-%s", urlKey(ref))
+}
+
+// pullImageImport copies ref to the layer-bases cache, unless it is pinned by
+// digest and already there.
+func pullImageImport(c types.StackerConfig, ref string, progress bool) error {
+	// the same image is only pulled once at a time, different ones in
+	// parallel
+	tag := imageImportTag(ref)
+	defer fetchLocks.lock("image:" + tag)()
+
+	if hasCachedImage(c, tag) && (c.Offline || strings.Contains(ref, "@")) {
+		return nil
+	}
+
+	if c.Offline {
+		return errors.Errorf("offline: %s wasn't fetched, run 'stacker fetch' first", ref)
+	}
+
+	copyOpts, err := withRegistries(c, lib.ImageCopyOpts{Src: ref})
+	if err != nil {
+		return err
+	}
+	copyOpts = withCopyProgress(copyOpts, ref, fetchProgress(c, progress))
+
+	log.Infof("loading %s", ref)
+	if err := copyToLayerBases(c, copyOpts, tag); err != nil {
+		return errors.Wrapf(err, "couldn't import %s", ref)
+	}
+
+	return nil
+}
+
+func lookupManifest(oci casext.Engine, tag string) (ispec.Descriptor, ispec.Manifest, error) {
+	descPaths, err := oci.ResolveReference(context.Background(), tag)
+	if err != nil {
+		return ispec.Descriptor{}, ispec.Manifest{}, err
+	}
+
+	if len(descPaths) != 1 {
+		return ispec.Descriptor{}, ispec.Manifest{}, errors.Errorf("bad number of manifests for %s: %d", tag, len(descPaths))
+	}
+
+	desc := descPaths[0].Descriptor()
+	blob, err := oci.FromDescriptor(context.Background(), desc)
+	if err != nil {
+		return ispec.Descriptor{}, ispec.Manifest{}, err
+	}
+	defer blob.Close()
+
+	manifest, ok := blob.Data.(ispec.Manifest)
+	if !ok {
+		return ispec.Descriptor{}, ispec.Manifest{}, errors.Errorf("%s isn't an image manifest: %s", tag, desc.MediaType)
+	}
+
+	return desc, manifest, nil
+}
+
+// resolveInRoot resolves the symlinks in rel, a path in the filesystem at
+// root, as if root was /; the last element of rel isn't resolved.
+func resolveInRoot(root string, rel string) (string, error) {
+	resolved := "/"
+	names := strings.Split(strings.Trim(path.Clean("/"+rel), "/"), "/")
+	for links := 0; len(names) > 1; {
+		next := path.Join(resolved, names[0])
+		names = names[1:]
+
+		st, err := os.Lstat(path.Join(root, next))
+		if err != nil || st.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		links++
+		if links > 40 {
+			return "", errors.Errorf("too many levels of symlinks in %s", rel)
+		}
+
+		target, err := os.Readlink(path.Join(root, next))
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+
+		if path.IsAbs(target) {
+			resolved = "/"
+		}
+		names = append(strings.Split(strings.Trim(path.Clean("/"+target), "/"), "/"), names...)
+	}
+
+	return path.Join(root, resolved, names[0]), nil
+}
+
+// stageArtifact writes the layers of an artifact to dir, named by their
+// title annotations.
+func stageArtifact(oci casext.Engine, manifest ispec.Manifest, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.WithStack(err)
+	}
+
+	for _, desc := range manifest.Layers {
+		name := desc.Annotations[ispec.AnnotationTitle]
+		if name == "" {
+			name = desc.Digest.Encoded()
+		}
+
+		if !filepath.IsLocal(name) {
+			return errors.Errorf("bad file name in artifact: %s", name)
+		}
+
+		dest := path.Join(dir, name)
+		if err := os.MkdirAll(path.Dir(dest), 0755); err != nil {
+			return errors.WithStack(err)
+		}
+
+		err := func() error {
+			blob, err := oci.GetVerifiedBlob(context.Background(), desc)
+			if err != nil {
+				return err
+			}
+			defer blob.Close()
+
+			out, err := os.Create(dest)
+			if err != nil {
+				return err
+			}
+			defer out.Close()
+
+			if _, err := io.Copy(out, blob); err != nil {
+				return err
+			}
+			return out.Close()
+		}()
+		if err != nil {
+			return errors.Wrapf(err, "couldn't write %s", name)
+		}
+	}
+
+	return nil
+}
+
+// stageImageImport pulls the image or artifact i is from, and puts what's
+// imported from it in the stacker dir, where it is kept until the image
+// changes. It returns where.
+func stageImageImport(c types.StackerConfig, i string, progress bool) (string, error) {
+	ref, imagePath := parseImageImport(i)
+	dir := path.Join(c.StackerDir, "imports-images", urlKey(i))
+	defer fetchLocks.lock(dir)()
+
+	if err := pullImageImport(c, ref, progress); err != nil {
+		return "", err
+	}
+
+	cacheDir := path.Join(c.StackerDir, "layer-bases", "oci")
+	unlock := fetchLocks.lock(cacheDir)
+	oci, err := umoci.OpenLayout(cacheDir)
+	if err != nil {
+		unlock()
+		return "", err
+	}
+	defer oci.Close()
+
+	desc, manifest, err := lookupManifest(oci, imageImportTag(ref))
+	unlock()
+	if err != nil {
+		return "", err
+	}
+
+	staged := path.Join(dir, imageImportName(i))
+	marker := path.Join(dir, ".manifest")
+	if content, err := os.ReadFile(marker); err == nil && string(content) == desc.Digest.String() {
+		return staged, nil
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	if imagePath == "" {
+		if err := stageArtifact(oci, manifest, staged); err != nil {
+			return "", err
+		}
+	} else {
+		rootfs := path.Join(dir, ".rootfs")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return "", errors.WithStack(err)
+		}
+
+		log.Infof("unpacking %s to import %s", ref, imagePath)
+		err = layer.UnpackRootfs(context.Background(), oci, rootfs, manifest, &layer.UnpackOptions{KeepDirlinks: true})
+		if err != nil {
+			return "", errors.Wrapf(err, "couldn't unpack %s", ref)
+		}
+
+		source, err := resolveInRoot(rootfs, imagePath)
+		if err != nil {
+			return "", err
+		}
+
+		if err := os.Rename(source, staged); err != nil {
+			return "", errors.Wrapf(err, "couldn't find %s in %s", imagePath, ref)
+		}
+
+		if err := os.RemoveAll(rootfs); err != nil {
+			return "", errors.WithStack(err)
+		}
+	}
+
+	return staged, errors.WithStack(os.WriteFile(marker, []byte(desc.Digest.String()), 0644))
+}
+
+// verifyArtifactHash checks the hash of an artifact import, which is the hash
+// of the one file in it.
+func verifyArtifactHash(dir string, hash string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if len(entries) != 1 || !entries[0].Type().IsRegular() {
+		return errors.Errorf("a hash can only be given for artifacts with one file in them")
+	}
+
+	_, err = verifyImportFileHash(path.Join(dir, entries[0].Name()), hash)
+	return err
+}
@@ -0,0 +1,130 @@
+package stacker
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/stretchr/testify/assert"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+func putBlob(t *testing.T, oci casext.Engine, mediaType string, content []byte, annotations map[string]string) v1.Descriptor {
+	digest, size, err := oci.PutBlob(context.Background(), bytes.NewReader(content))
+	assert.NoError(t, err)
+	return v1.Descriptor{MediaType: mediaType, Digest: digest, Size: size, Annotations: annotations}
+}
+
+func putManifest(t *testing.T, oci casext.Engine, tag string, manifest v1.Manifest) {
+	manifest.Versioned = ispec.Versioned{SchemaVersion: 2}
+	manifest.MediaType = v1.MediaTypeImageManifest
+	digest, size, err := oci.PutBlobJSON(context.Background(), manifest)
+	assert.NoError(t, err)
+	desc := v1.Descriptor{MediaType: v1.MediaTypeImageManifest, Digest: digest, Size: size}
+	assert.NoError(t, oci.UpdateReference(context.Background(), tag, desc))
+}
+
+// imageLayout makes an OCI layout with an artifact with a tool and its
+// README in it, and an image with the tool in /usr/bin, which /bin links to.
+func imageLayout(t *testing.T) string {
+	dir := path.Join(t.TempDir(), "tools")
+	oci, err := umoci.CreateLayout(dir)
+	assert.NoError(t, err)
+	defer oci.Close()
+
+	empty := putBlob(t, oci, v1.MediaTypeEmptyJSON, []byte("{}"), nil)
+	putManifest(t, oci, "artifact", v1.Manifest{
+		ArtifactType: "application/vnd.example.tool",
+		Config:       empty,
+		Layers: []v1.Descriptor{
+			putBlob(t, oci, "application/octet-stream", []byte("#!/bin/sh"), map[string]string{v1.AnnotationTitle: "tool"}),
+			putBlob(t, oci, "text/plain", []byte("read me"), map[string]string{v1.AnnotationTitle: "README"}),
+		},
+	})
+
+	buf := bytes.Buffer{}
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []*tar.Header{
+		{Name: "usr/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "usr/bin/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "usr/bin/tool", Typeflag: tar.TypeReg, Mode: 0755, Size: 9},
+		{Name: "bin", Typeflag: tar.TypeSymlink, Linkname: "usr/bin"},
+	} {
+		assert.NoError(t, tw.WriteHeader(hdr))
+		if hdr.Typeflag == tar.TypeReg {
+			_, err := tw.Write([]byte("#!/bin/sh"))
+			assert.NoError(t, err)
+		}
+	}
+	assert.NoError(t, tw.Close())
+
+	layer := putBlob(t, oci, v1.MediaTypeImageLayer, buf.Bytes(), nil)
+	config, size, err := oci.PutBlobJSON(context.Background(), v1.Image{
+		Platform: v1.Platform{OS: "linux", Architecture: "amd64"},
+		RootFS:   v1.RootFS{Type: "layers", DiffIDs: []digest.Digest{layer.Digest}},
+	})
+	assert.NoError(t, err)
+	putManifest(t, oci, "image", v1.Manifest{
+		Config: v1.Descriptor{MediaType: v1.MediaTypeImageConfig, Digest: config, Size: size},
+		Layers: []v1.Descriptor{layer},
+	})
+
+	return dir
+}
+
+func TestImageImportName(t *testing.T) {
+	assert := assert.New(t)
+
+	for i, expected := range map[string]string{
+		"docker://example.com/tools/tool:1.0":                "tool",
+		"docker://localhost:5000/tool@sha256:abcd":           "tool",
+		"docker://example.com/tools:1.0#/usr/bin/tool":       "tool",
+		"oci:///path/to/layout:tag":                          "layout",
+		"oci:///path/to/layout:tag#/etc/ssl/certs/":          "certs",
+		"docker://example.com/org/repo:latest#/opt/app/data": "data",
+	} {
+		assert.Equal(expected, imageImportName(i), i)
+	}
+}
+
+func TestImageImports(t *testing.T) {
+	assert := assert.New(t)
+	layout := imageLayout(t)
+	config := types.StackerConfig{StackerDir: t.TempDir()}
+
+	staged, err := stageImageImport(config, "oci://"+layout+":artifact", false)
+	assert.NoError(err)
+	assert.Equal("tools", path.Base(staged))
+	content, err := os.ReadFile(path.Join(staged, "tool"))
+	assert.NoError(err)
+	assert.Equal("#!/bin/sh", string(content))
+	assert.FileExists(path.Join(staged, "README"))
+
+	// a hash is only for artifacts with one file
+	assert.Error(verifyArtifactHash(staged, "abcd"))
+
+	// files are found through the image's own symlinks
+	staged, err = stageImageImport(config, "oci://"+layout+":image#/bin/tool", false)
+	assert.NoError(err)
+	content, err = os.ReadFile(staged)
+	assert.NoError(err)
+	assert.Equal("#!/bin/sh", string(content))
+
+	_, err = stageImageImport(config, "oci://"+layout+":image#/missing", false)
+	assert.Error(err)
+
+	// fetched images can be used offline
+	config.Offline = true
+	_, err = stageImageImport(config, "oci://"+layout+":artifact", false)
+	assert.NoError(err)
+	_, err = stageImageImport(config, "oci://"+layout+":other", false)
+	assert.Error(err)
+}
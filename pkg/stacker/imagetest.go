@@ -0,0 +1,345 @@
+package stacker
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"stackerbuild.io/stacker/pkg/container"
+	"stackerbuild.io/stacker/pkg/log"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+// TestResult is the outcome of a single image test case.
+type TestResult struct {
+	Name     string        `json:"name"`
+	Failure  string        `json:"failure,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// TestSuite is the set of test results for one image.
+type TestSuite struct {
+	Name    string
+	Results []TestResult
+}
+
+// Failed returns the number of failed test cases in the suite.
+func (ts TestSuite) Failed() int {
+	failed := 0
+	for _, r := range ts.Results {
+		if r.Failure != "" {
+			failed++
+		}
+	}
+	return failed
+}
+
+// ImageTestOpts are the arguments to RunImageTests.
+type ImageTestOpts struct {
+	Config  types.StackerConfig
+	Storage types.Storage
+
+	// Name is the storage snapshot containing the image's rootfs.
+	Name string
+
+	Test        types.ImageTest
+	ImageConfig ispec.ImageConfig
+}
+
+// RunImageTests runs the checks described in a layer's 'test' directive
+// against the image in opts.Name. An error is only returned if the tests
+// could not be run; individual test failures are recorded in the suite.
+func RunImageTests(opts ImageTestOpts) (TestSuite, error) {
+	suite := TestSuite{Name: opts.Name}
+
+	if opts.Test.Config != nil {
+		suite.Results = append(suite.Results, checkConfig(*opts.Test.Config, opts.ImageConfig)...)
+	}
+
+	if len(opts.Test.Files) == 0 && len(opts.Test.Run) == 0 {
+		return suite, nil
+	}
+
+	writable, cleanup, err := opts.Storage.TemporaryWritableSnapshot(opts.Name)
+	if err != nil {
+		return suite, err
+	}
+	defer cleanup()
+
+	dir, err := os.MkdirTemp(opts.Config.StackerDir, fmt.Sprintf("test-%s-", opts.Name))
+	if err != nil {
+		return suite, errors.Wrapf(err, "failed to create test tempdir")
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := container.New(opts.Config, writable)
+	if err != nil {
+		return suite, err
+	}
+	defer c.Close()
+
+	inDir := types.InternalStackerDir
+	err = SetupBuildContainerConfig(opts.Config, opts.Storage, c, inDir, writable)
+	if err != nil {
+		return suite, err
+	}
+
+	for _, env := range opts.ImageConfig.Env {
+		err = c.SetConfig("lxc.environment", env)
+		if err != nil {
+			return suite, err
+		}
+	}
+
+	// /stacker/test
+	testInDir := filepath.Join(inDir, "test")
+	err = c.BindMount(dir, testInDir, "")
+	if err != nil {
+		return suite, err
+	}
+
+	if len(opts.Test.Files) > 0 {
+		content, err := json.Marshal(opts.Test.Files)
+		if err != nil {
+			return suite, errors.Wrapf(err, "couldn't marshal file tests")
+		}
+
+		err = os.WriteFile(filepath.Join(dir, "files.json"), content, 0644)
+		if err != nil {
+			return suite, errors.Wrapf(err, "couldn't write file tests")
+		}
+
+		err = c.Execute([]string{
+			filepath.Join(inDir, types.BinStacker), "internal-go", "check-files",
+			filepath.Join(testInDir, "files.json"),
+			filepath.Join(testInDir, "results.json"),
+		}, nil)
+		if err != nil {
+			return suite, errors.Wrapf(err, "failed to check files")
+		}
+
+		content, err = os.ReadFile(filepath.Join(dir, "results.json"))
+		if err != nil {
+			return suite, errors.Wrapf(err, "couldn't read file test results")
+		}
+
+		results := []TestResult{}
+		if err := json.Unmarshal(content, &results); err != nil {
+			return suite, errors.Wrapf(err, "couldn't parse file test results")
+		}
+		suite.Results = append(suite.Results, results...)
+	}
+
+	rootfs := filepath.Join(opts.Config.RootFSDir, writable, "rootfs")
+	for i, cmd := range opts.Test.Run {
+		script := fmt.Sprintf(".stacker-test-%d.sh", i)
+		err = generateShellForRunning(rootfs, []string{cmd}, filepath.Join(dir, script))
+		if err != nil {
+			return suite, err
+		}
+
+		start := time.Now()
+		result := TestResult{Name: fmt.Sprintf("run: %s", strings.TrimSpace(cmd))}
+		err = c.Execute([]string{filepath.Join(testInDir, script)}, nil)
+		result.Duration = time.Since(start)
+		if err != nil {
+			result.Failure = err.Error()
+		}
+		suite.Results = append(suite.Results, result)
+	}
+
+	return suite, nil
+}
+
+// CheckFiles evaluates the file tests against the current root filesystem;
+// it is run inside the image under test.
+func CheckFiles(tests []types.FileTest) []TestResult {
+	results := []TestResult{}
+	for _, ft := range tests {
+		start := time.Now()
+		result := TestResult{Name: fmt.Sprintf("file: %s", ft.Path)}
+		if err := checkFile(ft); err != nil {
+			result.Failure = err.Error()
+		}
+		result.Duration = time.Since(start)
+		results = append(results, result)
+	}
+
+	return results
+}
+
+func checkFile(ft types.FileTest) error {
+	fi, err := os.Lstat(ft.Path)
+	if ft.Absent {
+		if err == nil {
+			return errors.Errorf("%s exists", ft.Path)
+		}
+		if !os.IsNotExist(err) {
+			return errors.Wrapf(err, "couldn't stat %s", ft.Path)
+		}
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "couldn't stat %s", ft.Path)
+	}
+
+	switch ft.Type {
+	case types.FileTestTypeFile:
+		if !fi.Mode().IsRegular() {
+			return errors.Errorf("%s is not a regular file", ft.Path)
+		}
+	case types.FileTestTypeDir:
+		if !fi.IsDir() {
+			return errors.Errorf("%s is not a directory", ft.Path)
+		}
+	case types.FileTestTypeSymlink:
+		if fi.Mode()&fs.ModeSymlink == 0 {
+			return errors.Errorf("%s is not a symlink", ft.Path)
+		}
+	}
+
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return errors.Errorf("couldn't get stat info for %s", ft.Path)
+	}
+
+	if ft.Mode != nil && fs.FileMode(stat.Mode&07777) != *ft.Mode {
+		return errors.Errorf("%s has mode %#o, expected %#o", ft.Path, stat.Mode&07777, uint32(*ft.Mode))
+	}
+
+	if ft.Uid != nil && int(stat.Uid) != *ft.Uid {
+		return errors.Errorf("%s has uid %d, expected %d", ft.Path, stat.Uid, *ft.Uid)
+	}
+
+	if ft.Gid != nil && int(stat.Gid) != *ft.Gid {
+		return errors.Errorf("%s has gid %d, expected %d", ft.Path, stat.Gid, *ft.Gid)
+	}
+
+	return nil
+}
+
+func checkConfig(expected types.ConfigTest, actual ispec.ImageConfig) []TestResult {
+	results := []TestResult{}
+	check := func(name string, ok bool, format string, args ...interface{}) {
+		result := TestResult{Name: fmt.Sprintf("config: %s", name)}
+		if !ok {
+			result.Failure = fmt.Sprintf(format, args...)
+		}
+		results = append(results, result)
+	}
+
+	env := map[string]string{}
+	for _, e := range actual.Env {
+		k, v, _ := strings.Cut(e, "=")
+		env[k] = v
+	}
+	for _, k := range slices.Sorted(maps.Keys(expected.Env)) {
+		v, ok := env[k]
+		check("env "+k, ok && v == expected.Env[k], "env %s is %q, expected %q", k, v, expected.Env[k])
+	}
+
+	if expected.Entrypoint != nil {
+		check("entrypoint", reflect.DeepEqual([]string(expected.Entrypoint), actual.Entrypoint),
+			"entrypoint is %q, expected %q", actual.Entrypoint, []string(expected.Entrypoint))
+	}
+
+	if expected.Cmd != nil {
+		check("cmd", reflect.DeepEqual([]string(expected.Cmd), actual.Cmd),
+			"cmd is %q, expected %q", actual.Cmd, []string(expected.Cmd))
+	}
+
+	if expected.WorkingDir != "" {
+		check("working_dir", expected.WorkingDir == actual.WorkingDir,
+			"working_dir is %q, expected %q", actual.WorkingDir, expected.WorkingDir)
+	}
+
+	if expected.User != "" {
+		check("user", expected.User == actual.User, "user is %q, expected %q", actual.User, expected.User)
+	}
+
+	for _, k := range slices.Sorted(maps.Keys(expected.Labels)) {
+		v, ok := actual.Labels[k]
+		check("label "+k, ok && v == expected.Labels[k], "label %s is %q, expected %q", k, v, expected.Labels[k])
+	}
+
+	return results
+}
+
+// LogTestSuite logs the results of an image test suite.
+func LogTestSuite(suite TestSuite) {
+	for _, r := range suite.Results {
+		if r.Failure != "" {
+			log.Infof("FAIL %s: %s: %s", suite.Name, r.Name, r.Failure)
+		} else {
+			log.Infof("PASS %s: %s", suite.Name, r.Name)
+		}
+	}
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Time      string          `xml:"time,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+}
+
+// WriteJUnit writes the test suites as a JUnit XML report.
+func WriteJUnit(w io.Writer, suites []TestSuite) error {
+	report := junitTestSuites{}
+	for _, suite := range suites {
+		js := junitTestSuite{Name: suite.Name, Tests: len(suite.Results), Failures: suite.Failed()}
+		total := time.Duration(0)
+		for _, r := range suite.Results {
+			tc := junitTestCase{Name: r.Name, ClassName: suite.Name, Time: fmt.Sprintf("%.3f", r.Duration.Seconds())}
+			if r.Failure != "" {
+				tc.Failure = &junitFailure{Message: r.Failure}
+			}
+			total += r.Duration
+			js.TestCases = append(js.TestCases, tc)
+		}
+		js.Time = fmt.Sprintf("%.3f", total.Seconds())
+		report.Suites = append(report.Suites, js)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return errors.WithStack(err)
+	}
+
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		return errors.Wrapf(err, "couldn't encode junit report")
+	}
+
+	_, err := io.WriteString(w, "\n")
+	return errors.WithStack(err)
+}
@@ -0,0 +1,92 @@
+package stacker
+
+import (
+	"bytes"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+func TestCheckConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	actual := ispec.ImageConfig{
+		Env:        []string{"PATH=/bin", "FOO=bar=baz"},
+		Entrypoint: []string{"/bin/app"},
+		WorkingDir: "/srv",
+		Labels:     map[string]string{"version": "1"},
+	}
+
+	results := checkConfig(types.ConfigTest{
+		Env:        map[string]string{"FOO": "bar=baz"},
+		Entrypoint: types.Command{"/bin/app"},
+		WorkingDir: "/srv",
+		Labels:     map[string]string{"version": "1"},
+	}, actual)
+	assert.Len(results, 4)
+	assert.Equal(0, TestSuite{Results: results}.Failed())
+
+	results = checkConfig(types.ConfigTest{
+		Env:  map[string]string{"MISSING": "x"},
+		Cmd:  types.Command{"serve"},
+		User: "app",
+	}, actual)
+	assert.Equal(3, TestSuite{Results: results}.Failed())
+	assert.Equal("config: env MISSING", results[0].Name)
+}
+
+func TestCheckFiles(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	assert.NoError(os.WriteFile(file, []byte("hello"), 0600))
+	assert.NoError(os.Chmod(file, 0640))
+	link := filepath.Join(dir, "link")
+	assert.NoError(os.Symlink(file, link))
+
+	mode := fs.FileMode(0640)
+	uid := os.Getuid()
+	results := CheckFiles([]types.FileTest{
+		{Path: file, Type: types.FileTestTypeFile, Mode: &mode, Uid: &uid},
+		{Path: link, Type: types.FileTestTypeSymlink},
+		{Path: dir, Type: types.FileTestTypeDir},
+		{Path: filepath.Join(dir, "missing"), Absent: true},
+	})
+	assert.Equal(0, TestSuite{Results: results}.Failed())
+
+	wrongMode := fs.FileMode(0755)
+	results = CheckFiles([]types.FileTest{
+		{Path: file, Mode: &wrongMode},
+		{Path: link, Type: types.FileTestTypeFile},
+		{Path: file, Absent: true},
+		{Path: filepath.Join(dir, "missing")},
+	})
+	assert.Equal(4, TestSuite{Results: results}.Failed())
+	assert.Contains(results[0].Failure, "has mode 0640, expected 0755")
+}
+
+func TestWriteJUnit(t *testing.T) {
+	assert := assert.New(t)
+
+	suites := []TestSuite{{
+		Name: "app",
+		Results: []TestResult{
+			{Name: "run: true", Duration: 1500 * time.Millisecond},
+			{Name: "file: /etc/app", Failure: "couldn't stat /etc/app"},
+		},
+	}}
+
+	buf := bytes.Buffer{}
+	assert.NoError(WriteJUnit(&buf, suites))
+	out := buf.String()
+	assert.Contains(out, `<testsuite name="app" tests="2" failures="1" time="1.500">`)
+	assert.Contains(out, `<testcase name="run: true" classname="app" time="1.500"></testcase>`)
+	assert.Contains(out, `<failure message="couldn&#39;t stat /etc/app"></failure>`)
+}
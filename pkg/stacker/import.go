@@ -1,10 +1,13 @@
 package stacker
 
 import (
+	"context"
+	"fmt"
 	"io"
 	"io/fs"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
 
 	"github.com/opencontainers/go-digest"
@@ -14,6 +17,7 @@ import (
 	"github.com/vbatts/go-mtree"
 	"stackerbuild.io/stacker/pkg/lib"
 	"stackerbuild.io/stacker/pkg/log"
+	"stackerbuild.io/stacker/pkg/overlay"
 	"stackerbuild.io/stacker/pkg/types"
 )
 
@@ -94,7 +98,7 @@ func verifyImportFileHash(imp string, hash string) (string, error) {
 	return actualHash, nil
 }
 
-func importFile(imp string, cacheDir string, hash string, idest string, mode *fs.FileMode, uid, gid int) (string, error) {
+func importFile(imp string, cacheDir string, hash string, idest string, mode *fs.FileMode, uid, gid int, filter *importFilter) (string, error) {
 	e1, err := os.Lstat(imp)
 	if err != nil {
 		return "", errors.Wrapf(err, "couldn't stat import %s", imp)
@@ -133,9 +137,11 @@ func importFile(imp string, cacheDir string, hash string, idest string, mode *fs
 		return dest, nil
 	}
 
+	// a dir is copied into cacheDir under its own name, or its dest's if
+	// it is renamed; with a trailing slash only its contents are copied
 	var dest string
 	if imp[len(imp)-1:] != "/" {
-		if idest != "" && path.Base(imp) != path.Base(idest) {
+		if idest != "" && path.Base(imp) != path.Base(idest) && idest[len(idest)-1:] != "/" {
 			dest = path.Join(cacheDir, path.Base(idest))
 		} else {
 			dest = path.Join(cacheDir, path.Base(imp))
@@ -148,12 +154,12 @@ func importFile(imp string, cacheDir string, hash string, idest string, mode *fs
 		return "", errors.Wrapf(err, "failed making cache dir")
 	}
 
-	existing, err := walkImport(dest)
+	existing, err := walkImport(dest, nil)
 	if err != nil {
 		return "", errors.Wrapf(err, "failed walking existing import dir")
 	}
 
-	toImport, err := walkImport(imp)
+	toImport, err := walkImport(imp, filter)
 	if err != nil {
 		return "", errors.Wrapf(err, "failed walking dir to import")
 	}
@@ -166,29 +172,16 @@ func importFile(imp string, cacheDir string, hash string, idest string, mode *fs
 	for _, d := range diff {
 		switch d.Type() {
 		case mtree.Missing:
-			p := path.Join(cacheDir, path.Base(imp), d.Path())
+			p := path.Join(dest, d.Path())
 			err := os.RemoveAll(p)
 			if err != nil {
-				return "", errors.Wrapf(err, "couldn't remove missing import %s", path.Join(cacheDir, path.Base(imp), d.Path()))
+				return "", errors.Wrapf(err, "couldn't remove missing import %s", p)
 			}
 		case mtree.Modified:
 			fallthrough
 		case mtree.Extra:
 			srcpath := path.Join(imp, d.Path())
-			var destpath string
-			if imp[len(imp)-1:] != "/" {
-				if idest != "" && path.Base(imp) != path.Base(idest) {
-					if idest[len(idest)-1:] != "/" {
-						destpath = path.Join(cacheDir, path.Base(idest), d.Path())
-					} else {
-						destpath = path.Join(cacheDir, path.Base(imp), d.Path())
-					}
-				} else {
-					destpath = path.Join(cacheDir, path.Base(imp), d.Path())
-				}
-			} else {
-				destpath = path.Join(cacheDir, d.Path())
-			}
+			destpath := path.Join(dest, d.Path())
 
 			if d.New().IsDir() {
 				fi, err := os.Lstat(destpath)
@@ -251,9 +244,9 @@ func validateHash(hash string) error {
 
 // downloads or copies import url depending on scheme, and returns the path and
 // hash of the downloaded file
-func acquireUrl(c types.StackerConfig, storage types.Storage, i string, cache string, expectedHash string,
-	idest string, mode *fs.FileMode, uid, gid int, progress bool,
-) (string, string, error) {
+func acquireUrl(c types.StackerConfig, storage types.Storage, imp types.Import, cache string, progress bool) (string, string, error) {
+	i, expectedHash, idest, mode, uid, gid := imp.Path, imp.Hash, imp.Dest, imp.Mode, imp.Uid, imp.Gid
+
 	url, err := types.NewDockerishUrl(i)
 	if err != nil {
 		return "", "", err
@@ -264,9 +257,27 @@ func acquireUrl(c types.StackerConfig, storage types.Storage, i string, cache st
 		return "", "", err
 	}
 
+	filter, err := newImportFilter(imp)
+	if err != nil {
+		return "", "", err
+	}
+
 	// It's just a path, let's copy it to .stacker.
 	if url.Scheme == "" {
-		path, err := importFile(i, cache, expectedHash, idest, mode, uid, gid)
+		path, err := importFile(i, cache, expectedHash, idest, mode, uid, gid, filter)
+		return path, "", err
+	} else if (url.Scheme == "http" || url.Scheme == "https") && (imp.Checksums != "" || imp.Signature != "") {
+		// verified where it's downloaded, before it's copied to the imports dir
+		path, err := acquireVerifiedUrl(c, imp, cache, progress)
+		return path, "", err
+	} else if (url.Scheme == "http" || url.Scheme == "https") && c.Offline {
+		// use what stacker fetch downloaded instead
+		fetched := fetchedPath(c, i)
+		if !lib.PathExists(fetched) {
+			return "", "", errors.Errorf("offline: %s wasn't fetched, run 'stacker fetch' first", i)
+		}
+
+		path, err := importFile(fetched, cache, expectedHash, idest, mode, uid, gid, nil)
 		return path, "", err
 	} else if url.Scheme == "http" || url.Scheme == "https" {
 		// otherwise, we need to download it
@@ -283,14 +294,40 @@ func acquireUrl(c types.StackerConfig, storage types.Storage, i string, cache st
 			return "", "", errors.Errorf("The requested hash of %s import is different than the actual hash: %s != %s",
 				i, expectedHash, remoteHash)
 		}
-		path, err := Download(cache, i, progress, expectedHash, remoteHash, remoteSize, idest, mode, uid, gid)
+		path, err := Download(cache, i, imp.Mirrors, c.DownloadRetries, fetchProgress(c, progress), expectedHash, remoteHash, remoteSize, idest, mode, uid, gid)
 		return path, remoteHash, err
+	} else if types.IsGitUrl(i) {
+		checkout, _, err := gitCheckout(c, i, imp.Ref, imp.Submodules)
+		if err != nil {
+			return "", "", err
+		}
+
+		// git imports are pinned by commit rather than hash
+		path, err := importFile(checkout, cache, "", idest, mode, uid, gid, filter)
+		return path, "", err
+	} else if types.IsImageUrl(i) {
+		staged, err := stageImageImport(c, i, progress)
+		if err != nil {
+			return "", "", err
+		}
+
+		hash := expectedHash
+		if _, imagePath := parseImageImport(i); imagePath == "" && hash != "" {
+			if err := verifyArtifactHash(staged, hash); err != nil {
+				return "", "", err
+			}
+			hash = ""
+		}
+
+		path, err := importFile(staged, cache, hash, idest, mode, uid, gid, filter)
+		return path, "", err
 	} else if url.Scheme == "stacker" {
 		// we always Grab() things from stacker://, because we need to
 		// mount the container's rootfs to get them and don't
 		// necessarily have a good way to do that. so this i/o is
 		// always done.
 		p := path.Join(cache, path.Base(url.Path))
+		defer fetchLocks.lock("stacker://" + url.Host)()
 		snap, cleanup, err := storage.TemporaryWritableSnapshot(url.Host)
 		if err != nil {
 			return "", "", err
@@ -308,32 +345,186 @@ func acquireUrl(c types.StackerConfig, storage types.Storage, i string, cache st
 	return "", "", errors.Errorf("unsupported url scheme %s", i)
 }
 
-func CleanImportsDir(c types.StackerConfig, name string, imports types.Imports, cache *BuildCache) error {
-	// remove all copied imports
-	dir := path.Join(c.StackerDir, "imports-copy", name)
-	_ = os.RemoveAll(dir)
+// importCopyDir is where an import with a dest is copied to before it's
+// overlaid onto the rootfs. It only depends on the import, so that it can be
+// kept and cached across builds.
+func importCopyDir(c types.StackerConfig, name string, imp types.Import) string {
+	id := imp.Path + "\x00" + imp.Dest
+	if imp.Extract {
+		id += "\x00extract"
+	}
+	key := urlKey(id)
+	return path.Join(c.StackerDir, "imports-copy", name, fmt.Sprintf("%s-%s", importName(imp.Path), key[:12]))
+}
+
+// importArchiveDir is where the archive of an import with extract that is
+// unpacked to dir is kept.
+func importArchiveDir(dir string) string {
+	return dir + ".archive"
+}
+
+// extractImport unpacks the archive imp points to to dir, unless what's there
+// was unpacked from the same archive with the same mode and owner.
+func extractImport(c types.StackerConfig, storage types.Storage, imp types.Import, dir string, progress bool) error {
+	archiveDir := importArchiveDir(dir)
+	if err := os.MkdirAll(archiveDir, 0755); err != nil {
+		return errors.Wrapf(err, "couldn't create import archive directory")
+	}
+
+	// the mode and owner are for what's in the archive
+	archiveImp := imp
+	archiveImp.Dest, archiveImp.Extract = "", false
+	archiveImp.Mode, archiveImp.Uid, archiveImp.Gid = nil, lib.UidEmpty, lib.GidEmpty
+
+	archive, _, err := acquireUrl(c, storage, archiveImp, archiveDir, progress)
+	if err != nil {
+		return err
+	}
+
+	st, err := os.Stat(archive)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if st.IsDir() {
+		return errors.Errorf("can't extract %s: it is a directory", imp.Path)
+	}
+
+	hash, err := lib.HashFile(archive, false)
+	if err != nil {
+		return err
+	}
+
+	key := fmt.Sprintf("%s uid=%d gid=%d", hash, imp.Uid, imp.Gid)
+	if imp.Mode != nil {
+		key += fmt.Sprintf(" mode=%o", *imp.Mode)
+	}
+
+	marker := path.Join(archiveDir, ".extracted")
+	if content, err := os.ReadFile(marker); err == nil && string(content) == key {
+		log.Infof("using cached extraction of %s", imp.Path)
+		return nil
+	}
+
+	log.Infof("extracting %s", imp.Path)
+	if err := os.RemoveAll(marker); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err := unpackArchive(dir, archive); err != nil {
+		return errors.Wrapf(err, "couldn't extract %s", imp.Path)
+	}
+
+	// the overrides apply to everything in the archive; the mode only
+	// to files, since directories need to stay searchable
+	err = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if p == dir {
+			return nil
+		}
+
+		if imp.Uid != lib.UidEmpty || imp.Gid != lib.GidEmpty {
+			if err := os.Lchown(p, imp.Uid, imp.Gid); err != nil {
+				return errors.Wrapf(err, "couldn't set ownership of %s", p)
+			}
+		}
+
+		if imp.Mode != nil && d.Type().IsRegular() {
+			if err := os.Chmod(p, *imp.Mode); err != nil {
+				return errors.Wrapf(err, "couldn't set mode of %s", p)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return errors.WithStack(os.WriteFile(marker, []byte(key), 0644))
+}
+
+// importDiskPath is where imp ends up before the layer is built.
+func importDiskPath(c types.StackerConfig, name string, imp types.Import) string {
+	if imp.Dest != "" {
+		return importCopyDir(c, name, imp)
+	}
+	return path.Join(c.StackerDir, "imports", name, importName(imp.Path))
+}
+
+// importName is the name of the file or directory an import is copied to.
+func importName(i string) string {
+	if types.IsGitUrl(i) {
+		return gitRepoName(i)
+	}
+	if types.IsImageUrl(i) {
+		return imageImportName(i)
+	}
+	return path.Base(i)
+}
 
+// importDiskFilter is the filter for walks of importDiskPath(imp). Imports
+// with a dest are copied to a directory of their own, which only has what
+// the filter let through in it, and under another root.
+func importDiskFilter(imp types.Import) (*importFilter, error) {
+	if imp.Dest != "" {
+		return nil, nil
+	}
+	return newImportFilter(imp)
+}
+
+// importCacheKey is the key of imp in a CacheEntry's Imports; the same path
+// can be imported to several dests.
+func importCacheKey(imp types.Import) string {
+	if imp.Dest != "" {
+		return fmt.Sprintf("%s -> %s", imp.Path, imp.Dest)
+	}
+	return imp.Path
+}
+
+func CleanImportsDir(c types.StackerConfig, name string, imports types.Imports, cache *BuildCache) error {
 	// remove all artifacts
-	dir = path.Join(c.StackerDir, "artifacts", name)
+	dir := path.Join(c.StackerDir, "artifacts", name)
 	_ = os.RemoveAll(dir)
 
 	dir = path.Join(c.StackerDir, "imports", name)
+	cpdir := path.Join(c.StackerDir, "imports-copy", name)
 
 	cacheEntry, cacheHit := cache.Cache[name]
 	if !cacheHit {
 		// no previous build means we should delete everything that was
 		// imported; who knows where it came from.
+		if err := os.RemoveAll(cpdir); err != nil {
+			return err
+		}
 		return os.RemoveAll(dir)
 	}
 
 	// If the base name of two things was the same across builds
 	// but the URL they were imported from was different, let's
-	// make sure we invalidate the cached version.
+	// make sure we invalidate the cached version. Imports with a
+	// dest have their own directories, so they don't need this.
 	for _, i := range imports {
-		for cached := range cacheEntry.Imports {
-			if path.Base(cached) == path.Base(i.Path) && cached != i.Path {
+		if i.Dest != "" {
+			continue
+		}
+		for cached, ih := range cacheEntry.Imports {
+			if ih.Dest != "" {
+				continue
+			}
+			if importName(cached) == importName(i.Path) && cached != i.Path {
 				log.Infof("%s url changed to %s, pruning cache", cached, i.Path)
-				err := os.RemoveAll(path.Join(dir, path.Base(i.Path)))
+				err := os.RemoveAll(path.Join(dir, importName(i.Path)))
 				if err != nil {
 					return err
 				}
@@ -344,84 +535,174 @@ func CleanImportsDir(c types.StackerConfig, name string, imports types.Imports,
 	return nil
 }
 
-// Import files from different sources to an ephemeral or permanent destination.
-func Import(c types.StackerConfig, storage types.Storage, name string, imports types.Imports, overlayDirs *types.OverlayDirs, progress bool) error {
+// importJob is an import of a layer, and where it's acquired to.
+type importJob struct {
+	imp   types.Import
+	cache string
+	name  string
+	hash  string
+}
+
+// addImportJobs sets up the directories the imports of layer name are
+// acquired to, and adds jobs that acquire them to pool. Imports that are
+// acquired to the same place are acquired by the same job, in order. The
+// function it returns deletes what's left of old imports, and logs the hashes
+// of the downloaded ones; it must only be called once the pool ran.
+func addImportJobs(pool *overlay.ThreadPool, c types.StackerConfig, storage types.Storage, name string, imports types.Imports, overlayDirs *types.OverlayDirs, progress bool) (func() error, error) {
 	dir := path.Join(c.StackerDir, "artifacts", name)
 
 	if err := os.MkdirAll(dir, 0755); err != nil {
-		return err
+		return nil, err
 	}
 
 	dir = path.Join(c.StackerDir, "imports", name)
 
 	if err := os.MkdirAll(dir, 0755); err != nil {
-		return err
+		return nil, err
 	}
 
 	cpdir := path.Join(c.StackerDir, "imports-copy", name)
 
 	if err := os.MkdirAll(cpdir, 0755); err != nil {
-		return err
+		return nil, err
 	}
 
 	existing, err := os.ReadDir(dir)
 	if err != nil {
-		return errors.Wrapf(err, "couldn't read existing directory")
+		return nil, errors.Wrapf(err, "couldn't read existing directory")
 	}
 
-	importHashes := map[string]string{}
-	for _, i := range imports {
-		cache := dir
+	existingCopies, err := os.ReadDir(cpdir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't read existing directory")
+	}
+
+	jobs := make([]*importJob, len(imports))
+	groups := map[string][]*importJob{}
+	keys := []string{}
+	for idx, i := range imports {
+		job := &importJob{imp: i, cache: dir}
+		jobs[idx] = job
 
 		// if "import" directives has a "dest", then convert them into overlay_dir entries
 		if i.Dest != "" {
-			tmpdir, err := os.MkdirTemp(cpdir, "")
-			if err != nil {
-				return errors.Wrapf(err, "couldn't create temp import copy directory")
+			tmpdir := importCopyDir(c, name, i)
+			if err := os.MkdirAll(tmpdir, 0755); err != nil {
+				return nil, errors.Wrapf(err, "couldn't create import copy directory")
+			}
+
+			kept := existingCopies[:0]
+			for _, ext := range existingCopies {
+				if ext.Name() != path.Base(tmpdir) && ext.Name() != path.Base(importArchiveDir(tmpdir)) {
+					kept = append(kept, ext)
+				}
 			}
+			existingCopies = kept
 
 			dest := i.Dest
 
-			if i.Dest[len(i.Dest)-1:] != "/" && i.Path[len(i.Path)-1:] != "/" {
+			if !i.Extract && i.Dest[len(i.Dest)-1:] != "/" && i.Path[len(i.Path)-1:] != "/" {
 				dest = path.Dir(i.Dest)
 			}
 
 			ovl := types.OverlayDir{Source: tmpdir, Dest: dest}
 			*overlayDirs = append(*overlayDirs, ovl)
 
-			cache = tmpdir
+			job.cache = tmpdir
 		}
 
-		name, downloadedFileHash, err := acquireUrl(c, storage, i.Path, cache, i.Hash, i.Dest, i.Mode, i.Uid, i.Gid, progress)
-		if err != nil {
-			return err
+		key := job.cache
+		if i.Dest == "" {
+			key = path.Join(dir, importName(i.Path))
+		}
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
 		}
+		groups[key] = append(groups[key], job)
+	}
+
+	for _, key := range keys {
+		group := groups[key]
+		pool.Add(func(ctx context.Context) error {
+			for _, job := range group {
+				if ctx.Err() != nil {
+					return overlay.ThreadPoolCancelled
+				}
+
+				if job.imp.Extract {
+					if err := extractImport(c, storage, job.imp, job.cache, progress); err != nil {
+						return err
+					}
+					continue
+				}
+
+				var err error
+				job.name, job.hash, err = acquireUrl(c, storage, job.imp, job.cache, progress)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+
+	return func() error {
+		importHashes := map[string]string{}
+		for _, job := range jobs {
+			// "" is returned for local files, ignore they won't be checked anyway
+			if job.hash != "" {
+				importHashes[job.imp.Path] = job.hash
+			}
+
+			if job.imp.Dest != "" {
+				continue
+			}
 
-		// "" is returned for local files, ignore they won't be checked anyway
-		if downloadedFileHash != "" {
-			importHashes[i.Path] = downloadedFileHash
+			for i, ext := range existing {
+				if ext.Name() == path.Base(job.name) {
+					existing = append(existing[:i], existing[i+1:]...)
+					break
+				}
+			}
 		}
 
-		for i, ext := range existing {
-			if ext.Name() == path.Base(name) {
-				existing = append(existing[:i], existing[i+1:]...)
-				break
+		// Now, delete all the old imports.
+		for _, ext := range existing {
+			err := os.RemoveAll(path.Join(dir, ext.Name()))
+			if err != nil {
+				return err
 			}
 		}
-	}
 
-	// Now, delete all the old imports.
-	for _, ext := range existing {
-		err = os.RemoveAll(path.Join(dir, ext.Name()))
-		if err != nil {
-			return err
+		for _, ext := range existingCopies {
+			err := os.RemoveAll(path.Join(cpdir, ext.Name()))
+			if err != nil {
+				return err
+			}
+		}
+
+		log.Infof("imported file hashes (after substitutions):")
+		for path, hash := range importHashes {
+			log.Infof("  - path: %q\n    hash: %q", path, hash)
 		}
+
+		return nil
+	}, nil
+}
+
+// Import files from different sources to an ephemeral or permanent
+// destination. Up to fetchJobs(c) of them are acquired at the same time.
+func Import(c types.StackerConfig, storage types.Storage, name string, imports types.Imports, overlayDirs *types.OverlayDirs, progress bool) error {
+	pool := overlay.NewThreadPool(fetchJobs(c))
+	finish, err := addImportJobs(pool, c, storage, name, imports, overlayDirs, progress && fetchJobs(c) == 1)
+	if err != nil {
+		return err
 	}
 
-	log.Infof("imported file hashes (after substitutions):")
-	for path, hash := range importHashes {
-		log.Infof("  - path: %q\n    hash: %q", path, hash)
+	pool.DoneAddingJobs()
+	if err := pool.Run(); err != nil {
+		return err
 	}
 
-	return nil
+	return finish()
 }
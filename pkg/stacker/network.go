@@ -10,6 +10,7 @@ import (
 	"path"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/containers/image/v5/pkg/docker/config"
 	"github.com/containers/image/v5/types"
@@ -20,71 +21,150 @@ import (
 	"stackerbuild.io/stacker/pkg/log"
 )
 
-// download with caching support in the specified cache dir.
-func Download(cacheDir string, remoteUrl string, progress bool, expectedHash, remoteHash, remoteSize string,
-	idest string, mode *fs.FileMode, uid, gid int,
-) (string, error) {
-	var name string
-	if idest != "" && idest[len(idest)-1:] != "/" {
-		name = path.Join(cacheDir, path.Base(idest))
-	} else {
-		name = path.Join(cacheDir, path.Base(remoteUrl))
+// downloadRetryDelay is how long to wait before retrying a failed download;
+// it doubles after each try, up to maxDownloadRetryDelay.
+var (
+	downloadRetryDelay    = time.Second
+	maxDownloadRetryDelay = 30 * time.Second
+)
+
+// downloadProgressInterval is how often the progress of a download is logged
+// when it is shown in lines.
+const downloadProgressInterval = 5 * time.Second
+
+// progressLogger logs how much of a download was read so far, every
+// downloadProgressInterval.
+type progressLogger struct {
+	io.Reader
+	url  string
+	read int64
+	size int64
+	last time.Time
+}
+
+func (p *progressLogger) Read(b []byte) (int, error) {
+	n, err := p.Reader.Read(b)
+	p.read += int64(n)
+	if time.Since(p.last) >= downloadProgressInterval {
+		log.Infof("downloading %s: %d/%d bytes", p.url, p.read, p.size)
+		p.last = time.Now()
 	}
+	return n, err
+}
 
-	if fi, err := os.Stat(name); err == nil {
-		// Couldn't get remoteHash then use cached copy of import
-		if remoteHash == "" {
-			log.Infof("Couldn't obtain file info of %s, using cached copy", remoteUrl)
-			return name, nil
-		}
-		// File is found in cache
-		// need to check if cache is valid before using it
-		localHash, err := lib.HashFile(name, false)
-		if err != nil {
-			return "", err
-		}
-		localHash = strings.TrimPrefix(localHash, "sha256:")
-		localSize := strconv.FormatInt(fi.Size(), 10)
-		log.Debugf("Local file: hash: %s length: %s", localHash, localSize)
+type httpStatusError struct {
+	url    string
+	status string
+	code   int
+}
 
-		if localHash == remoteHash {
-			// Cached file has same hash as the remote file
-			log.Infof("matched hash of %s, using cached copy", remoteUrl)
-			return name, nil
-		} else if localSize == remoteSize {
-			// Cached file has same content length as the remote file
-			log.Infof("matched content length of %s, taking a leap of faith and using cached copy", remoteUrl)
-			return name, nil
+func (e httpStatusError) Error() string {
+	return fmt.Sprintf("couldn't download %s: %s", e.url, e.status)
+}
+
+// retryable is whether a failed download is worth trying again from the same
+// url: network and server errors are, client errors aren't.
+func retryable(err error) bool {
+	se, ok := errors.Cause(err).(httpStatusError)
+	if !ok {
+		return true
+	}
+
+	switch se.code {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusRequestedRangeNotSatisfiable:
+		return true
+	}
+	return se.code >= 500
+}
+
+// cachedDownloadValid is whether a previously downloaded copy of remoteUrl
+// can be used instead of downloading it again.
+func cachedDownloadValid(name string, fi os.FileInfo, remoteUrl, expectedHash, remoteHash, remoteSize string) (bool, error) {
+	hash := expectedHash
+	if hash == "" {
+		hash = remoteHash
+	}
+
+	if hash == "" {
+		// there's nothing but the size to check the cached copy against
+		localSize := strconv.FormatInt(fi.Size(), 10)
+		if remoteSize != "" && remoteSize != localSize {
+			return false, nil
 		}
-		// Cached file has a different hash from the remote one
-		// Need to cleanup
-		err = os.RemoveAll(name)
-		if err != nil {
-			return "", err
+		log.Infof("no hash for %s, taking a leap of faith and using cached copy", remoteUrl)
+		return true, nil
+	}
+
+	localHash, err := lib.HashFile(name, false)
+	if err != nil {
+		return false, err
+	}
+	localHash = strings.TrimPrefix(localHash, "sha256:")
+	log.Debugf("Local file: hash: %s length: %d", localHash, fi.Size())
+
+	if localHash != hash {
+		return false, nil
+	}
+
+	log.Infof("matched hash of %s, using cached copy", remoteUrl)
+	return true, nil
+}
+
+// partialValidator is where the validator (ETag or Last-Modified) of the
+// file a partial download is of is kept, so that it is only resumed if the
+// file didn't change since.
+func partialValidator(partial string) string {
+	return partial + ".validator"
+}
+
+// saveValidator keeps the validator of the file resp is for in validatorPath,
+// or removes what's there if resp has none. Weak ETags can't be used to
+// resume downloads.
+func saveValidator(validatorPath string, resp *http.Response) error {
+	validator := resp.Header.Get("ETag")
+	if validator == "" || strings.HasPrefix(validator, "W/") {
+		validator = resp.Header.Get("Last-Modified")
+	}
+
+	if validator == "" {
+		if err := os.Remove(validatorPath); err != nil && !os.IsNotExist(err) {
+			return errors.WithStack(err)
 		}
-	} else if !os.IsNotExist(err) {
-		// File is not found in cache but there are other errors
-		return "", err
+		return nil
 	}
 
-	// File is not in cache
-	// it wasn't there in the first place or it was cleaned up
-	out, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	return errors.WithStack(os.WriteFile(validatorPath, []byte(validator), 0644))
+}
+
+// downloadOnce downloads remoteUrl to out, resuming after what's already in
+// out if the server supports Range requests and the file is still the same.
+// Without a validator from when out was started, that can't be checked, so
+// it is only resumed if verified is set, i.e. the result's hash is checked.
+func downloadOnce(out *os.File, validatorPath string, verified bool, remoteUrl string, progress progressStyle) error {
+	fi, err := out.Stat()
 	if err != nil {
-		return "", err
+		return errors.WithStack(err)
+	}
+	offset := fi.Size()
+
+	validator, err := os.ReadFile(validatorPath)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
 	}
-	defer out.Close()
 
-	log.Infof("downloading %v", remoteUrl)
+	if offset > 0 && len(validator) == 0 && !verified {
+		log.Infof("can't tell if %s changed since its download started, starting over", remoteUrl)
+		offset = 0
+	}
 
 	request, err := http.NewRequest(http.MethodGet, remoteUrl, nil)
 	if err != nil {
-		return "", err
+		return errors.WithStack(err)
 	}
 
 	u, err := url.Parse(remoteUrl)
 	if err != nil {
-		return "", err
+		return errors.WithStack(err)
 	}
 	key := fmt.Sprintf("%s%s", u.Host, u.Path)
 	log.Infof("searching creds for key %q", key)
@@ -95,51 +175,165 @@ func Download(cacheDir string, remoteUrl string, progress bool, expectedHash, re
 	log.Debugf("found creds for key %q", key)
 	request.SetBasicAuth(creds.Username, creds.Password)
 
+	if offset > 0 {
+		request.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		// if the file changed, the server sends all of it
+		if len(validator) > 0 {
+			request.Header.Set("If-Range", string(validator))
+		}
+	}
+
 	client := &http.Client{}
 
 	resp, err := client.Do(request)
 	if err != nil {
-		os.RemoveAll(name)
-		return "", err
+		return errors.Wrapf(err, "couldn't download %s", remoteUrl)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		os.RemoveAll(name)
-		return "", errors.Errorf("couldn't download %s: %s", remoteUrl, resp.Status)
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		log.Infof("resuming download of %s after %d bytes", remoteUrl, offset)
+	case http.StatusOK:
+		// the server sent the whole file
+		offset = 0
+	case http.StatusRequestedRangeNotSatisfiable:
+		// what was downloaded doesn't fit the file, start over
+		if err := out.Truncate(0); err != nil {
+			return errors.WithStack(err)
+		}
+		fallthrough
+	default:
+		return httpStatusError{url: remoteUrl, status: resp.Status, code: resp.StatusCode}
 	}
 
-	source := resp.Body
-	if progress {
-		bar := pb.New(int(resp.ContentLength)).Set(pb.Bytes, true)
+	if err := saveValidator(validatorPath, resp); err != nil {
+		return err
+	}
+
+	if err := out.Truncate(offset); err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err := out.Seek(offset, io.SeekStart); err != nil {
+		return errors.WithStack(err)
+	}
+
+	var source io.Reader = resp.Body
+	switch progress {
+	case progressBars:
+		bar := pb.New64(offset+resp.ContentLength).Set(pb.Bytes, true)
+		bar.SetCurrent(offset)
 		bar.Start()
 		source = bar.NewProxyReader(source)
 		defer bar.Finish()
+	case progressLines:
+		source = &progressLogger{Reader: source, url: remoteUrl, read: offset, size: offset + resp.ContentLength, last: time.Now()}
 	}
 
 	_, err = io.Copy(out, source)
+	return errors.Wrapf(err, "couldn't download %s", remoteUrl)
+}
 
-	if err != nil {
+// download with caching support in the specified cache dir. The file is
+// downloaded from remoteUrl or, if that fails, from each of mirrors in turn,
+// up to retries more times.
+func Download(cacheDir string, remoteUrl string, mirrors []string, retries int, progress progressStyle,
+	expectedHash, remoteHash, remoteSize string, idest string, mode *fs.FileMode, uid, gid int,
+) (string, error) {
+	var name string
+	if idest != "" && idest[len(idest)-1:] != "/" {
+		name = path.Join(cacheDir, path.Base(idest))
+	} else {
+		name = path.Join(cacheDir, path.Base(remoteUrl))
+	}
+	expectedHash = strings.ToLower(expectedHash)
+
+	defer fetchLocks.lock(name)()
+
+	if fi, err := os.Stat(name); err == nil {
+		// File is found in cache
+		// need to check if cache is valid before using it
+		valid, err := cachedDownloadValid(name, fi, remoteUrl, expectedHash, remoteHash, remoteSize)
+		if err != nil {
+			return "", err
+		}
+		if valid {
+			return name, nil
+		}
+
+		// Cached file is stale, need to cleanup
+		err = os.RemoveAll(name)
+		if err != nil {
+			return "", err
+		}
+	} else if !os.IsNotExist(err) {
+		// File is not found in cache but there are other errors
 		return "", err
 	}
 
-	downloadHash, err := lib.HashFile(name, false)
+	// File is not in cache. It's downloaded to a temporary file that is
+	// kept if the download fails, so that the next try resumes it.
+	partial := name + ".partial"
+	out, err := os.OpenFile(partial, os.O_RDWR|os.O_CREATE, 0644)
 	if err != nil {
 		return "", err
 	}
+	defer out.Close()
+
+	validatorPath := partialValidator(partial)
+	verified := expectedHash != "" || remoteHash != ""
+
+	urls := append([]string{remoteUrl}, mirrors...)
+	delay := downloadRetryDelay
+	for try := 0; ; try++ {
+		again := false
+		for _, u := range urls {
+			log.Infof("downloading %v", u)
+			err = downloadOnce(out, validatorPath, verified, u, progress)
+			if err == nil {
+				break
+			}
+			log.Infof("%v", err)
+			again = again || retryable(err)
+		}
+
+		if err == nil {
+			break
+		}
 
-	if expectedHash != "" {
+		if !again || try >= retries {
+			return "", err
+		}
+
+		log.Infof("retrying download of %s in %s", remoteUrl, delay)
+		time.Sleep(delay)
+		delay = min(delay*2, maxDownloadRetryDelay)
+	}
+
+	if verified {
 		log.Infof("Checking shasum of downloaded file")
+		downloadHash, err := lib.HashFile(partial, false)
+		if err != nil {
+			return "", err
+		}
 		downloadHash = strings.TrimPrefix(downloadHash, "sha256:")
 		log.Debugf("Downloaded file hash: %s", downloadHash)
 
-		if downloadHash != remoteHash {
+		if expectedHash != "" && remoteHash != "" && downloadHash != remoteHash {
 			log.Warnf("Downloaded file hash %q does not match hash from HTTP header %q", downloadHash, remoteHash)
 		}
 
-		if expectedHash != downloadHash {
-			os.RemoveAll(name)
-			return "", errors.Errorf("Downloaded file hash does not match. Expected: %s Actual: %s", expectedHash, downloadHash)
+		// without a hash in the stackerfile, the one from the server
+		// has to match
+		hash := expectedHash
+		if hash == "" {
+			hash = remoteHash
+		}
+
+		if hash != downloadHash {
+			os.RemoveAll(partial)
+			os.RemoveAll(validatorPath)
+			return "", errors.Errorf("Downloaded file hash does not match. Expected: %s Actual: %s", hash, downloadHash)
 		}
 	}
 
@@ -152,10 +346,19 @@ func Download(cacheDir string, remoteUrl string, progress bool, expectedHash, re
 
 	err = out.Chown(uid, gid)
 	if err != nil {
-		return "", errors.Wrapf(err, "Coudn't chown file %s", source)
+		return "", errors.Wrapf(err, "Coudn't chown file %s", name)
+	}
+
+	// only now that it's complete, the file shows up in the cache
+	if err := os.Rename(partial, name); err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	if err := os.RemoveAll(validatorPath); err != nil {
+		return "", errors.WithStack(err)
 	}
 
-	return name, err
+	return name, nil
 }
 
 // getHttpFileInfo returns the hash and content size a file stored on a web server
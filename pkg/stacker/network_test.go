@@ -0,0 +1,205 @@
+package stacker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	downloadRetryDelay = time.Millisecond
+}
+
+const downloadContent = "stacker downloads things"
+
+func downloadHash() string {
+	sum := sha256.Sum256([]byte(downloadContent))
+	return hex.EncodeToString(sum[:])
+}
+
+// serveContent serves downloadContent, with Range support.
+func serveContent(w http.ResponseWriter, r *http.Request) {
+	http.ServeContent(w, r, "file", time.Time{}, strings.NewReader(downloadContent))
+}
+
+func TestDownloadRetries(t *testing.T) {
+	assert := assert.New(t)
+
+	var tries int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&tries, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		serveContent(w, r)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	name, err := Download(dir, server.URL+"/file", nil, 2, noProgress, downloadHash(), "", "", "", nil, -1, -1)
+	assert.NoError(err)
+	assert.EqualValues(3, tries)
+
+	content, err := os.ReadFile(name)
+	assert.NoError(err)
+	assert.Equal(downloadContent, string(content))
+	assert.NoFileExists(name + ".partial")
+
+	// not enough retries
+	atomic.StoreInt32(&tries, 0)
+	_, err = Download(t.TempDir(), server.URL+"/file", nil, 1, noProgress, "", "", "", "", nil, -1, -1)
+	assert.ErrorContains(err, "503")
+}
+
+func TestDownloadResume(t *testing.T) {
+	assert := assert.New(t)
+
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		serveContent(w, r)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	err := os.WriteFile(path.Join(dir, "file.partial"), []byte(downloadContent[:7]), 0644)
+	assert.NoError(err)
+
+	name, err := Download(dir, server.URL+"/file", nil, 0, noProgress, downloadHash(), "", "", "", nil, -1, -1)
+	assert.NoError(err)
+	assert.Equal([]string{"bytes=7-"}, ranges)
+
+	content, err := os.ReadFile(name)
+	assert.NoError(err)
+	assert.Equal(downloadContent, string(content))
+}
+
+func TestDownloadMirrors(t *testing.T) {
+	assert := assert.New(t)
+
+	broken := httptest.NewServer(http.NotFoundHandler())
+	defer broken.Close()
+	mirror := httptest.NewServer(http.HandlerFunc(serveContent))
+	defer mirror.Close()
+
+	name, err := Download(t.TempDir(), broken.URL+"/file", []string{mirror.URL + "/file"}, 0, noProgress, downloadHash(), "", "", "", nil, -1, -1)
+	assert.NoError(err)
+	assert.Equal("file", path.Base(name))
+
+	content, err := os.ReadFile(name)
+	assert.NoError(err)
+	assert.Equal(downloadContent, string(content))
+}
+
+func TestDownloadCacheNeedsHashMatch(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(serveContent))
+	defer server.Close()
+
+	// a cached file of the same size but different content isn't used
+	dir := t.TempDir()
+	stale := strings.Repeat("x", len(downloadContent))
+	err := os.WriteFile(path.Join(dir, "file"), []byte(stale), 0644)
+	assert.NoError(err)
+
+	size := strconv.Itoa(len(downloadContent))
+	name, err := Download(dir, server.URL+"/file", nil, 0, noProgress, downloadHash(), "", size, "", nil, -1, -1)
+	assert.NoError(err)
+
+	content, err := os.ReadFile(name)
+	assert.NoError(err)
+	assert.Equal(downloadContent, string(content))
+}
+
+func TestDownloadResumeChangedFile(t *testing.T) {
+	assert := assert.New(t)
+
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		w.Header().Set("ETag", `"new"`)
+		serveContent(w, r)
+	}))
+	defer server.Close()
+
+	// a partial download of what the file was before, without a hash to
+	// check the result against
+	dir := t.TempDir()
+	partial := path.Join(dir, "file.partial")
+	assert.NoError(os.WriteFile(partial, []byte("old cont"), 0644))
+	assert.NoError(os.WriteFile(partialValidator(partial), []byte(`"old"`), 0644))
+
+	name, err := Download(dir, server.URL+"/file", nil, 0, noProgress, "", "", "", "", nil, -1, -1)
+	assert.NoError(err)
+	assert.Equal([]string{"bytes=8-"}, ranges)
+
+	// the ETag didn't match, so all of the new file was downloaded
+	content, err := os.ReadFile(name)
+	assert.NoError(err)
+	assert.Equal(downloadContent, string(content))
+	assert.NoFileExists(partialValidator(partial))
+
+	// an unchanged file is resumed
+	ranges = nil
+	assert.NoError(os.Remove(name))
+	assert.NoError(os.WriteFile(partial, []byte(downloadContent[:7]), 0644))
+	assert.NoError(os.WriteFile(partialValidator(partial), []byte(`"new"`), 0644))
+	name, err = Download(dir, server.URL+"/file", nil, 0, noProgress, "", "", "", "", nil, -1, -1)
+	assert.NoError(err)
+	assert.Equal([]string{"bytes=7-"}, ranges)
+	content, err = os.ReadFile(name)
+	assert.NoError(err)
+	assert.Equal(downloadContent, string(content))
+}
+
+func TestDownloadNoValidatorStartsOver(t *testing.T) {
+	assert := assert.New(t)
+
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		serveContent(w, r)
+	}))
+	defer server.Close()
+
+	// neither a hash nor a validator, so nothing would notice if the
+	// partial download is of another file
+	dir := t.TempDir()
+	assert.NoError(os.WriteFile(path.Join(dir, "file.partial"), []byte("old cont"), 0644))
+
+	name, err := Download(dir, server.URL+"/file", nil, 0, noProgress, "", "", "", "", nil, -1, -1)
+	assert.NoError(err)
+	assert.Equal([]string{""}, ranges)
+
+	content, err := os.ReadFile(name)
+	assert.NoError(err)
+	assert.Equal(downloadContent, string(content))
+}
+
+func TestDownloadChecksRemoteHash(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(serveContent))
+	defer server.Close()
+
+	dir := t.TempDir()
+	_, err := Download(dir, server.URL+"/file", nil, 0, noProgress, "", strings.Repeat("0", 64), "", "", nil, -1, -1)
+	assert.ErrorContains(err, "Downloaded file hash does not match")
+	assert.NoFileExists(path.Join(dir, "file"))
+	assert.NoFileExists(path.Join(dir, "file.partial"))
+
+	name, err := Download(dir, server.URL+"/file", nil, 0, noProgress, "", downloadHash(), "", "", nil, -1, -1)
+	assert.NoError(err)
+	assert.FileExists(name)
+}
@@ -0,0 +1,317 @@
+package stacker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"stackerbuild.io/stacker/pkg/lib"
+	"stackerbuild.io/stacker/pkg/log"
+	"stackerbuild.io/stacker/pkg/overlay"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+// defaultFetchJobs is how many imports and base images are fetched at the
+// same time, unless the config says otherwise.
+const defaultFetchJobs = 4
+
+// fetchJobs is how many things are fetched at the same time.
+func fetchJobs(c types.StackerConfig) int {
+	if c.FetchJobs > 0 {
+		return c.FetchJobs
+	}
+	return defaultFetchJobs
+}
+
+// progressStyle is how the progress of fetching something is shown.
+type progressStyle int
+
+const (
+	noProgress progressStyle = iota
+	// progressBars are drawn on the terminal
+	progressBars
+	// progressLines are logged a line at a time, which stays readable
+	// when several things are fetched at the same time
+	progressLines
+)
+
+// fetchProgress is how the progress of fetches is shown, if it is: with bars
+// when things are fetched one at a time, or else in lines, since the bars of
+// parallel fetches would be drawn over each other.
+func fetchProgress(c types.StackerConfig, progress bool) progressStyle {
+	switch {
+	case !progress:
+		return noProgress
+	case fetchJobs(c) == 1:
+		return progressBars
+	default:
+		return progressLines
+	}
+}
+
+// withCopyProgress sets up opts to show the progress of copying the image
+// name in style.
+func withCopyProgress(opts lib.ImageCopyOpts, name string, style progressStyle) lib.ImageCopyOpts {
+	switch style {
+	case progressBars:
+		opts.Progress = os.Stderr
+	case progressLines:
+		opts.LogProgress = func(format string, args ...interface{}) {
+			log.Infof("%s: %s", name, fmt.Sprintf(format, args...))
+		}
+	}
+	return opts
+}
+
+// layerBasesDir is the OCI layout that base images and image imports are
+// pulled to.
+func layerBasesDir(c types.StackerConfig) string {
+	return path.Join(c.StackerDir, "layer-bases", "oci")
+}
+
+// openLayerBases opens the layer-bases layout, creating it if it doesn't
+// exist yet. fetchLocks must be held for it.
+func openLayerBases(c types.StackerConfig) (casext.Engine, error) {
+	cacheDir := layerBasesDir(c)
+	oci, err := umoci.OpenLayout(cacheDir)
+	if err == nil {
+		return oci, nil
+	}
+
+	// an empty directory is fine to create it in
+	if err := os.Remove(cacheDir); err != nil && !os.IsNotExist(err) {
+		return casext.Engine{}, errors.Wrapf(err, "couldn't open %s", cacheDir)
+	}
+
+	return umoci.CreateLayout(cacheDir)
+}
+
+// copyToLayerBases copies the image opts.Src to tag in the layer-bases layout.
+// Its blobs are written to the layout's blobs directly, which is fine to do
+// in parallel since they are content addressed, and its manifest is tagged
+// in a layout of its own. Only tagging it in the layer-bases layout is done
+// under fetchLocks, so that several images are copied at the same time.
+func copyToLayerBases(c types.StackerConfig, opts lib.ImageCopyOpts, tag string) error {
+	cacheDir := layerBasesDir(c)
+
+	unlock := fetchLocks.lock(cacheDir)
+	oci, err := openLayerBases(c)
+	if err == nil {
+		oci.Close()
+	}
+	unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.MkdirTemp(path.Dir(cacheDir), "pull-")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	layout := path.Join(tmp, "oci")
+	tmpOci, err := umoci.CreateLayout(layout)
+	if err != nil {
+		return err
+	}
+	tmpOci.Close()
+
+	opts.Dest = fmt.Sprintf("oci:%s:%s", layout, tag)
+	opts.DestSharedBlobDir = path.Join(cacheDir, "blobs")
+	if err := lib.ImageCopy(opts); err != nil {
+		return err
+	}
+
+	// the manifest is in the shared blobs, so it can't be resolved in
+	// the temporary layout, but its index has the descriptor
+	content, err := os.ReadFile(path.Join(layout, "index.json"))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	index := ispec.Index{}
+	if err := json.Unmarshal(content, &index); err != nil {
+		return errors.Wrapf(err, "couldn't parse index of %s", opts.Src)
+	}
+
+	for _, desc := range index.Manifests {
+		if desc.Annotations[ispec.AnnotationRefName] != tag {
+			continue
+		}
+
+		defer fetchLocks.lock(cacheDir)()
+		oci, err := umoci.OpenLayout(cacheDir)
+		if err != nil {
+			return err
+		}
+		defer oci.Close()
+
+		return oci.UpdateReference(context.Background(), tag, desc)
+	}
+
+	return errors.Errorf("%s wasn't copied to %s", opts.Src, tag)
+}
+
+// keyedLocks are mutexes by name.
+type keyedLocks struct {
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+// lock locks the mutex for key, and returns the function that unlocks it.
+func (kl *keyedLocks) lock(key string) func() {
+	kl.mu.Lock()
+	l, ok := kl.locks[key]
+	if !ok {
+		l = &sync.Mutex{}
+		kl.locks[key] = l
+	}
+	kl.mu.Unlock()
+
+	l.Lock()
+	return l.Unlock
+}
+
+// fetchLocks keep things that are fetched in parallel from writing to the
+// same place at the same time: a download, a git checkout, or an OCI layout,
+// whose index.json only keeps the last of concurrent updates.
+var fetchLocks = keyedLocks{locks: map[string]*sync.Mutex{}}
+
+// isRemoteImport is whether i is fetched from somewhere else, rather than
+// from a local path or a layer being built.
+func isRemoteImport(i string) bool {
+	return isHttpUrl(i) || types.IsGitUrl(i) || types.IsImageUrl(i)
+}
+
+// prefetchable is whether the base of l can be fetched before the layers
+// before it are built: base images that aren't in the OCI layout being built
+// to, and don't share their tag in the layer-bases cache with a different
+// base image, tar bases and git bases.
+func prefetchable(c types.StackerConfig, l types.Layer, tagBases map[string]map[string]bool) bool {
+	switch l.From.Type {
+	case types.TarLayer, types.GitLayer:
+		return true
+	case types.OCILayer:
+		layout, _, _ := strings.Cut(l.From.Url, ":")
+		if abs, err := filepath.Abs(layout); err != nil || abs == c.OCIDir {
+			return false
+		}
+		fallthrough
+	case types.DockerLayer:
+		tag, err := l.From.ParseTag()
+		return err == nil && len(tagBases[tag]) == 1
+	}
+	return false
+}
+
+// prefetched is what prefetchLayers fetched.
+type prefetched struct {
+	// overlayDirs are the overlay dirs of the layers whose imports were
+	// fetched, including the ones for their imports.
+	overlayDirs map[string]types.OverlayDirs
+	// bases are the layers whose base was fetched.
+	bases map[string]bool
+}
+
+// prefetchLayers fetches the base images and imports of the layers in order
+// that don't depend on other layers being built first, fetchJobs(c) at a time:
+// the imports of layers that only import remote files, and the bases that are
+// prefetchable.
+func prefetchLayers(opts *BuildArgs, s types.Storage, sf *types.Stackerfile, order []string, cache *BuildCache, oci casext.Engine) (prefetched, error) {
+	config := opts.Config
+	progress := opts.Progress
+	pool := overlay.NewThreadPool(fetchJobs(config))
+
+	tagBases := map[string]map[string]bool{}
+	for _, name := range order {
+		l, ok := sf.Get(name)
+		if !ok || !types.IsContainersImageLayer(l.From.Type) {
+			continue
+		}
+		tag, err := l.From.ParseTag()
+		if err != nil {
+			return prefetched{}, err
+		}
+		if tagBases[tag] == nil {
+			tagBases[tag] = map[string]bool{}
+		}
+		tagBases[tag][fetchedImageTag(l)] = true
+	}
+
+	fetched := prefetched{overlayDirs: map[string]types.OverlayDirs{}, bases: map[string]bool{}}
+	finishes := []func() error{}
+	seenBases := map[string]bool{}
+	for _, name := range order {
+		l, ok := sf.Get(name)
+		if !ok {
+			return prefetched{}, errors.Errorf("%s not present in stackerfile?", name)
+		}
+
+		remote := true
+		for _, imp := range l.Imports {
+			remote = remote && isRemoteImport(imp.Path)
+		}
+
+		if remote {
+			if err := CleanImportsDir(config, name, l.Imports, cache); err != nil {
+				return prefetched{}, err
+			}
+
+			overlayDirs := append(types.OverlayDirs{}, l.OverlayDirs...)
+			finish, err := addImportJobs(pool, config, s, name, l.Imports, &overlayDirs, progress)
+			if err != nil {
+				return prefetched{}, err
+			}
+			fetched.overlayDirs[name] = overlayDirs
+			finishes = append(finishes, finish)
+		}
+
+		if !prefetchable(config, l, tagBases) {
+			continue
+		}
+
+		fetched.bases[name] = true
+		key := fmt.Sprintf("%s\x00%s\x00%s\x00%v", l.From.Type, fetchedImageTag(l), l.From.Ref, l.From.Submodules)
+		if seenBases[key] {
+			continue
+		}
+		seenBases[key] = true
+
+		baseOpts := BaseLayerOpts{
+			Config:     config,
+			Name:       name,
+			Layer:      l,
+			Cache:      cache,
+			OCI:        oci,
+			LayerTypes: opts.LayerTypes,
+			Storage:    s,
+			Progress:   progress,
+		}
+		pool.Add(func(ctx context.Context) error {
+			return GetBase(baseOpts)
+		})
+	}
+
+	pool.DoneAddingJobs()
+	if err := pool.Run(); err != nil {
+		return prefetched{}, err
+	}
+
+	for _, finish := range finishes {
+		if err := finish(); err != nil {
+			return prefetched{}, err
+		}
+	}
+
+	return fetched, nil
+}
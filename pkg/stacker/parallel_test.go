@@ -0,0 +1,107 @@
+package stacker
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/umoci"
+	"github.com/stretchr/testify/assert"
+	"stackerbuild.io/stacker/pkg/lib"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+func TestImportParallel(t *testing.T) {
+	assert := assert.New(t)
+
+	// the files are only served once all three are being downloaded
+	var started sync.WaitGroup
+	started.Add(3)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && path.Dir(r.URL.Path) == "/" {
+			started.Done()
+			done := make(chan struct{})
+			go func() { started.Wait(); close(done) }()
+			select {
+			case <-done:
+			case <-time.After(10 * time.Second):
+				w.WriteHeader(http.StatusGatewayTimeout)
+				return
+			}
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer server.Close()
+
+	config := types.StackerConfig{StackerDir: t.TempDir(), FetchJobs: 3}
+	dir := path.Join(config.StackerDir, "imports", "foo")
+	assert.NoError(os.MkdirAll(dir, 0755))
+	assert.NoError(os.WriteFile(path.Join(dir, "old"), []byte("old"), 0644))
+
+	imports := types.Imports{}
+	for _, p := range []string{"/one", "/two", "/three", "/a/file", "/bb/file"} {
+		imports = append(imports, types.Import{Path: server.URL + p, Uid: lib.UidEmpty, Gid: lib.GidEmpty})
+	}
+
+	overlayDirs := types.OverlayDirs{}
+	assert.NoError(Import(config, nil, "foo", imports, &overlayDirs, false))
+
+	for _, name := range []string{"one", "two", "three"} {
+		content, err := os.ReadFile(path.Join(dir, name))
+		assert.NoError(err)
+		assert.Equal("/"+name, string(content))
+	}
+
+	// imports with the same name are imported in order, so the last wins
+	content, err := os.ReadFile(path.Join(dir, "file"))
+	assert.NoError(err)
+	assert.Equal("/bb/file", string(content))
+
+	// and what isn't imported anymore is still cleaned up
+	assert.NoFileExists(path.Join(dir, "old"))
+}
+
+func TestCopyToLayerBasesParallel(t *testing.T) {
+	assert := assert.New(t)
+	layout := imageLayout(t)
+	config := types.StackerConfig{StackerDir: t.TempDir()}
+
+	tags := []string{"artifact", "image"}
+	errs := make([]error, len(tags))
+	var wg sync.WaitGroup
+	for i, tag := range tags {
+		wg.Add(1)
+		go func(i int, tag string) {
+			defer wg.Done()
+			opts := lib.ImageCopyOpts{Src: "oci:" + layout + ":" + tag}
+			errs[i] = copyToLayerBases(config, opts, tag)
+		}(i, tag)
+	}
+	wg.Wait()
+
+	oci, err := umoci.OpenLayout(layerBasesDir(config))
+	assert.NoError(err)
+	defer oci.Close()
+
+	for i, tag := range tags {
+		assert.NoError(errs[i])
+
+		// both tags make it to the index, and their blobs to its blobs
+		descPaths, err := oci.ResolveReference(context.Background(), tag)
+		assert.NoError(err)
+		assert.Len(descPaths, 1)
+		blob, err := oci.FromDescriptor(context.Background(), descPaths[0].Descriptor())
+		assert.NoError(err)
+		blob.Close()
+	}
+
+	// and the temporary layouts are gone
+	ents, err := os.ReadDir(path.Dir(layerBasesDir(config)))
+	assert.NoError(err)
+	assert.Len(ents, 1)
+}
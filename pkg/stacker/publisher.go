@@ -1,6 +1,7 @@
 package stacker
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
@@ -31,6 +32,7 @@ type PublishArgs struct {
 	SkipTLS        bool
 	LayerTypes     []types.LayerType
 	Images         []string
+	Squash         bool
 }
 
 // Publisher is responsible for publishing the layers based on stackerfiles
@@ -106,6 +108,16 @@ func (p *Publisher) Publish(file string) error {
 		return err
 	}
 
+	var storage types.Storage
+	if opts.Squash && !opts.ShowOnly {
+		s, locks, err := NewStorage(opts.Config)
+		if err != nil {
+			return err
+		}
+		defer locks.Unlock()
+		storage = s
+	}
+
 	// Iterate through all layers defined in this stackerfile
 	for _, name := range sf.FileOrder {
 
@@ -168,10 +180,20 @@ func (p *Publisher) Publish(file string) error {
 					progressWriter = os.Stderr
 				}
 
+				srcName := layerName
+				if opts.Squash {
+					srcName = fmt.Sprintf("%s-squashed", layerName)
+					log.Infof("squashing %s", layerName)
+					err = storage.Squash(layerName, srcName, layerType)
+					if err != nil {
+						return err
+					}
+				}
+
 				// Store the layers to new destination
 				log.Infof("publishing %s %s to %s\n", file, layerName, destUrl)
-				err = lib.ImageCopy(lib.ImageCopyOpts{
-					Src:          fmt.Sprintf("oci:%s:%s", opts.Config.OCIDir, layerName),
+				copyOpts, err := withRegistries(opts.Config, lib.ImageCopyOpts{
+					Src:          fmt.Sprintf("oci:%s:%s", opts.Config.OCIDir, srcName),
 					Dest:         destUrl,
 					DestUsername: opts.Username,
 					DestPassword: opts.Password,
@@ -183,6 +205,17 @@ func (p *Publisher) Publish(file string) error {
 					return err
 				}
 
+				err = lib.ImageCopy(copyOpts)
+				if err != nil {
+					return err
+				}
+
+				if opts.Squash {
+					err = oci.DeleteReference(context.Background(), srcName)
+					if err != nil {
+						return err
+					}
+				}
 			}
 		}
 	}
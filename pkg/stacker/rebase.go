@@ -0,0 +1,297 @@
+package stacker
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"reflect"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+	stackeroci "machinerun.io/atomfs/pkg/oci"
+	"stackerbuild.io/stacker/pkg/lib"
+	"stackerbuild.io/stacker/pkg/log"
+	"stackerbuild.io/stacker/pkg/overlay"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+type RebaseArgs struct {
+	Config     types.StackerConfig
+	Name       string
+	Onto       string
+	LayerTypes []types.LayerType
+	Progress   bool
+}
+
+// ociImage is an image's manifest along with its config.
+type ociImage struct {
+	Manifest ispec.Manifest
+	Config   ispec.Image
+}
+
+func lookupImage(oci casext.Engine, tag string) (ociImage, error) {
+	manifest, err := stackeroci.LookupManifest(oci, tag)
+	if err != nil {
+		return ociImage{}, err
+	}
+
+	config, err := stackeroci.LookupConfig(oci, manifest.Config)
+	if err != nil {
+		return ociImage{}, err
+	}
+
+	return ociImage{manifest, config}, nil
+}
+
+// spliceBase returns image with the layers and history of oldBase replaced by
+// those of newBase. If checkLayers is set, oldBase's layers are in the same
+// format as image's, and must be the ones image starts with.
+func spliceBase(image ociImage, oldBase ociImage, newBase ociImage, checkLayers bool) (ociImage, error) {
+	nLayers := len(oldBase.Manifest.Layers)
+	nHistory := len(oldBase.Config.History)
+
+	if len(image.Manifest.Layers) < nLayers || len(image.Config.RootFS.DiffIDs) < nLayers {
+		return ociImage{}, errors.Errorf("image has fewer layers than its base")
+	}
+
+	if checkLayers && !reflect.DeepEqual(image.Config.RootFS.DiffIDs[:nLayers], oldBase.Config.RootFS.DiffIDs) {
+		return ociImage{}, errors.Errorf("image's layers don't start with its base's")
+	}
+
+	if len(image.Config.History) < nHistory || !reflect.DeepEqual(image.Config.History[:nHistory], oldBase.Config.History) {
+		return ociImage{}, errors.Errorf("image's history doesn't start with its base's")
+	}
+
+	rebased := image
+
+	rebased.Manifest.Layers = append([]ispec.Descriptor{}, newBase.Manifest.Layers...)
+	rebased.Manifest.Layers = append(rebased.Manifest.Layers, image.Manifest.Layers[nLayers:]...)
+
+	rebased.Config.RootFS.DiffIDs = append([]digest.Digest{}, newBase.Config.RootFS.DiffIDs...)
+	rebased.Config.RootFS.DiffIDs = append(rebased.Config.RootFS.DiffIDs, image.Config.RootFS.DiffIDs[nLayers:]...)
+
+	rebased.Config.History = append([]ispec.History{}, newBase.Config.History...)
+	rebased.Config.History = append(rebased.Config.History, image.Config.History[nHistory:]...)
+
+	return rebased, nil
+}
+
+// outputBase writes the image tag in the layer-bases cache to the output OCI
+// dir as name in layerType's format, returning the image.
+func outputBase(config types.StackerConfig, s types.Storage, oci casext.Engine, tag string, name string, layerType types.LayerType) (ociImage, error) {
+	cacheDir := path.Join(config.StackerDir, "layer-bases", "oci")
+	cacheOCI, err := umoci.OpenLayout(cacheDir)
+	if err != nil {
+		return ociImage{}, err
+	}
+	defer cacheOCI.Close()
+
+	base, err := lookupImage(cacheOCI, tag)
+	if err != nil {
+		return ociImage{}, err
+	}
+
+	sourceLayerType, err := types.NewLayerTypeManifest(base.Manifest)
+	if err != nil {
+		return ociImage{}, err
+	}
+
+	if sourceLayerType.SameFormat(layerType) {
+		err = lib.ImageCopy(lib.ImageCopyOpts{
+			Src:  fmt.Sprintf("oci:%s:%s", cacheDir, tag),
+			Dest: fmt.Sprintf("oci:%s:%s", config.OCIDir, layerType.LayerName(name)),
+		})
+		if err != nil {
+			return ociImage{}, err
+		}
+
+		return lookupImage(oci, layerType.LayerName(name))
+	}
+
+	if s.Name() != "overlay" && s.Name() != "fuse-overlay" {
+		return ociImage{}, errors.Errorf("can't convert %s to %s for storage type %v", tag, layerType, s.Name())
+	}
+
+	// the layers need to be unpacked to be converted
+	if err := s.Unpack(tag, name); err != nil {
+		return ociImage{}, err
+	}
+	defer s.Delete(name)
+
+	err = overlay.ConvertAndOutput(config, tag, name, layerType)
+	if err != nil {
+		return ociImage{}, err
+	}
+
+	return lookupImage(oci, layerType.LayerName(name))
+}
+
+// Rebase replaces the layers of the base image of a layer built from a
+// docker or oci base in the output with those of another image, keeping the
+// layers stacker built.
+func Rebase(opts RebaseArgs, sfm types.StackerFiles) error {
+	config := opts.Config
+
+	l, ok := sfm.LookupLayerDefinition(opts.Name)
+	if !ok {
+		return errors.Errorf("%s is not in the stackerfile", opts.Name)
+	}
+
+	if !types.IsContainersImageLayer(l.From.Type) {
+		return errors.Errorf("can't rebase %s: only layers built from docker or oci bases can be rebased, not %s", opts.Name, l.From.Type)
+	}
+
+	onto, err := types.NewImageSource(opts.Onto)
+	if err != nil {
+		return err
+	}
+
+	s, locks, err := NewStorage(config)
+	if err != nil {
+		return err
+	}
+	defer locks.Unlock()
+
+	oci, err := umoci.OpenLayout(config.OCIDir)
+	if err != nil {
+		return err
+	}
+	defer oci.Close()
+
+	buildCache, err := OpenCache(config, oci, sfm)
+	if err != nil {
+		return err
+	}
+
+	_, cached, err := buildCache.Lookup(opts.Name)
+	if err != nil {
+		return err
+	}
+
+	oldTag, err := l.From.ParseTag()
+	if err != nil {
+		return err
+	}
+
+	newTag, err := onto.ParseTag()
+	if err != nil {
+		return err
+	}
+
+	// the new base may be imported over the old one, so we need to look at
+	// the old one before importing it.
+	cacheOCI, err := umoci.OpenLayout(path.Join(config.StackerDir, "layer-bases", "oci"))
+	if err != nil {
+		return err
+	}
+	defer cacheOCI.Close()
+
+	oldBase, err := lookupImage(cacheOCI, oldTag)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't find the base of %s, was it built?", opts.Name)
+	}
+
+	oldBaseLayerType, err := types.NewLayerTypeManifest(oldBase.Manifest)
+	if err != nil {
+		return err
+	}
+
+	newLayer := l
+	newLayer.From = *onto
+	if err := importContainersImage(newLayer, config, opts.Progress); err != nil {
+		return err
+	}
+
+	descPaths, err := cacheOCI.ResolveReference(context.Background(), newTag)
+	if err != nil {
+		return err
+	}
+
+	if len(descPaths) != 1 {
+		return errors.Errorf("duplicate manifests for %s", newTag)
+	}
+	newBaseDigest := descPaths[0].Descriptor().Digest
+
+	now := time.Now()
+	if config.SourceDateEpoch != nil {
+		now = *config.SourceDateEpoch
+	}
+
+	manifests := map[types.LayerType]ispec.Descriptor{}
+	for _, layerType := range opts.LayerTypes {
+		layerName := layerType.LayerName(opts.Name)
+
+		image, err := lookupImage(oci, layerName)
+		if err != nil {
+			return errors.Wrapf(err, "couldn't find %s, was it built?", layerName)
+		}
+
+		// the old base's layers may have been converted when this was
+		// built, in which case we can't compare them
+		checkLayers := oldBaseLayerType.SameFormat(layerType)
+
+		baseName := fmt.Sprintf("%s-rebase-base", opts.Name)
+		newBase, err := outputBase(config, s, oci, newTag, baseName, layerType)
+		if err != nil {
+			return err
+		}
+
+		rebased, err := spliceBase(image, oldBase, newBase, checkLayers)
+		if err != nil {
+			return errors.Wrapf(err, "can't rebase %s", layerName)
+		}
+
+		rebased.Config.History = append(rebased.Config.History, ispec.History{
+			Created:    &now,
+			CreatedBy:  fmt.Sprintf("stacker rebase of %s onto %s", opts.Name, opts.Onto),
+			Comment:    fmt.Sprintf("replaced base %s", l.From.Url),
+			EmptyLayer: true,
+		})
+
+		if rebased.Manifest.Annotations == nil {
+			rebased.Manifest.Annotations = map[string]string{}
+		}
+		rebased.Manifest.Annotations[ispec.AnnotationBaseImageName] = opts.Onto
+		rebased.Manifest.Annotations[ispec.AnnotationBaseImageDigest] = newBaseDigest.String()
+
+		_, err = stackeroci.UpdateImageConfig(oci, layerName, rebased.Config, rebased.Manifest)
+		if err != nil {
+			return err
+		}
+
+		descPaths, err := oci.ResolveReference(context.Background(), layerName)
+		if err != nil {
+			return err
+		}
+		manifests[layerType] = descPaths[0].Descriptor()
+
+		err = oci.DeleteReference(context.Background(), layerType.LayerName(baseName))
+		if err != nil {
+			return err
+		}
+
+		log.Infof("rebased %s onto %s", layerName, opts.Onto)
+	}
+
+	// if the new base replaced the old one in the layer-bases cache, the
+	// layer's cache entry has to be for the rebased image, or it would be
+	// rebuilt. Otherwise the stackerfile's base is still the old one, so
+	// the next build rebuilds the layer on it, rather than outputting the
+	// images from before the rebase, which the GC below removes.
+	if cached {
+		if oldTag == newTag {
+			err = buildCache.Put(opts.Name, manifests, nil)
+		} else {
+			err = buildCache.Delete(opts.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return oci.GC(context.Background())
+}
@@ -0,0 +1,54 @@
+package stacker
+
+import (
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func testImage(layers ...string) ociImage {
+	image := ociImage{}
+	for _, l := range layers {
+		d := digest.FromString(l)
+		image.Manifest.Layers = append(image.Manifest.Layers, ispec.Descriptor{Digest: d})
+		image.Config.RootFS.DiffIDs = append(image.Config.RootFS.DiffIDs, d)
+		image.Config.History = append(image.Config.History, ispec.History{CreatedBy: l})
+	}
+	return image
+}
+
+func TestSpliceBase(t *testing.T) {
+	assert := assert.New(t)
+
+	oldBase := testImage("base1", "base2")
+	newBase := testImage("patched1", "patched2", "patched3")
+	image := testImage("base1", "base2", "ours1", "ours2")
+	image.Config.Config.Env = []string{"FOO=bar"}
+
+	rebased, err := spliceBase(image, oldBase, newBase, true)
+	assert.NoError(err)
+	assert.Equal(testImage("patched1", "patched2", "patched3", "ours1", "ours2").Manifest.Layers, rebased.Manifest.Layers)
+	assert.Equal(testImage("patched1", "patched2", "patched3", "ours1", "ours2").Config.RootFS.DiffIDs, rebased.Config.RootFS.DiffIDs)
+	assert.Equal(testImage("patched1", "patched2", "patched3", "ours1", "ours2").Config.History, rebased.Config.History)
+	assert.Equal([]string{"FOO=bar"}, rebased.Config.Config.Env)
+
+	// the original image is left alone
+	assert.Equal(testImage("base1", "base2", "ours1", "ours2").Manifest.Layers, image.Manifest.Layers)
+
+	// converted base layers can't be compared, but the history can
+	converted := testImage("base1", "base2", "ours1")
+	converted.Config.RootFS.DiffIDs[0] = digest.FromString("squashfs")
+	_, err = spliceBase(converted, oldBase, newBase, true)
+	assert.ErrorContains(err, "layers don't start with its base's")
+	_, err = spliceBase(converted, oldBase, newBase, false)
+	assert.NoError(err)
+
+	_, err = spliceBase(testImage("other", "base2", "ours1"), oldBase, newBase, false)
+	assert.ErrorContains(err, "history doesn't start with its base's")
+
+	// e.g. a squashed image
+	_, err = spliceBase(testImage("squashed"), oldBase, newBase, false)
+	assert.ErrorContains(err, "fewer layers than its base")
+}
@@ -0,0 +1,83 @@
+package stacker
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"stackerbuild.io/stacker/pkg/lib"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+// registryMirrorsConf renders registry_mirrors as a registries.conf drop-in.
+func registryMirrorsConf(mirrors map[string][]types.RegistryMirror) (string, error) {
+	registries := []string{}
+	for registry := range mirrors {
+		registries = append(registries, registry)
+	}
+	sort.Strings(registries)
+
+	b := strings.Builder{}
+	for _, registry := range registries {
+		if registry == "" {
+			return "", errors.Errorf("registry_mirrors: empty registry name")
+		}
+
+		fmt.Fprintf(&b, "[[registry]]\nprefix = %s\nlocation = %s\n\n", strconv.Quote(registry), strconv.Quote(registry))
+		for _, mirror := range mirrors[registry] {
+			if mirror.Location == "" {
+				return "", errors.Errorf("registry_mirrors: mirror of %s has no location", registry)
+			}
+
+			fmt.Fprintf(&b, "[[registry.mirror]]\nlocation = %s\n", strconv.Quote(mirror.Location))
+			if mirror.Insecure {
+				fmt.Fprintf(&b, "insecure = true\n")
+			}
+			fmt.Fprintf(&b, "\n")
+		}
+	}
+
+	return b.String(), nil
+}
+
+// withRegistries sets up an image copy to or from a registry to use the
+// registries.conf and mirrors in config.
+func withRegistries(config types.StackerConfig, opts lib.ImageCopyOpts) (lib.ImageCopyOpts, error) {
+	if config.RegistriesConf == "" && len(config.RegistryMirrors) == 0 {
+		return opts, nil
+	}
+
+	// short names are only resolved with the aliases of configured
+	// registries; containers/image keeps (and locks) the user's own
+	// aliases in the stacker dir rather than in $HOME
+	opts.RegistriesConf = config.RegistriesConf
+	opts.ShortNameAliasesConf = path.Join(config.StackerDir, "short-name-aliases.conf")
+
+	if len(config.RegistryMirrors) == 0 {
+		return opts, nil
+	}
+
+	content, err := registryMirrorsConf(config.RegistryMirrors)
+	if err != nil {
+		return opts, err
+	}
+
+	// the mirrors are a drop-in, so they're merged with (and replace the
+	// same registries in) the main registries.conf
+	dir := path.Join(config.StackerDir, "registries.conf.d")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return opts, errors.WithStack(err)
+	}
+
+	err = os.WriteFile(path.Join(dir, "registry-mirrors.conf"), []byte(content), 0644)
+	if err != nil {
+		return opts, errors.Wrapf(err, "couldn't write registry mirrors")
+	}
+
+	opts.RegistriesConfDir = dir
+	return opts, nil
+}
@@ -0,0 +1,81 @@
+package stacker
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/containers/image/v5/pkg/sysregistriesv2"
+	imagetypes "github.com/containers/image/v5/types"
+	"github.com/stretchr/testify/assert"
+	"stackerbuild.io/stacker/pkg/lib"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+func TestRegistryMirrors(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+
+	registriesConf := path.Join(dir, "registries.conf")
+	err := os.WriteFile(registriesConf, []byte(`
+[[registry]]
+prefix = "quay.io"
+location = "quay.io"
+blocked = true
+
+[[registry]]
+prefix = "docker.io"
+location = "docker.io"
+
+[[registry.mirror]]
+location = "replaced.example.com"
+`), 0644)
+	assert.NoError(err)
+
+	config := types.StackerConfig{
+		StackerDir:     dir,
+		RegistriesConf: registriesConf,
+		RegistryMirrors: map[string][]types.RegistryMirror{
+			"docker.io": {
+				{Location: "mirror.example.com:5000", Insecure: true},
+				{Location: "mirror2.example.com"},
+			},
+		},
+	}
+
+	opts, err := withRegistries(config, lib.ImageCopyOpts{})
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal(registriesConf, opts.RegistriesConf)
+	assert.Equal(path.Join(dir, "short-name-aliases.conf"), opts.ShortNameAliasesConf)
+
+	sys := &imagetypes.SystemContext{
+		SystemRegistriesConfPath:    opts.RegistriesConf,
+		SystemRegistriesConfDirPath: opts.RegistriesConfDir,
+	}
+
+	dockerio, err := sysregistriesv2.FindRegistry(sys, "docker.io/library/busybox:latest")
+	assert.NoError(err)
+	if assert.NotNil(dockerio) && assert.Len(dockerio.Mirrors, 2) {
+		assert.Equal("mirror.example.com:5000", dockerio.Mirrors[0].Location)
+		assert.True(dockerio.Mirrors[0].Insecure)
+		assert.Equal("mirror2.example.com", dockerio.Mirrors[1].Location)
+	}
+
+	// the rest of registries.conf still applies
+	quayio, err := sysregistriesv2.FindRegistry(sys, "quay.io/foo/bar:latest")
+	assert.NoError(err)
+	if assert.NotNil(quayio) {
+		assert.True(quayio.Blocked)
+	}
+
+	config.RegistryMirrors = map[string][]types.RegistryMirror{"docker.io": {{}}}
+	_, err = withRegistries(config, lib.ImageCopyOpts{})
+	assert.ErrorContains(err, "mirror of docker.io has no location")
+
+	// without registries configured, pulls are left alone
+	opts, err = withRegistries(types.StackerConfig{StackerDir: dir}, lib.ImageCopyOpts{Src: "docker://busybox"})
+	assert.NoError(err)
+	assert.Equal(lib.ImageCopyOpts{Src: "docker://busybox"}, opts)
+}
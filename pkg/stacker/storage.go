@@ -5,6 +5,7 @@ import (
 	"path"
 
 	"github.com/pkg/errors"
+	"stackerbuild.io/stacker/pkg/dir"
 	"stackerbuild.io/stacker/pkg/log"
 	"stackerbuild.io/stacker/pkg/overlay"
 	"stackerbuild.io/stacker/pkg/storage"
@@ -24,6 +25,15 @@ func openStorage(c types.StackerConfig, storageType string) (types.Storage, erro
 		}
 
 		return overlay.NewOverlay(c)
+	case "fuse-overlay":
+		err := overlay.CheckFuse(c)
+		if err != nil {
+			return nil, err
+		}
+
+		return overlay.NewFuseOverlay(c)
+	case "dir":
+		return dir.NewDir(c)
 	default:
 		return nil, errors.Errorf("unknown storage type %s", storageType)
 	}
@@ -65,34 +75,44 @@ func tryToDetectStorageType(c types.StackerConfig) (string, error) {
 			log.Debugf("detected some overlay layers, assuming previous storage type overlay")
 			return "overlay", nil
 		}
+
+		if _, err := os.Stat(path.Join(c.RootFSDir, ent.Name(), "baseline.mtree")); err == nil {
+			log.Debugf("detected some dir layers, assuming previous storage type dir")
+			return "dir", nil
+		}
 	}
 
 	log.Debugf("no overlay layers detected, assuming previous storage type btrfs")
 	return "btrfs", nil
 }
 
-// errorOnStorageTypeSwitch returns an error if there was a previous stacker
-// run with a different storage type.
-func errorOnStorageTypeSwitch(c types.StackerConfig) error {
-	var storageType string
+// previousStorageType is the storage type of a previous stacker run, or ""
+// if there wasn't one.
+func previousStorageType(c types.StackerConfig) (string, error) {
 	content, err := os.ReadFile(path.Join(c.StackerDir, storageTypeFile))
 	if err != nil {
 		// older versions of stacker didn't write this file
 		if !os.IsNotExist(err) {
-			return errors.Wrapf(err, "couldn't read storage type")
+			return "", errors.Wrapf(err, "couldn't read storage type")
 		}
 
-		storageType, err = tryToDetectStorageType(c)
-		if err != nil {
-			return err
-		}
+		return tryToDetectStorageType(c)
+	}
 
-		// no previous storage is fine
-		if storageType == "" {
-			return nil
-		}
-	} else {
-		storageType = string(content)
+	return string(content), nil
+}
+
+// errorOnStorageTypeSwitch returns an error if there was a previous stacker
+// run with a different storage type.
+func errorOnStorageTypeSwitch(c types.StackerConfig) error {
+	storageType, err := previousStorageType(c)
+	if err != nil {
+		return err
+	}
+
+	// no previous storage is fine
+	if storageType == "" {
+		return nil
 	}
 
 	if storageType != c.StorageType {
@@ -103,19 +123,97 @@ func errorOnStorageTypeSwitch(c types.StackerConfig) error {
 
 }
 
+// SelectStorageType picks the storage type for when none was asked for:
+// overlay if the kernel's overlay can be used, fuse-overlay if not, and the
+// copy based dir storage if neither can be mounted.
+func SelectStorageType(c types.StackerConfig) (string, error) {
+	err := overlay.Check(c)
+	if err == nil {
+		return "overlay", nil
+	}
+	log.Debugf("can't use overlay storage: %v", err)
+
+	fuseErr := overlay.CheckFuse(c)
+	if fuseErr == nil {
+		log.Infof("kernel overlay unavailable, using fuse-overlay storage")
+		return "fuse-overlay", nil
+	}
+	log.Debugf("can't use fuse-overlay storage: %v", fuseErr)
+
+	log.Infof("overlay and fuse-overlay unavailable, using dir storage")
+	return "dir", dir.Check(c)
+}
+
+// recordStorageType writes the storage type that builds in c's stacker dir
+// use when none is asked for.
+func recordStorageType(c types.StackerConfig, storageType string) error {
+	err := os.MkdirAll(c.StackerDir, 0755)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't make stacker dir")
+	}
+
+	err = os.WriteFile(path.Join(c.StackerDir, storageTypeFile), []byte(storageType), 0644)
+	return errors.Wrapf(err, "couldn't write storage type")
+}
+
+// CheckStorage checks that c's storage type can be used, and returns it.
+// Without one, that is the storage type of previous builds, or the one
+// SelectStorageType picks, which is then recorded for the builds that follow.
+func CheckStorage(c types.StackerConfig) (string, error) {
+	storageType := c.StorageType
+	if storageType == "" {
+		previous, err := previousStorageType(c)
+		if err != nil {
+			return "", err
+		}
+
+		if previous == "" {
+			storageType, err = SelectStorageType(c)
+			if err != nil {
+				return "", err
+			}
+
+			return storageType, recordStorageType(c, storageType)
+		}
+		storageType = previous
+	}
+
+	switch storageType {
+	case "overlay":
+		return storageType, overlay.Check(c)
+	case "fuse-overlay":
+		return storageType, overlay.CheckFuse(c)
+	case "dir":
+		return storageType, dir.Check(c)
+	default:
+		return "", errors.Errorf("invalid storage type %v", storageType)
+	}
+}
+
 func NewStorage(c types.StackerConfig) (types.Storage, *StackerLocks, error) {
 	if err := os.MkdirAll(c.RootFSDir, 0755); err != nil {
 		return nil, nil, err
 	}
 
-	err := errorOnStorageTypeSwitch(c)
-	if err != nil {
-		return nil, nil, err
+	// without a storage type, use the previous one, or pick one
+	if c.StorageType == "" {
+		storageType, err := previousStorageType(c)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if storageType == "" {
+			storageType, err = SelectStorageType(c)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		c.StorageType = storageType
 	}
 
-	err = os.MkdirAll(c.StackerDir, 0755)
+	err := errorOnStorageTypeSwitch(c)
 	if err != nil {
-		return nil, nil, errors.Wrapf(err, "couldn't make stacker dir")
+		return nil, nil, err
 	}
 
 	err = os.MkdirAll(c.RootFSDir, 0755)
@@ -123,9 +221,9 @@ func NewStorage(c types.StackerConfig) (types.Storage, *StackerLocks, error) {
 		return nil, nil, errors.Wrapf(err, "couldn't make rootfs dir")
 	}
 
-	err = os.WriteFile(path.Join(c.StackerDir, storageTypeFile), []byte(c.StorageType), 0644)
+	err = recordStorageType(c, c.StorageType)
 	if err != nil {
-		return nil, nil, errors.Wrapf(err, "couldn't write storage type")
+		return nil, nil, err
 	}
 
 	s, err := openStorage(c, c.StorageType)
@@ -152,8 +250,15 @@ func UnprivSetup(c types.StackerConfig, username string, uid, gid int) error {
 	}
 
 	switch c.StorageType {
+	case "":
+		_, err := SelectStorageType(c)
+		return err
 	case "overlay":
 		return overlay.UnprivSetup(c, uid, gid)
+	case "fuse-overlay":
+		return overlay.CheckFuse(c)
+	case "dir":
+		return dir.Check(c)
 	default:
 		return errors.Errorf("unknown storage type %s", c.StorageType)
 	}
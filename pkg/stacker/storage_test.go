@@ -0,0 +1,40 @@
+package stacker
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+func TestPreviousStorageType(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	config := types.StackerConfig{
+		StackerDir: path.Join(dir, ".stacker"),
+		RootFSDir:  path.Join(dir, "roots"),
+	}
+
+	storageType, err := previousStorageType(config)
+	assert.NoError(err)
+	assert.Equal("", storageType)
+
+	assert.NoError(recordStorageType(config, "fuse-overlay"))
+	storageType, err = previousStorageType(config)
+	assert.NoError(err)
+	assert.Equal("fuse-overlay", storageType)
+
+	config.StorageType = "fuse-overlay"
+	assert.NoError(errorOnStorageTypeSwitch(config))
+	config.StorageType = "overlay"
+	assert.ErrorContains(errorOnStorageTypeSwitch(config), "previous storage type fuse-overlay")
+
+	// without a storage type, the recorded one is checked
+	assert.NoError(os.WriteFile(path.Join(config.StackerDir, storageTypeFile), []byte("btrfs"), 0644))
+	config.StorageType = ""
+	_, err = CheckStorage(config)
+	assert.ErrorContains(err, "invalid storage type btrfs")
+}
@@ -0,0 +1,156 @@
+package stacker
+
+import (
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"stackerbuild.io/stacker/pkg/lib"
+	"stackerbuild.io/stacker/pkg/log"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+// fetchHttp downloads the http file u to fetchedPath, or just returns where
+// it is when offline.
+func fetchHttp(c types.StackerConfig, u string, hash string, mirrors []string, progress bool) (string, error) {
+	dest := fetchedPath(c, u)
+	if c.Offline {
+		if !lib.PathExists(dest) {
+			return "", errors.Errorf("offline: %s wasn't fetched, run 'stacker fetch' first", u)
+		}
+		return dest, nil
+	}
+
+	if err := validateHash(hash); err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(path.Dir(dest), 0755); err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	remoteHash, remoteSize, err := getHttpFileInfo(u)
+	if err != nil {
+		log.Infof("cannot obtain file info of %s", u)
+	}
+	if hash != "" && remoteHash != "" && strings.ToLower(hash) != remoteHash {
+		return "", errors.Errorf("The requested hash of %s import is different than the actual hash: %s != %s",
+			u, hash, remoteHash)
+	}
+
+	return Download(path.Dir(dest), u, mirrors, c.DownloadRetries, fetchProgress(c, progress), strings.ToLower(hash), remoteHash, remoteSize, "", nil, -1, -1)
+}
+
+// acquireVerifyFile gets the checksum file or signature p of an import,
+// which is either a local path or an http(s) url.
+func acquireVerifyFile(c types.StackerConfig, p string, progress bool) (string, error) {
+	if !isHttpUrl(p) {
+		if !lib.PathExists(p) {
+			return "", errors.Errorf("%s doesn't exist", p)
+		}
+		return p, nil
+	}
+
+	// there is no hash to check a fetched copy against, and checksum files
+	// and signatures are usually replaced in place by new releases, so
+	// they're always fetched again
+	if !c.Offline {
+		if err := os.RemoveAll(fetchedPath(c, p)); err != nil {
+			return "", errors.WithStack(err)
+		}
+	}
+
+	return fetchHttp(c, p, "", nil, progress)
+}
+
+// verifyImport checks file, the downloaded http(s) import imp, against the
+// checksum file and signature in imp. The signature is of the checksum file if
+// there is one, and of file otherwise. When it doesn't pass, the fetched
+// checksum file and signature are removed.
+func verifyImport(c types.StackerConfig, imp types.Import, file string, progress bool) error {
+	// imports may share checksum files and signatures, which are fetched
+	// again for each of them, so imports that do are verified one at a
+	// time
+	urls := []string{}
+	for _, u := range []string{imp.Checksums, imp.Signature} {
+		if isHttpUrl(u) {
+			urls = append(urls, u)
+		}
+	}
+	sort.Strings(urls)
+	for i, u := range urls {
+		if i == 0 || u != urls[i-1] {
+			defer fetchLocks.lock("verify:" + u)()
+		}
+	}
+
+	err := checkImport(c, imp, file, progress)
+	if err != nil && !c.Offline {
+		for _, u := range urls {
+			os.RemoveAll(fetchedPath(c, u))
+		}
+	}
+	return err
+}
+
+func checkImport(c types.StackerConfig, imp types.Import, file string, progress bool) error {
+	checksums := ""
+	if imp.Checksums != "" {
+		var err error
+		checksums, err = acquireVerifyFile(c, imp.Checksums, progress)
+		if err != nil {
+			return errors.Wrapf(err, "couldn't get the checksum file of %s", imp.Path)
+		}
+	}
+
+	if imp.Signature != "" {
+		sig, err := acquireVerifyFile(c, imp.Signature, progress)
+		if err != nil {
+			return errors.Wrapf(err, "couldn't get the signature of %s", imp.Path)
+		}
+
+		signed := file
+		if checksums != "" {
+			signed = checksums
+		}
+
+		if err := lib.VerifySignature(signed, sig, c.TrustedKeys); err != nil {
+			return err
+		}
+	}
+
+	if checksums != "" {
+		d, err := lib.ChecksumFor(checksums, path.Base(imp.Path))
+		if err != nil {
+			return err
+		}
+
+		if err := lib.VerifyFileDigest(file, d); err != nil {
+			return err
+		}
+	}
+
+	log.Infof("verified %s", imp.Path)
+	return nil
+}
+
+// acquireVerifiedUrl downloads the http(s) import imp, checks it against its
+// checksum file and signature, and only then copies it to cache. A download
+// that doesn't pass is removed.
+func acquireVerifiedUrl(c types.StackerConfig, imp types.Import, cache string, progress bool) (string, error) {
+	fetched, err := fetchHttp(c, imp.Path, imp.Hash, imp.Mirrors, progress)
+	if err != nil {
+		return "", err
+	}
+
+	if err := verifyImport(c, imp, fetched, progress); err != nil {
+		if !c.Offline {
+			os.RemoveAll(fetchedPath(c, imp.Path))
+		}
+		return "", err
+	}
+
+	return importFile(fetched, cache, imp.Hash, imp.Dest, imp.Mode, imp.Uid, imp.Gid, nil)
+}
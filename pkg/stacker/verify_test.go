@@ -0,0 +1,99 @@
+package stacker
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/stretchr/testify/assert"
+	"stackerbuild.io/stacker/pkg/lib"
+	"stackerbuild.io/stacker/pkg/types"
+)
+
+func TestAcquireVerifiedUrl(t *testing.T) {
+	assert := assert.New(t)
+
+	entity, err := openpgp.NewEntity("stacker", "", "stacker@example.com", nil)
+	assert.NoError(err)
+	key := path.Join(t.TempDir(), "key.gpg")
+	buf := bytes.Buffer{}
+	assert.NoError(entity.Serialize(&buf))
+	assert.NoError(os.WriteFile(key, buf.Bytes(), 0644))
+
+	files := map[string][]byte{
+		"/foo.tar.gz":     []byte(downloadContent),
+		"/SHA256SUMS":     []byte(fmt.Sprintf("%s  foo.tar.gz\n", downloadHash())),
+		"/BADSUMS":        []byte(fmt.Sprintf("%s  foo.tar.gz\n", urlKey("other"))),
+		"/SHA256SUMS.sig": nil,
+	}
+	buf.Reset()
+	assert.NoError(openpgp.DetachSign(&buf, entity, bytes.NewReader(files["/SHA256SUMS"]), nil))
+	files["/SHA256SUMS.sig"] = buf.Bytes()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(content)
+	}))
+	defer server.Close()
+
+	config := types.StackerConfig{StackerDir: t.TempDir(), TrustedKeys: []string{key}}
+	imp := types.Import{
+		Path:      server.URL + "/foo.tar.gz",
+		Checksums: server.URL + "/SHA256SUMS",
+		Signature: server.URL + "/SHA256SUMS.sig",
+		Uid:       lib.UidEmpty,
+		Gid:       lib.GidEmpty,
+	}
+
+	cache := t.TempDir()
+	name, err := acquireVerifiedUrl(config, imp, cache, false)
+	assert.NoError(err)
+	assert.Equal(path.Join(cache, "foo.tar.gz"), name)
+	content, err := os.ReadFile(name)
+	assert.NoError(err)
+	assert.Equal(downloadContent, string(content))
+
+	// what was fetched is verified again offline
+	offline := config
+	offline.Offline = true
+	_, err = acquireVerifiedUrl(offline, imp, t.TempDir(), false)
+	assert.NoError(err)
+
+	offline.TrustedKeys = nil
+	_, err = acquireVerifiedUrl(offline, imp, t.TempDir(), false)
+	assert.ErrorContains(err, "no trusted keys")
+
+	// files that don't pass don't make it to the imports dir, and aren't
+	// kept around
+	bad := imp
+	bad.Checksums, bad.Signature = server.URL+"/BADSUMS", ""
+	cache = t.TempDir()
+	_, err = acquireVerifiedUrl(config, bad, cache, false)
+	assert.ErrorContains(err, "different than its checksum")
+	assert.NoFileExists(path.Join(cache, "foo.tar.gz"))
+	assert.NoFileExists(fetchedPath(config, bad.Path))
+	assert.NoFileExists(fetchedPath(config, bad.Checksums))
+
+	// the signature of the good checksum file isn't for the bad one
+	bad.Signature = imp.Signature
+	_, err = acquireVerifiedUrl(config, bad, cache, false)
+	assert.ErrorContains(err, "bad GPG signature")
+
+	// checksum files are fetched again, even if they have the same size
+	unsigned := imp
+	unsigned.Signature = ""
+	_, err = acquireVerifiedUrl(config, unsigned, t.TempDir(), false)
+	assert.NoError(err)
+	files["/SHA256SUMS"] = files["/BADSUMS"]
+	_, err = acquireVerifiedUrl(config, unsigned, t.TempDir(), false)
+	assert.ErrorContains(err, "different than its checksum")
+}
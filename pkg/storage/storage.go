@@ -2,7 +2,18 @@
 package storage
 
 import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/casext"
 	"github.com/pkg/errors"
+	stackeroci "machinerun.io/atomfs/pkg/oci"
+	"stackerbuild.io/stacker/pkg/lib"
+	"stackerbuild.io/stacker/pkg/log"
 	"stackerbuild.io/stacker/pkg/types"
 )
 
@@ -49,3 +60,196 @@ func FindFirstBaseInOutput(name string, sfm types.StackerFiles) (string, types.L
 	// otherwise, we didn't find anything
 	return "", types.Layer{}, false, nil
 }
+
+// ConvertFunc writes the image cacheTag in the layer-bases cache to the
+// output as layerType's image of name, in layerType's format.
+type ConvertFunc func(cacheTag string, name string, layerType types.LayerType) error
+
+// InitializeBasesInOutput creates name's image for each of layerTypes in the
+// output, from the first base of it that is in the output or the layer-bases
+// cache, so that its layers can be added on top. Bases in another format than
+// a layer type are converted with convert.
+func InitializeBasesInOutput(config types.StackerConfig, name string, layerTypes []types.LayerType, sfm types.StackerFiles, convert ConvertFunc) error {
+	baseTag, baseLayer, foundBase, err := FindFirstBaseInOutput(name, sfm)
+	if err != nil {
+		return err
+	}
+
+	initialized := false
+	if foundBase {
+		if !baseLayer.BuildOnly && baseTag != name {
+			// otherwise if it's already been built and the base
+			// types match, import it from there
+			for _, layerType := range layerTypes {
+				// layers are added to the unsquashed layers of
+				// a squashed base, like they are to its rootfs
+				src := layerType.LayerName(baseTag)
+				unsquashed, err := tagExists(config.OCIDir, UnsquashedTag(src))
+				if err != nil {
+					return err
+				}
+				if unsquashed {
+					src = UnsquashedTag(src)
+				}
+
+				log.Debugf("Running image copy to oci:%s:%s", config.OCIDir, layerType.LayerName(name))
+				err = lib.ImageCopy(lib.ImageCopyOpts{
+					Src:  fmt.Sprintf("oci:%s:%s", config.OCIDir, src),
+					Dest: fmt.Sprintf("oci:%s:%s", config.OCIDir, layerType.LayerName(name)),
+				})
+				if err != nil {
+					return err
+				}
+			}
+
+			initialized = true
+		} else if types.IsContainersImageLayer(baseLayer.From.Type) {
+			cacheDir := path.Join(config.StackerDir, "layer-bases", "oci")
+			cacheTag, err := baseLayer.From.ParseTag()
+			if err != nil {
+				return err
+			}
+
+			manifest, err := lookupManifestInDir(cacheDir, cacheTag)
+			if err != nil {
+				return err
+			}
+
+			sourceLayerType, err := types.NewLayerTypeManifest(manifest)
+			if err != nil {
+				return err
+			}
+
+			for _, layerType := range layerTypes {
+				if sourceLayerType.SameFormat(layerType) {
+					err = lib.ImageCopy(lib.ImageCopyOpts{
+						Src:  fmt.Sprintf("oci:%s:%s", cacheDir, cacheTag),
+						Dest: fmt.Sprintf("oci:%s:%s", config.OCIDir, layerType.LayerName(name)),
+					})
+					if err != nil {
+						return err
+					}
+				} else {
+					log.Debugf("creating oci image %s (type=%s) by converting %s (type=%s)",
+						layerType.LayerName(name), layerType, sourceLayerType.LayerName(name), sourceLayerType)
+					err = convert(cacheTag, name, layerType)
+					if err != nil {
+						return err
+					}
+				}
+			}
+
+			initialized = true
+		}
+	}
+
+	if !initialized {
+		oci, err := umoci.OpenLayout(config.OCIDir)
+		if err != nil {
+			return err
+		}
+		defer oci.Close()
+
+		for _, layerType := range layerTypes {
+			err = umoci.NewImage(oci, layerType.LayerName(name), config.SourceDateEpoch)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func tagExists(dir, tag string) (bool, error) {
+	oci, err := umoci.OpenLayout(dir)
+	if err != nil {
+		return false, err
+	}
+	defer oci.Close()
+
+	descPaths, err := oci.ResolveReference(context.Background(), tag)
+	if err != nil {
+		return false, err
+	}
+
+	return len(descPaths) > 0, nil
+}
+
+// UnsquashedTag is the tag the image tag of a squashed layer is kept under
+// in the output. It is what the build cache and the layers built on the
+// squashed one use, and keeping it tagged keeps its layers from being GCed.
+func UnsquashedTag(tag string) string {
+	return tag + "-unsquashed"
+}
+
+// KeepUnsquashed tags the image tag in oci as UnsquashedTag(tag), before it
+// is squashed in place.
+func KeepUnsquashed(oci casext.Engine, tag string) error {
+	descPaths, err := oci.ResolveReference(context.Background(), tag)
+	if err != nil {
+		return err
+	}
+
+	if len(descPaths) == 0 {
+		return errors.Errorf("tag %s not found", tag)
+	}
+
+	return oci.UpdateReference(context.Background(), UnsquashedTag(tag), descPaths[0].Root())
+}
+
+// DropUnsquashed removes the unsquashed image of tag from oci, if there is
+// one, e.g. when tag's layer isn't squashed anymore.
+func DropUnsquashed(oci casext.Engine, tag string) error {
+	return oci.DeleteReference(context.Background(), UnsquashedTag(tag))
+}
+
+func lookupManifestInDir(dir, name string) (ispec.Manifest, error) {
+	oci, err := umoci.OpenLayout(dir)
+	if err != nil {
+		return ispec.Manifest{}, err
+	}
+	defer oci.Close()
+
+	return stackeroci.LookupManifest(oci, name)
+}
+
+// tempDirPrefixes are the prefixes of the dirs storage backends create in the
+// roots dir while working on a layer.
+var tempDirPrefixes = []string{"temp-snapshot-", "squash-", "stacker-overlay-whiteout-"}
+
+// IsTempDir is whether name in the roots dir is named like a temporary dir of
+// a storage backend, which is left over from an interrupted build if it exists
+// while no build is running. Layers can be named like that too, so names in
+// types.FsckOpts.Layers aren't temporary dirs.
+func IsTempDir(name string) bool {
+	for _, prefix := range tempDirPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// FsckProblems collects the problems a storage backend's Fsck finds.
+type FsckProblems struct {
+	// Repair is whether problems are repaired when they're found
+	Repair   bool
+	Problems []types.FsckProblem
+}
+
+// Found records that thing has a problem, and when repairing, repairs it by
+// calling remove.
+func (f *FsckProblems) Found(thing string, remove func() error, format string, args ...interface{}) error {
+	problem := types.FsckProblem{Path: thing, Problem: fmt.Sprintf(format, args...)}
+	if f.Repair {
+		if err := remove(); err != nil {
+			return errors.Wrapf(err, "couldn't repair %s", thing)
+		}
+		problem.Repaired = true
+	}
+
+	log.Debugf("fsck: %s: %s (repaired: %v)", problem.Path, problem.Problem, problem.Repaired)
+	f.Problems = append(f.Problems, problem)
+	return nil
+}
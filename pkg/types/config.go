@@ -7,6 +7,10 @@ import (
 	"time"
 )
 
+// DefaultDownloadRetries is the DownloadRetries used when the config file
+// doesn't set it.
+const DefaultDownloadRetries = 3
+
 // StackerConfig is a struct that contains global (or widely used) stacker
 // config options.
 type StackerConfig struct {
@@ -17,6 +21,35 @@ type StackerConfig struct {
 	Debug       bool   `yaml:"-"`
 	StorageType string `yaml:"-"`
 
+	// Security is the default confinement for build containers; a
+	// layer's 'security' directive takes precedence over it.
+	Security *Security `yaml:"security,omitempty"`
+
+	// RegistriesConf is the registries.conf used for pulling base images
+	// and publishing, instead of the system one.
+	RegistriesConf string `yaml:"registries_conf,omitempty"`
+
+	// RegistryMirrors are mirrors to pull images from each registry
+	// from, which take precedence over RegistriesConf's for the same
+	// registry.
+	RegistryMirrors map[string][]RegistryMirror `yaml:"registry_mirrors,omitempty"`
+
+	// DownloadRetries is how many times a failed http(s) import download
+	// is retried, with an exponential backoff between tries.
+	DownloadRetries int `yaml:"download_retries,omitempty"`
+
+	// FetchJobs is how many imports and base images are fetched at the
+	// same time; 4 if it isn't set.
+	FetchJobs int `yaml:"fetch_jobs,omitempty"`
+
+	// TrustedKeys are the GPG and minisign public key files the
+	// signatures of http(s) imports are checked against.
+	TrustedKeys []string `yaml:"trusted_keys,omitempty"`
+
+	// Offline builds only use base images and files downloaded by
+	// 'stacker fetch', and run without network access.
+	Offline bool `yaml:"-"`
+
 	// SourceDateEpoch, if set, is used to clamp timestamps in OCI layers
 	// and image configs for reproducible builds. Parsed from the
 	// SOURCE_DATE_EPOCH environment variable.
@@ -28,6 +61,13 @@ type StackerConfig struct {
 	EmbeddedFS embed.FS `yaml:"-"`
 }
 
+// RegistryMirror is a mirror of a registry, e.g. an internal pull-through
+// cache of docker.io.
+type RegistryMirror struct {
+	Location string `yaml:"location"`
+	Insecure bool   `yaml:"insecure,omitempty"`
+}
+
 // Substitutions - return an array of substitutions for StackerFiles
 func (sc *StackerConfig) Substitutions() []string {
 	return []string{
@@ -0,0 +1,39 @@
+package types
+
+import (
+	"github.com/pkg/errors"
+)
+
+// FilesystemOptions are the settings squashfs and erofs outputs of a layer are
+// generated with, via the 'filesystem' directive. They override the ones in
+// the --layer-type the layer is being output as.
+type FilesystemOptions struct {
+	// Compression is one of gzip, zstd, xz, lz4 and lz4hc.
+	Compression string `yaml:"compression" json:"compression,omitempty"`
+
+	// Level is the compression level, if the compression has levels.
+	Level int `yaml:"level" json:"level,omitempty"`
+
+	// BlockSize is the squashfs block size or the maximum erofs physical
+	// cluster size, in bytes.
+	BlockSize int `yaml:"block_size" json:"block_size,omitempty"`
+
+	// Dedupe and Fragments enable the erofs features of the same name;
+	// they're ignored for squashfs.
+	Dedupe    bool `yaml:"dedupe" json:"dedupe,omitempty"`
+	Fragments bool `yaml:"fragments" json:"fragments,omitempty"`
+}
+
+func (fo FilesystemOptions) validate() error {
+	// the options have to make sense for at least one of the filesystems,
+	// since the layer may only be output as that one.
+	var err error
+	for _, fsType := range []string{"squashfs", "erofs"} {
+		_, err = LayerType{Type: fsType}.WithFilesystemOptions(&fo)
+		if err == nil {
+			return nil
+		}
+	}
+
+	return errors.Wrapf(err, "invalid filesystem options")
+}
@@ -47,6 +47,13 @@ type ImageSource struct {
 	Url      string `yaml:"url" json:"url,omitempty"`
 	Tag      string `yaml:"tag" json:"tag,omitempty"`
 	Insecure bool   `yaml:"insecure" json:"insecure,omitempty"`
+	// Ref, Path and Submodules are for git sources: the branch, tag or
+	// commit to use, the directory or tarball in the repository that is
+	// the rootfs (the whole repository if it's empty), and whether to
+	// check out submodules.
+	Ref        string `yaml:"ref" json:"ref,omitempty"`
+	Path       string `yaml:"path" json:"path,omitempty"`
+	Submodules bool   `yaml:"submodules" json:"submodules,omitempty"`
 }
 
 func NewImageSource(containersImageString string) (*ImageSource, error) {
@@ -0,0 +1,68 @@
+package types
+
+import (
+	"io/fs"
+
+	"github.com/pkg/errors"
+)
+
+// ImageTest describes the checks run against the final image of a layer, via
+// the 'test' directive.
+type ImageTest struct {
+	// Commands to run inside the image; each entry is a separate test
+	// case.
+	Run StringList `yaml:"run" json:"run,omitempty"`
+
+	// Files that are expected to (or not to) exist in the image.
+	Files []FileTest `yaml:"files" json:"files,omitempty"`
+
+	// Expected values in the image's OCI config.
+	Config *ConfigTest `yaml:"config" json:"config,omitempty"`
+}
+
+// FileTest describes the expected state of a path in the image.
+type FileTest struct {
+	Path   string       `yaml:"path" json:"path"`
+	Type   string       `yaml:"type" json:"type,omitempty"`
+	Mode   *fs.FileMode `yaml:"mode" json:"mode,omitempty"`
+	Uid    *int         `yaml:"uid" json:"uid,omitempty"`
+	Gid    *int         `yaml:"gid" json:"gid,omitempty"`
+	Absent bool         `yaml:"absent" json:"absent,omitempty"`
+}
+
+// ConfigTest describes the expected values in the OCI image config. Only the
+// values that are set are checked.
+type ConfigTest struct {
+	Env        map[string]string `yaml:"env" json:"env,omitempty"`
+	Entrypoint Command           `yaml:"entrypoint" json:"entrypoint,omitempty"`
+	Cmd        Command           `yaml:"cmd" json:"cmd,omitempty"`
+	WorkingDir string            `yaml:"working_dir" json:"working_dir,omitempty"`
+	User       string            `yaml:"user" json:"user,omitempty"`
+	Labels     map[string]string `yaml:"labels" json:"labels,omitempty"`
+}
+
+const (
+	FileTestTypeFile    = "file"
+	FileTestTypeDir     = "dir"
+	FileTestTypeSymlink = "symlink"
+)
+
+func (it *ImageTest) validate() error {
+	for _, f := range it.Files {
+		if f.Path == "" {
+			return errors.Errorf("test file entry is missing 'path'")
+		}
+
+		switch f.Type {
+		case "", FileTestTypeFile, FileTestTypeDir, FileTestTypeSymlink:
+		default:
+			return errors.Errorf("test file %s: invalid type %q (must be one of file, dir, symlink)", f.Path, f.Type)
+		}
+
+		if f.Absent && (f.Type != "" || f.Mode != nil || f.Uid != nil || f.Gid != nil) {
+			return errors.Errorf("test file %s: 'absent' can't be combined with other checks", f.Path)
+		}
+	}
+
+	return nil
+}
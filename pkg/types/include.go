@@ -0,0 +1,358 @@
+package types
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+	"stackerbuild.io/stacker/pkg/log"
+)
+
+const extendsDirective = "extends"
+
+// remoteClient downloads remote stackerfiles and includes, so that a server
+// that stops answering doesn't hang loading them forever.
+var remoteClient = &http.Client{Timeout: 60 * time.Second}
+
+// downloadRemote downloads u, which is the remote "stackerfile" or "include"
+// what says it is.
+func downloadRemote(what string, u string) ([]byte, error) {
+	resp, err := remoteClient.Get(u)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't download %s %s", what, u)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("%s: couldn't download %s: %s", what, u, resp.Status)
+	}
+
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't download %s %s", what, u)
+	}
+
+	return raw, nil
+}
+
+// Include is an entry in the 'include' list of the 'config' section. It
+// points to a yaml file (local or http(s)) containing layer templates that can
+// be referenced with 'extends'.
+type Include struct {
+	Path string `yaml:"path"`
+	Hash string `yaml:"hash"`
+}
+
+type Includes []Include
+
+// UnmarshalYAML allows an include to be either a plain path or a map with
+// 'path' and 'hash'.
+func (inc *Include) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	asStr := ""
+	if err := unmarshal(&asStr); err == nil {
+		inc.Path = asStr
+		return nil
+	}
+
+	type rawInclude Include
+	raw := rawInclude{}
+	if err := unmarshal(&raw); err != nil {
+		return errors.Errorf("invalid include: %v", err)
+	}
+
+	if raw.Path == "" {
+		return errors.Errorf("include is missing required field 'path'")
+	}
+
+	*inc = Include(raw)
+	return nil
+}
+
+// layer fields whose values are merged key by key with the template's
+var extendsMapFields = map[string]bool{
+	"build_env":   true,
+	"environment": true,
+	"labels":      true,
+	"annotations": true,
+}
+
+// layer fields whose values are appended to the template's
+var extendsListFields = map[string]bool{
+	"imports":               true,
+	"import":                true,
+	"overlay_dirs":          true,
+	"run":                   true,
+	"volumes":               true,
+	"binds":                 true,
+	"build_env_passthrough": true,
+	"generate_labels":       true,
+}
+
+// readInclude fetches the content of an include, verifying its hash if one
+// was given. Remote includes must always be pinned with a hash.
+func readInclude(referenceDirectory string, inc Include) ([]byte, error) {
+	url, err := NewDockerishUrl(inc.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw []byte
+	switch url.Scheme {
+	case "":
+		p := inc.Path
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(referenceDirectory, p)
+		}
+
+		raw, err = os.ReadFile(p)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't read include %s", inc.Path)
+		}
+	case "http", "https":
+		if inc.Hash == "" {
+			return nil, errors.Errorf("remote include %s needs a hash", inc.Path)
+		}
+
+		if Offline {
+			return nil, errors.Errorf("offline: can't download include %s, use a local copy of it", inc.Path)
+		}
+
+		raw, err = downloadRemote("include", inc.Path)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.Errorf("unsupported include scheme %s for %s", url.Scheme, inc.Path)
+	}
+
+	if inc.Hash != "" {
+		actual := fmt.Sprintf("%x", sha256.Sum256(raw))
+		expected := strings.ToLower(strings.TrimPrefix(inc.Hash, "sha256:"))
+		if actual != expected {
+			return nil, errors.Errorf("the requested hash of include %s is different than the actual hash: %s != %s",
+				inc.Path, expected, actual)
+		}
+	}
+
+	return raw, nil
+}
+
+// loadIncludes reads all the includes and returns the layer templates they
+// define, in the order they were defined.
+func loadIncludes(referenceDirectory string, includes Includes, substitutions []string) (yaml.MapSlice, error) {
+	templates := yaml.MapSlice{}
+	seen := map[string]string{}
+
+	for _, inc := range includes {
+		raw, err := readInclude(referenceDirectory, inc)
+		if err != nil {
+			return nil, err
+		}
+
+		content, err := substitute(string(raw), substitutions)
+		if err != nil {
+			return nil, errors.Wrapf(err, "include %s", inc.Path)
+		}
+
+		ms := yaml.MapSlice{}
+		if err := yaml.Unmarshal([]byte(content), &ms); err != nil {
+			return nil, errors.Wrapf(err, "couldn't parse include %s", inc.Path)
+		}
+
+		for _, e := range ms {
+			name, ok := e.Key.(string)
+			if !ok {
+				return nil, errors.Errorf("include %s: cannot cast %v to string", inc.Path, e.Key)
+			}
+
+			if name == "config" {
+				return nil, errors.Errorf("include %s: 'config' is not allowed in included files", inc.Path)
+			}
+
+			if other, ok := seen[name]; ok {
+				return nil, errors.Errorf("duplicate template name: both %s and %s have %s", other, inc.Path, name)
+			}
+			seen[name] = inc.Path
+
+			log.Debugf("include %s: found template %s", inc.Path, name)
+			templates = append(templates, e)
+		}
+	}
+
+	return templates, nil
+}
+
+// asList returns a yaml value as a list, so that a single string and a list
+// of strings can be concatenated.
+func asList(v interface{}) []interface{} {
+	switch val := v.(type) {
+	case nil:
+		return []interface{}{}
+	case []interface{}:
+		return val
+	default:
+		return []interface{}{val}
+	}
+}
+
+// mergeLayerDefinitions merges a layer definition on top of the template it
+// extends. Maps are merged key by key, lists (including run) are appended to
+// the template's and any other directive replaces the template's value. An
+// explicit null in the layer clears the template's value.
+func mergeLayerDefinitions(template yaml.MapSlice, layer yaml.MapSlice) yaml.MapSlice {
+	ret := yaml.MapSlice{}
+	index := map[string]int{}
+	for _, e := range template {
+		key := e.Key.(string)
+		if key == extendsDirective {
+			continue
+		}
+		index[key] = len(ret)
+		ret = append(ret, e)
+	}
+
+	for _, e := range layer {
+		key := e.Key.(string)
+		if key == extendsDirective {
+			continue
+		}
+
+		i, ok := index[key]
+		if !ok {
+			index[key] = len(ret)
+			ret = append(ret, e)
+			continue
+		}
+
+		old := ret[i].Value
+		switch {
+		case e.Value == nil:
+			ret[i].Value = nil
+		case extendsMapFields[key]:
+			oldMap, ok1 := old.(yaml.MapSlice)
+			newMap, ok2 := e.Value.(yaml.MapSlice)
+			if !ok1 || !ok2 {
+				ret[i].Value = e.Value
+				break
+			}
+			ret[i].Value = mergeMapSlice(oldMap, newMap)
+		case extendsListFields[key]:
+			merged := append([]interface{}{}, asList(old)...)
+			ret[i].Value = append(merged, asList(e.Value)...)
+		default:
+			ret[i].Value = e.Value
+		}
+	}
+
+	return ret
+}
+
+func mergeMapSlice(base yaml.MapSlice, overrides yaml.MapSlice) yaml.MapSlice {
+	ret := append(yaml.MapSlice{}, base...)
+	for _, o := range overrides {
+		found := false
+		for i := range ret {
+			if reflect.DeepEqual(ret[i].Key, o.Key) {
+				ret[i].Value = o.Value
+				found = true
+				break
+			}
+		}
+		if !found {
+			ret = append(ret, o)
+		}
+	}
+	return ret
+}
+
+// expandExtends resolves the 'extends' directive of all layers, using the
+// other layers of the file and the included templates as templates. Layers in
+// the stackerfile take precedence over included templates with the same name.
+func expandExtends(lms yaml.MapSlice, templates yaml.MapSlice) (yaml.MapSlice, error) {
+	definitions := map[string]yaml.MapSlice{}
+	for _, source := range []yaml.MapSlice{templates, lms} {
+		for _, e := range source {
+			name := e.Key.(string)
+			if e.Value == nil {
+				definitions[name] = yaml.MapSlice{}
+				continue
+			}
+
+			def, ok := e.Value.(yaml.MapSlice)
+			if !ok {
+				return nil, errors.Errorf("stackerfile: layer %s is not a map", name)
+			}
+			definitions[name] = def
+		}
+	}
+
+	resolved := map[string]yaml.MapSlice{}
+
+	var resolve func(name string, chain []string) (yaml.MapSlice, error)
+	resolve = func(name string, chain []string) (yaml.MapSlice, error) {
+		if def, ok := resolved[name]; ok {
+			return def, nil
+		}
+
+		for _, c := range chain {
+			if c == name {
+				return nil, errors.Errorf("stackerfile: 'extends' cycle: %s -> %s", strings.Join(chain, " -> "), name)
+			}
+		}
+
+		def, ok := definitions[name]
+		if !ok {
+			return nil, errors.Errorf("stackerfile: %s extends unknown layer %s", chain[len(chain)-1], name)
+		}
+
+		var parent string
+		for _, e := range def {
+			if e.Key.(string) == extendsDirective {
+				parent, ok = e.Value.(string)
+				if !ok || parent == "" {
+					return nil, errors.Errorf("stackerfile: 'extends' in %s must be a layer name", name)
+				}
+			}
+		}
+
+		if parent == "" {
+			resolved[name] = def
+			return def, nil
+		}
+
+		template, err := resolve(parent, append(chain, name))
+		if err != nil {
+			return nil, err
+		}
+
+		merged := mergeLayerDefinitions(template, def)
+		resolved[name] = merged
+		return merged, nil
+	}
+
+	ret := yaml.MapSlice{}
+	for _, e := range lms {
+		name := e.Key.(string)
+		def, err := resolve(name, []string{})
+		if err != nil {
+			return nil, err
+		}
+
+		if len(def) == 0 && e.Value == nil {
+			ret = append(ret, e)
+			continue
+		}
+
+		ret = append(ret, yaml.MapItem{Key: name, Value: def})
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,230 @@
+package types
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeStackerfiles(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("couldn't write %s: %s", name, err)
+		}
+	}
+	return dir
+}
+
+func TestExtendsIncludedTemplate(t *testing.T) {
+	assert := assert.New(t)
+	template := `base:
+    from:
+        type: docker
+        url: docker://ubuntu:latest
+    environment:
+        A: a
+        B: b
+    run: |
+        echo template
+    volumes:
+        - /data
+`
+	content := fmt.Sprintf(`config:
+    include:
+        - path: templates.yaml
+          hash: %x
+child:
+    extends: base
+    environment:
+        B: overridden
+        C: c
+    run:
+        - echo child
+    volumes:
+        - /logs
+`, sha256.Sum256([]byte(template)))
+
+	dir := writeStackerfiles(t, map[string]string{
+		"templates.yaml": template,
+		"stacker.yaml":   content,
+	})
+
+	sf, err := NewStackerfile(filepath.Join(dir, "stacker.yaml"), false, nil)
+	if !assert.NoError(err) {
+		return
+	}
+
+	// templates from includes are not layers of their own
+	assert.Equal([]string{"child"}, sf.FileOrder)
+	assert.Equal(1, sf.Len())
+
+	l, ok := sf.Get("child")
+	assert.True(ok)
+	assert.Equal(DockerLayer, l.From.Type)
+	assert.Equal("docker://ubuntu:latest", l.From.Url)
+	assert.Equal(map[string]string{"A": "a", "B": "overridden", "C": "c"}, l.Environment)
+	assert.Equal(StringList{"echo template\n", "echo child"}, l.Run)
+	assert.Equal([]string{"/data", "/logs"}, l.Volumes)
+
+	// the contents stacker records are what was built, not the file
+	assert.NotContains(sf.AfterSubstitutions, "extends")
+	assert.NoError(os.WriteFile(filepath.Join(dir, "expanded.yaml"), []byte(sf.AfterSubstitutions), 0644))
+	expanded, err := NewStackerfile(filepath.Join(dir, "expanded.yaml"), false, nil)
+	if !assert.NoError(err) {
+		return
+	}
+	el, ok := expanded.Get("child")
+	assert.True(ok)
+	assert.Equal(l, el)
+}
+
+func TestExtendsInFile(t *testing.T) {
+	assert := assert.New(t)
+	content := `first:
+    from:
+        type: docker
+        url: docker://ubuntu:latest
+    cmd: /bin/first
+    labels:
+        foo: bar
+second:
+    extends: first
+    cmd: /bin/second
+    labels: null
+`
+	dir := writeStackerfiles(t, map[string]string{"stacker.yaml": content})
+
+	sf, err := NewStackerfile(filepath.Join(dir, "stacker.yaml"), false, nil)
+	if !assert.NoError(err) {
+		return
+	}
+
+	assert.Equal([]string{"first", "second"}, sf.FileOrder)
+	l, ok := sf.Get("second")
+	assert.True(ok)
+	assert.Equal("docker://ubuntu:latest", l.From.Url)
+	assert.Equal(Command{"/bin/second"}, l.Cmd)
+	assert.Nil(l.Labels)
+
+	// files without includes or extends are recorded as they are
+	unexpanded := "layer:\n    from:\n        type: docker\n        url: docker://ubuntu:latest # pinned\n"
+	dir = writeStackerfiles(t, map[string]string{"stacker.yaml": unexpanded})
+	sf, err = NewStackerfile(filepath.Join(dir, "stacker.yaml"), false, nil)
+	assert.NoError(err)
+	assert.Equal(unexpanded, sf.AfterSubstitutions)
+}
+
+func TestExtendsErrors(t *testing.T) {
+	assert := assert.New(t)
+	tables := []struct {
+		desc   string
+		files  map[string]string
+		errstr string
+	}{
+		{desc: "unknown template",
+			files: map[string]string{"stacker.yaml": `child:
+    extends: nope
+`},
+			errstr: "extends unknown layer nope"},
+		{desc: "cycle",
+			files: map[string]string{"stacker.yaml": `a:
+    extends: b
+b:
+    extends: a
+`},
+			errstr: "cycle"},
+		{desc: "bad hash",
+			files: map[string]string{
+				"t.yaml": "base:\n    run: true\n",
+				"stacker.yaml": `config:
+    include:
+        - path: t.yaml
+          hash: 1234
+child:
+    extends: base
+`},
+			errstr: "different than the actual hash"},
+		{desc: "remote include needs hash",
+			files: map[string]string{"stacker.yaml": `config:
+    include:
+        - https://example.com/t.yaml
+child:
+    extends: base
+`},
+			errstr: "needs a hash"},
+	}
+
+	for _, tt := range tables {
+		dir := writeStackerfiles(t, tt.files)
+		_, err := NewStackerfile(filepath.Join(dir, "stacker.yaml"), false, nil)
+		if assert.Error(err, tt.desc) {
+			assert.Contains(err.Error(), tt.errstr, tt.desc)
+		}
+	}
+}
+
+func TestOfflineRemoteIncludes(t *testing.T) {
+	assert := assert.New(t)
+	Offline = true
+	defer func() { Offline = false }()
+
+	dir := writeStackerfiles(t, map[string]string{"stacker.yaml": `config:
+    include:
+        - path: https://example.com/t.yaml
+          hash: 1234
+child:
+    extends: base
+`})
+	_, err := NewStackerfile(filepath.Join(dir, "stacker.yaml"), false, nil)
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "offline: can't download include https://example.com/t.yaml")
+	}
+
+	_, err = NewStackerfile("https://example.com/stacker.yaml", false, nil)
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "offline: can't download stackerfile https://example.com/stacker.yaml")
+	}
+}
+
+func TestRemoteIncludes(t *testing.T) {
+	assert := assert.New(t)
+	template := "base:\n    run: true\n"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/t.yaml":
+			w.Write([]byte(template))
+		case "/slow.yaml":
+			time.Sleep(time.Second)
+			w.Write([]byte(template))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	old := remoteClient
+	remoteClient = &http.Client{Timeout: 100 * time.Millisecond}
+	defer func() { remoteClient = old }()
+
+	raw, err := readInclude("", Include{Path: server.URL + "/t.yaml", Hash: fmt.Sprintf("%x", sha256.Sum256([]byte(template)))})
+	assert.NoError(err)
+	assert.Equal(template, string(raw))
+
+	_, err = readInclude("", Include{Path: server.URL + "/missing.yaml", Hash: "1234"})
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "404 Not Found")
+	}
+
+	_, err = readInclude("", Include{Path: server.URL + "/slow.yaml", Hash: "1234"})
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "couldn't download include")
+	}
+}
@@ -24,6 +24,7 @@ const (
 	OCILayer     = "oci"
 	BuiltLayer   = "built"
 	ScratchLayer = "scratch"
+	GitLayer     = "git"
 )
 
 const (
@@ -43,6 +44,31 @@ func IsContainersImageLayer(from string) bool {
 	return false
 }
 
+var gitCommitRegexp = regexp.MustCompile("^[0-9a-f]{40}$")
+
+// IsGitUrl is whether u is a git repository, i.e. a git+https://,
+// git+ssh:// or git+file:// url.
+func IsGitUrl(u string) bool {
+	for _, scheme := range []string{"git+https://", "git+ssh://", "git+file://"} {
+		if strings.HasPrefix(u, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsImageUrl is whether u is an image or artifact in a registry
+// (docker://) or an OCI layout (oci://).
+func IsImageUrl(u string) bool {
+	return strings.HasPrefix(u, "docker://") || strings.HasPrefix(u, "oci://")
+}
+
+// IsGitCommit is whether ref is a full commit id, rather than a branch or a
+// tag that can move.
+func IsGitCommit(ref string) bool {
+	return gitCommitRegexp.MatchString(ref)
+}
+
 type Import struct {
 	Path string       `yaml:"path" json:"path"`
 	Hash string       `yaml:"hash" json:"hash,omitempty"`
@@ -50,6 +76,70 @@ type Import struct {
 	Mode *fs.FileMode `yaml:"mode" json:"mode,omitempty"`
 	Uid  int          `yaml:"uid" json:"uid,omitempty"`
 	Gid  int          `yaml:"gid" json:"gid,omitempty"`
+	// Mirrors are other http(s) urls of the same file, tried in order if
+	// Path can't be downloaded.
+	Mirrors []string `yaml:"mirrors" json:"mirrors,omitempty"`
+	// Include and Exclude are gitignore style patterns of the files in a
+	// directory import to import, and to leave out.
+	Include []string `yaml:"include" json:"include,omitempty"`
+	Exclude []string `yaml:"exclude" json:"exclude,omitempty"`
+	// Ref is the branch, tag or commit of a git import; the default
+	// branch if it's empty.
+	Ref string `yaml:"ref" json:"ref,omitempty"`
+	// Submodules is whether a git import's submodules are checked out too.
+	Submodules bool `yaml:"submodules" json:"submodules,omitempty"`
+	// Extract is whether an archive import is unpacked to Dest, rather
+	// than copied.
+	Extract bool `yaml:"extract" json:"extract,omitempty"`
+	// Checksums is the url or path of a checksum file (e.g. SHA256SUMS)
+	// with the hash of an http(s) import in it.
+	Checksums string `yaml:"checksums" json:"checksums,omitempty"`
+	// Signature is the url or path of a detached GPG or minisign
+	// signature of the checksum file if there is one, or of the import,
+	// by one of the configured trusted keys.
+	Signature string `yaml:"signature" json:"signature,omitempty"`
+	// StackerIgnore is the .stackerignore next to the stackerfile, if
+	// the import is in its directory.
+	StackerIgnore *StackerIgnore `yaml:"-" json:"stackerignore,omitempty"`
+}
+
+// StackerIgnore holds the patterns of a .stackerignore, which apply to the
+// local imports under its directory like a .gitignore would.
+type StackerIgnore struct {
+	Patterns []string `json:"patterns"`
+	// Dir is the import's path relative to the .stackerignore's
+	// directory.
+	Dir string `json:"dir"`
+}
+
+// readStackerIgnore reads the patterns in dir's .stackerignore, if there is
+// one.
+func readStackerIgnore(dir string) ([]string, error) {
+	content, err := os.ReadFile(filepath.Join(dir, ".stackerignore"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "couldn't read .stackerignore")
+	}
+
+	patterns := []string{}
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+
+	if _, err := lib.NewPathMatcher(patterns); err != nil {
+		return nil, errors.Wrapf(err, "bad .stackerignore in %s", dir)
+	}
+
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	return patterns, nil
 }
 
 type Imports []Import
@@ -238,30 +328,36 @@ func (bs *Bind) UnmarshalYAML(unmarshal func(interface{}) error) error {
 }
 
 type Layer struct {
-	From            ImageSource       `yaml:"from" json:"from"`
-	Imports         Imports           `yaml:"imports" json:"imports,omitempty"`
-	LegacyImport    Imports           `yaml:"import" json:"import,omitempty"`
-	OverlayDirs     OverlayDirs       `yaml:"overlay_dirs" json:"overlay_dirs,omitempty"`
-	Run             StringList        `yaml:"run" json:"run,omitempty"`
-	Cmd             Command           `yaml:"cmd" json:"cmd,omitempty"`
-	Entrypoint      Command           `yaml:"entrypoint" json:"entrypoint,omitempty"`
-	FullCommand     Command           `yaml:"full_command" json:"full_command,omitempty"`
-	BuildEnvPt      []string          `yaml:"build_env_passthrough" json:"build_env_passthrough,omitempty"`
-	BuildEnv        map[string]string `yaml:"build_env" json:"build_env,omitempty"`
-	Environment     map[string]string `yaml:"environment" json:"environment,omitempty"`
-	Volumes         []string          `yaml:"volumes" json:"volumes,omitempty"`
-	Labels          map[string]string `yaml:"labels" json:"labels,omitempty"`
-	GenerateLabels  StringList        `yaml:"generate_labels" json:"generate_labels,omitempty"`
-	WorkingDir      string            `yaml:"working_dir" json:"working_dir,omitempty"`
-	BuildOnly       bool              `yaml:"build_only" json:"build_only,omitempty"`
-	Binds           Binds             `yaml:"binds" json:"binds,omitempty"`
-	RuntimeUser     string            `yaml:"runtime_user" json:"runtime_user,omitempty"`
-	Annotations     map[string]string `yaml:"annotations" json:"annotations,omitempty"`
-	OS              *string           `yaml:"os" json:"os,omitempty"`
-	Arch            *string           `yaml:"arch" json:"arch,omitempty"`
-	Bom             *Bom              `yaml:"bom" json:"bom,omitempty"`
-	WasLegacyImport bool              `yaml:"was_legacy_import" json:"was_legacy_import,omitempty"`
-	WasBom          bool              `yaml:"was_bom" json:"was_bom,omitempty"`
+	From            ImageSource        `yaml:"from" json:"from"`
+	Imports         Imports            `yaml:"imports" json:"imports,omitempty"`
+	LegacyImport    Imports            `yaml:"import" json:"import,omitempty"`
+	OverlayDirs     OverlayDirs        `yaml:"overlay_dirs" json:"overlay_dirs,omitempty"`
+	Run             StringList         `yaml:"run" json:"run,omitempty"`
+	Cmd             Command            `yaml:"cmd" json:"cmd,omitempty"`
+	Entrypoint      Command            `yaml:"entrypoint" json:"entrypoint,omitempty"`
+	FullCommand     Command            `yaml:"full_command" json:"full_command,omitempty"`
+	BuildEnvPt      []string           `yaml:"build_env_passthrough" json:"build_env_passthrough,omitempty"`
+	BuildEnv        map[string]string  `yaml:"build_env" json:"build_env,omitempty"`
+	Environment     map[string]string  `yaml:"environment" json:"environment,omitempty"`
+	Volumes         []string           `yaml:"volumes" json:"volumes,omitempty"`
+	Labels          map[string]string  `yaml:"labels" json:"labels,omitempty"`
+	GenerateLabels  StringList         `yaml:"generate_labels" json:"generate_labels,omitempty"`
+	WorkingDir      string             `yaml:"working_dir" json:"working_dir,omitempty"`
+	BuildOnly       bool               `yaml:"build_only" json:"build_only,omitempty"`
+	Binds           Binds              `yaml:"binds" json:"binds,omitempty"`
+	RuntimeUser     string             `yaml:"runtime_user" json:"runtime_user,omitempty"`
+	Annotations     map[string]string  `yaml:"annotations" json:"annotations,omitempty"`
+	OS              *string            `yaml:"os" json:"os,omitempty"`
+	Arch            *string            `yaml:"arch" json:"arch,omitempty"`
+	Bom             *Bom               `yaml:"bom" json:"bom,omitempty"`
+	Test            *ImageTest         `yaml:"test" json:"test,omitempty"`
+	Limits          *Limits            `yaml:"limits" json:"limits,omitempty"`
+	Timeout         string             `yaml:"timeout" json:"timeout,omitempty"`
+	Security        *Security          `yaml:"security" json:"security,omitempty"`
+	Filesystem      *FilesystemOptions `yaml:"filesystem" json:"filesystem,omitempty"`
+	Squash          bool               `yaml:"squash" json:"squash,omitempty"`
+	WasLegacyImport bool               `yaml:"was_legacy_import" json:"was_legacy_import,omitempty"`
+	WasBom          bool               `yaml:"was_bom" json:"was_bom,omitempty"`
 }
 
 func parseLayers(referenceDirectory string, lms yaml.MapSlice, requireHash bool) (map[string]Layer, error) {
@@ -331,6 +427,17 @@ func parseLayers(referenceDirectory string, lms yaml.MapSlice, requireHash bool)
 			if len(layer.From.Tag) == 0 {
 				return nil, errors.Errorf("%s: from tag cannot be empty for image type 'built'", name)
 			}
+		case GitLayer:
+			if !IsGitUrl(layer.From.Url) {
+				return nil, errors.Errorf("%s: from url must be a git+https://, git+ssh:// or git+file:// url for image type 'git'", name)
+			}
+			if requireHash && !IsGitCommit(layer.From.Ref) {
+				return nil, errors.Errorf("%s: from ref must be a commit for image type 'git'", name)
+			}
+		}
+
+		if layer.From.Type != GitLayer && (layer.From.Ref != "" || layer.From.Path != "" || layer.From.Submodules) {
+			return nil, errors.Errorf("%s: from ref, path and submodules are only supported for image type 'git'", name)
 		}
 
 		if layer.OS == nil {
@@ -345,6 +452,38 @@ func parseLayers(referenceDirectory string, lms yaml.MapSlice, requireHash bool)
 			layer.Arch = &arch
 		}
 
+		if layer.Test != nil {
+			if err := layer.Test.validate(); err != nil {
+				return nil, errors.Wrapf(err, "%s", name)
+			}
+
+			if layer.BuildOnly && layer.Test.Config != nil {
+				return nil, errors.Errorf("%s: build_only layers have no image config to test", name)
+			}
+		}
+
+		if layer.Limits != nil {
+			if _, err := layer.Limits.LXCConfig(); err != nil {
+				return nil, errors.Wrapf(err, "%s", name)
+			}
+		}
+
+		if _, err := layer.RunTimeout(); err != nil {
+			return nil, errors.Wrapf(err, "%s", name)
+		}
+
+		if layer.Security != nil {
+			if err := layer.Security.Validate(); err != nil {
+				return nil, errors.Wrapf(err, "%s", name)
+			}
+		}
+
+		if layer.Filesystem != nil {
+			if err := layer.Filesystem.validate(); err != nil {
+				return nil, errors.Wrapf(err, "%s", name)
+			}
+		}
+
 		if layer.Bom != nil {
 			layer.WasBom = true
 			layer.Bom = nil
@@ -387,6 +526,11 @@ func (l Layer) absolutify(referenceDirectory string) (Layer, error) {
 
 	ret := l
 
+	ignore, err := readStackerIgnore(referenceDirectory)
+	if err != nil {
+		return ret, err
+	}
+
 	ret.Imports = nil
 	for _, rawImport := range l.Imports {
 		absImportPath, err := getAbsPath(rawImport.Path)
@@ -396,7 +540,31 @@ func (l Layer) absolutify(referenceDirectory string) (Layer, error) {
 		if rawImport.Path[len(rawImport.Path)-1:] == "/" {
 			absImportPath += "/"
 		}
-		absImport := Import{Hash: rawImport.Hash, Path: absImportPath, Dest: rawImport.Dest, Mode: rawImport.Mode, Uid: rawImport.Uid, Gid: rawImport.Gid}
+		absImport := rawImport
+		absImport.Path = absImportPath
+
+		for _, verify := range []*string{&absImport.Checksums, &absImport.Signature} {
+			if *verify == "" {
+				continue
+			}
+			*verify, err = getAbsPath(*verify)
+			if err != nil {
+				return ret, err
+			}
+		}
+
+		url, err := NewDockerishUrl(absImportPath)
+		if err != nil {
+			return ret, err
+		}
+
+		if ignore != nil && url.Scheme == "" {
+			rel, err := filepath.Rel(referenceDirectory, absImportPath)
+			if err == nil && rel != ".." && !strings.HasPrefix(rel, "../") {
+				absImport.StackerIgnore = &StackerIgnore{Patterns: ignore, Dir: filepath.ToSlash(rel)}
+			}
+		}
+
 		ret.Imports = append(ret.Imports, absImport)
 	}
 
@@ -426,17 +594,39 @@ func (l Layer) absolutify(referenceDirectory string) (Layer, error) {
 		ret.Binds = append(ret.Binds, b)
 	}
 
+	if l.Security != nil && l.Security.Seccomp != "" {
+		security := *l.Security
+		absSeccomp, err := getAbsPath(security.Seccomp)
+		if err != nil {
+			return ret, err
+		}
+		security.Seccomp = absSeccomp
+		ret.Security = &security
+	}
+
 	return ret, nil
 }
 
+// isLocalPath is whether p is set, and is a path rather than a url.
+func isLocalPath(p string) bool {
+	url, err := NewDockerishUrl(p)
+	return p != "" && err == nil && url.Scheme == ""
+}
+
 func requireImportHash(imports Imports) error {
 	for _, imp := range imports {
 		url, err := NewDockerishUrl(imp.Path)
 		if err != nil {
 			return err
 		}
-		if (url.Scheme == "http" || url.Scheme == "https") && imp.Hash == "" {
-			return errors.Errorf("Remote import needs a hash in yaml for path: %s", imp.Path)
+		if (url.Scheme == "http" || url.Scheme == "https") && imp.Hash == "" && imp.Signature == "" && !isLocalPath(imp.Checksums) {
+			return errors.Errorf("Remote import needs a hash, a signature or a local checksum file in yaml for path: %s", imp.Path)
+		}
+		if IsGitUrl(imp.Path) && !IsGitCommit(imp.Ref) {
+			return errors.Errorf("Git import needs a commit as its ref in yaml for path: %s", imp.Path)
+		}
+		if IsImageUrl(imp.Path) && imp.Hash == "" && !strings.Contains(imp.Path, "@") {
+			return errors.Errorf("Image import needs a hash in yaml or a digest for path: %s", imp.Path)
 		}
 	}
 	return nil
@@ -472,7 +662,7 @@ func getImportFromInterface(v interface{}) (Import, error) {
 	}
 
 	// if present, these must have string values.
-	for name, dest := range map[string]*string{"hash": &ret.Hash, "path": &ret.Path, "dest": &ret.Dest} {
+	for name, dest := range map[string]*string{"hash": &ret.Hash, "path": &ret.Path, "dest": &ret.Dest, "ref": &ret.Ref, "checksums": &ret.Checksums, "signature": &ret.Signature} {
 		val, found := m[name]
 		if !found {
 			continue
@@ -497,10 +687,109 @@ func getImportFromInterface(v interface{}) (Import, error) {
 		*dest = i
 	}
 
+	// if present, these must have bool values
+	for name, dest := range map[string]*bool{"submodules": &ret.Submodules, "extract": &ret.Extract} {
+		val, found := m[name]
+		if !found {
+			continue
+		}
+		b, ok := val.(bool)
+		if !ok {
+			return Import{}, errors.Errorf("value for '%s' in import is not a boolean: %#v", name, v)
+		}
+		*dest = b
+	}
+
+	// if present, these must be lists of strings
+	for name, dest := range map[string]*[]string{"mirrors": &ret.Mirrors, "include": &ret.Include, "exclude": &ret.Exclude} {
+		val, found := m[name]
+		if !found {
+			continue
+		}
+		l, ok := val.([]interface{})
+		if !ok {
+			return Import{}, errors.Errorf("value for '%s' in import is not a list: %#v", name, v)
+		}
+		for _, entry := range l {
+			s, ok := entry.(string)
+			if !ok {
+				return Import{}, errors.Errorf("entry in '%s' in import is not a string: %#v", name, v)
+			}
+			*dest = append(*dest, s)
+		}
+	}
+
 	if ret.Path == "" {
 		return ret, errors.Errorf("No 'path' entry found in import: %#v", v)
 	}
 
+	if len(ret.Include) > 0 || len(ret.Exclude) > 0 {
+		url, err := NewDockerishUrl(ret.Path)
+		if err != nil {
+			return Import{}, err
+		}
+		if url.Scheme != "" && !IsGitUrl(ret.Path) {
+			return Import{}, errors.Errorf("'include' and 'exclude' are only supported for local and git imports: %#v", v)
+		}
+
+		for _, patterns := range [][]string{ret.Include, ret.Exclude} {
+			if _, err := lib.NewPathMatcher(patterns); err != nil {
+				return Import{}, err
+			}
+		}
+	}
+
+	if IsImageUrl(ret.Path) {
+		_, imagePath, found := strings.Cut(ret.Path, "#")
+		if found && (!filepath.IsAbs(imagePath) || filepath.Clean(imagePath) == "/") {
+			return Import{}, errors.Errorf("the path in the image must be absolute, and not /: %#v", v)
+		}
+	}
+
+	if IsGitUrl(ret.Path) {
+		if ret.Hash != "" {
+			return Import{}, errors.Errorf("'hash' isn't supported for git imports, pin a commit with 'ref' instead: %#v", v)
+		}
+	} else if ret.Ref != "" || ret.Submodules {
+		return Import{}, errors.Errorf("'ref' and 'submodules' are only supported for git imports: %#v", v)
+	}
+
+	if len(ret.Mirrors) > 0 {
+		for _, u := range append([]string{ret.Path}, ret.Mirrors...) {
+			url, err := NewDockerishUrl(u)
+			if err != nil {
+				return Import{}, err
+			}
+			if url.Scheme != "http" && url.Scheme != "https" {
+				return Import{}, errors.Errorf("'mirrors' are only supported for http(s) imports, found %s: %#v", u, v)
+			}
+		}
+	}
+
+	if ret.Checksums != "" || ret.Signature != "" {
+		for _, u := range []string{ret.Path, ret.Checksums, ret.Signature} {
+			url, err := NewDockerishUrl(u)
+			if err != nil {
+				return Import{}, err
+			}
+			if u == ret.Path && url.Scheme != "http" && url.Scheme != "https" {
+				return Import{}, errors.Errorf("'checksums' and 'signature' are only supported for http(s) imports: %#v", v)
+			}
+			if url.Scheme != "" && url.Scheme != "http" && url.Scheme != "https" {
+				return Import{}, errors.Errorf("'checksums' and 'signature' must be http(s) urls or paths, found %s: %#v", u, v)
+			}
+		}
+	}
+
+	if ret.Extract {
+		if ret.Dest == "" {
+			return Import{}, errors.Errorf("'extract' needs a 'dest' to extract to: %#v", v)
+		}
+		if IsGitUrl(ret.Path) || len(ret.Include) > 0 || len(ret.Exclude) > 0 {
+			return Import{}, errors.Errorf("'extract' is only supported for archives, without 'include' or 'exclude': %#v", v)
+		}
+	}
+
 	if ret.Dest != "" && !filepath.IsAbs(ret.Dest) {
 		return Import{}, errors.Errorf("'dest' path cannot be relative for: %#v", v)
 	}
@@ -78,6 +78,103 @@ func TestGetImportFromInterface(t *testing.T) {
 			},
 			errstr: "No 'path' entry found",
 		},
+		{desc: "mirrors",
+			val: map[interface{}]interface{}{
+				"path":    "https://example.com/foo.tar.gz",
+				"mirrors": []interface{}{"https://mirror.example.com/foo.tar.gz"},
+			},
+			expected: Import{Path: "https://example.com/foo.tar.gz", Uid: eUGid, Gid: eUGid, Mirrors: []string{"https://mirror.example.com/foo.tar.gz"}}},
+		{desc: "mirrors must be http",
+			val: map[interface{}]interface{}{
+				"path":    "https://example.com/foo.tar.gz",
+				"mirrors": []interface{}{"/path/to/foo.tar.gz"},
+			},
+			errstr: "only supported for http(s) imports",
+		},
+		{desc: "mirrors of a local import",
+			val: map[interface{}]interface{}{
+				"path":    "/path/to/foo.tar.gz",
+				"mirrors": []interface{}{"https://mirror.example.com/foo.tar.gz"},
+			},
+			errstr: "only supported for http(s) imports",
+		},
+		{desc: "git",
+			val: map[interface{}]interface{}{
+				"path":       "git+https://example.com/foo.git",
+				"ref":        "v1.0",
+				"submodules": true,
+				"exclude":    []interface{}{"docs/"},
+			},
+			expected: Import{Path: "git+https://example.com/foo.git", Uid: eUGid, Gid: eUGid, Ref: "v1.0", Submodules: true, Exclude: []string{"docs/"}}},
+		{desc: "git imports have no hash",
+			val: map[interface{}]interface{}{
+				"path": "git+https://example.com/foo.git",
+				"hash": "bad",
+			},
+			errstr: "'hash' isn't supported for git imports",
+		},
+		{desc: "ref of a local import",
+			val: map[interface{}]interface{}{
+				"path": "/path/to/foo",
+				"ref":  "main",
+			},
+			errstr: "only supported for git imports",
+		},
+		{desc: "submodules must be a boolean",
+			val: map[interface{}]interface{}{
+				"path":       "git+https://example.com/foo.git",
+				"submodules": "yes",
+			},
+			errstr: "not a boolean",
+		},
+		{desc: "extract",
+			val: map[interface{}]interface{}{
+				"path":    "https://example.com/foo.tar.gz",
+				"dest":    "/opt/foo",
+				"extract": true,
+				"uid":     1000,
+			},
+			expected: Import{Path: "https://example.com/foo.tar.gz", Dest: "/opt/foo", Uid: 1000, Gid: eUGid, Extract: true}},
+		{desc: "extract needs a dest",
+			val: map[interface{}]interface{}{
+				"path":    "foo.zip",
+				"extract": true,
+			},
+			errstr: "'extract' needs a 'dest'",
+		},
+		{desc: "checksums and signature",
+			val: map[interface{}]interface{}{
+				"path":      "https://example.com/foo-1.0.tar.gz",
+				"checksums": "https://example.com/SHA256SUMS",
+				"signature": "https://example.com/SHA256SUMS.asc",
+			},
+			expected: Import{Path: "https://example.com/foo-1.0.tar.gz", Uid: eUGid, Gid: eUGid, Checksums: "https://example.com/SHA256SUMS", Signature: "https://example.com/SHA256SUMS.asc"}},
+		{desc: "checksums of a local import",
+			val: map[interface{}]interface{}{
+				"path":      "foo-1.0.tar.gz",
+				"checksums": "SHA256SUMS",
+			},
+			errstr: "only supported for http(s) imports",
+		},
+		{desc: "signature must be http or a path",
+			val: map[interface{}]interface{}{
+				"path":      "https://example.com/foo-1.0.tar.gz",
+				"signature": "stacker://foo/foo.sig",
+			},
+			errstr: "must be http(s) urls or paths",
+		},
+		{desc: "image import",
+			val: map[interface{}]interface{}{
+				"path": "docker://example.com/tools:1.0#/usr/bin/tool",
+				"dest": "/usr/bin/",
+			},
+			expected: Import{Path: "docker://example.com/tools:1.0#/usr/bin/tool", Dest: "/usr/bin/", Uid: eUGid, Gid: eUGid}},
+		{desc: "path in image must be absolute",
+			val: map[interface{}]interface{}{
+				"path": "oci:///path/to/layout:tag#usr/bin/tool",
+			},
+			errstr: "must be absolute",
+		},
 		{desc: "bad type - list",
 			val:    []interface{}{"foo", "bar"},
 			errstr: "could not read imports entry",
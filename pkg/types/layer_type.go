@@ -14,52 +14,273 @@ import (
 
 var ErrEmptyLayers = errors.New("empty layers")
 
+// The annotations zstd:chunked and estargz layers are identified by; both
+// are otherwise plain zstd and gzip tar layers.
+const (
+	ZstdChunkedManifestChecksumAnnotation = "io.github.containers.zstd-chunked.manifest-checksum"
+	EstargzTOCDigestAnnotation            = "containerd.io/snapshot/stargz/toc.digest"
+)
+
+// the compressions each layer type supports, and the range of compression
+// levels they accept. A zero range means the compression has no levels, and a
+// level of 0 always means the compressor's default.
+var compressionLevels = map[string]map[string][2]int{
+	"tar": {
+		"":             {1, 9},
+		"zstd":         {1, 22},
+		"zstd:chunked": {1, 22},
+		"estargz":      {1, 9},
+	},
+	"squashfs": {
+		"":      {},
+		"gzip":  {1, 9},
+		"zstd":  {1, 22},
+		"xz":    {},
+		"lz4":   {},
+		"lz4hc": {},
+	},
+	"erofs": {
+		"":      {},
+		"gzip":  {1, 9},
+		"zstd":  {1, 22},
+		"xz":    {1, 9},
+		"lz4":   {},
+		"lz4hc": {1, 12},
+	},
+}
+
 type LayerType struct {
-	Type   string
-	Verity verity.VerityMetadata
+	Type string
+	// Compression is the compression of the layer. For tar layers, it is
+	// "" for gzip, or one of "zstd", "zstd:chunked" and "estargz". For
+	// squashfs and erofs it is one of "gzip", "zstd", "xz", "lz4" and
+	// "lz4hc", or "" to let atomfs pick.
+	Compression string
+	// Level is the compression level, or 0 for the default.
+	Level int
+	// BlockSize is the squashfs block size or the maximum erofs physical
+	// cluster size, or 0 for the default.
+	BlockSize int
+	// Dedupe and Fragments enable the erofs features of the same name.
+	Dedupe    bool
+	Fragments bool
+	Verity    verity.VerityMetadata
+}
+
+// name is the layer type as accepted by NewLayerType, e.g. tar+zstd@19 or
+// erofs+lz4hc@12,dedupe
+func (lt LayerType) name() string {
+	name := lt.Type
+	if lt.Compression != "" {
+		name = fmt.Sprintf("%s+%s", name, lt.Compression)
+	}
+	if lt.Level != 0 {
+		name = fmt.Sprintf("%s@%d", name, lt.Level)
+	}
+	if lt.BlockSize != 0 {
+		name = fmt.Sprintf("%s,block-size=%d", name, lt.BlockSize)
+	}
+	if lt.Dedupe {
+		name += ",dedupe"
+	}
+	if lt.Fragments {
+		name += ",fragments"
+	}
+	return name
 }
 
 func (lt LayerType) String() string {
 	if lt.Verity {
-		return fmt.Sprintf("%s+verity", lt.Type)
+		return fmt.Sprintf("%s+verity", lt.name())
 	}
-	return lt.Type
+	return lt.name()
 }
 
 func (lt LayerType) MarshalText() ([]byte, error) {
-	return []byte(fmt.Sprintf("%s+%v", lt.Type, lt.Verity)), nil
+	return []byte(fmt.Sprintf("%s+%v", lt.name(), lt.Verity)), nil
 }
 
 func (lt *LayerType) UnmarshalText(text []byte) error {
-	fields := strings.Split(string(text), "+")
-	if len(fields) > 2 {
-		return errors.Errorf("invalid layer type %s", string(text))
-	}
+	name := string(text)
+	verityMetadata := verity.VerityMetadataMissing
 
-	lt.Type = fields[0]
-	if len(fields) == 1 {
-		return nil
+	// the verity bool is always last, but older stackers didn't write it
+	if i := strings.LastIndex(name, "+"); i >= 0 {
+		result, err := strconv.ParseBool(name[i+1:])
+		if err == nil {
+			name = name[:i]
+			verityMetadata = verity.VerityMetadata(result)
+		}
 	}
 
-	result, err := strconv.ParseBool(fields[1])
+	parsed, err := parseLayerType(name)
 	if err != nil {
-		return errors.Wrapf(err, "bad verity bool: %s", fields[1])
+		return err
 	}
 
-	lt.Verity = verity.VerityMetadata(result)
+	*lt = parsed
+	if lt.Type != "tar" {
+		lt.Verity = verityMetadata
+	}
 
 	return nil
 }
 
-func NewLayerType(lt string, verity verity.VerityMetadata) (LayerType, error) {
-	switch lt {
-	case "squashfs", "erofs":
-		return LayerType{Type: lt, Verity: verity}, nil
-	case "tar":
-		return LayerType{Type: lt}, nil
-	default:
+func parseLayerType(lt string) (LayerType, error) {
+	ret := LayerType{}
+
+	fields := strings.Split(lt, ",")
+	name, level, hasLevel := strings.Cut(fields[0], "@")
+	ret.Type, ret.Compression, _ = strings.Cut(name, "+")
+
+	if _, ok := compressionLevels[ret.Type]; !ok {
 		return LayerType{}, errors.Errorf("invalid layer type: %s", lt)
 	}
+
+	if hasLevel {
+		var err error
+		ret.Level, err = strconv.Atoi(level)
+		if err != nil {
+			return LayerType{}, errors.Wrapf(err, "invalid compression level in layer type %s", lt)
+		}
+	}
+
+	for _, option := range fields[1:] {
+		key, value, _ := strings.Cut(option, "=")
+		switch key {
+		case "block-size":
+			var err error
+			ret.BlockSize, err = strconv.Atoi(value)
+			if err != nil {
+				return LayerType{}, errors.Wrapf(err, "invalid block size in layer type %s", lt)
+			}
+		case "dedupe":
+			ret.Dedupe = true
+		case "fragments":
+			ret.Fragments = true
+		default:
+			return LayerType{}, errors.Errorf("invalid option %s in layer type %s", option, lt)
+		}
+	}
+
+	if err := ret.validate(); err != nil {
+		return LayerType{}, errors.Wrapf(err, "invalid layer type %s", lt)
+	}
+
+	return ret, nil
+}
+
+func (lt LayerType) validate() error {
+	levels, ok := compressionLevels[lt.Type][lt.Compression]
+	if !ok {
+		return errors.Errorf("invalid %s compression %s", lt.Type, lt.Compression)
+	}
+
+	if lt.Level != 0 {
+		if lt.Type != "tar" && lt.Compression == "" {
+			return errors.Errorf("a compression level needs a %s compression", lt.Type)
+		}
+
+		if levels == [2]int{} {
+			return errors.Errorf("%s %s compression has no compression levels", lt.Type, lt.Compression)
+		}
+
+		if lt.Level < levels[0] || lt.Level > levels[1] {
+			return errors.Errorf("compression level must be between %d and %d", levels[0], levels[1])
+		}
+	}
+
+	if lt.BlockSize != 0 {
+		if lt.Type == "tar" {
+			return errors.Errorf("tar layers have no block size")
+		}
+
+		if lt.BlockSize < 4096 || lt.BlockSize > 1048576 || lt.BlockSize&(lt.BlockSize-1) != 0 {
+			return errors.Errorf("block size must be a power of two between 4096 and 1048576")
+		}
+	}
+
+	if (lt.Dedupe || lt.Fragments) && lt.Type != "erofs" {
+		return errors.Errorf("dedupe and fragments are erofs options")
+	}
+
+	return nil
+}
+
+// HasFilesystemOptions reports whether lt is a squashfs or erofs layer type
+// with settings other than atomfs's defaults.
+func (lt LayerType) HasFilesystemOptions() bool {
+	if lt.Type == "tar" {
+		return false
+	}
+
+	return lt.Compression != "" || lt.Level != 0 || lt.BlockSize != 0 || lt.Dedupe || lt.Fragments
+}
+
+// WithFilesystemOptions returns lt with a layer's filesystem options applied
+// on top. tar layer types are returned as is, and the erofs options are
+// ignored for squashfs.
+func (lt LayerType) WithFilesystemOptions(opts *FilesystemOptions) (LayerType, error) {
+	if opts == nil || lt.Type == "tar" {
+		return lt, nil
+	}
+
+	if opts.Compression != "" {
+		// the level of another compression probably doesn't make sense
+		lt.Compression = opts.Compression
+		lt.Level = 0
+	}
+	if opts.Level != 0 {
+		lt.Level = opts.Level
+	}
+	if opts.BlockSize != 0 {
+		lt.BlockSize = opts.BlockSize
+	}
+	if lt.Type == "erofs" {
+		lt.Dedupe = lt.Dedupe || opts.Dedupe
+		lt.Fragments = lt.Fragments || opts.Fragments
+	}
+
+	if err := lt.validate(); err != nil {
+		return LayerType{}, errors.Wrapf(err, "invalid filesystem options for %s", lt.Type)
+	}
+
+	return lt, nil
+}
+
+// NewLayerType parses a layer type, e.g. "squashfs" or "tar+zstd@19". tar
+// layers are gzip compressed unless the compression is one of zstd,
+// zstd:chunked or estargz, and the compression level can be set with @.
+// squashfs and erofs layer types can also have comma separated options:
+// block-size=<bytes>, and dedupe and fragments for erofs.
+func NewLayerType(lt string, verity verity.VerityMetadata) (LayerType, error) {
+	ret, err := parseLayerType(lt)
+	if err != nil {
+		return LayerType{}, err
+	}
+
+	if ret.Type != "tar" {
+		ret.Verity = verity
+	}
+
+	return ret, nil
+}
+
+// FilesystemMediaType returns the filesystem type of squashfs and erofs layer
+// media types, and "" for anything else. Older stackers generated media types
+// without compression information, and newer ones can use any compression the
+// filesystem supports.
+func FilesystemMediaType(mediaType string) string {
+	for fsType, base := range map[string]string{
+		"squashfs": squashfs.BaseMediaTypeLayerSquashfs,
+		"erofs":    erofs.BaseMediaTypeLayerErofs,
+	} {
+		if mediaType == base || strings.HasPrefix(mediaType, base+"+") {
+			return fsType
+		}
+	}
+
+	return ""
 }
 
 func NewLayerTypeManifest(manifest ispec.Manifest) (LayerType, error) {
@@ -69,24 +290,21 @@ func NewLayerTypeManifest(manifest ispec.Manifest) (LayerType, error) {
 
 	_, verityMetadataPresent := manifest.Layers[0].Annotations[verity.VerityRootHashAnnotation]
 
-	switch manifest.Layers[0].MediaType {
-	case squashfs.BaseMediaTypeLayerSquashfs:
-		// older stackers generated media types without compression information
-		fallthrough
-	case squashfs.GenerateSquashfsMediaType(squashfs.GzipCompression):
-		fallthrough
-	case squashfs.GenerateSquashfsMediaType(squashfs.ZstdCompression):
-		return NewLayerType("squashfs", verity.VerityMetadata(verityMetadataPresent))
-	case erofs.BaseMediaTypeLayerErofs:
-		// older stackers generated media types without compression information
-		fallthrough
-	case erofs.GenerateErofsMediaType(erofs.LZ4HCCompression):
-		fallthrough
-	case erofs.GenerateErofsMediaType(erofs.LZ4Compression):
-		fallthrough
-	case erofs.GenerateErofsMediaType(erofs.ZstdCompression):
-		return NewLayerType("erofs", verity.VerityMetadata(verityMetadataPresent))
+	mediaType := manifest.Layers[0].MediaType
+	if fsType := FilesystemMediaType(mediaType); fsType != "" {
+		return NewLayerType(fsType, verity.VerityMetadata(verityMetadataPresent))
+	}
+
+	switch mediaType {
+	case ispec.MediaTypeImageLayerZstd:
+		if _, ok := manifest.Layers[0].Annotations[ZstdChunkedManifestChecksumAnnotation]; ok {
+			return NewLayerType("tar+zstd:chunked", verity.VerityMetadataMissing)
+		}
+		return NewLayerType("tar+zstd", verity.VerityMetadataMissing)
 	case ispec.MediaTypeImageLayerGzip:
+		if _, ok := manifest.Layers[0].Annotations[EstargzTOCDigestAnnotation]; ok {
+			return NewLayerType("tar+estargz", verity.VerityMetadataMissing)
+		}
 		fallthrough
 	case ispec.MediaTypeImageLayer:
 		return NewLayerType("tar", verity.VerityMetadataMissing)
@@ -109,9 +327,28 @@ func NewLayerTypes(lts []string, verity verity.VerityMetadata) ([]LayerType, err
 	return ret, nil
 }
 
+// SameFormat reports whether layers of type lt and other are interchangeable,
+// i.e. whether they only differ in how they're compressed.
+func (lt LayerType) SameFormat(other LayerType) bool {
+	if lt.Type != other.Type || lt.Verity != other.Verity {
+		return false
+	}
+
+	// squashfs and erofs are mounted the same way whatever their
+	// compression is, but tar layers can only be lazily pulled etc. if
+	// they're the right kind.
+	return lt.Type != "tar" || lt.Compression == other.Compression
+}
+
+// LayerName is the tag the layer type's output of tag is stored under. gzip
+// tar layers are stored under tag itself, and everything else gets a suffix
+// so that the outputs can coexist, e.g. tag-squashfs or tag-zstd-chunked.
 func (lt LayerType) LayerName(tag string) string {
 	if lt.Type == "tar" {
-		return tag
+		if lt.Compression == "" {
+			return tag
+		}
+		return fmt.Sprintf("%s-%s", tag, strings.ReplaceAll(lt.Compression, ":", "-"))
 	}
 
 	return fmt.Sprintf("%s-%s", tag, lt.Type)
@@ -0,0 +1,159 @@
+package types
+
+import (
+	"testing"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"machinerun.io/atomfs/pkg/verity"
+)
+
+func TestNewLayerType(t *testing.T) {
+	assert := assert.New(t)
+	tables := []struct {
+		layerType string
+		expected  LayerType
+		name      string
+		errstr    string
+	}{
+		{layerType: "tar",
+			expected: LayerType{Type: "tar"},
+			name:     "foo"},
+		{layerType: "tar@6",
+			expected: LayerType{Type: "tar", Level: 6},
+			name:     "foo"},
+		{layerType: "tar+zstd",
+			expected: LayerType{Type: "tar", Compression: "zstd"},
+			name:     "foo-zstd"},
+		{layerType: "tar+zstd:chunked@19",
+			expected: LayerType{Type: "tar", Compression: "zstd:chunked", Level: 19},
+			name:     "foo-zstd-chunked"},
+		{layerType: "tar+estargz",
+			expected: LayerType{Type: "tar", Compression: "estargz"},
+			name:     "foo-estargz"},
+		{layerType: "squashfs",
+			expected: LayerType{Type: "squashfs", Verity: verity.VerityMetadataPresent},
+			name:     "foo-squashfs"},
+		{layerType: "squashfs+xz,block-size=262144",
+			expected: LayerType{Type: "squashfs", Compression: "xz", BlockSize: 262144, Verity: verity.VerityMetadataPresent},
+			name:     "foo-squashfs"},
+		{layerType: "erofs+lz4hc@12,dedupe,fragments",
+			expected: LayerType{Type: "erofs", Compression: "lz4hc", Level: 12, Dedupe: true, Fragments: true, Verity: verity.VerityMetadataPresent},
+			name:     "foo-erofs"},
+		{layerType: "squashfs+xz@9",
+			errstr: "has no compression levels"},
+		{layerType: "squashfs@9",
+			errstr: "a compression level needs a squashfs compression"},
+		{layerType: "squashfs,block-size=5000",
+			errstr: "power of two"},
+		{layerType: "squashfs,dedupe",
+			errstr: "erofs options"},
+		{layerType: "erofs,shiny",
+			errstr: "invalid option shiny"},
+		{layerType: "tar,block-size=4096",
+			errstr: "no block size"},
+		{layerType: "tar+lzma",
+			errstr: "invalid tar compression lzma"},
+		{layerType: "tar+zstd@23",
+			errstr: "between 1 and 22"},
+		{layerType: "tar@fast",
+			errstr: "invalid compression level"},
+		{layerType: "zip",
+			errstr: "invalid layer type"},
+	}
+
+	for _, tt := range tables {
+		lt, err := NewLayerType(tt.layerType, verity.VerityMetadataPresent)
+		if tt.errstr != "" {
+			assert.ErrorContains(err, tt.errstr, tt.layerType)
+			continue
+		}
+
+		if !assert.NoError(err, tt.layerType) {
+			continue
+		}
+		assert.Equal(tt.expected, lt, tt.layerType)
+		assert.Equal(tt.name, lt.LayerName("foo"), tt.layerType)
+
+		// layer types are used as map keys in json, so they have to
+		// round trip
+		text, err := lt.MarshalText()
+		assert.NoError(err)
+		unmarshalled := LayerType{}
+		assert.NoError(unmarshalled.UnmarshalText(text))
+		assert.Equal(lt, unmarshalled, tt.layerType)
+	}
+}
+
+func TestUnmarshalOldLayerTypes(t *testing.T) {
+	assert := assert.New(t)
+
+	lt := LayerType{}
+	assert.NoError(lt.UnmarshalText([]byte("squashfs+true")))
+	assert.Equal(LayerType{Type: "squashfs", Verity: verity.VerityMetadataPresent}, lt)
+
+	lt = LayerType{}
+	assert.NoError(lt.UnmarshalText([]byte("tar")))
+	assert.Equal(LayerType{Type: "tar"}, lt)
+}
+
+func TestNewLayerTypeManifest(t *testing.T) {
+	assert := assert.New(t)
+	tables := []struct {
+		layer    ispec.Descriptor
+		expected string
+	}{
+		{layer: ispec.Descriptor{MediaType: ispec.MediaTypeImageLayerGzip},
+			expected: "tar"},
+		{layer: ispec.Descriptor{MediaType: ispec.MediaTypeImageLayer},
+			expected: "tar"},
+		{layer: ispec.Descriptor{MediaType: ispec.MediaTypeImageLayerZstd},
+			expected: "tar+zstd"},
+		{layer: ispec.Descriptor{
+			MediaType:   ispec.MediaTypeImageLayerZstd,
+			Annotations: map[string]string{ZstdChunkedManifestChecksumAnnotation: "sha256:1234"}},
+			expected: "tar+zstd:chunked"},
+		{layer: ispec.Descriptor{
+			MediaType:   ispec.MediaTypeImageLayerGzip,
+			Annotations: map[string]string{EstargzTOCDigestAnnotation: "sha256:1234"}},
+			expected: "tar+estargz"},
+	}
+
+	for _, tt := range tables {
+		lt, err := NewLayerTypeManifest(ispec.Manifest{Layers: []ispec.Descriptor{tt.layer}})
+		assert.NoError(err)
+		assert.Equal(tt.expected, lt.String())
+	}
+}
+
+func TestWithFilesystemOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	squashfs := LayerType{Type: "squashfs", Compression: "gzip", Level: 9, Verity: verity.VerityMetadataPresent}
+	erofs := LayerType{Type: "erofs", Dedupe: true}
+	tar := LayerType{Type: "tar", Compression: "zstd"}
+
+	lt, err := squashfs.WithFilesystemOptions(nil)
+	assert.NoError(err)
+	assert.Equal(squashfs, lt)
+
+	// a new compression doesn't inherit the old one's level
+	lt, err = squashfs.WithFilesystemOptions(&FilesystemOptions{Compression: "xz", Fragments: true})
+	assert.NoError(err)
+	assert.Equal(LayerType{Type: "squashfs", Compression: "xz", Verity: verity.VerityMetadataPresent}, lt)
+
+	lt, err = erofs.WithFilesystemOptions(&FilesystemOptions{Compression: "lz4hc", Level: 12, Fragments: true})
+	assert.NoError(err)
+	assert.Equal(LayerType{Type: "erofs", Compression: "lz4hc", Level: 12, Dedupe: true, Fragments: true}, lt)
+
+	lt, err = tar.WithFilesystemOptions(&FilesystemOptions{Compression: "xz"})
+	assert.NoError(err)
+	assert.Equal(tar, lt)
+
+	_, err = squashfs.WithFilesystemOptions(&FilesystemOptions{Compression: "lz4hc", Level: 12})
+	assert.ErrorContains(err, "no compression levels")
+
+	// only valid for erofs, but the layer may only be output as erofs
+	assert.NoError(FilesystemOptions{Compression: "lz4hc", Level: 12}.validate())
+	assert.Error(FilesystemOptions{Compression: "brotli"}.validate())
+}
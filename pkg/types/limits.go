@@ -0,0 +1,106 @@
+package types
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// cpuPeriod is the cgroup v2 cpu.max period, in microseconds, that cpu limits
+// are expressed against.
+const cpuPeriod = 100000
+
+// Limits are the resource limits applied to a layer's build container, via
+// the 'limits' directive.
+type Limits struct {
+	// Memory is the maximum amount of memory, in bytes or with a K, M, G
+	// or T suffix (powers of 1024).
+	Memory string `yaml:"memory" json:"memory,omitempty"`
+
+	// CPUs is the number of CPUs worth of time the container may use,
+	// e.g. 1.5.
+	CPUs float64 `yaml:"cpus" json:"cpus,omitempty"`
+
+	// Pids is the maximum number of processes in the container.
+	Pids int64 `yaml:"pids" json:"pids,omitempty"`
+}
+
+func parseMemory(mem string) (uint64, error) {
+	s := strings.TrimSpace(mem)
+	multiplier := uint64(1)
+	if len(s) > 0 {
+		switch strings.ToUpper(s[len(s)-1:]) {
+		case "K":
+			multiplier = 1 << 10
+		case "M":
+			multiplier = 1 << 20
+		case "G":
+			multiplier = 1 << 30
+		case "T":
+			multiplier = 1 << 40
+		}
+		if multiplier != 1 {
+			s = s[:len(s)-1]
+		}
+	}
+
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || n == 0 {
+		return 0, errors.Errorf("invalid memory limit %q", mem)
+	}
+
+	return n * multiplier, nil
+}
+
+// LXCConfig returns the cgroup v2 LXC config items that implement the limits.
+func (l Limits) LXCConfig() (map[string]string, error) {
+	config := map[string]string{}
+
+	if l.Memory != "" {
+		mem, err := parseMemory(l.Memory)
+		if err != nil {
+			return nil, err
+		}
+		config["lxc.cgroup2.memory.max"] = fmt.Sprintf("%d", mem)
+	}
+
+	if l.CPUs < 0 {
+		return nil, errors.Errorf("invalid cpus limit %v", l.CPUs)
+	} else if l.CPUs > 0 {
+		quota := int64(l.CPUs * cpuPeriod)
+		if quota < 1000 {
+			return nil, errors.Errorf("cpus limit %v is too small", l.CPUs)
+		}
+		config["lxc.cgroup2.cpu.max"] = fmt.Sprintf("%d %d", quota, cpuPeriod)
+	}
+
+	if l.Pids < 0 {
+		return nil, errors.Errorf("invalid pids limit %d", l.Pids)
+	} else if l.Pids > 0 {
+		config["lxc.cgroup2.pids.max"] = fmt.Sprintf("%d", l.Pids)
+	}
+
+	return config, nil
+}
+
+// RunTimeout returns the maximum duration of the layer's run step, or zero if
+// the layer has no timeout.
+func (l Layer) RunTimeout() (time.Duration, error) {
+	if l.Timeout == "" {
+		return 0, nil
+	}
+
+	timeout, err := time.ParseDuration(l.Timeout)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid timeout %q", l.Timeout)
+	}
+
+	if timeout <= 0 {
+		return 0, errors.Errorf("invalid timeout %q: must be positive", l.Timeout)
+	}
+
+	return timeout, nil
+}
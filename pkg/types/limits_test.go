@@ -0,0 +1,75 @@
+package types
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimitsLXCConfig(t *testing.T) {
+	assert := assert.New(t)
+	tables := []struct {
+		desc     string
+		limits   Limits
+		expected map[string]string
+		errstr   string
+	}{
+		{desc: "empty",
+			limits:   Limits{},
+			expected: map[string]string{}},
+		{desc: "all limits",
+			limits: Limits{Memory: "2G", CPUs: 1.5, Pids: 512},
+			expected: map[string]string{
+				"lxc.cgroup2.memory.max": "2147483648",
+				"lxc.cgroup2.cpu.max":    "150000 100000",
+				"lxc.cgroup2.pids.max":   "512",
+			}},
+		{desc: "memory in bytes",
+			limits:   Limits{Memory: "1048576"},
+			expected: map[string]string{"lxc.cgroup2.memory.max": "1048576"}},
+		{desc: "bad memory",
+			limits: Limits{Memory: "2GB"},
+			errstr: "invalid memory limit"},
+		{desc: "negative cpus",
+			limits: Limits{CPUs: -1},
+			errstr: "invalid cpus limit"},
+		{desc: "tiny cpus",
+			limits: Limits{CPUs: 0.001},
+			errstr: "too small"},
+		{desc: "negative pids",
+			limits: Limits{Pids: -1},
+			errstr: "invalid pids limit"},
+	}
+
+	for _, tt := range tables {
+		config, err := tt.limits.LXCConfig()
+		if tt.errstr != "" {
+			if assert.Error(err, tt.desc) {
+				assert.Contains(err.Error(), tt.errstr, tt.desc)
+			}
+			continue
+		}
+
+		assert.NoError(err, tt.desc)
+		assert.Equal(tt.expected, config, tt.desc)
+	}
+}
+
+func TestLayerRunTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	timeout, err := Layer{}.RunTimeout()
+	assert.NoError(err)
+	assert.Equal(time.Duration(0), timeout)
+
+	timeout, err = Layer{Timeout: "1h30m"}.RunTimeout()
+	assert.NoError(err)
+	assert.Equal(90*time.Minute, timeout)
+
+	_, err = Layer{Timeout: "soon"}.RunTimeout()
+	assert.Error(err)
+
+	_, err = Layer{Timeout: "-5s"}.RunTimeout()
+	assert.Error(err)
+}
@@ -0,0 +1,222 @@
+package types
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+	"stackerbuild.io/stacker/pkg/log"
+)
+
+const matrixDirective = "matrix"
+
+var matrixValueRegex = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// matrixAxis is one variable of a layer's matrix and the values it takes.
+type matrixAxis struct {
+	Name   string
+	Values []string
+}
+
+// matrixVariant is a single combination of matrix values.
+type matrixVariant struct {
+	Name          string
+	Substitutions []string
+}
+
+// matrixVariables returns the names of all variables used in 'matrix'
+// directives in the (unsubstituted) stackerfile content.
+func matrixVariables(raw string) (map[string]bool, error) {
+	ms := yaml.MapSlice{}
+	if err := yaml.Unmarshal([]byte(raw), &ms); err != nil {
+		return nil, errors.Wrapf(err, "couldn't look for matrix variables before substitution")
+	}
+
+	vars := map[string]bool{}
+	for _, e := range ms {
+		def, ok := e.Value.(yaml.MapSlice)
+		if !ok {
+			continue
+		}
+
+		for _, directive := range def {
+			if directive.Key != matrixDirective {
+				continue
+			}
+
+			axes, ok := directive.Value.(yaml.MapSlice)
+			if !ok {
+				continue
+			}
+
+			for _, axis := range axes {
+				if name, ok := axis.Key.(string); ok {
+					vars[name] = true
+				}
+			}
+		}
+	}
+
+	return vars, nil
+}
+
+// parseMatrix reads the 'matrix' directive of a layer, if any.
+func parseMatrix(name string, def yaml.MapSlice) ([]matrixAxis, error) {
+	for _, directive := range def {
+		if directive.Key != matrixDirective {
+			continue
+		}
+
+		axes, ok := directive.Value.(yaml.MapSlice)
+		if !ok || len(axes) == 0 {
+			return nil, errors.Errorf("%s: 'matrix' must be a non-empty map of variables to lists of values", name)
+		}
+
+		ret := []matrixAxis{}
+		for _, a := range axes {
+			axisName, ok := a.Key.(string)
+			if !ok {
+				return nil, errors.Errorf("%s: matrix variable %v is not a string", name, a.Key)
+			}
+
+			rawValues, ok := a.Value.([]interface{})
+			if !ok || len(rawValues) == 0 {
+				return nil, errors.Errorf("%s: matrix variable %s must be a non-empty list", name, axisName)
+			}
+
+			axis := matrixAxis{Name: axisName}
+			for _, v := range rawValues {
+				value := fmt.Sprintf("%v", v)
+				if !matrixValueRegex.MatchString(value) {
+					return nil, errors.Errorf("%s: invalid value %q for matrix variable %s", name, value, axisName)
+				}
+				axis.Values = append(axis.Values, value)
+			}
+			ret = append(ret, axis)
+		}
+
+		return ret, nil
+	}
+
+	return nil, nil
+}
+
+// matrixVariants computes every combination of the matrix values. Variants
+// are named after the layer followed by their values, in the order the
+// variables were defined, e.g. 'app-jammy-min'.
+func matrixVariants(name string, axes []matrixAxis) []matrixVariant {
+	variants := []matrixVariant{{Name: name}}
+	for _, axis := range axes {
+		next := []matrixVariant{}
+		for _, v := range variants {
+			for _, value := range axis.Values {
+				next = append(next, matrixVariant{
+					Name:          fmt.Sprintf("%s-%s", v.Name, value),
+					Substitutions: append(append([]string{}, v.Substitutions...), fmt.Sprintf("%s=%s", axis.Name, value)),
+				})
+			}
+		}
+		variants = next
+	}
+	return variants
+}
+
+// expandMatrix replaces every layer with a 'matrix' directive by one layer per
+// combination of matrix values. Each variant is taken from the stackerfile
+// content substituted with its own matrix values, so the matrix variables can
+// be used anywhere in the layer definition.
+func expandMatrix(raw string, lms yaml.MapSlice, substitutions []string, skip map[string]bool) (yaml.MapSlice, error) {
+	ret := yaml.MapSlice{}
+	seen := map[string]bool{}
+	for _, e := range lms {
+		seen[e.Key.(string)] = true
+	}
+
+	for _, e := range lms {
+		name := e.Key.(string)
+		def, _ := e.Value.(yaml.MapSlice)
+
+		axes, err := parseMatrix(name, def)
+		if err != nil {
+			return nil, err
+		}
+
+		if axes == nil {
+			// placeholders for matrix variables were left alone in
+			// every layer; outside of a matrix they are just regular
+			// substitutions.
+			if len(skip) > 0 && def != nil {
+				e, err = substituteLayer(e, substitutions)
+				if err != nil {
+					return nil, err
+				}
+			}
+			ret = append(ret, e)
+			continue
+		}
+
+		for _, variant := range matrixVariants(name, axes) {
+			if seen[variant.Name] {
+				return nil, errors.Errorf("matrix variant %s of %s conflicts with another layer", variant.Name, name)
+			}
+			seen[variant.Name] = true
+
+			// matrix values take precedence over the user's substitutions
+			content, err := substituteExcept(raw, append(variant.Substitutions, substitutions...), skip)
+			if err != nil {
+				return nil, errors.Wrapf(err, "matrix variant %s", variant.Name)
+			}
+
+			ms := yaml.MapSlice{}
+			if err := yaml.Unmarshal([]byte(content), &ms); err != nil {
+				return nil, errors.Wrapf(err, "couldn't parse matrix variant %s", variant.Name)
+			}
+
+			var variantDef yaml.MapSlice
+			for _, vl := range ms {
+				if vl.Key == name {
+					variantDef, _ = vl.Value.(yaml.MapSlice)
+				}
+			}
+
+			expanded := yaml.MapSlice{}
+			for _, directive := range variantDef {
+				if directive.Key != matrixDirective {
+					expanded = append(expanded, directive)
+				}
+			}
+
+			log.Debugf("matrix: expanded %s into %s (%s)", name, variant.Name, strings.Join(variant.Substitutions, ", "))
+			ret = append(ret, yaml.MapItem{Key: variant.Name, Value: expanded})
+		}
+	}
+
+	return ret, nil
+}
+
+// substituteLayer resolves the placeholders still present in a layer
+// definition.
+func substituteLayer(e yaml.MapItem, substitutions []string) (yaml.MapItem, error) {
+	content, err := yaml.Marshal(yaml.MapSlice{e})
+	if err != nil {
+		return e, err
+	}
+
+	if !strings.Contains(string(content), "${{") {
+		return e, nil
+	}
+
+	substituted, err := substitute(string(content), substitutions)
+	if err != nil {
+		return e, errors.Wrapf(err, "layer %v", e.Key)
+	}
+
+	ms := yaml.MapSlice{}
+	if err := yaml.Unmarshal([]byte(substituted), &ms); err != nil {
+		return e, errors.Wrapf(err, "couldn't parse layer %v", e.Key)
+	}
+
+	return ms[0], nil
+}
@@ -0,0 +1,102 @@
+package types
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatrixExpansion(t *testing.T) {
+	assert := assert.New(t)
+	content := `base:
+    from:
+        type: docker
+        url: docker://ubuntu:${{DISTRO:noble}}
+app:
+    matrix:
+        DISTRO: [focal, jammy]
+        FLAVOR: [min, full]
+    from:
+        type: docker
+        url: docker://ubuntu:${{DISTRO}}
+    run: |
+        echo ${{FLAVOR}} > /flavor
+    labels:
+        version: ${{VERSION}}
+`
+	dir := writeStackerfiles(t, map[string]string{"stacker.yaml": content})
+
+	sf, err := NewStackerfile(filepath.Join(dir, "stacker.yaml"), false, []string{"VERSION=v1"})
+	if !assert.NoError(err) {
+		return
+	}
+
+	assert.Equal([]string{"base", "app-focal-min", "app-focal-full", "app-jammy-min", "app-jammy-full"}, sf.FileOrder)
+
+	// matrix variables outside of a matrix are regular substitutions
+	l, ok := sf.Get("base")
+	assert.True(ok)
+	assert.Equal("docker://ubuntu:noble", l.From.Url)
+
+	l, ok = sf.Get("app-jammy-full")
+	assert.True(ok)
+	assert.Equal("docker://ubuntu:jammy", l.From.Url)
+	assert.Equal(StringList{"echo full > /flavor\n"}, l.Run)
+	assert.Equal(map[string]string{"version": "v1"}, l.Labels)
+
+	_, ok = sf.Get("app")
+	assert.False(ok)
+
+	// the recorded contents have each variant, with its values
+	assert.NotContains(sf.AfterSubstitutions, "${{")
+	assert.NotContains(sf.AfterSubstitutions, "matrix")
+	assert.Contains(sf.AfterSubstitutions, "app-jammy-full:")
+	assert.Contains(sf.AfterSubstitutions, "url: docker://ubuntu:noble")
+	assert.Contains(sf.AfterSubstitutions, "url: docker://ubuntu:focal")
+}
+
+func TestMatrixErrors(t *testing.T) {
+	assert := assert.New(t)
+	tables := []struct {
+		desc    string
+		content string
+		errstr  string
+	}{
+		{desc: "not a list",
+			content: `app:
+    matrix:
+        DISTRO: focal
+`,
+			errstr: "must be a non-empty list"},
+		{desc: "unparseable",
+			content: `app:
+    matrix:
+        DISTRO: [focal
+`,
+			errstr: "couldn't look for matrix variables"},
+		{desc: "bad value",
+			content: `app:
+    matrix:
+        DISTRO: ["a:b"]
+`,
+			errstr: "invalid value"},
+		{desc: "name conflict",
+			content: `app-focal:
+    from:
+        type: scratch
+app:
+    matrix:
+        DISTRO: [focal]
+`,
+			errstr: "conflicts with another layer"},
+	}
+
+	for _, tt := range tables {
+		dir := writeStackerfiles(t, map[string]string{"stacker.yaml": tt.content})
+		_, err := NewStackerfile(filepath.Join(dir, "stacker.yaml"), false, nil)
+		if assert.Error(err, tt.desc) {
+			assert.Contains(err.Error(), tt.errstr, tt.desc)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package types
+
+import (
+	"bufio"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Security describes how a layer's build container is confined, via the
+// 'security' directive or the stacker config file.
+type Security struct {
+	// Capabilities to drop from the container's default set.
+	CapDrop []string `yaml:"cap_drop" json:"cap_drop,omitempty"`
+
+	// Capabilities to keep; all others are dropped.
+	CapKeep []string `yaml:"cap_keep" json:"cap_keep,omitempty"`
+
+	// Path to an LXC seccomp policy file.
+	Seccomp string `yaml:"seccomp" json:"seccomp,omitempty"`
+
+	// Name of the AppArmor profile to run the container under.
+	AppArmor string `yaml:"apparmor" json:"apparmor,omitempty"`
+
+	// NoNewPrivs prevents processes from gaining privileges, e.g. via
+	// setuid binaries.
+	NoNewPrivs bool `yaml:"no_new_privs" json:"no_new_privs,omitempty"`
+}
+
+var capabilities = map[string]bool{
+	"chown": true, "dac_override": true, "dac_read_search": true,
+	"fowner": true, "fsetid": true, "kill": true, "setgid": true,
+	"setuid": true, "setpcap": true, "linux_immutable": true,
+	"net_bind_service": true, "net_broadcast": true, "net_admin": true,
+	"net_raw": true, "ipc_lock": true, "ipc_owner": true,
+	"sys_module": true, "sys_rawio": true, "sys_chroot": true,
+	"sys_ptrace": true, "sys_pacct": true, "sys_admin": true,
+	"sys_boot": true, "sys_nice": true, "sys_resource": true,
+	"sys_time": true, "sys_tty_config": true, "mknod": true,
+	"lease": true, "audit_write": true, "audit_control": true,
+	"setfcap": true, "mac_override": true, "mac_admin": true,
+	"syslog": true, "wake_alarm": true, "block_suspend": true,
+	"audit_read": true, "perfmon": true, "bpf": true,
+	"checkpoint_restore": true,
+}
+
+// normalizeCap turns e.g. CAP_SYS_ADMIN into sys_admin, the form LXC
+// expects.
+func normalizeCap(c string) (string, error) {
+	name := strings.TrimPrefix(strings.ToLower(strings.TrimSpace(c)), "cap_")
+	if !capabilities[name] {
+		return "", errors.Errorf("unknown capability %q", c)
+	}
+	return name, nil
+}
+
+func normalizeCaps(caps []string) ([]string, error) {
+	ret := []string{}
+	for _, c := range caps {
+		name, err := normalizeCap(c)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, name)
+	}
+	return ret, nil
+}
+
+// Merge returns the security settings with those in override taking
+// precedence. Capability lists replace each other as a whole, since
+// cap_drop and cap_keep can't be combined.
+func (s *Security) Merge(override *Security) *Security {
+	if s == nil {
+		return override
+	}
+	if override == nil {
+		return s
+	}
+
+	ret := *s
+	if len(override.CapDrop) > 0 || len(override.CapKeep) > 0 {
+		ret.CapDrop = override.CapDrop
+		ret.CapKeep = override.CapKeep
+	}
+	if override.Seccomp != "" {
+		ret.Seccomp = override.Seccomp
+	}
+	if override.AppArmor != "" {
+		ret.AppArmor = override.AppArmor
+	}
+	ret.NoNewPrivs = ret.NoNewPrivs || override.NoNewPrivs
+	return &ret
+}
+
+// Validate checks the settings that don't depend on the host.
+func (s Security) Validate() error {
+	if len(s.CapDrop) > 0 && len(s.CapKeep) > 0 {
+		return errors.Errorf("security: cap_drop and cap_keep can't be used together")
+	}
+
+	if _, err := normalizeCaps(s.CapDrop); err != nil {
+		return errors.Wrapf(err, "security: cap_drop")
+	}
+
+	// lxc allows "none" to drop every capability
+	if !(len(s.CapKeep) == 1 && s.CapKeep[0] == "none") {
+		if _, err := normalizeCaps(s.CapKeep); err != nil {
+			return errors.Wrapf(err, "security: cap_keep")
+		}
+	}
+
+	return nil
+}
+
+// CheckSeccompProfile verifies that the seccomp profile exists and looks like
+// an LXC seccomp policy.
+func (s Security) CheckSeccompProfile() error {
+	if s.Seccomp == "" {
+		return nil
+	}
+
+	f, err := os.Open(s.Seccomp)
+	if err != nil {
+		return errors.Wrapf(err, "security: couldn't open seccomp profile")
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	lines := []string{}
+	for len(lines) < 2 && scanner.Scan() {
+		lines = append(lines, strings.TrimSpace(scanner.Text()))
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.Wrapf(err, "security: couldn't read seccomp profile %s", s.Seccomp)
+	}
+
+	if len(lines) == 0 {
+		return errors.Errorf("security: seccomp profile %s is empty", s.Seccomp)
+	}
+
+	switch lines[0] {
+	case "1":
+		return nil
+	case "2":
+		if len(lines) > 1 && len(strings.Fields(lines[1])) > 0 {
+			switch strings.Fields(lines[1])[0] {
+			case "allowlist", "denylist", "whitelist", "blacklist":
+				return nil
+			}
+		}
+		return errors.Errorf("security: seccomp profile %s: version 2 policies must start with allowlist or denylist", s.Seccomp)
+	default:
+		return errors.Errorf("security: seccomp profile %s: unsupported policy version %q", s.Seccomp, lines[0])
+	}
+}
+
+// LXCConfig returns the LXC config items that implement the settings. The
+// AppArmor profile is not included, since whether it is available depends on
+// the host.
+func (s Security) LXCConfig() (map[string]string, error) {
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+
+	config := map[string]string{}
+	if len(s.CapDrop) > 0 {
+		caps, _ := normalizeCaps(s.CapDrop)
+		config["lxc.cap.drop"] = strings.Join(caps, " ")
+	}
+
+	if len(s.CapKeep) > 0 {
+		caps := s.CapKeep
+		if !(len(caps) == 1 && caps[0] == "none") {
+			caps, _ = normalizeCaps(caps)
+		}
+		config["lxc.cap.keep"] = strings.Join(caps, " ")
+	}
+
+	if s.Seccomp != "" {
+		config["lxc.seccomp.profile"] = s.Seccomp
+	}
+
+	if s.NoNewPrivs {
+		config["lxc.no_new_privs"] = "1"
+	}
+
+	return config, nil
+}
@@ -0,0 +1,101 @@
+package types
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecurityLXCConfig(t *testing.T) {
+	assert := assert.New(t)
+	tables := []struct {
+		desc     string
+		security Security
+		expected map[string]string
+		errstr   string
+	}{
+		{desc: "drop caps",
+			security: Security{CapDrop: []string{"CAP_SYS_ADMIN", "net_raw"}, NoNewPrivs: true},
+			expected: map[string]string{
+				"lxc.cap.drop":     "sys_admin net_raw",
+				"lxc.no_new_privs": "1",
+			}},
+		{desc: "keep no caps",
+			security: Security{CapKeep: []string{"none"}, Seccomp: "/etc/stacker/seccomp"},
+			expected: map[string]string{
+				"lxc.cap.keep":        "none",
+				"lxc.seccomp.profile": "/etc/stacker/seccomp",
+			}},
+		{desc: "apparmor is host dependent",
+			security: Security{AppArmor: "stacker-build"},
+			expected: map[string]string{}},
+		{desc: "drop and keep",
+			security: Security{CapDrop: []string{"sys_admin"}, CapKeep: []string{"chown"}},
+			errstr:   "can't be used together"},
+		{desc: "unknown cap",
+			security: Security{CapKeep: []string{"sys_wat"}},
+			errstr:   "unknown capability \"sys_wat\""},
+	}
+
+	for _, tt := range tables {
+		config, err := tt.security.LXCConfig()
+		if tt.errstr != "" {
+			if assert.Error(err, tt.desc) {
+				assert.Contains(err.Error(), tt.errstr, tt.desc)
+			}
+			continue
+		}
+
+		assert.NoError(err, tt.desc)
+		assert.Equal(tt.expected, config, tt.desc)
+	}
+}
+
+func TestSecurityMerge(t *testing.T) {
+	assert := assert.New(t)
+
+	global := &Security{CapDrop: []string{"sys_admin"}, AppArmor: "stacker-build", NoNewPrivs: true}
+	layer := &Security{CapKeep: []string{"chown"}, Seccomp: "/seccomp"}
+
+	var unset *Security
+	assert.Nil(unset.Merge(nil))
+	assert.Equal(layer, unset.Merge(layer))
+	assert.Equal(global, global.Merge(nil))
+	assert.Equal(&Security{
+		CapKeep:    []string{"chown"},
+		Seccomp:    "/seccomp",
+		AppArmor:   "stacker-build",
+		NoNewPrivs: true,
+	}, global.Merge(layer))
+}
+
+func TestCheckSeccompProfile(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+
+	tables := []struct {
+		content string
+		errstr  string
+	}{
+		{content: "1\nreject_force_umount\n"},
+		{content: "2\ndenylist\nmount errno 1\n"},
+		{content: "2\nmount\n", errstr: "must start with allowlist or denylist"},
+		{content: "3\n", errstr: "unsupported policy version"},
+		{content: "", errstr: "is empty"},
+	}
+
+	for i, tt := range tables {
+		p := filepath.Join(dir, "seccomp")
+		assert.NoError(os.WriteFile(p, []byte(tt.content), 0644))
+		err := Security{Seccomp: p}.CheckSeccompProfile()
+		if tt.errstr == "" {
+			assert.NoError(err, i)
+		} else if assert.Error(err, i) {
+			assert.Contains(err.Error(), tt.errstr, i)
+		}
+	}
+
+	assert.Error(Security{Seccomp: filepath.Join(dir, "missing")}.CheckSeccompProfile())
+}
@@ -3,8 +3,6 @@ package types
 import (
 	"bytes"
 	"fmt"
-	"io"
-	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -23,11 +21,14 @@ const (
 
 type BuildConfig struct {
 	Prerequisites []string `yaml:"prerequisites"`
+	Includes      Includes `yaml:"include"`
 }
 
 type Stackerfile struct {
 	// AfterSubstitutions is the contents of the stacker file after
 	// substitutions (i.e., the content that is actually used by stacker).
+	// When layers extend others or have a matrix, it is the expanded
+	// layers instead, since the file alone doesn't say what they are.
 	AfterSubstitutions string
 
 	// internal is the actual representation of the stackerfile as a map.
@@ -61,7 +62,34 @@ func (sf *Stackerfile) Len() int {
 	return len(sf.internal)
 }
 
+// expandedContent returns content, or if expanding its layers changed them,
+// the expanded layers.
+func expandedContent(content string, unexpanded yaml.MapSlice, expanded yaml.MapSlice) (string, error) {
+	before, err := yaml.Marshal(unexpanded)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	after, err := yaml.Marshal(expanded)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	if bytes.Equal(before, after) {
+		return content, nil
+	}
+
+	return string(after), nil
+}
+
 func substitute(content string, substitutions []string) (string, error) {
+	return substituteExcept(content, substitutions, nil)
+}
+
+// substituteExcept works like substitute, but placeholders for the variables
+// in skip are left untouched when no substitution was provided for them,
+// instead of being replaced by their default or causing an error.
+func substituteExcept(content string, substitutions []string, skip map[string]bool) (string, error) {
 	// replace all placeholders where we have a substitution provided
 	sub_usage := []int{}
 	unsupported_messages := []string{}
@@ -135,18 +163,24 @@ func substitute(content string, substitutions []string) (string, error) {
 	// now, anything that's left was not provided in substitutions but should
 	// have a default value. Not having a default here is an error.
 	re := regexp.MustCompile(`\$\{\{[^\}]*\}\}`)
+	start := 0
 	for {
-		indexes := re.FindAllStringIndex(content, -1)
-		if len(indexes) == 0 {
+		loc := re.FindStringIndex(content[start:])
+		if loc == nil {
 			break
 		}
 
-		idx := indexes[0]
+		idx := []int{loc[0] + start, loc[1] + start}
 
 		// get content without ${{}}
 		variable := content[idx[0]+3 : idx[1]-2]
 
 		membs := strings.SplitN(variable, ":", 2)
+		if skip[membs[0]] {
+			start = idx[1]
+			continue
+		}
+
 		if len(membs) != 2 {
 			return "", errors.Errorf("no value for substitution %s", variable)
 		}
@@ -167,6 +201,10 @@ func substitute(content string, substitutions []string) (string, error) {
 	return content, nil
 }
 
+// Offline makes loading stackerfiles fail on remote stackerfiles and includes
+// instead of downloading them; it is set by 'stacker build --offline'.
+var Offline bool
+
 // NewStackerfile creates a new stackerfile from the given path. substitutions
 // is a list of KEY=VALUE pairs of things to substitute. Note that this is
 // explicitly not a map, because the substitutions are performed one at a time
@@ -206,17 +244,11 @@ func NewStackerfile(stackerfile string, validateHash bool, substitutions []strin
 		sf.ReferenceDirectory = filepath.Dir(sf.path)
 
 	} else {
-		resp, err := http.Get(stackerfile)
-		if err != nil {
-			return nil, err
-		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode != 200 {
-			return nil, errors.Errorf("stackerfile: couldn't download %s: %s", stackerfile, resp.Status)
+		if Offline {
+			return nil, errors.Errorf("offline: can't download stackerfile %s, use a local copy of it", stackerfile)
 		}
 
-		raw, err = io.ReadAll(resp.Body)
+		raw, err = downloadRemote("stackerfile", stackerfile)
 		if err != nil {
 			return nil, err
 		}
@@ -225,12 +257,17 @@ func NewStackerfile(stackerfile string, validateHash bool, substitutions []strin
 		// Continue to use the working directory
 	}
 
-	content, err := substitute(string(raw), substitutions)
+	// matrix variables are substituted separately for each variant of a
+	// layer, so leave their placeholders alone for now
+	matrixVars, err := matrixVariables(string(raw))
 	if err != nil {
-		return nil, err
+		return nil, errors.Wrapf(err, "couldn't parse stacker file %s", stackerfile)
 	}
 
-	sf.AfterSubstitutions = content
+	content, err := substituteExcept(string(raw), substitutions, matrixVars)
+	if err != nil {
+		return nil, err
+	}
 
 	// Parse the first time to validate the format/content
 	ms := yaml.MapSlice{}
@@ -261,11 +298,37 @@ func NewStackerfile(stackerfile string, validateHash bool, substitutions []strin
 				return nil, errors.New(msg)
 			}
 		} else {
-			sf.FileOrder = append(sf.FileOrder, e.Key.(string))
 			lms = append(lms, e)
 		}
 	}
 
+	unexpanded := lms
+	lms, err = expandMatrix(string(raw), lms, substitutions, matrixVars)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range lms {
+		sf.FileOrder = append(sf.FileOrder, e.Key.(string))
+	}
+
+	// Resolve includes and 'extends' so everything after this point only
+	// sees the fully expanded layer definitions.
+	templates, err := loadIncludes(sf.ReferenceDirectory, sf.buildConfig.Includes, substitutions)
+	if err != nil {
+		return nil, err
+	}
+
+	lms, err = expandExtends(lms, templates)
+	if err != nil {
+		return nil, err
+	}
+
+	sf.AfterSubstitutions, err = expandedContent(content, unexpanded, lms)
+	if err != nil {
+		return nil, err
+	}
+
 	sf.internal, err = parseLayers(sf.ReferenceDirectory, lms, validateHash)
 	if err != nil {
 		return nil, err
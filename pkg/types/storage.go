@@ -1,5 +1,7 @@
 package types
 
+import "github.com/opencontainers/go-digest"
+
 type Storage interface {
 	// Name of this storage driver (e.g. "overlay")
 	Name() string
@@ -26,6 +28,10 @@ type Storage interface {
 	// Test if a storage tag exists.
 	Exists(thing string) bool
 
+	// Rename moves a storage tag to a new name, replacing any existing
+	// tag with that name.
+	Rename(source string, target string) error
+
 	// Create a temporary writable snapshot of the source, returning the
 	// snapshot's tag and a cleanup function.
 	TemporaryWritableSnapshot(source string) (string, func(), error)
@@ -49,6 +55,11 @@ type Storage interface {
 	// Repack repacks the specified working dir into the specified OCI dir.
 	Repack(name string, layer Layer, layerTypes []LayerType, sfm StackerFiles) error
 
+	// Squash writes the image tag in the output OCI dir to target as an
+	// image with a single layer of layerType, which has the contents of
+	// all of tag's layers.
+	Squash(tag string, target string, layerType LayerType) error
+
 	// GetLXCRootfsConfig returns the string that should be set as
 	// lxc.rootfs.path in the LXC container's config.
 	GetLXCRootfsConfig(name string) (string, error)
@@ -60,4 +71,35 @@ type Storage interface {
 	// Add overlay_dirs into overlay metadata so that later we can mount them
 	// in the lxc container, works only for storage-type 'overlay'
 	SetOverlayDirs(name string, overlayDirs []OverlayDir, layerTypes []LayerType) error
+
+	// Fsck checks the storage for what interrupted builds left behind,
+	// and if opts.Repair is set, removes what can't be used anymore. It
+	// must only be called while no build uses the storage.
+	Fsck(opts FsckOpts) ([]FsckProblem, error)
+}
+
+// FsckOpts are the options of a storage's Fsck.
+type FsckOpts struct {
+	// Repair is whether problems that are found are repaired
+	Repair bool
+
+	// Layers are the layers stacker knows of, from the build cache and
+	// the output. They are never temporary dirs, whatever their names.
+	Layers map[string]bool
+
+	// CorruptBlobs are the blobs of the OCI layouts that don't match
+	// their digest, so layers can't be unpacked from them.
+	CorruptBlobs map[digest.Digest]bool
+}
+
+// FsckProblem is something wrong that stacker fsck found.
+type FsckProblem struct {
+	// Path is the file or dir that has the problem
+	Path string
+
+	// Problem describes what is wrong with it
+	Problem string
+
+	// Repaired is whether it was repaired
+	Repaired bool
 }
@@ -89,6 +89,33 @@ EOF
     [ "$(sha tree2/foo/zomg)" == "$(sha dest/rootfs/zomg)" ]
 }
 
+@test "dest import caching" {
+    cat > stacker.yaml <<"EOF"
+dest-cache:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    imports:
+        - path: foo
+          dest: /etc/foo
+    run: cp /etc/foo /bar
+EOF
+    echo first > foo
+    stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+
+    # unchanged, it's a cache hit
+    stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    echo "$output" | grep "found cached layer dest-cache"
+
+    # changed, it's rebuilt
+    echo second > foo
+    stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    echo "$output" | grep "cache miss because import dir content changed"
+    umoci unpack --image oci:dest-cache dest
+    [ "$(cat dest/rootfs/etc/foo)" == "second" ]
+    [ "$(cat dest/rootfs/bar)" == "second" ]
+}
+
 @test "remove from a dir" {
     cat > stacker.yaml <<"EOF"
 a:
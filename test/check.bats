@@ -1,5 +1,13 @@
 load helpers
 
+function setup() {
+    stacker_setup
+}
+
+function teardown() {
+    cleanup
+}
+
 @test "stacker check is reasonable priv overlay" {
     require_privilege priv
     stacker check
@@ -8,12 +16,50 @@ load helpers
 @test "stacker check is reasonable unpriv overlay" {
     require_privilege unpriv
 
-    # if we don't have overlay support, stacker check should fail, otherwise it
-    # should succeed
+    # if we don't have overlay support, stacker check should fall back to
+    # fuse-overlay or fail, otherwise it should succeed
     run sudo -u $SUDO_USER "${ROOT_DIR}/stacker" --debug internal-go testsuite-check-overlay
-    if [ "$status" -eq 50 ]; then
+    if [ "$status" -eq 50 ] && ! command -v fuse-overlayfs; then
         bad_stacker check
     else
         stacker check
     fi
 }
+
+@test "stacker check picks and records the storage type" {
+    stacker check
+    # overlay, unless the kernel's overlay can't be used
+    grep -xE "(fuse-)?overlay" .stacker/storage.type
+}
+
+@test "fuse-overlay storage builds images" {
+    command -v fuse-overlayfs || skip "fuse-overlayfs not installed"
+    cat > stacker.yaml <<"EOF"
+base:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    run: |
+        rm /etc/passwd
+        rm -rf /home && mkdir -p /home/new
+        echo built > /built
+next:
+    from:
+        type: built
+        tag: base
+    run: |
+        [ ! -e /etc/passwd ]
+        grep built /built
+        echo next >> /built
+EOF
+    stacker --storage-type fuse-overlay build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    [ "$(cat .stacker/storage.type)" = "fuse-overlay" ]
+
+    umoci unpack --image oci:next dest
+    [ ! -e dest/rootfs/etc/passwd ]
+    [ -d dest/rootfs/home/new ]
+    [ "$(cat dest/rootfs/built)" = "$(printf 'built\nnext')" ]
+
+    # the storage can't be switched without a clean
+    bad_stacker --storage-type overlay build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+}
@@ -0,0 +1,75 @@
+load helpers
+
+function setup() {
+    stacker_setup
+    cat > stacker.yaml <<"EOF"
+test:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    run: |
+        echo meshuggah > /rocks
+EOF
+}
+
+function teardown() {
+    cleanup
+}
+
+function last_layer() {
+    local manifest=$(jq -r ".manifests[] | select(.annotations[\"org.opencontainers.image.ref.name\"] == \"$1\") | .digest" oci/index.json | cut -f2 -d:)
+    jq ".layers[-1]" oci/blobs/sha256/$manifest
+}
+
+@test "zstd tar layers" {
+    stacker build --layer-type tar --layer-type tar+zstd@19 --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+
+    [ "$(last_layer test | jq -r .mediaType)" == "application/vnd.oci.image.layer.v1.tar+gzip" ]
+    [ "$(last_layer test-zstd | jq -r .mediaType)" == "application/vnd.oci.image.layer.v1.tar+zstd" ]
+
+    umoci unpack --image oci:test-zstd dest
+    [ "$(cat dest/rootfs/rocks)" == "meshuggah" ]
+}
+
+@test "zstd:chunked and estargz tar layers" {
+    stacker build --layer-type tar+zstd:chunked --layer-type tar+estargz --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+
+    last_layer test-zstd-chunked | jq -e '.annotations["io.github.containers.zstd-chunked.manifest-checksum"]'
+    [ "$(last_layer test-estargz | jq -r .mediaType)" == "application/vnd.oci.image.layer.v1.tar+gzip" ]
+    last_layer test-estargz | jq -e '.annotations["containerd.io/snapshot/stargz/toc.digest"]'
+
+    umoci unpack --image oci:test-zstd-chunked dest
+    [ "$(cat dest/rootfs/rocks)" == "meshuggah" ]
+}
+
+@test "building from compressed tar layers" {
+    stacker build --layer-type tar+zstd:chunked --layer-type tar+estargz --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    mv oci compressed
+    stacker clean
+
+    cat > stacker.yaml <<"EOF"
+from-chunked:
+    from:
+        type: oci
+        url: oci:${{COMPRESSED}}:test-zstd-chunked
+    run: |
+        [ "$(cat /rocks)" == "meshuggah" ]
+from-estargz:
+    from:
+        type: oci
+        url: oci:${{COMPRESSED}}:test-estargz
+    run: |
+        [ "$(cat /rocks)" == "meshuggah" ]
+        # estargz's table of contents isn't part of the filesystem
+        [ ! -e /stargz.index.json ]
+EOF
+    stacker build --substitute COMPRESSED=$(pwd)/compressed
+}
+
+@test "bad compressions are rejected" {
+    bad_stacker build --layer-type tar+lzma --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    echo "$output" | grep "invalid tar compression lzma"
+
+    bad_stacker build --layer-type tar+zstd@1 --layer-type tar+zstd@19 --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    echo "$output" | grep "can't both be output"
+}
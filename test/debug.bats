@@ -0,0 +1,59 @@
+load helpers
+
+function setup() {
+    stacker_setup
+}
+
+function teardown() {
+    cleanup
+}
+
+@test "debug re-enters a failed layer" {
+    cat > stacker.yaml <<"EOF"
+broken:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    imports:
+        - import
+    environment:
+        FOO: bar
+    run: |
+        cp /stacker/imports/import /imported
+        false
+EOF
+    echo "hello" > import
+    bad_stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI} --keep-failed
+    echo "$output" | grep "kept failed layer broken"
+
+    # state from the failed run, and the layer's imports and env are there
+    stacker debug broken /bin/sh -c '[ "$(cat /imported)" == "hello" ] && [ -f /stacker/imports/import ] && [ "$FOO" == "bar" ]'
+
+    # changes made while debugging are kept between sessions
+    stacker debug broken /bin/sh -c 'echo fixed > /fixed'
+    stacker debug --commit fix.tar broken /bin/sh -c '[ "$(cat /fixed)" == "fixed" ]'
+    tar -tf fix.tar | grep "fixed$"
+    tar -tf fix.tar | grep "imported$"
+
+    # once the layer builds, what was kept of the failure is removed
+    sed -i '$ d' stacker.yaml
+    stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    [ ! -e roots/failed-broken ]
+    [ ! -e .stacker/failed/broken.json ]
+    bad_stacker debug broken
+    echo "$output" | grep "no failed state for broken"
+}
+
+@test "debug without a kept failed layer fails" {
+    cat > stacker.yaml <<"EOF"
+broken:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    run: |
+        false
+EOF
+    bad_stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    bad_stacker debug broken
+    echo "$output" | grep "no failed state for broken"
+}
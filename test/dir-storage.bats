@@ -0,0 +1,101 @@
+load helpers
+
+function setup() {
+    stacker_setup
+}
+
+function teardown() {
+    cleanup
+}
+
+function manifest() {
+    local manifest=$(jq -r ".manifests[] | select(.annotations[\"org.opencontainers.image.ref.name\"] == \"$1\") | .digest" "$2/index.json" | cut -f2 -d:)
+    cat "$2/blobs/sha256/$manifest"
+}
+
+@test "dir storage builds images" {
+    cat > stacker.yaml <<"EOF"
+base:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    run: |
+        rm /etc/passwd
+        rm -rf /home && mkdir -p /home/new
+        echo built > /built
+build:
+    from:
+        type: built
+        tag: base
+    build_only: true
+    run: |
+        echo build > /build-only
+next:
+    from:
+        type: built
+        tag: build
+    run: |
+        [ ! -e /etc/passwd ]
+        grep built /built
+        echo next >> /built
+EOF
+    stacker --storage-type dir build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    [ "$(cat .stacker/storage.type)" = "dir" ]
+
+    umoci unpack --image oci:next dest
+    [ ! -e dest/rootfs/etc/passwd ]
+    [ -d dest/rootfs/home/new ]
+    [ ! -e dest/rootfs/stacker ]
+    [ "$(cat dest/rootfs/built)" = "$(printf 'built\nnext')" ]
+    # the build only layer's changes are in next's layer
+    [ "$(cat dest/rootfs/build-only)" = "build" ]
+
+    # base's layers and one more
+    [ "$(manifest next oci | jq '.layers | length')" -eq "$(( $(manifest base oci | jq '.layers | length') + 1 ))" ]
+
+    # rebuilding is cached
+    stacker --storage-type dir build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    echo "$output" | grep "found cached layer next"
+
+    # the storage can't be switched without a clean
+    bad_stacker --storage-type overlay build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+}
+
+@test "dir storage squashes images" {
+    cat > stacker.yaml <<"EOF"
+base:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    run: |
+        echo gone > /removed
+test:
+    from:
+        type: built
+        tag: base
+    squash: true
+    run: |
+        echo squashed > /squashed
+        rm /removed
+EOF
+    stacker --storage-type dir build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    [ "$(manifest base oci | jq '.layers | length')" -gt 1 ]
+    [ "$(manifest test oci | jq '.layers | length')" == "1" ]
+
+    umoci unpack --image oci:test dest
+    [ "$(cat dest/rootfs/squashed)" == "squashed" ]
+    [ ! -e dest/rootfs/removed ]
+}
+
+@test "dir storage rejects filesystem layers" {
+    cat > stacker.yaml <<"EOF"
+base:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    run: |
+        touch /foo
+EOF
+    bad_stacker --storage-type dir build --layer-type squashfs --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    echo "$output" | grep "can only generate tar layers"
+}
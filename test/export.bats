@@ -0,0 +1,65 @@
+load helpers
+
+function setup() {
+    stacker_setup
+    cat > stacker.yaml <<"EOF"
+base:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    run: |
+        mkdir -p /data/old
+        echo base > /data/old/file
+        echo removed > /removed
+child:
+    from:
+        type: built
+        tag: base
+    run: |
+        rm -rf /data/old /removed
+        echo child > /data/new
+        chmod 4755 /data/new
+EOF
+    stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+}
+
+function teardown() {
+    cleanup
+}
+
+@test "export to a directory applies whiteouts" {
+    stacker export child exported
+    [ "$(cat exported/data/new)" == "child" ]
+    [ -u exported/data/new ]
+    [ ! -e exported/data/old ]
+    [ ! -e exported/removed ]
+    [ -x exported/bin/busybox ]
+
+    bad_stacker export child exported
+    echo "$output" | grep "is not empty"
+}
+
+@test "export to a tarball" {
+    stacker export --format tar child child.tar
+    mkdir extracted
+    tar -C extracted -xf child.tar
+    [ "$(cat extracted/data/new)" == "child" ]
+    [ ! -e extracted/removed ]
+    ! tar -tf child.tar | grep "\.wh\."
+}
+
+@test "export to image archives" {
+    stacker export --format oci-archive child child-oci.tar
+    mkdir from-archive
+    tar -C from-archive -xf child-oci.tar
+    umoci unpack --image from-archive:child dest
+    [ "$(cat dest/rootfs/data/new)" == "child" ]
+
+    stacker export --format docker-archive --name example/child:1.0 child child-docker.tar
+    tar -xOf child-docker.tar manifest.json | grep "example/child:1.0"
+}
+
+@test "export rejects bad formats" {
+    bad_stacker export --format zip child child.zip
+    echo "$output" | grep "invalid export format: zip"
+}
@@ -0,0 +1,89 @@
+load helpers
+
+function setup() {
+    stacker_setup
+}
+
+function teardown() {
+    cleanup
+}
+
+function last_layer() {
+    local manifest=$(jq -r ".manifests[] | select(.annotations[\"org.opencontainers.image.ref.name\"] == \"$1\") | .digest" oci/index.json | cut -f2 -d:)
+    jq ".layers[-1]" oci/blobs/sha256/$manifest
+}
+
+@test "squashfs and erofs options from the command line" {
+    cat > stacker.yaml <<"EOF"
+test:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    run: |
+        echo meshuggah > /rocks
+EOF
+    stacker build --layer-type squashfs+xz,block-size=262144 --layer-type erofs+lz4hc@12,dedupe --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    [ "$(last_layer test-squashfs | jq -r .mediaType)" == "application/vnd.stacker.image.layer.squashfs+xz" ]
+    [ "$(last_layer test-erofs | jq -r .mediaType)" == "application/vnd.stacker.image.layer.erofs+lz4hc" ]
+
+    squashfs=$(last_layer test-squashfs | jq -r .digest | cut -f2 -d:)
+    unsquashfs -s oci/blobs/sha256/$squashfs | grep "Block size 262144"
+    unsquashfs -s oci/blobs/sha256/$squashfs | grep "Compression xz"
+
+    # changing the options rebuilds the layer
+    stacker build --layer-type squashfs+gzip@9 --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    ! echo "$output" | grep "found cached layer test-squashfs"
+    [ "$(last_layer test-squashfs | jq -r .mediaType)" == "application/vnd.stacker.image.layer.squashfs+gzip" ]
+}
+
+@test "filesystem directive overrides the layer type" {
+    cat > stacker.yaml <<"EOF"
+test:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    run: |
+        echo meshuggah > /rocks
+    filesystem:
+        compression: gzip
+        level: 1
+EOF
+    stacker build --layer-type squashfs+xz --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    [ "$(last_layer test-squashfs | jq -r .mediaType)" == "application/vnd.stacker.image.layer.squashfs+gzip" ]
+
+    # and the result can be built on
+    cat > stacker.yaml <<"EOF"
+test:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    run: |
+        echo meshuggah > /rocks
+    filesystem:
+        compression: gzip
+        level: 1
+child:
+    from:
+        type: built
+        tag: test
+    run: |
+        [ "$(cat /rocks)" == "meshuggah" ]
+EOF
+    stacker build --layer-type squashfs+xz --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+}
+
+@test "bad filesystem options are rejected" {
+    cat > stacker.yaml <<"EOF"
+test:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    filesystem:
+        compression: brotli
+EOF
+    bad_stacker build --layer-type squashfs --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    echo "$output" | grep "invalid filesystem options"
+
+    bad_stacker build --layer-type squashfs+xz@3 --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    echo "$output" | grep "has no compression levels"
+}
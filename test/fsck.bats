@@ -0,0 +1,55 @@
+load helpers
+
+function setup() {
+    stacker_setup
+}
+
+function teardown() {
+    cleanup
+}
+
+function config_blob() {
+    local manifest=$(jq -r ".manifests[] | select(.annotations[\"org.opencontainers.image.ref.name\"] == \"$1\") | .digest" oci/index.json | cut -f2 -d:)
+    echo "oci/blobs/sha256/$(jq -r .config.digest oci/blobs/sha256/$manifest | cut -f2 -d:)"
+}
+
+@test "fsck finds and repairs what interrupted builds leave behind" {
+    cat > stacker.yaml <<"EOF"
+base:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    run: |
+        touch /built
+EOF
+    stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+
+    stacker fsck
+    echo "$output" | grep "no problems found"
+
+    # a snapshot that was never cleaned up, and a partially written blob
+    mkdir roots/temp-snapshot-base-1234
+    config=$(config_blob base)
+    echo corrupt > "$config"
+
+    bad_stacker fsck
+    echo "$output" | grep "temp-snapshot-base-1234: orphaned temporary dir"
+    echo "$output" | grep "$(basename $config): blob content has digest"
+    echo "$output" | grep "oci:base: missing blob"
+    echo "$output" | grep "build.cache: tar output of base is missing blob"
+    [ -d roots/temp-snapshot-base-1234 ]
+    [ -f "$config" ]
+
+    stacker fsck --repair
+    echo "$output" | grep "repaired"
+    [ ! -e roots/temp-snapshot-base-1234 ]
+    [ ! -e "$config" ]
+
+    stacker fsck
+    echo "$output" | grep "no problems found"
+
+    # and the next build rebuilds what was removed
+    stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    umoci unpack --image oci:base dest
+    [ -f dest/rootfs/built ]
+}
@@ -0,0 +1,142 @@
+load helpers
+
+function setup() {
+    stacker_setup
+    mkdir -p repo/rootfs/etc
+    echo v1 > repo/rootfs/etc/version
+    echo hello > repo/README
+    (
+        cd repo
+        git init -q -b main
+        git add .
+        git -c user.name=stacker -c user.email=stacker@example.com commit -q -m v1
+        git tag v1
+    )
+}
+
+function teardown() {
+    cleanup
+    rm -rf repo || true
+}
+
+function commit_v2() {
+    echo v2 > repo/rootfs/etc/version
+    git -C repo -c user.name=stacker -c user.email=stacker@example.com commit -q -a -m v2
+}
+
+@test "git imports" {
+    cat > stacker.yaml <<"EOF"
+branch:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    imports:
+        - path: git+file://${{REPO}}
+          exclude:
+              - README
+    run: |
+        cp /stacker/imports/repo/rootfs/etc/version /version
+        [ ! -e /stacker/imports/repo/README ]
+        [ ! -e /stacker/imports/repo/.git ]
+tag:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    imports:
+        - path: git+file://${{REPO}}
+          ref: v1
+          dest: /src/
+EOF
+    stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI} --substitute REPO=$(pwd)/repo
+    umoci unpack --image oci:branch dest
+    [ "$(cat dest/rootfs/version)" = "v1" ]
+
+    # nothing moved, so nothing is rebuilt
+    stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI} --substitute REPO=$(pwd)/repo
+    echo "$output" | grep "found cached layer branch"
+    echo "$output" | grep "found cached layer tag"
+
+    # the branch moved, the tag didn't
+    commit_v2
+    stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI} --substitute REPO=$(pwd)/repo
+    echo "$output" | grep "found cached layer tag"
+    rm -rf dest
+    umoci unpack --image oci:branch dest
+    [ "$(cat dest/rootfs/version)" = "v2" ]
+    rm -rf dest
+    umoci unpack --image oci:tag dest
+    [ "$(cat dest/rootfs/src/repo/rootfs/etc/version)" = "v1" ]
+}
+
+@test "git imports need a commit with --require-hash" {
+    cat > stacker.yaml <<"EOF"
+test:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    imports:
+        - path: git+file://${{REPO}}
+          ref: main
+EOF
+    bad_stacker build --require-hash --substitute BUSYBOX_OCI=${BUSYBOX_OCI} --substitute REPO=$(pwd)/repo
+    echo "$output" | grep "needs a commit"
+}
+
+@test "git bases" {
+    tar -C repo/rootfs -czf repo/rootfs.tar.gz .
+    git -C repo add rootfs.tar.gz
+    git -C repo -c user.name=stacker -c user.email=stacker@example.com commit -q -m tarball
+
+    cat > stacker.yaml <<"EOF"
+dir:
+    from:
+        type: git
+        url: git+file://${{REPO}}
+        path: rootfs
+tarball:
+    from:
+        type: git
+        url: git+file://${{REPO}}
+        ref: main
+        path: rootfs.tar.gz
+EOF
+    stacker build --substitute REPO=$(pwd)/repo
+    umoci unpack --image oci:dir dest
+    [ "$(cat dest/rootfs/etc/version)" = "v1" ]
+    [ ! -e dest/rootfs/README ]
+    rm -rf dest
+    umoci unpack --image oci:tarball dest
+    [ "$(cat dest/rootfs/etc/version)" = "v1" ]
+
+    stacker build --substitute REPO=$(pwd)/repo
+    echo "$output" | grep "found cached layer dir"
+
+    # a new commit is a new base
+    commit_v2
+    stacker build --substitute REPO=$(pwd)/repo
+    rm -rf dest
+    umoci unpack --image oci:dir dest
+    [ "$(cat dest/rootfs/etc/version)" = "v2" ]
+}
+
+@test "git inputs can be fetched for offline builds" {
+    cat > stacker.yaml <<"EOF"
+test:
+    from:
+        type: git
+        url: git+file://${{REPO}}
+        path: rootfs
+    imports:
+        - path: git+file://${{REPO}}
+          ref: v1
+EOF
+    bad_stacker build --offline --substitute REPO=$(pwd)/repo
+    echo "$output" | grep "test import git+file://.*/repo at v1"
+
+    stacker fetch --substitute REPO=$(pwd)/repo
+    stacker bundle fetched.tar
+    tar tf fetched.tar | grep "^git/checkouts/"
+
+    rm -rf .stacker repo
+    stacker build --offline --bundle fetched.tar --substitute REPO=$(pwd)/repo
+}
@@ -40,6 +40,10 @@ function skip_if_no_unpriv_overlay {
 
 function run_stacker {
     echo "Debug mode: $NO_DEBUG"
+    # STORAGE_TYPE runs the tests with another storage than stacker picks
+    if [ -n "$STORAGE_TYPE" ]; then
+        set -- "--storage-type=$STORAGE_TYPE" "$@"
+    fi
     if [ "$PRIVILEGE_LEVEL" = "priv" ]; then
         if [[ -n "$NO_DEBUG" && "$NO_DEBUG" = 1 ]]; then
             run "${ROOT_DIR}/stacker" "$@"
@@ -47,7 +51,7 @@ function run_stacker {
             run "${ROOT_DIR}/stacker" --debug "$@"
         fi
     else
-        skip_if_no_unpriv_overlay
+        [ "$STORAGE_TYPE" = "dir" ] || skip_if_no_unpriv_overlay
         if [[ -n "$NO_DEBUG" && "$NO_DEBUG" = 1 ]]; then
             run sudo --preserve-env=SOURCE_DATE_EPOCH -u $SUDO_USER "${ROOT_DIR}/stacker" "$@"
         else
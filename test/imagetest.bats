@@ -0,0 +1,154 @@
+load helpers
+
+function setup() {
+    stacker_setup
+}
+
+function teardown() {
+    cleanup
+}
+
+@test "layer tests run after build" {
+    cat > stacker.yaml <<"EOF"
+app:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    run: |
+        echo hello > /hello
+        chmod 640 /hello
+        ln -s /hello /hello-link
+    environment:
+        GREETING: hello
+    entrypoint: /bin/sh
+    test:
+        run:
+            - '[ "$(cat /hello)" == "$GREETING" ]'
+            - touch /scratch
+        files:
+            - path: /hello
+              type: file
+              mode: 0640
+              uid: 0
+            - path: /hello-link
+              type: symlink
+            - path: /nonexistent
+              absent: true
+        config:
+            env:
+                GREETING: hello
+            entrypoint: /bin/sh
+EOF
+    stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    echo "$output" | grep "PASS app: run: touch /scratch"
+    echo "$output" | grep "PASS app: file: /hello"
+    echo "$output" | grep "PASS app: config: entrypoint"
+
+    # tests run in a throwaway copy of the image
+    umoci unpack --image oci:app dest
+    [ ! -f dest/rootfs/scratch ]
+}
+
+@test "failing layer tests fail the build" {
+    cat > stacker.yaml <<"EOF"
+app:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    run: |
+        touch /hello
+    test:
+        run: |
+            [ -f /goodbye ]
+        files:
+            - path: /hello
+              absent: true
+EOF
+    bad_stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    echo "$output" | grep "FAIL app: file: /hello: /hello exists"
+    echo "$output" | grep "2 of 2 tests failed for app"
+}
+
+@test "invalid test directives are rejected" {
+    cat > stacker.yaml <<"EOF"
+app:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    build_only: true
+    test:
+        config:
+            user: root
+EOF
+    bad_stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    echo "$output" | grep "build_only layers have no image config to test"
+}
+
+@test "stacker test runs against built images" {
+    cat > stacker.yaml <<"EOF"
+app:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    run: |
+        touch /hello
+    test:
+        files:
+            - path: /hello
+EOF
+    stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    stacker test --substitute BUSYBOX_OCI=${BUSYBOX_OCI} --junit report.xml
+    grep '<testsuite name="app" tests="1" failures="0"' report.xml
+
+    # the tests now fail against the image that was built
+    sed -i 's|path: /hello|path: /goodbye|' stacker.yaml
+    bad_stacker test --substitute BUSYBOX_OCI=${BUSYBOX_OCI} --junit report.xml app
+    grep '<testsuite name="app" tests="1" failures="1"' report.xml
+    grep "couldn&#39;t stat /goodbye" report.xml
+}
+
+@test "layer tests check the output image and failures aren't cached" {
+    cat > stacker.yaml <<"EOF"
+app:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    run: |
+        touch /hello
+    entrypoint: /bin/true
+    test:
+        config:
+            entrypoint: /bin/false
+EOF
+    bad_stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    echo "$output" | grep "FAIL app: config: entrypoint"
+
+    # and the image that failed isn't in the output
+    [ -z "$(jq -r '.manifests[].annotations["org.opencontainers.image.ref.name"]' oci/index.json | grep '^app$')" ]
+
+    # the failed layer is rebuilt and tested again
+    bad_stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    [ -z "$(echo "$output" | grep "found cached layer app")" ]
+    echo "$output" | grep "FAIL app: config: entrypoint"
+
+    sed -i 's|entrypoint: /bin/false|entrypoint: /bin/true|' stacker.yaml
+    stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    echo "$output" | grep "PASS app: config: entrypoint"
+}
+
+@test "stacker test cleans up its temporary tag" {
+    cat > stacker.yaml <<"EOF"
+app:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    run: |
+        touch /hello
+    test:
+        files:
+            - path: /hello
+EOF
+    stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    stacker test --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    [ -z "$(jq -r '.manifests[].annotations["org.opencontainers.image.ref.name"]' .stacker/layer-bases/oci/index.json | grep stacker-test-)" ]
+}
@@ -268,6 +268,63 @@ EOF
     stacker build --require-hash
 }
 
+@test "http imports can be checked against a checksum file" {
+    wget https://google.com/favicon.ico -O google_fav
+    echo "$(sha google_fav)  favicon.ico" > SHA256SUMS
+    echo "SHA512 (favicon.ico) = $(sha512sum google_fav | cut -f1 -d" ")" > SHA512SUMS
+    echo "$(printf '0%.0s' $(seq 64))  favicon.ico" > BADSUMS
+    # see above for why this heredoc is unquoted and we're using $BUSYBOX_OCI
+    cat > stacker.yaml <<EOF
+thing:
+    from:
+        type: oci
+        url: $BUSYBOX_OCI
+    imports:
+        - path: https://www.google.com/favicon.ico
+          checksums: \${{SUMS}}
+    run: |
+        [ -f /stacker/imports/favicon.ico ]
+EOF
+
+    # a local checksum file pins the import like a hash does
+    stacker build --require-hash --substitute SUMS=SHA256SUMS
+    stacker build --require-hash --substitute SUMS=SHA512SUMS
+    bad_stacker build --substitute SUMS=BADSUMS
+    echo "$output" | grep "different than its checksum"
+}
+
+@test "imports are fetched in parallel" {
+    cat > stacker.yaml <<"EOF"
+first:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    imports:
+        - https://bing.com/favicon.ico
+        - path: https://www.google.com/favicon.ico
+          dest: /google/
+    run: |
+        [ -f /stacker/imports/favicon.ico ]
+        [ -f /google/favicon.ico ]
+        echo built > /built
+second:
+    from:
+        type: built
+        tag: first
+    imports:
+        - path: https://www.google.com/favicon.ico
+          dest: /google2/
+        - stacker://first/built
+    run: |
+        [ -f /google2/favicon.ico ]
+        grep built /stacker/imports/built
+EOF
+    stacker --fetch-jobs 3 build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    # the same again, one at a time
+    stacker --fetch-jobs 1 build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    echo "$output" | grep "found cached layer first"
+}
+
 @test "invalid import " {
     cat > stacker.yaml <<"EOF"
 busybox:
@@ -554,3 +611,99 @@ EOF
 
     stacker build --substitute CENTOS_OCI=${CENTOS_OCI}
 }
+
+@test "import include, exclude and .stackerignore" {
+    mkdir -p src/.git src/build src/docs
+    touch src/main.go src/main.go.swp src/.git/HEAD src/build/out src/docs/README src/docs/notes.txt
+    cat > .stackerignore <<"EOF"
+.git/
+/src/build
+EOF
+    cat > stacker.yaml <<"EOF"
+filtered:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    imports:
+        - path: src
+          exclude:
+              - "*.swp"
+              - docs/*.txt
+    run: |
+        [ -f /stacker/imports/src/main.go ]
+        [ -f /stacker/imports/src/docs/README ]
+        [ ! -e /stacker/imports/src/docs/notes.txt ]
+        [ ! -e /stacker/imports/src/main.go.swp ]
+        [ ! -e /stacker/imports/src/.git ]
+        [ ! -e /stacker/imports/src/build ]
+included:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    imports:
+        - path: src
+          include:
+              - docs/*.txt
+    run: |
+        [ -f /stacker/imports/src/docs/notes.txt ]
+        [ ! -e /stacker/imports/src/docs/README ]
+        [ ! -e /stacker/imports/src/main.go ]
+EOF
+    stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+
+    # ignored files don't invalidate the cache
+    touch src/.git/ORIG_HEAD src/build/more src/other.swp
+    stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    echo "$output" | grep "found cached layer filtered"
+}
+
+@test "import extract" {
+    mkdir -p app/bin
+    echo hello > app/bin/hello
+    tar -C app -czf app.tar.gz .
+    (cd app && zip -qr ../app.zip .)
+    cat > stacker.yaml <<"EOF"
+extracted:
+    from:
+        type: scratch
+    imports:
+        - path: app.tar.gz
+          dest: /opt/app
+          extract: true
+          mode: 0700
+          uid: 1000
+        - path: app.zip
+          dest: /opt/zipped/
+          extract: true
+EOF
+    stacker build
+    umoci unpack --image oci:extracted dest
+    [ "$(cat dest/rootfs/opt/app/bin/hello)" = "hello" ]
+    [ "$(stat -c %a dest/rootfs/opt/app/bin/hello)" = "700" ]
+    [ "$(stat -c %u dest/rootfs/opt/app/bin/hello)" = "1000" ]
+    [ "$(cat dest/rootfs/opt/zipped/bin/hello)" = "hello" ]
+    [ ! -e dest/rootfs/opt/app.tar.gz ]
+
+    stacker build
+    echo "$output" | grep "found cached layer extracted"
+}
+
+@test "import from images" {
+    cat > stacker.yaml <<"EOF"
+tools:
+    from:
+        type: scratch
+    imports:
+        - path: oci://${{BUSYBOX_OCI}}#/bin/busybox
+          dest: /bin/
+EOF
+    stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    umoci unpack --image oci:tools dest
+    [ -f dest/rootfs/bin/busybox ]
+
+    stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    echo "$output" | grep "found cached layer tools"
+
+    bad_stacker build --require-hash --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    echo "$output" | grep "needs a hash in yaml or a digest"
+}
@@ -0,0 +1,89 @@
+load helpers
+
+function setup() {
+    stacker_setup
+}
+
+function teardown() {
+    cleanup
+}
+
+@test "extends a template from an include" {
+    cat > templates.yaml <<"EOF"
+base:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    environment:
+        FOO: template
+        BAR: template
+    run: |
+        touch /template
+EOF
+    cat > stacker.yaml <<EOF
+config:
+    include:
+        - path: templates.yaml
+          hash: $(sha templates.yaml)
+child:
+    extends: base
+    environment:
+        BAR: child
+    run: |
+        [ -f /template ]
+        touch /child
+EOF
+    stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    umoci unpack --image oci:child dest
+    [ -f dest/rootfs/template ]
+    [ -f dest/rootfs/child ]
+    manifest=$(cat oci/index.json | jq -r .manifests[0].digest | cut -f2 -d:)
+    config=$(cat oci/blobs/sha256/$manifest | jq -r .config.digest | cut -f2 -d:)
+    cat oci/blobs/sha256/$config | jq -r '.config.Env[]' | grep "FOO=template"
+    cat oci/blobs/sha256/$config | jq -r '.config.Env[]' | grep "BAR=child"
+
+    # templates from includes are not built on their own
+    [ "$(umoci ls --layout ./oci)" == "$(printf "child")" ]
+}
+
+@test "changing a template invalidates the cache" {
+    cat > templates.yaml <<"EOF"
+base:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    run: |
+        echo one > /template
+EOF
+    cat > stacker.yaml <<"EOF"
+config:
+    include:
+        - templates.yaml
+child:
+    extends: base
+EOF
+    stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    sed -i 's/one/two/' templates.yaml
+    stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    umoci unpack --image oci:child dest
+    [ "$(cat dest/rootfs/template)" == "two" ]
+}
+
+@test "include hash mismatch fails" {
+    cat > templates.yaml <<"EOF"
+base:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+EOF
+    cat > stacker.yaml <<"EOF"
+config:
+    include:
+        - path: templates.yaml
+          hash: 0000000000000000000000000000000000000000000000000000000000000000
+child:
+    extends: base
+EOF
+    bad_stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    echo $output | grep "different than the actual hash"
+}
@@ -0,0 +1,88 @@
+load helpers
+
+function setup() {
+    stacker_setup
+}
+
+function teardown() {
+    cleanup
+}
+
+@test "layer timeout kills a hung run" {
+    cat > stacker.yaml <<"EOF"
+hung:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    timeout: 2s
+    run: |
+        sleep 600
+EOF
+    bad_stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    echo "$output" | grep "hung: timed out after 2s"
+}
+
+@test "--run-timeout applies to layers without a timeout" {
+    cat > stacker.yaml <<"EOF"
+fast:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    timeout: 10m
+    run: |
+        sleep 3
+hung:
+    from:
+        type: built
+        tag: fast
+    run: |
+        sleep 600
+EOF
+    bad_stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI} --run-timeout 2s
+    echo "$output" | grep "filesystem fast built successfully"
+    echo "$output" | grep "hung: timed out after 2s"
+}
+
+@test "invalid limits are rejected" {
+    cat > stacker.yaml <<"EOF"
+bad:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    limits:
+        memory: 2GB
+EOF
+    bad_stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    echo "$output" | grep "invalid memory limit"
+
+    cat > stacker.yaml <<"EOF"
+bad:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    timeout: soon
+EOF
+    bad_stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    echo "$output" | grep "invalid timeout"
+}
+
+@test "limits are applied to the build container" {
+    [ -f /sys/fs/cgroup/cgroup.controllers ] || skip "limits need cgroup v2"
+    require_privilege priv
+
+    cat > stacker.yaml <<"EOF"
+limited:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    limits:
+        memory: 256M
+        cpus: 0.5
+        pids: 20
+    run: |
+        for i in $(seq 50); do sleep 60 & done
+        wait
+EOF
+    bad_stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    echo "$output" | grep -i "can't fork"
+}
@@ -0,0 +1,58 @@
+load helpers
+
+function setup() {
+    stacker_setup
+}
+
+function teardown() {
+    cleanup
+}
+
+@test "matrix layers build every variant" {
+    cat > stacker.yaml <<"EOF"
+app:
+    matrix:
+        NUM: [one, two]
+        FLAVOR: [min, full]
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    run: |
+        echo ${{NUM}}-${{FLAVOR}} > /variant
+EOF
+    stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    for variant in one-min one-full two-min two-full; do
+        umoci unpack --image oci:app-$variant dest-$variant
+        [ "$(cat dest-$variant/rootfs/variant)" == "$variant" ]
+    done
+    [ "$(umoci ls --layout ./oci | wc -l)" == "4" ]
+
+    # each variant has its own cache entry
+    stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    echo "$output" | grep "found cached layer app-one-min"
+    echo "$output" | grep "found cached layer app-two-full"
+}
+
+@test "matrix variants can be used as built bases" {
+    cat > stacker.yaml <<"EOF"
+base:
+    matrix:
+        NUM: [one, two]
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    run: |
+        echo ${{NUM}} > /base
+child:
+    from:
+        type: built
+        tag: base-two
+    run: |
+        [ "$(cat /base)" == "two" ]
+EOF
+    stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI} --order-only
+    echo "$output" | grep "layers: \[base-one base-two child\]"
+    stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    umoci unpack --image oci:child dest
+    [ "$(cat dest/rootfs/base)" == "two" ]
+}
@@ -0,0 +1,73 @@
+load helpers
+
+function setup() {
+    stacker_setup
+}
+
+function teardown() {
+    umount_under "$TEST_TMPDIR" || true
+    cleanup
+}
+
+function build_image() {
+    cat > stacker.yaml <<"EOF"
+test:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    run: |
+        touch /hello
+EOF
+    stacker build --layer-type=$1 $2 --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+}
+
+@test "mount and umount squashfs images" {
+    require_privilege priv
+    build_image squashfs
+
+    mkdir mountpoint
+    stacker mount test-squashfs mountpoint
+    [ -f mountpoint/hello ]
+    ! touch mountpoint/new
+
+    stacker mount
+    echo "$output" | grep "$(pwd)/mountpoint.*:test-squashfs.*ro"
+
+    stacker umount mountpoint
+    [ ! -f mountpoint/hello ]
+    stacker mount
+    [ -z "$output" ]
+}
+
+@test "mount erofs images writable" {
+    require_privilege priv
+    build_image erofs
+
+    mkdir mountpoint changes
+    stacker mount --writable-dir changes test-erofs mountpoint
+    touch mountpoint/new
+    stacker mount
+    echo "$output" | grep "test-erofs.*rw"
+    stacker umount mountpoint
+    [ -f changes/overlay/new ] || find changes | grep "/new$"
+}
+
+@test "mount enforces verity by default" {
+    require_privilege priv
+    build_image squashfs --no-verity
+
+    mkdir mountpoint
+    bad_stacker mount test-squashfs mountpoint
+    stacker mount --allow-missing-verity test-squashfs mountpoint
+    [ -f mountpoint/hello ]
+    stacker umount mountpoint
+}
+
+@test "mount rejects tar images" {
+    require_privilege priv
+    build_image tar
+
+    mkdir mountpoint
+    bad_stacker mount test mountpoint
+    echo "$output" | grep "only squashfs and erofs images can be mounted"
+}
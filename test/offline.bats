@@ -0,0 +1,46 @@
+load helpers
+
+function setup() {
+    stacker_setup
+    cat > stacker.yaml <<"EOF"
+test:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    imports:
+        - https://www.cisco.com/favicon.ico
+    run: |
+        cp /stacker/imports/favicon.ico /favicon.ico
+        # there's no network
+        [ "$(ls /sys/class/net)" = "lo" ]
+EOF
+}
+
+function teardown() {
+    cleanup
+}
+
+@test "offline builds use a fetched bundle" {
+    stacker fetch --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    stacker bundle fetched.tar
+    tar tf fetched.tar | grep "^layer-bases/oci/index.json$"
+    tar tf fetched.tar | grep "^imports/.fetched/.*/favicon.ico$"
+
+    rm -rf .stacker
+    stacker build --offline --bundle fetched.tar --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+
+    umoci unpack --image oci:test dest
+    [ -f dest/rootfs/favicon.ico ]
+}
+
+@test "offline builds fail early on missing inputs" {
+    bad_stacker build --offline --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    echo "$output" | grep "run 'stacker fetch' first"
+    echo "$output" | grep "test base image"
+    echo "$output" | grep "test import https://www.cisco.com/favicon.ico"
+}
+
+@test "offline builds don't download remote stackerfiles" {
+    bad_stacker build --offline -f https://www.cisco.com/stacker.yaml
+    echo "$output" | grep "offline: can't download stackerfile https://www.cisco.com/stacker.yaml"
+}
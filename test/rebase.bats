@@ -0,0 +1,98 @@
+load helpers
+
+function setup() {
+    stacker_setup
+    cat > stacker.yaml <<"EOF"
+base:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    run: |
+        echo 1.0 > /base-version
+patched:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    run: |
+        echo 1.1 > /base-version
+EOF
+    stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    mv oci bases
+    stacker clean
+
+    cat > stacker.yaml <<"EOF"
+test:
+    from:
+        type: oci
+        url: oci:${{BASES}}:base
+    run: |
+        echo meshuggah > /rocks
+built:
+    from:
+        type: built
+        tag: test
+    run: |
+        echo gojira > /also-rocks
+EOF
+}
+
+function teardown() {
+    cleanup
+}
+
+function manifest() {
+    local manifest=$(jq -r ".manifests[] | select(.annotations[\"org.opencontainers.image.ref.name\"] == \"$1\") | .digest" "$2/index.json" | cut -f2 -d:)
+    cat "$2/blobs/sha256/$manifest"
+}
+
+function image_config() {
+    local config=$(manifest "$1" "$2" | jq -r .config.digest | cut -f2 -d:)
+    cat "$2/blobs/sha256/$config"
+}
+
+@test "rebase swaps the base layers" {
+    stacker build --substitute BASES=$(pwd)/bases
+    ours=$(manifest test oci | jq -r '.layers[-1].digest')
+
+    stacker rebase test --onto oci:$(pwd)/bases:patched --substitute BASES=$(pwd)/bases
+
+    # the base's layers are the new base's, and ours are untouched
+    [ "$(manifest test oci | jq -r '.layers[:-1]')" == "$(manifest patched bases | jq -r '.layers')" ]
+    [ "$(manifest test oci | jq -r '.layers[-1].digest')" == "$ours" ]
+    [ "$(image_config test oci | jq -r '.rootfs.diff_ids[:-1]')" == "$(image_config patched bases | jq -r '.rootfs.diff_ids')" ]
+    image_config test oci | jq -r '.history[-1].created_by' | grep "stacker rebase of test onto"
+    [ "$(manifest test oci | jq -r '.annotations["org.opencontainers.image.base.name"]')" == "oci:$(pwd)/bases:patched" ]
+
+    umoci unpack --image oci:test dest
+    [ "$(cat dest/rootfs/base-version)" == "1.1" ]
+    [ "$(cat dest/rootfs/rocks)" == "meshuggah" ]
+}
+
+@test "rebuilding after a rebase onto another tag" {
+    stacker build --substitute BASES=$(pwd)/bases
+    stacker rebase test --onto oci:$(pwd)/bases:patched --substitute BASES=$(pwd)/bases
+
+    # the stackerfile still says the old base, so the layer is rebuilt on it
+    stacker build --substitute BASES=$(pwd)/bases
+    ! echo "$output" | grep "found cached layer test"
+    umoci unpack --image oci:test dest
+    [ "$(cat dest/rootfs/base-version)" == "1.0" ]
+    [ "$(cat dest/rootfs/rocks)" == "meshuggah" ]
+}
+
+@test "rebase squashfs layers" {
+    require_privilege priv
+    stacker build --layer-type squashfs --substitute BASES=$(pwd)/bases
+    stacker rebase test --layer-type squashfs --onto oci:$(pwd)/bases:patched --substitute BASES=$(pwd)/bases
+
+    [ "$(manifest test-squashfs oci | jq '.layers | length')" == "$(manifest patched bases | jq '.layers | length + 1')" ]
+    stacker export --layer-type squashfs test dest
+    [ "$(cat dest/base-version)" == "1.1" ]
+}
+
+@test "rebase refuses bases that can't be swapped" {
+    stacker build --substitute BASES=$(pwd)/bases
+
+    bad_stacker rebase built --onto oci:$(pwd)/bases:patched --substitute BASES=$(pwd)/bases
+    echo "$output" | grep "only layers built from docker or oci bases can be rebased"
+}
@@ -0,0 +1,78 @@
+load helpers
+
+function setup() {
+    stacker_setup
+    zot_setup
+}
+
+function teardown() {
+    zot_teardown
+    cleanup
+}
+
+function skip_without_zot() {
+    if [ -z "${ZOT_HOST}${ZOT_PORT}" ]; then
+        skip "skipping test because it requires running zot"
+    fi
+}
+
+@test "registry_mirrors are used for base image pulls" {
+    skip_without_zot
+    skopeo copy --dest-tls-verify=false oci:${BUSYBOX_OCI} docker://${ZOT_HOST}:${ZOT_PORT}/library/busybox:mirrored
+
+    cat > stacker.yaml <<"EOF"
+test:
+    from:
+        type: docker
+        url: docker://registry.invalid/library/busybox:mirrored
+    run: |
+        ls /bin/busybox
+EOF
+    cat > conf.yaml <<EOF
+registry_mirrors:
+    registry.invalid:
+        - location: ${ZOT_HOST}:${ZOT_PORT}
+          insecure: true
+EOF
+
+    # without the mirror, there's nothing to pull from
+    bad_stacker build
+
+    stacker --config conf.yaml build
+}
+
+@test "registries.conf short name aliases and blocked registries" {
+    skip_without_zot
+    skopeo copy --dest-tls-verify=false oci:${BUSYBOX_OCI} docker://${ZOT_HOST}:${ZOT_PORT}/library/aliased:latest
+
+    cat > registries.conf <<EOF
+[[registry]]
+prefix = "${ZOT_HOST}:${ZOT_PORT}"
+location = "${ZOT_HOST}:${ZOT_PORT}"
+insecure = true
+
+[[registry]]
+prefix = "blocked.invalid"
+location = "blocked.invalid"
+blocked = true
+
+[aliases]
+"aliased" = "${ZOT_HOST}:${ZOT_PORT}/library/aliased"
+EOF
+    cat > stacker.yaml <<"EOF"
+test:
+    from:
+        type: docker
+        url: docker://aliased:latest
+    run: |
+        ls /bin/busybox
+EOF
+    stacker --registries-conf registries.conf build
+
+    # the same settings are used for publishing
+    bad_stacker --registries-conf registries.conf publish --url docker://blocked.invalid --tag latest
+    echo "$output" | grep "blocked"
+
+    stacker --registries-conf registries.conf publish --url docker://${ZOT_HOST}:${ZOT_PORT} --tag latest
+    skopeo inspect --tls-verify=false docker://${ZOT_HOST}:${ZOT_PORT}/test:latest
+}
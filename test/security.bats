@@ -0,0 +1,88 @@
+load helpers
+
+function setup() {
+    stacker_setup
+}
+
+function teardown() {
+    cleanup
+}
+
+@test "security settings confine run commands" {
+    cat > stacker.yaml <<"EOF"
+confined:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    security:
+        cap_drop: [CAP_CHOWN]
+        no_new_privs: true
+    run: |
+        grep "NoNewPrivs:.*1" /proc/self/status
+        touch /file
+        ! chown 1000 /file
+EOF
+    stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+}
+
+@test "seccomp profile is applied to run commands" {
+    cat > seccomp.policy <<"EOF"
+2
+denylist
+mkdir errno 1
+mkdirat errno 1
+EOF
+    cat > stacker.yaml <<"EOF"
+confined:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    security:
+        seccomp: seccomp.policy
+    run: |
+        ! mkdir /nope
+EOF
+    stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+}
+
+@test "invalid security settings are rejected" {
+    cat > stacker.yaml <<"EOF"
+bad:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    security:
+        cap_drop: [sys_admin]
+        cap_keep: [chown]
+EOF
+    bad_stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    echo "$output" | grep "cap_drop and cap_keep can't be used together"
+
+    cat > stacker.yaml <<"EOF"
+bad:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    security:
+        apparmor: stacker-no-such-profile
+EOF
+    bad_stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    echo "$output" | grep "AppArmor profile stacker-no-such-profile is not available"
+}
+
+@test "stacker check validates security settings" {
+    require_privilege priv
+
+    echo "3" > seccomp.policy
+    cat > stacker.yaml <<"EOF"
+bad:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    security:
+        seccomp: seccomp.policy
+EOF
+    stacker check
+    bad_stacker check -f stacker.yaml --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    echo "$output" | grep "unsupported policy version"
+}
@@ -0,0 +1,107 @@
+load helpers
+
+function setup() {
+    stacker_setup
+    cat > stacker.yaml <<"EOF"
+base:
+    from:
+        type: oci
+        url: ${{BUSYBOX_OCI}}
+    run: |
+        echo meshuggah > /rocks
+        echo gone > /removed
+test:
+    from:
+        type: built
+        tag: base
+    squash: true
+    run: |
+        echo gojira > /also-rocks
+        rm /removed
+EOF
+}
+
+function teardown() {
+    cleanup
+}
+
+function manifest() {
+    local manifest=$(jq -r ".manifests[] | select(.annotations[\"org.opencontainers.image.ref.name\"] == \"$1\") | .digest" "$2/index.json" | cut -f2 -d:)
+    cat "$2/blobs/sha256/$manifest"
+}
+
+function image_config() {
+    local config=$(manifest "$1" "$2" | jq -r .config.digest | cut -f2 -d:)
+    cat "$2/blobs/sha256/$config"
+}
+
+@test "squash: true outputs a single layer" {
+    stacker build --layer-type tar --layer-type squashfs --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+
+    [ "$(manifest base oci | jq '.layers | length')" -gt 1 ]
+    [ "$(manifest test oci | jq '.layers | length')" == "1" ]
+    [ "$(manifest test-squashfs oci | jq '.layers | length')" == "1" ]
+    [ "$(image_config test oci | jq '.rootfs.diff_ids | length')" == "1" ]
+    [ "$(image_config test oci | jq '.history | length')" == "1" ]
+
+    umoci unpack --image oci:test dest
+    [ "$(cat dest/rootfs/rocks)" == "meshuggah" ]
+    [ "$(cat dest/rootfs/also-rocks)" == "gojira" ]
+    [ ! -e dest/rootfs/removed ]
+
+    # the unsquashed image is kept, and used for caching
+    [ "$(manifest test-unsquashed oci | jq '.layers | length')" -eq "$(( $(manifest base oci | jq '.layers | length') + 1 ))" ]
+    [ "$(manifest test-squashfs-unsquashed oci | jq '.layers | length')" -gt 1 ]
+    stacker build --layer-type tar --layer-type squashfs --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    echo "$output" | grep "found cached layer test"
+    [ "$(manifest test oci | jq '.layers | length')" == "1" ]
+    [ "$(manifest test-unsquashed oci | jq '.layers | length')" -gt 1 ]
+
+    # and its layers survive the output's GC
+    for layer in $(manifest test-unsquashed oci | jq -r '.layers[].digest' | cut -f2 -d:); do
+        [ -f oci/blobs/sha256/$layer ]
+    done
+
+    # it is dropped when the layer isn't squashed anymore
+    sed -i 's/squash: true/squash: false/' stacker.yaml
+    stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    [ -z "$(jq -r '.manifests[].annotations["org.opencontainers.image.ref.name"]' oci/index.json | grep unsquashed)" ]
+}
+
+@test "building on a squashed layer" {
+    sed -i 's/^    squash: true$/    squash: true\n    environment:\n        SQUASHED: parent/' stacker.yaml
+    cat >> stacker.yaml <<"EOF"
+child:
+    from:
+        type: built
+        tag: test
+    run: |
+        [ "$(cat /rocks)" == "meshuggah" ]
+        [ "$(cat /also-rocks)" == "gojira" ]
+        [ ! -e /removed ]
+        echo in flames > /child
+EOF
+    stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+
+    # the child's layer is added to the unsquashed layers
+    [ "$(manifest child oci | jq '.layers | length')" -eq "$(( $(manifest test-unsquashed oci | jq '.layers | length') + 1 ))" ]
+    umoci unpack --image oci:child dest
+    [ "$(cat dest/rootfs/child)" == "in flames" ]
+    [ "$(cat dest/rootfs/also-rocks)" == "gojira" ]
+
+    # and the parent's config along with them
+    image_config test-unsquashed oci | jq -r '.config.Env[]' | grep "^SQUASHED=parent$"
+    image_config child oci | jq -r '.config.Env[]' | grep "^SQUASHED=parent$"
+}
+
+@test "publish --squash" {
+    stacker build --substitute BUSYBOX_OCI=${BUSYBOX_OCI}
+    stacker publish --squash --url oci:$(pwd)/published --tag latest --image base
+
+    [ "$(manifest base oci | jq '.layers | length')" -gt 1 ]
+    [ "$(manifest base_latest published | jq '.layers | length')" == "1" ]
+    ! jq -r '.manifests[].annotations["org.opencontainers.image.ref.name"]' oci/index.json | grep -- -squashed
+
+    umoci unpack --image published:base_latest dest
+    [ "$(cat dest/rootfs/rocks)" == "meshuggah" ]
+}